@@ -0,0 +1,67 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Extended attributes holding the POSIX ACLs of a file.
+const (
+	accessACLXattr  = "system.posix_acl_access"
+	defaultACLXattr = "system.posix_acl_default"
+)
+
+// fileACLs returns the raw access ACL of path, and its default ACL if it's a
+// directory. Either is nil if path has none besides its mode.
+func fileACLs(path string, dir bool) (access, def []byte, err error) {
+	access, err = lgetxattr(path, accessACLXattr)
+	if err != nil || !dir {
+		return access, nil, err
+	}
+
+	def, err = lgetxattr(path, defaultACLXattr)
+	return access, def, err
+}
+
+// setFileACLs applies the raw access & default ACLs to path, unless they're
+// nil.
+func setFileACLs(path string, access, def []byte) error {
+	for name, acl := range map[string][]byte{accessACLXattr: access, defaultACLXattr: def} {
+		if acl == nil {
+			continue
+		}
+		if err := unix.Setxattr(path, name, acl, 0); err != nil {
+			return &os.PathError{Op: "setxattr", Path: path, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// lgetxattr returns the extended attribute name of path, or nil if it
+// doesn't exist or the file system doesn't support it.
+func lgetxattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err == unix.ENODATA || err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+
+	b := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, b)
+	if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+
+	return b[:size], nil
+}
@@ -0,0 +1,99 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// posixACL encodes ACL entries of tag, permissions & ID in the format of the
+// system.posix_acl_* extended attributes.
+func posixACL(entries ...[3]uint32) []byte {
+	b := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(b, 2)
+	for i, e := range entries {
+		binary.LittleEndian.PutUint16(b[4+8*i:], uint16(e[0]))
+		binary.LittleEndian.PutUint16(b[6+8*i:], uint16(e[1]))
+		binary.LittleEndian.PutUint32(b[8+8*i:], e[2])
+	}
+	return b
+}
+
+func TestPreserveDefaultACL(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	shared := filepath.Join(src, "shared")
+	_ = os.MkdirAll(shared, 0755)
+
+	// user::rwx, user:65534:rwx, group::r-x, mask::rwx, other::r-x
+	const undefinedID = 0xffffffff
+	acl := posixACL(
+		[3]uint32{0x01, 7, undefinedID},
+		[3]uint32{0x02, 7, 65534},
+		[3]uint32{0x04, 5, undefinedID},
+		[3]uint32{0x10, 7, undefinedID},
+		[3]uint32{0x20, 5, undefinedID},
+	)
+	if err := unix.Setxattr(shared, defaultACLXattr, acl, 0); err != nil {
+		t.Skipf("File system doesn't support ACLs: %s", err)
+	}
+	// inherits the default ACL as its access ACL
+	file := filepath.Join(shared, "file")
+	_ = ioutil.WriteFile(file, []byte("knoxite"), 0644)
+
+	r, _ := NewRepository("mem://acls", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:          wd,
+		Paths:        []string{src},
+		Encrypt:      EncryptionAES,
+		DataParts:    1,
+		PreserveACLs: true,
+	})
+	if arc := snapshot.Archives[shared]; arc == nil || len(arc.DefaultACL) == 0 {
+		t.Fatal("Expected the default ACL of the directory to be recorded")
+	}
+	if arc := snapshot.Archives[file]; arc == nil || len(arc.ACL) == 0 {
+		t.Fatal("Expected the inherited ACL of the file to be recorded")
+	}
+
+	for _, preserve := range []bool{false, true} {
+		dst := filepath.Join(dir, "dst")
+		_ = os.RemoveAll(dst)
+		if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{PreserveACLs: preserve}); len(errs) > 0 {
+			t.Fatalf("Failed restoring snapshot: %v", errs)
+		}
+
+		def, err := lgetxattr(filepath.Join(dst, shared), defaultACLXattr)
+		if err != nil {
+			t.Fatalf("Failed reading default ACL: %s", err)
+		}
+		if preserve != bytes.Equal(def, acl) {
+			t.Errorf("Expected default ACL to be restored: %v, got %v", preserve, def)
+		}
+		access, _ := lgetxattr(filepath.Join(dst, file), accessACLXattr)
+		if preserve && len(access) == 0 {
+			t.Error("Expected access ACL of the file to be restored")
+		}
+	}
+}
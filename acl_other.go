@@ -0,0 +1,20 @@
+// +build !linux
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+// fileACLs returns no ACLs, as they're only supported on Linux.
+func fileACLs(path string, dir bool) (access, def []byte, err error) {
+	return nil, nil, nil
+}
+
+// setFileACLs is a no-op, as ACLs are only supported on Linux.
+func setFileACLs(path string, access, def []byte) error {
+	return nil
+}
@@ -14,25 +14,35 @@ import (
 
 // Types of archives.
 const (
-	File      = iota // A File
-	Directory        // A Directory
-	SymLink          // A SymLink
+	File        = iota // A File
+	Directory          // A Directory
+	SymLink            // A SymLink
+	SpecialFile        // A FIFO or device node
 )
 
 // Archive contains all metadata belonging to a file/directory.
 type Archive struct {
-	Path        string      `json:"path"`               // Where in filesystem does this belong to
-	PointsTo    string      `json:"pointsto,omitempty"` // If this is a SymLink, where does it point to
-	Mode        os.FileMode `json:"mode"`               // file mode bits
-	ModTime     int64       `json:"modtime"`            // modification time
-	Size        uint64      `json:"size"`               // size
-	StorageSize uint64      `json:"storagesize"`        // size in storage
-	UID         uint32      `json:"uid"`                // owner
-	GID         uint32      `json:"gid"`                // group
-	Chunks      []Chunk     `json:"chunks,omitempty"`   // data chunks
-	Encrypted   uint16      `json:"encrypted"`          // encryption type
-	Compressed  uint16      `json:"compressed"`         // compression type
-	Type        uint8       `json:"type"`               // Is this a File, Directory or SymLink
+	Path        string      `json:"path"`                  // Where in filesystem does this belong to
+	PointsTo    string      `json:"pointsto,omitempty"`    // If this is a SymLink, where does it point to
+	Mode        os.FileMode `json:"mode"`                  // file mode bits
+	ModTime     int64       `json:"modtime"`               // modification time
+	AccessTime  int64       `json:"atime,omitempty"`       // access time, if recorded
+	Size        uint64      `json:"size"`                  // size
+	StorageSize uint64      `json:"storagesize"`           // size in storage
+	UID         uint32      `json:"uid"`                   // owner
+	GID         uint32      `json:"gid"`                   // group
+	Chunks      []Chunk     `json:"chunks,omitempty"`      // data chunks
+	ContentHash string      `json:"contenthash,omitempty"` // hash of the entire content, if recorded
+	HMAC        string      `json:"hmac,omitempty"`        // HMAC of the entire content
+	Encrypted   uint16      `json:"encrypted"`             // encryption type
+	Compressed  uint16      `json:"compressed"`            // compression type
+	Type        uint8       `json:"type"`                  // Is this a File, Directory, SymLink or SpecialFile
+	Rdev        uint64      `json:"rdev,omitempty"`        // device number, if this is a device node
+	Attributes  uint32      `json:"attributes,omitempty"`  // Windows file attributes, if recorded
+	Capability  []byte      `json:"capability,omitempty"`  // Linux file capabilities, if recorded
+	ACL         []byte      `json:"acl,omitempty"`         // Linux POSIX access ACL, if recorded
+	DefaultACL  []byte      `json:"defaultacl,omitempty"`  // Linux POSIX default ACL of a directory, if recorded
+	Failed      bool        `json:"failed,omitempty"`      // storing the content failed, so it can't be restored
 }
 
 // ArchiveResult wraps Archive and an error.
@@ -40,6 +50,7 @@ type Archive struct {
 type ArchiveResult struct {
 	Archive *Archive
 	Error   error
+	Warning error // reported, but the Archive gets stored nonetheless
 }
 
 // IndexOfChunk returns the slice-index for a specific chunk number.
@@ -0,0 +1,20 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+// fileAttributes returns no attributes, as they only exist on Windows.
+func fileAttributes(path string) (uint32, error) {
+	return 0, nil
+}
+
+// setFileAttributes is a no-op, as file attributes only exist on Windows.
+func setFileAttributes(path string, attrs uint32) error {
+	return nil
+}
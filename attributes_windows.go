@@ -0,0 +1,56 @@
+// +build windows
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"os"
+	"syscall"
+)
+
+// restorableAttributes are the file attributes that can be set with
+// SetFileAttributes. All others are managed by the filesystem.
+const restorableAttributes = syscall.FILE_ATTRIBUTE_READONLY |
+	syscall.FILE_ATTRIBUTE_HIDDEN |
+	syscall.FILE_ATTRIBUTE_SYSTEM |
+	syscall.FILE_ATTRIBUTE_ARCHIVE |
+	0x2000 // FILE_ATTRIBUTE_NOT_CONTENT_INDEXED
+
+// fileAttributes returns the Windows file attributes of path.
+func fileAttributes(path string) (uint32, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, &os.PathError{Op: "getfileattributes", Path: path, Err: err}
+	}
+
+	attrs, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		return 0, &os.PathError{Op: "getfileattributes", Path: path, Err: err}
+	}
+
+	return attrs & restorableAttributes, nil
+}
+
+// setFileAttributes applies the Windows file attributes attrs to path.
+func setFileAttributes(path string, attrs uint32) error {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return &os.PathError{Op: "setfileattributes", Path: path, Err: err}
+	}
+
+	attrs &= restorableAttributes
+	if attrs == 0 {
+		attrs = syscall.FILE_ATTRIBUTE_NORMAL
+	}
+	if err := syscall.SetFileAttributes(p, attrs); err != nil {
+		return &os.PathError{Op: "setfileattributes", Path: path, Err: err}
+	}
+
+	return nil
+}
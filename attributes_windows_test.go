@@ -0,0 +1,72 @@
+// +build windows
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPreserveWindowsAttrs(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(src, []byte("some content"), 0640); err != nil {
+		t.Fatalf("Failed writing test file: %s", err)
+	}
+	if err := setFileAttributes(src, syscall.FILE_ATTRIBUTE_READONLY|syscall.FILE_ATTRIBUTE_HIDDEN); err != nil {
+		t.Fatalf("Failed setting attributes: %s", err)
+	}
+	defer setFileAttributes(src, 0)
+
+	// store relative paths, as volume names can't be part of a restored path
+	wd, _ := os.Getwd()
+	_ = os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	r, _ := NewRepository("mem://preserve-windows-attrs", testPassword)
+	index, _ := OpenChunkIndex(&r)
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:                  dir,
+		Paths:                []string{src},
+		Encrypt:              EncryptionAES,
+		DataParts:            1,
+		PreserveWindowsAttrs: true,
+	})
+
+	target := filepath.Join(dir, "target")
+	if errs := restoreSnapshot(t, r, snapshot, target, RestoreOptions{PreserveWindowsAttrs: true}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+
+	restored := filepath.Join(target, "data")
+	defer setFileAttributes(restored, 0)
+	attrs, err := fileAttributes(restored)
+	if err != nil {
+		t.Fatalf("Failed reading attributes: %s", err)
+	}
+	if attrs&syscall.FILE_ATTRIBUTE_READONLY == 0 {
+		t.Error("Expected readonly attribute to be preserved")
+	}
+	if attrs&syscall.FILE_ATTRIBUTE_HIDDEN == 0 {
+		t.Error("Expected hidden attribute to be preserved")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"net/url"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // BackendFactory is used to initialize a new backend.
@@ -20,6 +21,146 @@ type BackendFactory interface {
 	Protocols() []string
 }
 
+// BackendOptions holds settings that apply to all storage backends of a
+// repository.
+type BackendOptions struct {
+	// MaxObjectSize is the maximum size in bytes of a single object stored on
+	// a backend. Zero means unlimited
+	MaxObjectSize uint64
+
+	// MaxConnections limits the amount of simultaneously open connections of
+	// connection-based backends. Zero uses a default of 4
+	MaxConnections int
+	// IdleTimeout closes connections that have been unused for longer than
+	// this duration. Zero keeps them open until the backend gets closed
+	IdleTimeout time.Duration
+
+	// Durability controls which writes of the local storage backend get
+	// synced to disk. The default syncs both files and their directories
+	Durability uint16
+
+	// ObjectTags get attached to stored chunks, e.g. to let lifecycle rules
+	// of the storage provider move them to cheaper storage classes. Backends
+	// that can't tag objects ignore them
+	ObjectTags map[string]string
+	// ObjectRetention locks stored chunks for this duration, protecting
+	// append-only repositories from deletion. Zero disables it. Backends
+	// without object-lock support ignore it
+	ObjectRetention time.Duration
+
+	// CredentialsFile is the path of a file with the credentials of the
+	// backends, which get used when neither the URL nor the environment
+	// provide any. Credentials are looked up in the URL first, then in the
+	// environment variables KNOXITE_<SCHEME>_USERNAME and
+	// KNOXITE_<SCHEME>_PASSWORD, followed by the provider's own variables.
+	// Every line of the file contains a URL of the form scheme://host, or
+	// just a scheme, followed by the username and the password
+	CredentialsFile string
+
+	// OperationTimeout aborts loading or storing a single chunk that takes
+	// longer than this duration, so it gets retried instead of stalling.
+	// Zero waits forever
+	OperationTimeout time.Duration
+	// SlowOperationThreshold reports chunk operations taking longer than
+	// this duration as slow. Zero disables it
+	SlowOperationThreshold time.Duration
+
+	// MetadataRetries is how often saving the repository or the chunk-index
+	// gets attempted on every backend, until it has been read back intact.
+	// Zero uses a default of 3
+	MetadataRetries int
+
+	// Prefix namespaces all objects of the repository on its backends, so
+	// several repositories can share a single bucket or directory. Every
+	// operation, including deleting unused chunks, stays within the prefix
+	Prefix string
+}
+
+// ConfigurableBackend is implemented by backends that make use of
+// BackendOptions.
+type ConfigurableBackend interface {
+	SetOptions(opts BackendOptions)
+}
+
+// PrefixedBackend is implemented by backends that can store all objects
+// below a prefix, see BackendOptions.Prefix.
+type PrefixedBackend interface {
+	SetPrefix(prefix string)
+}
+
+// A ChunkPart identifies a single stored part of a chunk.
+type ChunkPart struct {
+	Hash       string
+	Part       uint
+	TotalParts uint
+}
+
+// BatchDeleter is implemented by backends that can delete many chunk parts
+// with a single request. Backends without support for it delete one part
+// after another.
+type BatchDeleter interface {
+	// BatchDelete deletes parts and returns the ones that couldn't be
+	// deleted, with the error that occurred first
+	BatchDelete(parts []ChunkPart) ([]ChunkPart, error)
+}
+
+// ExistenceChecker is implemented by backends that can check whether many
+// chunk parts are stored with a single request, e.g. by listing objects with
+// a common prefix. Backends without support for it check for every part when
+// it gets stored.
+type ExistenceChecker interface {
+	// ChunksExist returns for every part whether it's stored on the backend
+	ChunksExist(parts []ChunkPart) ([]bool, error)
+}
+
+// ChunkStater is implemented by backends that can report the size of a
+// stored chunk part without downloading it, see VerifyChunkSizes.
+type ChunkStater interface {
+	// StatChunk returns the size in bytes of a stored chunk part
+	StatChunk(shasum string, part, totalParts uint) (uint64, error)
+}
+
+// RangeLoader is implemented by backends that can load a range of a stored
+// chunk part, e.g. with HTTP range requests. Chunks stored in pack objects
+// get loaded that way, see StoreOptions.PackSize. Backends without support
+// for it load the whole pack object.
+type RangeLoader interface {
+	// LoadChunkRange loads length bytes at offset of a stored chunk part
+	LoadChunkRange(shasum string, part, totalParts uint, offset, length uint64) ([]byte, error)
+}
+
+// IndexRotator is implemented by backends that can keep the previous
+// generation of the chunk-index when it gets replaced, which
+// RecoverChunkIndex falls back to. Backends without support for it keep no
+// previous generation.
+type IndexRotator interface {
+	// RotateChunkIndex keeps a copy of the stored chunk-index as its
+	// previous generation
+	RotateChunkIndex() error
+	// LoadPreviousChunkIndex loads the previous generation of the
+	// chunk-index
+	LoadPreviousChunkIndex() ([]byte, error)
+}
+
+// Metadata objects of a repository, see StagingBackend.
+const (
+	MetadataRepository = "repository"
+	MetadataChunkIndex = "chunk-index"
+)
+
+// StagingBackend is implemented by backends that can't replace a stored
+// object in a single step, e.g. file systems. The repository metadata and
+// the chunk-index then get stored under a temporary name first, and only
+// replace the stored object once they have been read back intact.
+type StagingBackend interface {
+	// StageMetadata stores the metadata object name under a temporary name
+	StageMetadata(name string, data []byte) error
+	// LoadStagedMetadata reads the staged metadata object name
+	LoadStagedMetadata(name string) ([]byte, error)
+	// CommitMetadata replaces the metadata object name with the staged one
+	CommitMetadata(name string) error
+}
+
 // Backend is used to store and access data.
 type Backend interface {
 	// Location returns the type and location of the repository
@@ -69,6 +210,8 @@ var (
 	ErrAvailableSpaceUnknown   = errors.New("Available space is unknown or undefined")
 	ErrAvailableSpaceUnlimited = errors.New("Available space is unlimited")
 	ErrInvalidUsername         = errors.New("Username wrong or missing")
+	ErrPrefixUnsupported       = errors.New("Storage backend can't store objects below a prefix")
+	ErrStatUnsupported         = errors.New("Storage backends can't report the size of chunks")
 
 	backends = []BackendFactory{}
 )
@@ -79,11 +222,12 @@ func RegisterStorageBackend(factory BackendFactory) {
 	backends = append(backends, factory)
 }
 
-func newBackendFromProtocol(url url.URL) (Backend, error) {
+// factoryForProtocol returns the factory of the backend supporting scheme.
+func factoryForProtocol(scheme string) (BackendFactory, error) {
 	for _, backend := range backends {
 		for _, p := range backend.Protocols() {
-			if p == url.Scheme {
-				return backend.NewBackend(url)
+			if p == scheme {
+				return backend, nil
 			}
 		}
 	}
@@ -93,6 +237,14 @@ func newBackendFromProtocol(url url.URL) (Backend, error) {
 
 // BackendFromURL returns the matching backend for path.
 func BackendFromURL(path string) (Backend, error) {
+	return BackendFromURLWithOptions(path, BackendOptions{})
+}
+
+// BackendFromURLWithOptions returns the matching backend for path. Missing
+// credentials get resolved from the environment or opts.CredentialsFile, see
+// BackendOptions, and passed to backends implementing CredentialsFactory.
+// Secrets are redacted from all returned errors.
+func BackendFromURLWithOptions(path string, opts BackendOptions) (Backend, error) {
 	if !strings.Contains(path, "://") {
 		if !filepath.IsAbs(path) {
 			var err error
@@ -108,9 +260,37 @@ func BackendFromURL(path string) (Backend, error) {
 	}
 
 	u, err := url.Parse(path)
+	if err != nil {
+		// the error contains the entire URL
+		return nil, &url.Error{Op: "parse", URL: RedactURL(path), Err: errors.Unwrap(err)}
+	}
+
+	factory, err := factoryForProtocol(u.Scheme)
 	if err != nil {
 		return nil, err
 	}
+	user, err := resolveCredentials(*u, factory, opts.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var backend Backend
+	if cf, ok := factory.(CredentialsFactory); ok {
+		backend, err = cf.NewBackendWithCredentials(*u, user)
+	} else {
+		backend, err = factory.NewBackend(*u)
+	}
+	if err != nil {
+		return backend, redactError(err, user)
+	}
 
-	return newBackendFromProtocol(*u)
+	if opts.Prefix != "" {
+		// without a prefix, another repository's objects could get deleted
+		pb, ok := backend.(PrefixedBackend)
+		if !ok {
+			return nil, ErrPrefixUnsupported
+		}
+		pb.SetPrefix(opts.Prefix)
+	}
+	return backend, nil
 }
@@ -7,7 +7,172 @@
 
 package knoxite
 
-import "testing"
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// memoryBackend is an in-memory Backend used for testing. Backends sharing a
+// host name (e.g. mem://foo) share their storage.
+type memoryBackend struct {
+	url    url.URL
+	prefix string
+
+	mut     *sync.Mutex
+	objects map[string][]byte
+}
+
+var (
+	errMemoryNotFound = errors.New("object not found")
+
+	memoryStoresMut = &sync.Mutex{}
+	memoryStores    = make(map[string]map[string][]byte)
+)
+
+func init() {
+	RegisterStorageBackend(&memoryBackend{})
+}
+
+func (*memoryBackend) NewBackend(u url.URL) (Backend, error) {
+	memoryStoresMut.Lock()
+	defer memoryStoresMut.Unlock()
+
+	objects, ok := memoryStores[u.Host]
+	if !ok {
+		objects = make(map[string][]byte)
+		memoryStores[u.Host] = objects
+	}
+
+	return &memoryBackend{
+		url:     u,
+		mut:     memoryStoresMut,
+		objects: objects,
+	}, nil
+}
+
+func (b *memoryBackend) Location() string {
+	return b.url.String()
+}
+
+func (b *memoryBackend) Protocols() []string {
+	return []string{"mem"}
+}
+
+func (b *memoryBackend) Description() string {
+	return "Memory Storage"
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+func (b *memoryBackend) AvailableSpace() (uint64, error) {
+	return 0, ErrAvailableSpaceUnlimited
+}
+
+func (b *memoryBackend) SetPrefix(prefix string) {
+	b.prefix = prefix + "/"
+}
+
+func (b *memoryBackend) load(key string) ([]byte, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	d, ok := b.objects[b.prefix+key]
+	if !ok {
+		return nil, errMemoryNotFound
+	}
+	return append([]byte{}, d...), nil
+}
+
+func (b *memoryBackend) save(key string, data []byte) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	b.objects[b.prefix+key] = append([]byte{}, data...)
+}
+
+func chunkKey(shasum string, part, totalParts uint) string {
+	return "chunks/" + shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+}
+
+func (b *memoryBackend) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
+	return b.load(chunkKey(shasum, part, totalParts))
+}
+
+func (b *memoryBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	b.save(chunkKey(shasum, part, totalParts), data)
+	return uint64(len(data)), nil
+}
+
+func (b *memoryBackend) StatChunk(shasum string, part, totalParts uint) (uint64, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	d, ok := b.objects[b.prefix+chunkKey(shasum, part, totalParts)]
+	if !ok {
+		return 0, errMemoryNotFound
+	}
+	return uint64(len(d)), nil
+}
+
+func (b *memoryBackend) DeleteChunk(shasum string, part, totalParts uint) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	delete(b.objects, b.prefix+chunkKey(shasum, part, totalParts))
+	return nil
+}
+
+func (b *memoryBackend) LoadSnapshot(id string) ([]byte, error) {
+	return b.load("snapshots/" + id)
+}
+
+func (b *memoryBackend) SaveSnapshot(id string, data []byte) error {
+	b.save("snapshots/"+id, data)
+	return nil
+}
+
+func (b *memoryBackend) LoadChunkIndex() ([]byte, error) {
+	return b.load("index")
+}
+
+func (b *memoryBackend) SaveChunkIndex(data []byte) error {
+	b.save("index", data)
+	return nil
+}
+
+func (b *memoryBackend) RotateChunkIndex() error {
+	data, err := b.load("index")
+	if err != nil {
+		return err
+	}
+	b.save("index.previous", data)
+	return nil
+}
+
+func (b *memoryBackend) LoadPreviousChunkIndex() ([]byte, error) {
+	return b.load("index.previous")
+}
+
+func (b *memoryBackend) InitRepository() error {
+	if _, err := b.load(RepoFilename); err == nil {
+		return ErrRepositoryExists
+	}
+	return nil
+}
+
+func (b *memoryBackend) LoadRepository() ([]byte, error) {
+	return b.load(RepoFilename)
+}
+
+func (b *memoryBackend) SaveRepository(data []byte) error {
+	b.save(RepoFilename, data)
+	return nil
+}
 
 func TestBackendURLError(t *testing.T) {
 	// Go 1.6 & up only
@@ -7,7 +7,13 @@
 
 package knoxite
 
-import "errors"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
 
 const (
 	retries = 3
@@ -16,8 +22,31 @@ const (
 // BackendManager stores data on multiple backends.
 type BackendManager struct {
 	Backends []*Backend
+	Options  BackendOptions
 
 	lastUsedBackend int
+	readOnly        bool // rejects all writes with ErrReadOnlyRepository
+
+	// state is shared by all copies of the manager, as repositories get
+	// passed by value
+	state *managerState
+
+	// slowHandler gets called for chunk operations exceeding
+	// Options.SlowOperationThreshold
+	slowHandler func(w *SlowOperationWarning)
+	// limiter bounds the chunk operations in flight, shared with other
+	// repositories
+	limiter *Limiter
+	// bandwidth records the data transferred to & from the backends
+	bandwidth *bandwidth
+}
+
+// managerState tracks whether a BackendManager has been closed, and the
+// chunk-indexes opened for its repository, which get saved on close.
+type managerState struct {
+	mut     sync.Mutex
+	closed  bool
+	indexes []*ChunkIndex
 }
 
 // Error declarations.
@@ -27,17 +56,80 @@ var (
 	ErrLoadChunkIndexFailed  = errors.New("Unable to load chunk-index from any storage backend")
 	ErrLoadRepositoryFailed  = errors.New("Unable to load repository from any storage backend")
 	ErrDeleteChunkFailed     = errors.New("Unable to delete chunk from any storage backend")
+	ErrStatChunkFailed       = errors.New("Unable to stat chunk on any storage backend")
 	ErrStoreChunkFailed      = errors.New("Storing chunk failed")
 	ErrStoreSnapshotFailed   = errors.New("Storing snapshot failed")
 	ErrStoreChunkIndexFailed = errors.New("Storing chunk-index failed")
 	ErrStoreRepositoryFailed = errors.New("Storing repository failed")
+	ErrOperationTimeout      = errors.New("Storage backend operation timed out")
 )
 
+// ObjectTooLargeError records the size of an object exceeding the configured
+// MaxObjectSize.
+type ObjectTooLargeError struct {
+	Size          uint64
+	MaxObjectSize uint64
+}
+
+func (e *ObjectTooLargeError) Error() string {
+	return fmt.Sprintf("Object of %d bytes exceeds the maximum object size of %d bytes", e.Size, e.MaxObjectSize)
+}
+
+// OperationTimeoutError records a chunk operation that got aborted because it
+// exceeded the configured OperationTimeout.
+type OperationTimeoutError struct {
+	Op      string
+	Hash    string
+	Part    uint
+	Timeout time.Duration
+}
+
+func (e *OperationTimeoutError) Error() string {
+	return fmt.Sprintf("%s of chunk %s (part %d) timed out after %s", e.Op, e.Hash, e.Part, e.Timeout)
+}
+
+// Is lets errors.Is match ErrOperationTimeout.
+func (e *OperationTimeoutError) Is(target error) bool {
+	return target == ErrOperationTimeout
+}
+
+// SlowOperationWarning records a chunk operation that took longer than the
+// configured SlowOperationThreshold.
+type SlowOperationWarning struct {
+	Op       string
+	Hash     string
+	Part     uint
+	Duration time.Duration
+}
+
+func (w *SlowOperationWarning) Error() string {
+	return fmt.Sprintf("Slow storage backend: %s of chunk %s (part %d) took %s", w.Op, w.Hash, w.Part, w.Duration.Round(time.Millisecond))
+}
+
 // AddBackend adds a backend.
 func (backend *BackendManager) AddBackend(be *Backend) {
+	if backend.bandwidth == nil {
+		backend.bandwidth = &bandwidth{}
+	}
+	if backend.state == nil {
+		backend.state = &managerState{}
+	}
+	if cb, ok := (*be).(ConfigurableBackend); ok {
+		cb.SetOptions(backend.Options)
+	}
 	backend.Backends = append(backend.Backends, be)
 }
 
+// SetOptions applies opts to all backends.
+func (backend *BackendManager) SetOptions(opts BackendOptions) {
+	backend.Options = opts
+	for _, be := range backend.Backends {
+		if cb, ok := (*be).(ConfigurableBackend); ok {
+			cb.SetOptions(opts)
+		}
+	}
+}
+
 // Locations returns the urls for all backends.
 func (backend *BackendManager) Locations() []string {
 	paths := []string{}
@@ -50,9 +142,17 @@ func (backend *BackendManager) Locations() []string {
 
 // LoadChunk loads a Chunk from backends.
 func (backend *BackendManager) LoadChunk(chunk Chunk, part uint) ([]byte, error) {
+	if backend.isClosed() {
+		return []byte{}, ErrRepositoryClosed
+	}
+
 	for _, be := range backend.Backends {
 		for i := 0; i < retries; i++ {
-			b, err := (*be).LoadChunk(chunk.Hash, part, chunk.DataParts)
+			b, _, err := backend.chunkOperation("Loading", chunk.Hash, part, func() ([]byte, uint64, error) {
+				b, err := (*be).LoadChunk(chunk.Hash, part, chunk.DataParts)
+				backend.bandwidth.receive(len(b))
+				return b, 0, err
+			})
 			if err == nil {
 				return b, err
 			}
@@ -62,8 +162,118 @@ func (backend *BackendManager) LoadChunk(chunk Chunk, part uint) ([]byte, error)
 	return []byte{}, ErrLoadChunkFailed
 }
 
+// LoadChunkRange loads length bytes at offset of a single part of chunk from
+// backends, see RangeLoader.
+func (backend *BackendManager) LoadChunkRange(chunk Chunk, part uint, offset, length int) ([]byte, error) {
+	if backend.isClosed() {
+		return []byte{}, ErrRepositoryClosed
+	}
+
+	for _, be := range backend.Backends {
+		load := func() ([]byte, uint64, error) {
+			b, err := (*be).LoadChunk(chunk.Hash, part, chunk.DataParts)
+			backend.bandwidth.receive(len(b))
+			if err == nil && len(b) >= offset+length {
+				b = b[offset : offset+length]
+			}
+			return b, 0, err
+		}
+		if rl, ok := (*be).(RangeLoader); ok {
+			load = func() ([]byte, uint64, error) {
+				b, err := rl.LoadChunkRange(chunk.Hash, part, chunk.DataParts, uint64(offset), uint64(length))
+				backend.bandwidth.receive(len(b))
+				return b, 0, err
+			}
+		}
+
+		for i := 0; i < retries; i++ {
+			b, _, err := backend.chunkOperation("Loading", chunk.Hash, part, load)
+			if err == nil && len(b) == length {
+				return b, nil
+			}
+		}
+	}
+
+	return []byte{}, ErrLoadChunkFailed
+}
+
+// StatChunk returns the size of a single part of chunk as stored on the
+// backends, without downloading it. It fails with ErrStatUnsupported if none
+// of the backends implements ChunkStater.
+func (backend *BackendManager) StatChunk(chunk Chunk, part uint) (uint64, error) {
+	if backend.isClosed() {
+		return 0, ErrRepositoryClosed
+	}
+
+	supported := false
+	for _, be := range backend.Backends {
+		cs, ok := (*be).(ChunkStater)
+		if !ok {
+			continue
+		}
+		supported = true
+
+		for i := 0; i < retries; i++ {
+			_, n, err := backend.chunkOperation("Stating", chunk.Hash, part, func() ([]byte, uint64, error) {
+				backend.bandwidth.receive(0)
+				n, err := cs.StatChunk(chunk.Hash, part, chunk.DataParts)
+				return nil, n, err
+			})
+			if err == nil {
+				return n, nil
+			}
+		}
+	}
+
+	if !supported {
+		return 0, ErrStatUnsupported
+	}
+	return 0, ErrStatChunkFailed
+}
+
+// maxChunkSize returns the maximum size of a chunk, limited to
+// opts.ChunkSize and to what fits into a single object on the backends, even
+// once encoding it added as much as it possibly can. Parity parts never
+// exceed the encoded chunk, so it always fits, too.
+func (backend *BackendManager) maxChunkSize(opts StoreOptions) uint {
+	preferred := opts.ChunkSize
+	if preferred == 0 {
+		preferred = preferredChunkSize
+	}
+
+	limit := backend.Options.MaxObjectSize
+	if limit == 0 {
+		return preferred
+	}
+	overhead := uint64(opts.maxEncodingOverhead(uint(limit)))
+	if limit <= overhead {
+		// every chunk exceeds the limit, which fails storing it
+		return 1
+	}
+	if limit-overhead < uint64(preferred) {
+		return uint(limit - overhead)
+	}
+
+	return preferred
+}
+
 // StoreChunk stores a single Chunk on backends.
 func (backend *BackendManager) StoreChunk(chunk Chunk) (size uint64, err error) {
+	if backend.isClosed() {
+		return 0, ErrRepositoryClosed
+	}
+	if backend.readOnly {
+		return 0, ErrReadOnlyRepository
+	}
+
+	if backend.Options.MaxObjectSize > 0 {
+		for _, data := range *chunk.Data {
+			if uint64(len(data)) > backend.Options.MaxObjectSize {
+				return 0, &ObjectTooLargeError{uint64(len(data)), backend.Options.MaxObjectSize}
+			}
+		}
+	}
+
 	for i, data := range *chunk.Data {
 		// Use storage backends in a round robin fashion to store chunks
 		backend.lastUsedBackend++
@@ -73,10 +283,25 @@ func (backend *BackendManager) StoreChunk(chunk Chunk) (size uint64, err error)
 
 		be := backend.Backends[backend.lastUsedBackend]
 
+		store := func() ([]byte, uint64, error) {
+			backend.bandwidth.send(len(data))
+			n, err := (*be).StoreChunk(chunk.Hash, uint(i), chunk.DataParts, data)
+			return nil, n, err
+		}
+		uploader, multipart := multipartUploader(*be, len(data))
+		upload := &MultipartUpload{Hash: chunk.Hash, Part: uint(i), TotalParts: chunk.DataParts}
+		if multipart {
+			// retries resume the upload
+			store = func() ([]byte, uint64, error) {
+				n, err := storeMultipart(uploader, upload, data, backend.bandwidth)
+				return nil, n, err
+			}
+		}
+
 		var n uint64
 		var err error
 		for j := 0; j < retries; j++ {
-			n, err = (*be).StoreChunk(chunk.Hash, uint(i), chunk.DataParts, data)
+			_, n, err = backend.chunkOperation("Storing", chunk.Hash, uint(i), store)
 			if err != nil {
 				// retry
 				continue
@@ -88,6 +313,16 @@ func (backend *BackendManager) StoreChunk(chunk Chunk) (size uint64, err error)
 			break
 		}
 		if err != nil {
+			if multipart {
+				go func() {
+					// wait for attempts still running in the background
+					upload.mut.Lock()
+					defer upload.mut.Unlock()
+					if upload.ID != "" {
+						_ = uploader.AbortUpload(upload)
+					}
+				}()
+			}
 			return 0, err
 		}
 	}
@@ -95,10 +330,75 @@ func (backend *BackendManager) StoreChunk(chunk Chunk) (size uint64, err error)
 	return size, nil
 }
 
+// chunkOperation runs the load or store op of a chunk part. It gets aborted
+// with an OperationTimeoutError once it exceeds Options.OperationTimeout. As
+// backends can't be interrupted, an aborted op keeps running in the
+// background and its result gets discarded. Ops taking longer than
+// Options.SlowOperationThreshold get reported to the slowHandler. Ops wait for
+// the limiter before being started, which counts towards the timeout.
+func (backend *BackendManager) chunkOperation(name, shasum string, part uint, op func() ([]byte, uint64, error)) ([]byte, uint64, error) {
+	timeout := backend.Options.OperationTimeout
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	if !backend.limiter.acquire(expired) {
+		return nil, 0, &OperationTimeoutError{name, shasum, part, timeout}
+	}
+	limited := op
+	op = func() ([]byte, uint64, error) {
+		// aborted ops still count until they're done
+		defer backend.limiter.release()
+		return limited()
+	}
+
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		threshold := backend.Options.SlowOperationThreshold
+		if threshold > 0 && d > threshold && backend.slowHandler != nil {
+			backend.slowHandler(&SlowOperationWarning{name, shasum, part, d})
+		}
+	}()
+
+	if timeout <= 0 {
+		return op()
+	}
+
+	type result struct {
+		b   []byte
+		n   uint64
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		b, n, err := op()
+		done <- result{b, n, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.b, r.n, r.err
+	case <-expired:
+		return nil, 0, &OperationTimeoutError{name, shasum, part, timeout}
+	}
+}
+
 // DeleteChunk deletes a single Chunk.
 func (backend *BackendManager) DeleteChunk(shasum string, part, totalParts uint) error {
+	if backend.isClosed() {
+		return ErrRepositoryClosed
+	}
+	if backend.readOnly {
+		return ErrReadOnlyRepository
+	}
+
 	for _, be := range backend.Backends {
 		for i := 0; i < retries; i++ {
+			backend.bandwidth.send(0)
 			err := (*be).DeleteChunk(shasum, part, totalParts)
 			if err == nil {
 				return nil
@@ -109,11 +409,119 @@ func (backend *BackendManager) DeleteChunk(shasum string, part, totalParts uint)
 	return ErrDeleteChunkFailed
 }
 
+// DeleteChunks deletes many chunk parts, using batched requests on backends
+// supporting them. Every part gets deleted from the first backend that
+// succeeds in deleting it. It returns the parts that couldn't be deleted.
+func (backend *BackendManager) DeleteChunks(parts []ChunkPart) ([]ChunkPart, error) {
+	if backend.isClosed() {
+		return parts, ErrRepositoryClosed
+	}
+	if backend.readOnly {
+		return parts, ErrReadOnlyRepository
+	}
+
+	remaining := parts
+	for _, be := range backend.Backends {
+		for i := 0; i < retries && len(remaining) > 0; i++ {
+			remaining = deleteChunkParts(*be, remaining, backend.bandwidth)
+		}
+	}
+
+	if len(remaining) > 0 {
+		return remaining, ErrDeleteChunkFailed
+	}
+	return nil, nil
+}
+
+// deleteChunkParts deletes parts from be and returns the ones that couldn't
+// be deleted.
+func deleteChunkParts(be Backend, parts []ChunkPart, bw *bandwidth) []ChunkPart {
+	if bd, ok := be.(BatchDeleter); ok {
+		bw.send(0)
+		failed, _ := bd.BatchDelete(parts)
+		return failed
+	}
+
+	var failed []ChunkPart
+	for _, p := range parts {
+		bw.send(0)
+		if err := be.DeleteChunk(p.Hash, p.Part, p.TotalParts); err != nil {
+			failed = append(failed, p)
+		}
+	}
+	return failed
+}
+
+// checksExistence returns true if any of the backends can check for the
+// existence of chunk parts in batches.
+func (backend *BackendManager) checksExistence() bool {
+	for _, be := range backend.Backends {
+		if _, ok := (*be).(ExistenceChecker); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ChunksExist returns for every part whether it's stored on any of the
+// backends, using batched requests on backends supporting them. Parts only
+// stored on backends without support for it are reported as missing.
+func (backend *BackendManager) ChunksExist(parts []ChunkPart) ([]bool, error) {
+	exists := make([]bool, len(parts))
+	if backend.isClosed() {
+		return exists, ErrRepositoryClosed
+	}
+
+	for _, be := range backend.Backends {
+		ec, ok := (*be).(ExistenceChecker)
+		if !ok {
+			continue
+		}
+
+		var missing []ChunkPart
+		var indices []int
+		for i, p := range parts {
+			if !exists[i] {
+				missing = append(missing, p)
+				indices = append(indices, i)
+			}
+		}
+		if len(missing) == 0 {
+			break
+		}
+
+		var found []bool
+		var err error
+		for i := 0; i < retries; i++ {
+			backend.limiter.acquire(nil)
+			backend.bandwidth.send(0)
+			found, err = ec.ChunksExist(missing)
+			backend.limiter.release()
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return exists, err
+		}
+		for i, f := range found {
+			exists[indices[i]] = f
+		}
+	}
+
+	return exists, nil
+}
+
 // LoadSnapshot loads a snapshot.
 func (backend *BackendManager) LoadSnapshot(id string) ([]byte, error) {
+	if backend.isClosed() {
+		return []byte{}, ErrRepositoryClosed
+	}
+
 	for _, be := range backend.Backends {
 		for i := 0; i < retries; i++ {
 			b, err := (*be).LoadSnapshot(id)
+			backend.bandwidth.receive(len(b))
 			if err == nil {
 				return b, err
 			}
@@ -125,9 +533,17 @@ func (backend *BackendManager) LoadSnapshot(id string) ([]byte, error) {
 
 // SaveSnapshot stores a snapshot on all storage backends.
 func (backend *BackendManager) SaveSnapshot(id string, b []byte) error {
+	if backend.isClosed() {
+		return ErrRepositoryClosed
+	}
+	if backend.readOnly {
+		return ErrReadOnlyRepository
+	}
+
 	for _, be := range backend.Backends {
 		var err error
 		for i := 0; i < retries; i++ {
+			backend.bandwidth.send(len(b))
 			err = (*be).SaveSnapshot(id, b)
 			if err == nil {
 				break
@@ -143,9 +559,14 @@ func (backend *BackendManager) SaveSnapshot(id string, b []byte) error {
 
 // LoadChunkIndex loads the chunk-index.
 func (backend *BackendManager) LoadChunkIndex() ([]byte, error) {
+	if backend.isClosed() {
+		return []byte{}, ErrRepositoryClosed
+	}
+
 	for _, be := range backend.Backends {
 		for i := 0; i < retries; i++ {
 			b, err := (*be).LoadChunkIndex()
+			backend.bandwidth.receive(len(b))
 			if err == nil {
 				return b, err
 			}
@@ -155,26 +576,148 @@ func (backend *BackendManager) LoadChunkIndex() ([]byte, error) {
 	return []byte{}, ErrLoadChunkIndexFailed
 }
 
-// SaveChunkIndex stores the chunk-index on all storage backends.
+// LoadPreviousChunkIndex loads the previous generation of the chunk-index
+// from the first backend keeping one.
+func (backend *BackendManager) LoadPreviousChunkIndex() ([]byte, error) {
+	if backend.isClosed() {
+		return []byte{}, ErrRepositoryClosed
+	}
+
+	for _, be := range backend.Backends {
+		ir, ok := (*be).(IndexRotator)
+		if !ok {
+			continue
+		}
+		for i := 0; i < retries; i++ {
+			b, err := ir.LoadPreviousChunkIndex()
+			backend.bandwidth.receive(len(b))
+			if err == nil {
+				return b, err
+			}
+		}
+	}
+
+	return []byte{}, ErrLoadChunkIndexFailed
+}
+
+// SaveChunkIndex stores the chunk-index on all storage backends. Backends
+// that are IndexRotators keep the chunk-index it replaces as its previous
+// generation.
 func (backend *BackendManager) SaveChunkIndex(b []byte) error {
+	return backend.saveChunkIndex(b, true)
+}
+
+// saveChunkIndex stores the chunk-index on all storage backends, keeping the
+// chunk-index it replaces as its previous generation if rotate is set.
+func (backend *BackendManager) saveChunkIndex(b []byte, rotate bool) error {
+	if backend.isClosed() {
+		return ErrRepositoryClosed
+	}
+	if backend.readOnly {
+		return ErrReadOnlyRepository
+	}
+
+	for _, be := range backend.Backends {
+		if ir, ok := (*be).(IndexRotator); ok && rotate {
+			// fails if there's no chunk-index yet, which leaves nothing to
+			// keep
+			_ = ir.RotateChunkIndex()
+		}
+		err := backend.saveVerified(*be, MetadataChunkIndex, b, (*be).SaveChunkIndex, (*be).LoadChunkIndex, ErrStoreChunkIndexFailed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rotatesIndex returns true if any backend keeps the previous generation of
+// the chunk-index.
+func (backend *BackendManager) rotatesIndex() bool {
+	for _, be := range backend.Backends {
+		if _, ok := (*be).(IndexRotator); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// loadIndexPart loads a part of the chunk-index, see ChunkIndex. Parts are
+// stored as chunk objects named by their ID.
+func (backend *BackendManager) loadIndexPart(id string) ([]byte, error) {
+	if backend.isClosed() {
+		return []byte{}, ErrRepositoryClosed
+	}
+
 	for _, be := range backend.Backends {
-		var err error
 		for i := 0; i < retries; i++ {
-			err = (*be).SaveChunkIndex(b)
+			b, err := (*be).LoadChunk(id, 0, 1)
+			backend.bandwidth.receive(len(b))
 			if err == nil {
+				return b, err
+			}
+		}
+	}
+
+	return []byte{}, ErrLoadChunkIndexFailed
+}
+
+// storeIndexPart stores a part of the chunk-index on all storage backends,
+// just like the chunk-index itself.
+func (backend *BackendManager) storeIndexPart(id string, b []byte) error {
+	if backend.isClosed() {
+		return ErrRepositoryClosed
+	}
+	if backend.readOnly {
+		return ErrReadOnlyRepository
+	}
+
+	for _, be := range backend.Backends {
+		var err error
+		for i := 0; i < retries; i++ {
+			backend.bandwidth.send(len(b))
+			if _, err = (*be).StoreChunk(id, 0, 1, b); err == nil {
 				break
 			}
 		}
 		if err != nil {
-			return err
+			return ErrStoreChunkIndexFailed
 		}
 	}
 
 	return nil
 }
 
+// deleteIndexPart deletes a part of the chunk-index that's no longer used by
+// any of its generations from all storage backends.
+func (backend *BackendManager) deleteIndexPart(id string) error {
+	if backend.isClosed() {
+		return ErrRepositoryClosed
+	}
+	if backend.readOnly {
+		return ErrReadOnlyRepository
+	}
+
+	var err error
+	for _, be := range backend.Backends {
+		if derr := (*be).DeleteChunk(id, 0, 1); derr != nil {
+			err = derr
+		}
+	}
+
+	return err
+}
+
 // InitRepository creates a new repository.
 func (backend *BackendManager) InitRepository() error {
+	if backend.isClosed() {
+		return ErrRepositoryClosed
+	}
+	if backend.readOnly {
+		return ErrReadOnlyRepository
+	}
+
 	for _, be := range backend.Backends {
 		err := (*be).InitRepository()
 		if err != nil {
@@ -187,9 +730,14 @@ func (backend *BackendManager) InitRepository() error {
 
 // LoadRepository reads the metadata for a repository.
 func (backend *BackendManager) LoadRepository() ([]byte, error) {
+	if backend.isClosed() {
+		return []byte{}, ErrRepositoryClosed
+	}
+
 	for _, be := range backend.Backends {
 		for i := 0; i < retries; i++ {
 			b, err := (*be).LoadRepository()
+			backend.bandwidth.receive(len(b))
 			if err == nil {
 				return b, err
 			}
@@ -201,14 +749,15 @@ func (backend *BackendManager) LoadRepository() ([]byte, error) {
 
 // SaveRepository stores the metadata for a repository.
 func (backend *BackendManager) SaveRepository(b []byte) error {
+	if backend.isClosed() {
+		return ErrRepositoryClosed
+	}
+	if backend.readOnly {
+		return ErrReadOnlyRepository
+	}
+
 	for _, be := range backend.Backends {
-		var err error
-		for i := 0; i < retries; i++ {
-			err = (*be).SaveRepository(b)
-			if err == nil {
-				break
-			}
-		}
+		err := backend.saveVerified(*be, MetadataRepository, b, (*be).SaveRepository, (*be).LoadRepository, ErrStoreRepositoryFailed)
 		if err != nil {
 			return err
 		}
@@ -216,3 +765,112 @@ func (backend *BackendManager) SaveRepository(b []byte) error {
 
 	return nil
 }
+
+// saveVerified stores b with save and reads it back with load, retrying until
+// it has been stored intact. A StagingBackend stores the metadata object name
+// under a temporary name instead, which only replaces the stored object once
+// it's intact, so an interrupted save never leaves a half-written object
+// behind and can simply be repeated.
+func (backend *BackendManager) saveVerified(be Backend, name string, b []byte, save func([]byte) error, load func() ([]byte, error), failed error) error {
+	sb, staging := be.(StagingBackend)
+	if staging {
+		save = func(b []byte) error { return sb.StageMetadata(name, b) }
+		load = func() ([]byte, error) { return sb.LoadStagedMetadata(name) }
+	}
+
+	save, load = backend.bandwidth.countSave(save), backend.bandwidth.countLoad(load)
+	if err := backend.writeVerified(b, save, load, failed); err != nil {
+		return err
+	}
+	if staging {
+		return sb.CommitMetadata(name)
+	}
+	return nil
+}
+
+// writeVerified stores b with save until load returns it unchanged, at most
+// Options.MetadataRetries times.
+func (backend *BackendManager) writeVerified(b []byte, save func([]byte) error, load func() ([]byte, error), failed error) error {
+	attempts := backend.Options.MetadataRetries
+	if attempts <= 0 {
+		attempts = retries
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		err = save(b)
+		if err != nil {
+			continue
+		}
+
+		var stored []byte
+		stored, err = load()
+		if err == nil && !bytes.Equal(stored, b) {
+			err = failed
+		}
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// isClosed returns true if the backends have been closed.
+func (backend *BackendManager) isClosed() bool {
+	if backend.state == nil {
+		return false
+	}
+
+	backend.state.mut.Lock()
+	defer backend.state.mut.Unlock()
+	return backend.state.closed
+}
+
+// trackIndex remembers a chunk-index opened for the repository, so its
+// pending changes get saved when the repository gets closed.
+func (backend *BackendManager) trackIndex(index *ChunkIndex) {
+	if backend.state == nil {
+		return
+	}
+
+	backend.state.mut.Lock()
+	defer backend.state.mut.Unlock()
+	backend.state.indexes = append(backend.state.indexes, index)
+}
+
+// trackedIndexes returns all chunk-indexes opened for the repository.
+func (backend *BackendManager) trackedIndexes() []*ChunkIndex {
+	if backend.state == nil {
+		return nil
+	}
+
+	backend.state.mut.Lock()
+	defer backend.state.mut.Unlock()
+	return append([]*ChunkIndex{}, backend.state.indexes...)
+}
+
+// Close closes all backends, releasing their connections. All further
+// operations fail with ErrRepositoryClosed, for every copy of the manager.
+func (backend *BackendManager) Close() error {
+	if backend.state == nil {
+		backend.state = &managerState{}
+	}
+	backend.state.mut.Lock()
+	closed := backend.state.closed
+	backend.state.closed = true
+	backend.state.indexes = nil
+	backend.state.mut.Unlock()
+	if closed {
+		return ErrRepositoryClosed
+	}
+
+	var err error
+	for _, be := range backend.Backends {
+		if cerr := (*be).Close(); cerr != nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
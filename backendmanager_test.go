@@ -0,0 +1,372 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackendManagerMaxObjectSize(t *testing.T) {
+	testPassword := "this_is_a_password"
+	maxObjectSize := uint64(4096)
+
+	r, err := NewRepository("mem://maxobjectsize", testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	r.BackendManager().Options.MaxObjectSize = maxObjectSize
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	opts := StoreOptions{
+		CWD:       wd,
+		Paths:     []string{"snapshot.go"},
+		Compress:  CompressionNone,
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}
+	snapshot := storeSnapshot(t, &r, &index, opts)
+	if len(snapshot.Archives["snapshot.go"].Chunks) < 2 {
+		t.Errorf("Expected file to be split into multiple chunks")
+	}
+
+	for key, data := range memoryStores["maxobjectsize"] {
+		if strings.HasPrefix(key, "chunks/") && uint64(len(data)) > maxObjectSize {
+			t.Errorf("Object %s exceeds max object size: %d > %d", key, len(data), maxObjectSize)
+		}
+	}
+
+	targetdir, err := ioutil.TempDir("", "knoxite.target")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for restore: %s", err)
+		return
+	}
+	defer os.RemoveAll(targetdir)
+
+	progress, _ := DecodeSnapshot(r, snapshot, targetdir, RestoreOptions{})
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed restoring snapshot: %s", p.Error)
+		}
+	}
+	hash1, _ := hashFile("snapshot.go")
+	hash2, _ := hashFile(filepath.Join(targetdir, "snapshot.go"))
+	if hash1 != hash2 {
+		t.Errorf("Failed verifying shasum: %s != %s", hash1, hash2)
+	}
+
+	// a single chunk exceeding the limit must fail
+	data := [][]byte{make([]byte, maxObjectSize+1)}
+	_, err = r.BackendManager().StoreChunk(Chunk{Data: &data, Hash: "toolarge", DataParts: 1})
+	if _, ok := err.(*ObjectTooLargeError); !ok {
+		t.Errorf("Expected ObjectTooLargeError, got %v", err)
+	}
+}
+
+// macEncrypter appends a MAC to the data of every chunk, without
+// encrypting it.
+type macEncrypter struct{}
+
+func (macEncrypter) Name() string {
+	return "mac"
+}
+
+func (macEncrypter) Overhead() uint {
+	return 32
+}
+
+func (macEncrypter) Encrypt(chunk ChunkMetadata, data []byte) ([]byte, error) {
+	return append(append([]byte{}, data...), make([]byte, 32)...), nil
+}
+
+func (macEncrypter) Decrypt(chunk ChunkMetadata, data []byte) ([]byte, error) {
+	return data[:len(data)-32], nil
+}
+
+func TestBackendManagerMaxObjectSizeRandomData(t *testing.T) {
+	testPassword := "this_is_a_password"
+	maxObjectSize := uint64(4096)
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// random data doesn't compress, so encoding it only adds to its size
+	data := make([]byte, 64*1024)
+	_, _ = rand.Read(data)
+	file := filepath.Join(dir, "random")
+	_ = ioutil.WriteFile(file, data, 0644)
+
+	compressions := []uint16{CompressionNone, CompressionGZip, CompressionLZMA, CompressionFlate, CompressionZlib, CompressionZstd}
+	for _, encrypter := range []Encrypter{nil, macEncrypter{}} {
+		for _, compression := range compressions {
+			host := "maxobjectsize-random-" + strconv.Itoa(int(compression))
+			if encrypter != nil {
+				host += "-" + encrypter.Name()
+			}
+			r, err := NewRepositoryWithOptions("mem://"+host, testPassword, RepositoryOptions{Encrypter: encrypter})
+			if err != nil {
+				t.Fatalf("Failed creating repository: %s", err)
+			}
+			r.BackendManager().Options.MaxObjectSize = maxObjectSize
+			index, _ := OpenChunkIndex(&r)
+			wd, _ := os.Getwd()
+
+			snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+				CWD:       wd,
+				Paths:     []string{file},
+				Compress:  compression,
+				Encrypt:   EncryptionAES,
+				DataParts: 1,
+			})
+			for key, b := range memoryStores[host] {
+				if strings.HasPrefix(key, "chunks/") && uint64(len(b)) > maxObjectSize {
+					t.Errorf("Object %s of %s exceeds max object size: %d > %d", key, host, len(b), maxObjectSize)
+				}
+			}
+
+			dst := filepath.Join(dir, host)
+			if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{}); len(errs) > 0 {
+				t.Fatalf("Failed restoring snapshot of %s: %v", host, errs)
+			}
+			if b, err := ioutil.ReadFile(filepath.Join(dst, file)); err != nil || !bytes.Equal(b, data) {
+				t.Errorf("Failed restoring random data of %s: %v", host, err)
+			}
+		}
+	}
+}
+
+// sleepingBackend hangs for delay on the first hangs loads & stores of chunks.
+type sleepingBackend struct {
+	Backend
+	delay time.Duration
+	hangs int32
+	calls *int32
+}
+
+func (b sleepingBackend) hang() {
+	if atomic.AddInt32(b.calls, 1) <= b.hangs {
+		time.Sleep(b.delay)
+	}
+}
+
+func (b sleepingBackend) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
+	b.hang()
+	return b.Backend.LoadChunk(shasum, part, totalParts)
+}
+
+func (b sleepingBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	b.hang()
+	return b.Backend.StoreChunk(shasum, part, totalParts, data)
+}
+
+func TestBackendManagerOperationTimeout(t *testing.T) {
+	r, err := NewRepository("mem://operationtimeout", "this_is_a_password")
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	var calls int32
+	var be Backend = sleepingBackend{*r.backend.Backends[0], time.Second, 1, &calls}
+	r.backend.Backends[0] = &be
+	r.BackendManager().Options.OperationTimeout = 50 * time.Millisecond
+
+	// the first attempt hangs, gets aborted and retried
+	data := [][]byte{[]byte("some data")}
+	start := time.Now()
+	if _, err := r.BackendManager().StoreChunk(Chunk{Data: &data, Hash: "hanging", DataParts: 1}); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Errorf("Expected the hanging store to be aborted, took %s", d)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("Expected the store to be retried once, got %d attempts", calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	b, err := r.BackendManager().LoadChunk(Chunk{Hash: "hanging", DataParts: 1}, 0)
+	if err != nil || string(b) != "some data" {
+		t.Errorf("Failed loading chunk: %v", err)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("Expected the load to be retried once, got %d attempts", calls)
+	}
+
+	// every attempt hangs
+	atomic.StoreInt32(&calls, -retries)
+	_, err = r.BackendManager().StoreChunk(Chunk{Data: &data, Hash: "hanging", DataParts: 1})
+	if !errors.Is(err, ErrOperationTimeout) {
+		t.Errorf("Expected ErrOperationTimeout, got %v", err)
+	}
+	if te, ok := err.(*OperationTimeoutError); !ok || te.Op != "Storing" || te.Hash != "hanging" {
+		t.Errorf("Expected OperationTimeoutError for storing the chunk, got %#v", err)
+	}
+
+	// waiting for the limiter counts towards the timeout
+	limiter := NewLimiter(1)
+	r.BackendManager().limiter = limiter
+	limiter.acquire(nil)
+	atomic.StoreInt32(&calls, 1)
+	start = time.Now()
+	_, err = r.BackendManager().StoreChunk(Chunk{Data: &data, Hash: "limited", DataParts: 1})
+	if !errors.Is(err, ErrOperationTimeout) {
+		t.Errorf("Expected ErrOperationTimeout while waiting for the limiter, got %v", err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Errorf("Expected waiting for the limiter to be aborted, took %s", d)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("Expected no store to be started, got %d attempts", calls-1)
+	}
+
+	limiter.release()
+	if _, err := r.BackendManager().StoreChunk(Chunk{Data: &data, Hash: "limited", DataParts: 1}); err != nil {
+		t.Errorf("Failed storing chunk once the limiter got released: %s", err)
+	}
+}
+
+func TestBackendManagerSlowOperation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "data")
+	_ = ioutil.WriteFile(file, []byte("some content"), 0600)
+
+	r, err := NewRepository("mem://slowoperation", "this_is_a_password")
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	var calls int32
+	var be Backend = sleepingBackend{*r.backend.Backends[0], 20 * time.Millisecond, 1, &calls}
+	r.backend.Backends[0] = &be
+	r.BackendManager().Options.SlowOperationThreshold = 10 * time.Millisecond
+
+	index, _ := OpenChunkIndex(&r)
+	snapshot, _ := NewSnapshot("test snapshot")
+	wd, _ := os.Getwd()
+	progress := snapshot.Add(r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{file},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	})
+
+	var warnings []error
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed storing file: %s", p.Error)
+		}
+		if p.Warning != nil {
+			warnings = append(warnings, p.Warning)
+		}
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("Expected one warning, got %v", warnings)
+	}
+	if w, ok := warnings[0].(*SlowOperationWarning); !ok || w.Op != "Storing" || w.Duration < 20*time.Millisecond {
+		t.Errorf("Expected SlowOperationWarning for storing the chunk, got %#v", warnings[0])
+	}
+}
+
+// multipartBackend stores chunks in pieces of 1 KiB. Uploading the piece
+// failAt fails once.
+type multipartBackend struct {
+	Backend
+	failAt  int
+	uploads map[string]map[int][]byte
+	pieces  *int
+	aborted *int
+}
+
+func (b multipartBackend) MultipartPieceSize() int {
+	return 1024
+}
+
+func (b multipartBackend) BeginUpload(upload *MultipartUpload) error {
+	upload.ID = strconv.Itoa(len(b.uploads))
+	b.uploads[upload.ID] = make(map[int][]byte)
+	return nil
+}
+
+func (b multipartBackend) UploadPiece(upload *MultipartUpload, number int, data []byte) (UploadedPiece, error) {
+	if number == b.failAt && b.uploads[upload.ID][-1] == nil {
+		b.uploads[upload.ID][-1] = []byte{}
+		return UploadedPiece{}, errors.New("connection reset")
+	}
+
+	*b.pieces++
+	b.uploads[upload.ID][number] = append([]byte{}, data...)
+	return UploadedPiece{Number: number, ETag: strconv.Itoa(number)}, nil
+}
+
+func (b multipartBackend) CompleteUpload(upload *MultipartUpload) error {
+	var data []byte
+	for _, piece := range upload.Pieces {
+		data = append(data, b.uploads[upload.ID][piece.Number]...)
+	}
+	_, err := b.Backend.StoreChunk(upload.Hash, upload.Part, upload.TotalParts, data)
+	return err
+}
+
+func (b multipartBackend) AbortUpload(upload *MultipartUpload) error {
+	*b.aborted++
+	delete(b.uploads, upload.ID)
+	return nil
+}
+
+func TestBackendManagerMultipartResume(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	r, _ := NewRepository("mem://multipart-resume", testPassword)
+	var pieces, aborted int
+	var be Backend = multipartBackend{*r.backend.Backends[0], 4, make(map[string]map[int][]byte), &pieces, &aborted}
+	r.backend.Backends[0] = &be
+
+	data := make([]byte, 10*1024+512)
+	_, _ = rand.Read(data)
+	chunk := Chunk{Data: &[][]byte{data}, Hash: "multipart", DataParts: 1}
+	if _, err := r.backend.StoreChunk(chunk); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	if pieces != 11 {
+		t.Errorf("Expected the interrupted upload to resume, got %d pieces uploaded instead of 11", pieces)
+	}
+
+	b, err := r.backend.LoadChunk(chunk, 0)
+	if err != nil {
+		t.Fatalf("Failed loading chunk: %s", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("Expected chunk to be stored completely")
+	}
+
+	// small chunks get stored at once
+	pieces = 0
+	small := Chunk{Data: &[][]byte{data[:1024]}, Hash: "small", DataParts: 1}
+	if _, err := r.backend.StoreChunk(small); err != nil || pieces != 0 {
+		t.Errorf("Expected small chunk to be stored without pieces, got %d pieces: %v", pieces, err)
+	}
+	if aborted != 0 {
+		t.Errorf("Expected no upload to be aborted, got %d", aborted)
+	}
+}
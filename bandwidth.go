@@ -0,0 +1,96 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"sync/atomic"
+)
+
+// BandwidthStats records the data transferred to & from the storage backends,
+// e.g. to estimate the bill of metered backends. Unlike the Stats of a
+// snapshot, it counts the compressed & encrypted data as it goes over the
+// wire, including the data of failed and retried requests.
+type BandwidthStats struct {
+	Sent     uint64 // bytes sent to the backends
+	Received uint64 // bytes received from the backends
+	Requests uint64 // requests made to the backends
+}
+
+// bandwidth accumulates the BandwidthStats of a BackendManager. It's shared
+// by all copies of a repository.
+type bandwidth struct {
+	sent     uint64
+	received uint64
+	requests uint64
+}
+
+// send records a request sending n bytes. A nil bandwidth records nothing.
+func (bw *bandwidth) send(n int) {
+	if bw != nil {
+		atomic.AddUint64(&bw.sent, uint64(n))
+		atomic.AddUint64(&bw.requests, 1)
+	}
+}
+
+// receive records a request receiving n bytes.
+func (bw *bandwidth) receive(n int) {
+	if bw != nil {
+		atomic.AddUint64(&bw.received, uint64(n))
+		atomic.AddUint64(&bw.requests, 1)
+	}
+}
+
+// countSave returns save, recording the data it sends.
+func (bw *bandwidth) countSave(save func([]byte) error) func([]byte) error {
+	return func(b []byte) error {
+		bw.send(len(b))
+		return save(b)
+	}
+}
+
+// countLoad returns load, recording the data it receives.
+func (bw *bandwidth) countLoad(load func() ([]byte, error)) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		b, err := load()
+		bw.receive(len(b))
+		return b, err
+	}
+}
+
+// stats returns the BandwidthStats recorded so far.
+func (bw *bandwidth) stats() BandwidthStats {
+	if bw == nil {
+		return BandwidthStats{}
+	}
+	return BandwidthStats{
+		Sent:     atomic.LoadUint64(&bw.sent),
+		Received: atomic.LoadUint64(&bw.received),
+		Requests: atomic.LoadUint64(&bw.requests),
+	}
+}
+
+// reset discards the BandwidthStats recorded so far.
+func (bw *bandwidth) reset() {
+	if bw != nil {
+		atomic.StoreUint64(&bw.sent, 0)
+		atomic.StoreUint64(&bw.received, 0)
+		atomic.StoreUint64(&bw.requests, 0)
+	}
+}
+
+// BandwidthStats returns the data transferred to & from the storage backends
+// since the repository got opened, or since the last ResetBandwidthStats.
+func (r *Repository) BandwidthStats() BandwidthStats {
+	return r.backend.bandwidth.stats()
+}
+
+// ResetBandwidthStats starts recording the BandwidthStats of a new
+// operation.
+func (r *Repository) ResetBandwidthStats() {
+	r.backend.bandwidth.reset()
+}
@@ -0,0 +1,151 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// wireCountingBackend counts the data transferred to & from a backend. The
+// first chunk it stores fails after being transferred.
+type wireCountingBackend struct {
+	Backend
+	mut      *sync.Mutex
+	sent     *uint64
+	received *uint64
+	failed   *bool
+}
+
+func (b wireCountingBackend) send(data []byte) {
+	b.mut.Lock()
+	*b.sent += uint64(len(data))
+	b.mut.Unlock()
+}
+
+func (b wireCountingBackend) receive(data []byte, err error) ([]byte, error) {
+	b.mut.Lock()
+	*b.received += uint64(len(data))
+	b.mut.Unlock()
+	return data, err
+}
+
+func (b wireCountingBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	b.send(data)
+	b.mut.Lock()
+	fail := !*b.failed
+	*b.failed = true
+	b.mut.Unlock()
+	if fail {
+		return 0, errors.New("connection reset")
+	}
+	return b.Backend.StoreChunk(shasum, part, totalParts, data)
+}
+
+func (b wireCountingBackend) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
+	return b.receive(b.Backend.LoadChunk(shasum, part, totalParts))
+}
+
+func (b wireCountingBackend) SaveSnapshot(id string, data []byte) error {
+	b.send(data)
+	return b.Backend.SaveSnapshot(id, data)
+}
+
+func (b wireCountingBackend) LoadSnapshot(id string) ([]byte, error) {
+	return b.receive(b.Backend.LoadSnapshot(id))
+}
+
+func (b wireCountingBackend) SaveChunkIndex(data []byte) error {
+	b.send(data)
+	return b.Backend.SaveChunkIndex(data)
+}
+
+func (b wireCountingBackend) LoadChunkIndex() ([]byte, error) {
+	return b.receive(b.Backend.LoadChunkIndex())
+}
+
+func (b wireCountingBackend) SaveRepository(data []byte) error {
+	b.send(data)
+	return b.Backend.SaveRepository(data)
+}
+
+func (b wireCountingBackend) LoadRepository() ([]byte, error) {
+	return b.receive(b.Backend.LoadRepository())
+}
+
+func TestBandwidthStats(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 256*1024)
+	_, _ = rand.Read(data)
+	file := filepath.Join(dir, "data")
+	_ = ioutil.WriteFile(file, data, 0644)
+
+	r, err := NewRepository("mem://bandwidth", testPassword)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	var mut sync.Mutex
+	var sent, received uint64
+	var failed bool
+	var be Backend = wireCountingBackend{*r.backend.Backends[0], &mut, &sent, &received, &failed}
+	r.backend.Backends[0] = &be
+	r.ResetBandwidthStats()
+
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{file},
+		Compress:  CompressionGZip,
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	})
+	if err := snapshot.Save(&r); err != nil {
+		t.Fatalf("Failed saving snapshot: %s", err)
+	}
+	if err := index.Save(&r); err != nil {
+		t.Fatalf("Failed saving chunk-index: %s", err)
+	}
+	if !failed {
+		t.Fatal("Expected a chunk to be stored twice")
+	}
+
+	stats := r.BandwidthStats()
+	if stats.Sent != sent {
+		t.Errorf("Expected %d bytes sent, got %d", sent, stats.Sent)
+	}
+	// the data is incompressible, so the retried chunk gets sent twice
+	if stats.Sent <= snapshot.Stats.StorageSize {
+		t.Errorf("Expected more than %d bytes sent including the retry, got %d", snapshot.Stats.StorageSize, stats.Sent)
+	}
+
+	r.ResetBandwidthStats()
+	received = 0
+	if _, _, err := DecodeArchiveData(r, *snapshot.Archives[file]); err != nil {
+		t.Fatalf("Failed decoding archive: %s", err)
+	}
+	stats = r.BandwidthStats()
+	if stats.Received != received || stats.Received < snapshot.Stats.StorageSize {
+		t.Errorf("Expected %d bytes received, got %d", received, stats.Received)
+	}
+	if stats.Sent != 0 {
+		t.Errorf("Expected no bytes sent while restoring, got %d", stats.Sent)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import "sync"
+
+var (
+	bufferPoolsMut sync.Mutex
+	bufferPools    = make(map[int]*sync.Pool)
+)
+
+// bufferPool returns the pool of buffers with a capacity of size bytes.
+func bufferPool(size int) *sync.Pool {
+	bufferPoolsMut.Lock()
+	defer bufferPoolsMut.Unlock()
+
+	p, ok := bufferPools[size]
+	if !ok {
+		p = &sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, size)
+				return &b
+			},
+		}
+		bufferPools[size] = p
+	}
+
+	return p
+}
+
+// getChunkBuffer returns a zeroed buffer of size bytes for chunk data.
+func getChunkBuffer(size uint) *[]byte {
+	b := bufferPool(int(size)).Get().(*[]byte)
+	*b = (*b)[:size]
+	return b
+}
+
+// putChunkBuffer zeroes b, so no data leaks into the next chunk, and returns
+// it to the pool for its size. Nil buffers are ignored.
+func putChunkBuffer(b *[]byte) {
+	if b == nil {
+		return
+	}
+
+	*b = (*b)[:cap(*b)]
+	for i := range *b {
+		(*b)[i] = 0
+	}
+
+	bufferPool(cap(*b)).Put(b)
+}
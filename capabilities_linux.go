@@ -0,0 +1,33 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// capabilityXattr is the extended attribute holding a file's capabilities.
+const capabilityXattr = "security.capability"
+
+// fileCapability returns the raw file capabilities of path, or nil if it has
+// none.
+func fileCapability(path string) ([]byte, error) {
+	return lgetxattr(path, capabilityXattr)
+}
+
+// setFileCapability applies the raw file capabilities capability to path,
+// which requires the CAP_SETFCAP capability.
+func setFileCapability(path string, capability []byte) error {
+	if err := unix.Setxattr(path, capabilityXattr, capability, 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+
+	return nil
+}
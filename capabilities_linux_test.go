@@ -0,0 +1,79 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreserveCapabilities(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	if os.Geteuid() != 0 {
+		t.Skip("Restoring file capabilities requires root")
+	}
+	setcap, err := exec.LookPath("setcap")
+	if err != nil {
+		t.Skip("setcap is not installed")
+	}
+	getcap, err := exec.LookPath("getcap")
+	if err != nil {
+		t.Skip("getcap is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	binary := filepath.Join(src, "binary")
+	if err := ioutil.WriteFile(binary, []byte("some content"), 0755); err != nil {
+		t.Fatalf("Failed writing test file: %s", err)
+	}
+	if out, err := exec.Command(setcap, "cap_net_bind_service=+ep", binary).CombinedOutput(); err != nil {
+		t.Skipf("File system doesn't support capabilities: %s", out)
+	}
+
+	r, _ := NewRepository("mem://capabilities", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:                  wd,
+		Paths:                []string{src},
+		Encrypt:              EncryptionAES,
+		DataParts:            1,
+		PreserveCapabilities: true,
+	})
+	if arc := snapshot.Archives[binary]; arc == nil || len(arc.Capability) == 0 {
+		t.Fatal("Expected the capabilities of the file to be recorded")
+	}
+
+	for _, preserve := range []bool{false, true} {
+		dst := filepath.Join(dir, "dst")
+		_ = os.RemoveAll(dst)
+		if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{PreserveCapabilities: preserve}); len(errs) > 0 {
+			t.Fatalf("Failed restoring snapshot: %v", errs)
+		}
+
+		out, err := exec.Command(getcap, filepath.Join(dst, binary)).CombinedOutput()
+		if err != nil {
+			t.Fatalf("Failed running getcap: %s", out)
+		}
+		if restored := strings.Contains(string(out), "cap_net_bind_service"); restored != preserve {
+			t.Errorf("Expected capabilities to be restored: %v, getcap shows: %q", preserve, out)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+// fileCapability returns no capabilities, as they only exist on Linux.
+func fileCapability(path string) ([]byte, error) {
+	return nil, nil
+}
+
+// setFileCapability is a no-op, as file capabilities only exist on Linux.
+func setFileCapability(path string, capability []byte) error {
+	return nil
+}
@@ -9,8 +9,9 @@ package knoxite
 
 import (
 	"io"
+	"math/bits"
 	"os"
-	"sync"
+	"runtime"
 
 	"github.com/restic/chunker"
 )
@@ -29,6 +30,33 @@ type Chunk struct {
 	DecryptedHash string    `json:"decrypted_hash"`
 	Hash          string    `json:"hash"`
 	Num           uint      `json:"num"`
+	Epoch         uint      `json:"epoch,omitempty"` // data encryption key epoch
+	Salt          string    `json:"salt,omitempty"`  // keys the chunk of a snapshot stored without deduplication
+	// Uncompressed is set if the chunk got stored without the compression
+	// of its archive, see StoreOptions.CompressMinChunkSize
+	Uncompressed bool `json:"uncompressed,omitempty"`
+	// Pack is the ID of the pack object the chunk is stored in at Offset,
+	// instead of in an object of its own, see StoreOptions.PackSize
+	Pack   string `json:"pack,omitempty"`
+	Offset int    `json:"offset,omitempty"`
+}
+
+// compression returns the compression method the chunk of arc got stored
+// with.
+func (chunk Chunk) compression(arc *Archive) uint16 {
+	if chunk.Uncompressed {
+		return CompressionNone
+	}
+	return arc.Compressed
+}
+
+// partSize returns the size of every stored part of the chunk. Chunks with
+// parity parts get split into parts of equal size, padded if necessary.
+func (chunk Chunk) partSize() uint64 {
+	if chunk.ParityParts > 0 {
+		return uint64((chunk.Size + int(chunk.DataParts) - 1) / int(chunk.DataParts))
+	}
+	return uint64(chunk.Size)
 }
 
 // ChunkResult is used to transfer either a chunk or an error down the channel.
@@ -40,102 +68,214 @@ type ChunkResult struct {
 type inputChunk struct {
 	Data []byte
 	Num  uint
+	buf  *[]byte // pooled buffer backing Data
+
+	result chan<- ChunkResult // receives the processed chunk
 }
 
-func processChunk(password string, opts StoreOptions, jobs <-chan inputChunk, chunks chan<- ChunkResult, wg *sync.WaitGroup) {
-	pipe, _ := NewEncodingPipeline(opts.Compress, opts.Encrypt, password)
+func processChunk(password string, opts StoreOptions, jobs <-chan inputChunk) {
+	compressor := Compressor{Method: opts.Compress, LZMA: opts.LZMA}
+	encryption := opts.pipelineEncryption()
+	pipe, _ := newEncodingPipelineWithCompressor(compressor, encryption, password)
+	dictPipe := pipe
+	if opts.dict != nil {
+		compressor.Dict = opts.dict
+		dictPipe, _ = newEncodingPipelineWithCompressor(compressor, encryption, password)
+	}
+	rawPipe, _ := newEncodingPipelineWithCompressor(Compressor{Method: CompressionNone}, encryption, password)
 
 	for j := range jobs {
 		// fmt.Println("\tWorker", id, "processing job", j.Num, len(j.Data))
 
-		b, err := pipe.Process(j.Data)
+		p := pipe
+		uncompressed := opts.Compress != CompressionNone && uint(len(j.Data)) < opts.CompressMinChunkSize
+		if uncompressed {
+			p = rawPipe
+		} else if len(j.Data) < compressionDictMaxChunkSize {
+			p = dictPipe
+		}
+		orighashsum := Hash(j.Data, HashHighway256)
+		b, err := p.Process(j.Data)
+		if err == nil && opts.encrypter != nil {
+			b, err = opts.encrypter.Encrypt(ChunkMetadata{DecryptedHash: orighashsum, Salt: opts.salt}, b)
+		}
 		if err != nil {
-			chunks <- ChunkResult{Error: err}
-			wg.Done()
+			putChunkBuffer(j.buf)
+			j.result <- ChunkResult{Error: err}
 			continue
 		}
 
+		if j.buf != nil && len(b) > 0 && &b[0] == &j.Data[0] {
+			// uncompressed & unencrypted data still refers to the pooled buffer
+			b = append([]byte(nil), b...)
+		}
+
 		hashsum := Hash(b, HashHighway256)
-		orighashsum := Hash(j.Data, HashHighway256)
+		if opts.salt != "" {
+			// key the storage location, even if the data isn't encrypted
+			hashsum = Hash(append([]byte(opts.salt), b...), HashHighway256)
+		}
+		size := len(j.Data)
+		putChunkBuffer(j.buf)
 
 		c := Chunk{
 			DataParts:     opts.DataParts,
 			ParityParts:   opts.ParityParts,
-			OriginalSize:  len(j.Data),
+			OriginalSize:  size,
 			Size:          len(b),
 			DecryptedHash: orighashsum,
 			Hash:          hashsum,
 			Num:           j.Num,
+			Uncompressed:  uncompressed,
 		}
 
-		if opts.ParityParts > 0 {
+		if opts.ParityParts > 0 && !opts.groupsParity(len(b)) {
 			pars, err := redundantData(b, int(opts.DataParts), int(opts.ParityParts))
 			if err != nil {
-				chunks <- ChunkResult{Error: err}
-				wg.Done()
+				j.result <- ChunkResult{Error: err}
 				continue
 			}
 			c.Data = &pars
 		} else {
 			c.DataParts = 1
+			c.ParityParts = 0
 			c.Data = &[][]byte{b}
 		}
 
-		chunks <- ChunkResult{Chunk: c}
-		wg.Done()
+		j.result <- ChunkResult{Chunk: c}
 	}
 }
 
-// chunkFile divides filename into chunks of 1MiB each.
-func chunkFile(filename string, password string, opts StoreOptions) (chan ChunkResult, error) {
-	c := make(chan ChunkResult)
+// maxEncodingOverhead returns how many bytes compressing & encrypting a
+// chunk of up to n bytes with opts adds at most. Compressing incompressible
+// data stores it in blocks of at least 16 KiB, each adding up to 5 bytes of
+// framing, in addition to the headers & checksums of the format.
+func (opts StoreOptions) maxEncodingOverhead(n uint) uint {
+	var overhead uint
+	if opts.Compress != CompressionNone {
+		overhead += (n/(16<<10)+1)*5 + 256
+	}
+	if opts.encrypter != nil {
+		if oe, ok := opts.encrypter.(OverheadEncrypter); ok {
+			overhead += oe.Overhead()
+		} else {
+			overhead += defaultEncrypterOverhead
+		}
+	}
+
+	return overhead
+}
 
+// chunkFile divides filename into chunks of up to maxSize bytes each. If mac
+// is not nil, the file's content gets written to it in order.
+func chunkFile(filename string, password string, maxSize uint, mac io.Writer, opts StoreOptions) (chan ChunkResult, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		return c, err
+		return make(chan ChunkResult), err
 	}
 
-	wg := &sync.WaitGroup{}
+	return chunkReader(file, password, maxSize, mac, opts), nil
+}
+
+// chunkReader divides the content read from r into chunks of up to maxSize
+// bytes each, closing r when done. If mac is not nil, the content gets
+// written to it in order. While the next chunk boundary gets searched for,
+// opts.ChunkWorkers goroutines compress & encrypt the previous chunks. The
+// chunks are sent in the order of their content nonetheless.
+func chunkReader(r io.ReadCloser, password string, maxSize uint, mac io.Writer, opts StoreOptions) chan ChunkResult {
+	c := make(chan ChunkResult)
+
+	workers := opts.ChunkWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
 	jobs := make(chan inputChunk)
-	for w := 1; w <= 4; w++ {
-		go processChunk(password, opts, jobs, c, wg)
+	for w := 0; w < workers; w++ {
+		go processChunk(password, opts, jobs)
 	}
 
-	wg.Add(1)
+	// the results of the chunks being processed, in order
+	pending := make(chan chan ChunkResult, workers)
+	go func() {
+		for result := range pending {
+			c <- <-result
+		}
+		close(c)
+	}()
+
 	go func() {
-		chunker := chunker.NewWithBoundaries(file, chunker.Pol(0x3DA3358B4DC173), chunker.MinSize, preferredChunkSize)
+		defer close(pending)
+		defer close(jobs)
+
+		var next func(buf []byte) ([]byte, error)
+		if opts.Chunker != nil {
+			next = customChunks(opts.Chunker, r, maxSize)
+		} else {
+			minSize := uint(chunker.MinSize)
+			if maxSize < 2*minSize {
+				minSize = maxSize / 2
+			}
+			averageBits := 0
+			if opts.StableChunkBoundaries {
+				minSize = maxSize / 4
+				averageBits = bits.Len(maxSize/4) - 1
+			}
+			chunker := chunker.NewWithBoundaries(r, chunker.Pol(0x3DA3358B4DC173), minSize, maxSize)
+			if averageBits > 0 {
+				// aim for chunks of about half the maximum size
+				chunker.SetAverageBits(averageBits)
+			}
+			next = func(buf []byte) ([]byte, error) {
+				chunk, err := chunker.Next(buf)
+				return chunk.Data, err
+			}
+		}
 
 		i := uint(0)
 		for {
-			buf := make([]byte, preferredChunkSize)
-			chunk, err := chunker.Next(buf)
+			var buf *[]byte
+			if opts.DisableBufferPool {
+				b := make([]byte, maxSize)
+				buf = &b
+			} else {
+				buf = getChunkBuffer(maxSize)
+			}
+			data, err := next(*buf)
 			if err == io.EOF {
-				wg.Done()
+				if !opts.DisableBufferPool {
+					putChunkBuffer(buf)
+				}
 				break
 			}
+
+			result := make(chan ChunkResult, 1)
+			pending <- result
 			if err != nil {
-				c <- ChunkResult{Error: err}
-				wg.Done()
+				if !opts.DisableBufferPool {
+					putChunkBuffer(buf)
+				}
+				result <- ChunkResult{Error: err}
 				break
 			}
 
-			wg.Add(1)
+			if mac != nil {
+				_, _ = mac.Write(data)
+			}
+
 			j := inputChunk{
-				Data: chunk.Data,
-				Num:  i,
+				Data:   data,
+				Num:    i,
+				result: result,
+			}
+			if !opts.DisableBufferPool {
+				j.buf = buf
 			}
 
 			i++
 			jobs <- j
 		}
-		_ = file.Close()
-	}()
-
-	go func() {
-		wg.Wait()
-		close(jobs)
-		close(c)
+		_ = r.Close()
 	}()
 
-	return c, nil
+	return c
 }
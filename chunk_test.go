@@ -0,0 +1,411 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestChunkBufferPool(t *testing.T) {
+	b := getChunkBuffer(1024)
+	if len(*b) != 1024 {
+		t.Fatalf("Expected a buffer of %d bytes, got %d", 1024, len(*b))
+	}
+	for i := range *b {
+		(*b)[i] = 0xff
+	}
+	putChunkBuffer(b)
+
+	b = getChunkBuffer(1024)
+	if !bytes.Equal(*b, make([]byte, 1024)) {
+		t.Error("Pooled buffer has not been reset")
+	}
+	putChunkBuffer(b)
+}
+
+func TestChunkReaderBufferPool(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, pool := range []bool{true, false} {
+		opts := StoreOptions{
+			Compress:          CompressionNone,
+			Encrypt:           EncryptionNone,
+			DataParts:         1,
+			DisableBufferPool: !pool,
+		}
+
+		chunks := make(map[uint][]byte)
+		for cr := range chunkReader(ioutil.NopCloser(bytes.NewReader(data)), "", 64*1024, nil, opts) {
+			if cr.Error != nil {
+				t.Fatal(cr.Error)
+			}
+			chunks[cr.Chunk.Num] = (*cr.Chunk.Data)[0]
+		}
+
+		var out []byte
+		for i := uint(0); i < uint(len(chunks)); i++ {
+			out = append(out, chunks[i]...)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("Chunked data differs from input (pool: %v)", pool)
+		}
+	}
+}
+
+func TestChunkReaderWorkers(t *testing.T) {
+	data := make([]byte, 8<<20)
+	rnd := rand.New(rand.NewSource(1))
+	// compressible data, so chunks take different amounts of time
+	for i := 0; i < len(data); i += 4096 {
+		if rnd.Intn(2) == 0 {
+			rnd.Read(data[i : i+4096])
+		}
+	}
+
+	chunkData := func(workers int) []Chunk {
+		opts := StoreOptions{
+			Compress:     CompressionZstd,
+			Encrypt:      EncryptionAES,
+			DataParts:    1,
+			ChunkWorkers: workers,
+		}
+
+		var chunks []Chunk
+		for cr := range chunkReader(ioutil.NopCloser(bytes.NewReader(data)), "this_is_a_password", 64*1024, nil, opts) {
+			if cr.Error != nil {
+				t.Fatal(cr.Error)
+			}
+			if cr.Chunk.Num != uint(len(chunks)) {
+				t.Fatalf("Expected chunk %d, got chunk %d (%d workers)", len(chunks), cr.Chunk.Num, workers)
+			}
+			chunks = append(chunks, cr.Chunk)
+		}
+		return chunks
+	}
+
+	serial := chunkData(1)
+	parallel := chunkData(8)
+	if len(serial) != len(parallel) {
+		t.Fatalf("Expected %d chunks, got %d", len(serial), len(parallel))
+	}
+	for i := range serial {
+		if serial[i].OriginalSize != parallel[i].OriginalSize || serial[i].DecryptedHash != parallel[i].DecryptedHash {
+			t.Errorf("Chunk %d differs between serial and parallel chunking", i)
+		}
+	}
+
+	// restore a file chunked in parallel
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "large")
+	_ = ioutil.WriteFile(file, data, 0644)
+
+	r, _ := NewRepository("mem://chunkworkers", "this_is_a_password")
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:          wd,
+		Paths:        []string{file},
+		Compress:     CompressionZstd,
+		Encrypt:      EncryptionAES,
+		DataParts:    1,
+		ChunkSize:    64 * 1024,
+		ChunkWorkers: 8,
+	})
+	b, _, err := DecodeArchiveData(r, *snapshot.Archives[file])
+	if err != nil {
+		t.Fatalf("Failed restoring file: %s", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("Restored data differs from the original file")
+	}
+}
+
+// fixedChunker divides data into chunks of size bytes.
+type fixedChunker struct {
+	size uint
+	skip bool // leaves a gap after every chunk
+}
+
+type fixedBoundaries struct {
+	r      io.Reader
+	size   uint
+	skip   bool
+	offset uint64
+}
+
+func (c fixedChunker) Split(r io.Reader, maxSize uint) ChunkBoundaries {
+	size := c.size
+	if size > maxSize {
+		size = maxSize
+	}
+	return &fixedBoundaries{r: r, size: size, skip: c.skip}
+}
+
+func (b *fixedBoundaries) Next() (uint64, uint, error) {
+	n, err := io.ReadFull(b.r, make([]byte, b.size))
+	if n == 0 {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, 0, err
+	}
+
+	offset := b.offset
+	b.offset += uint64(n)
+	if b.skip {
+		b.offset++
+	}
+	return offset, uint(n), nil
+}
+
+func TestCustomChunker(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "records")
+	_ = ioutil.WriteFile(file, data, 0644)
+
+	r, _ := NewRepository("mem://customchunker", "this_is_a_password")
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{file},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+		Chunker:   fixedChunker{size: 4096},
+	})
+
+	chunks := snapshot.Archives[file].Chunks
+	if len(chunks) != 25 {
+		t.Fatalf("Expected 25 chunks, got %d", len(chunks))
+	}
+	for i, c := range chunks {
+		if i < len(chunks)-1 && c.OriginalSize != 4096 {
+			t.Errorf("Expected chunk %d to contain 4096 bytes, got %d", i, c.OriginalSize)
+		}
+	}
+
+	dst := filepath.Join(dir, "restore")
+	if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dst, file))
+	if !bytes.Equal(b, data) {
+		t.Error("Restored data differs from the original file")
+	}
+
+	// chunks have to be consecutive
+	opts := StoreOptions{
+		Encrypt:   EncryptionNone,
+		DataParts: 1,
+		Chunker:   fixedChunker{size: 4096, skip: true},
+	}
+	var errs []error
+	for cr := range chunkReader(ioutil.NopCloser(bytes.NewReader(data)), "", 64*1024, nil, opts) {
+		if cr.Error != nil {
+			errs = append(errs, cr.Error)
+		}
+	}
+	if len(errs) != 1 || errs[0] != ErrInvalidChunkBoundary {
+		t.Errorf("Expected ErrInvalidChunkBoundary, got %v", errs)
+	}
+}
+
+func benchmarkChunkReader(b *testing.B, opts StoreOptions) {
+	data := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for cr := range chunkReader(ioutil.NopCloser(bytes.NewReader(data)), "this_is_a_password", 64*1024, nil, opts) {
+			if cr.Error != nil {
+				b.Fatal(cr.Error)
+			}
+		}
+	}
+}
+
+func BenchmarkChunkReader(b *testing.B) {
+	opts := StoreOptions{
+		Compress:  CompressionNone,
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}
+
+	b.Run("pooled", func(b *testing.B) {
+		benchmarkChunkReader(b, opts)
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		opts.DisableBufferPool = true
+		benchmarkChunkReader(b, opts)
+	})
+}
+
+func BenchmarkChunkReaderWorkers(b *testing.B) {
+	opts := StoreOptions{
+		Compress:  CompressionZstd,
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		opts.ChunkWorkers = workers
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			benchmarkChunkReader(b, opts)
+		})
+	}
+}
+
+// chunkReuse divides data into chunks of up to maxSize bytes, once as is and
+// once with a few bytes inserted at its beginning. It returns the amount of
+// chunks of the edited data and how many of them are shared with the
+// original.
+func chunkReuse(data []byte, maxSize uint, opts StoreOptions) (chunks, reused int) {
+	hashes := func(data []byte) []string {
+		var hashes []string
+		for cr := range chunkReader(ioutil.NopCloser(bytes.NewReader(data)), "", maxSize, nil, opts) {
+			hashes = append(hashes, cr.Chunk.Hash)
+		}
+		return hashes
+	}
+
+	original := make(map[string]bool)
+	for _, hash := range hashes(data) {
+		original[hash] = true
+	}
+	edited := hashes(append([]byte("a few prepended bytes"), data...))
+	for _, hash := range edited {
+		if original[hash] {
+			reused++
+		}
+	}
+	return len(edited), reused
+}
+
+func TestChunkBoundaryStability(t *testing.T) {
+	data := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, stable := range []bool{false, true} {
+		opts := StoreOptions{
+			Compress:              CompressionNone,
+			Encrypt:               EncryptionNone,
+			DataParts:             1,
+			StableChunkBoundaries: stable,
+		}
+		for _, maxSize := range []uint{64 << 10, preferredChunkSize} {
+			chunks, reused := chunkReuse(data, maxSize, opts)
+			t.Logf("Stable boundaries %v, chunks of up to %s: %d of %d chunks reused", stable, SizeToString(uint64(maxSize)), reused, chunks)
+
+			// the chunks following the first content-defined boundary
+			// found in both versions get reused. Chunks cut at maxSize
+			// delay that, while fixed-size chunks would never be reused
+			if float64(reused) < 0.75*float64(chunks) {
+				t.Errorf("Expected at least 75%% of %d chunks to be reused, got %d", chunks, reused)
+			}
+			if stable && chunks-reused > 2 {
+				t.Errorf("Expected at most 2 chunks to change with stable boundaries, got %d of %d", chunks-reused, chunks)
+			}
+		}
+	}
+}
+
+func BenchmarkChunkBoundaryStability(b *testing.B) {
+	data := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, stable := range []bool{false, true} {
+		opts := StoreOptions{
+			Compress:              CompressionNone,
+			Encrypt:               EncryptionNone,
+			DataParts:             1,
+			StableChunkBoundaries: stable,
+		}
+		b.Run("stable="+strconv.FormatBool(stable), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			var chunks, reused int
+			for i := 0; i < b.N; i++ {
+				chunks, reused = chunkReuse(data, 64<<10, opts)
+			}
+			b.ReportMetric(float64(reused)/float64(chunks), "reused")
+		})
+	}
+}
+
+func TestSnapshotCompressMinChunkSize(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	files := map[string][]byte{
+		"tiny":  bytes.Repeat([]byte("knoxite "), 64),
+		"large": bytes.Repeat([]byte("knoxite "), 64*1024),
+	}
+	for name, data := range files {
+		_ = ioutil.WriteFile(filepath.Join(src, name), data, 0644)
+	}
+
+	r, _ := NewRepository("mem://compress-min-chunk-size", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:                  wd,
+		Paths:                []string{src},
+		Compress:             CompressionGZip,
+		Encrypt:              EncryptionNone,
+		DataParts:            1,
+		CompressMinChunkSize: 4096,
+	})
+
+	tiny := snapshot.Archives[filepath.Join(src, "tiny")].Chunks[0]
+	if !tiny.Uncompressed || tiny.Size != tiny.OriginalSize {
+		t.Errorf("Expected chunk of %d bytes to be stored uncompressed, got %d bytes", tiny.OriginalSize, tiny.Size)
+	}
+	for _, chunk := range snapshot.Archives[filepath.Join(src, "large")].Chunks {
+		if chunk.Uncompressed || chunk.Size >= chunk.OriginalSize {
+			t.Errorf("Expected chunk of %d bytes to be compressed, got %d bytes", chunk.OriginalSize, chunk.Size)
+		}
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+	for name, data := range files {
+		if b, _ := ioutil.ReadFile(filepath.Join(dst, src, name)); !bytes.Equal(b, data) {
+			t.Errorf("Restored content of %s differs", name)
+		}
+	}
+}
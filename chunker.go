@@ -0,0 +1,89 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io"
+)
+
+// Error declarations.
+var (
+	ErrInvalidChunkBoundary = errors.New("Chunker returned an invalid chunk boundary")
+)
+
+// A Chunker divides data into chunks, see StoreOptions.Chunker. Formats with
+// fixed-size records, e.g. some databases, deduplicate better if their chunks
+// are aligned to the records.
+type Chunker interface {
+	// Split returns the boundaries of the chunks of the data read from r.
+	// No chunk may exceed maxSize bytes.
+	Split(r io.Reader, maxSize uint) ChunkBoundaries
+}
+
+// ChunkBoundaries yields the boundaries of consecutive chunks.
+type ChunkBoundaries interface {
+	// Next returns the offset and length of the next chunk, which has to
+	// start where the previous one ended. It returns io.EOF once all the data
+	// has been divided into chunks.
+	Next() (offset uint64, length uint, err error)
+}
+
+// recordingReader keeps the data read from r until it gets consumed.
+type recordingReader struct {
+	r      io.Reader
+	buf    []byte
+	offset uint64 // offset of buf in the data read from r
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf = append(rr.buf, p[:n]...)
+	return n, err
+}
+
+// consume copies the length bytes at offset to dst and drops them.
+func (rr *recordingReader) consume(dst []byte, offset uint64, length uint) ([]byte, error) {
+	if offset != rr.offset || length == 0 || length > uint(len(dst)) {
+		return nil, ErrInvalidChunkBoundary
+	}
+	if missing := int(length) - len(rr.buf); missing > 0 {
+		// the chunker hasn't read the entire chunk yet
+		if _, err := io.ReadFull(rr, make([]byte, missing)); err != nil {
+			return nil, err
+		}
+	}
+
+	n := copy(dst, rr.buf[:length])
+	rr.buf = append(rr.buf[:0], rr.buf[length:]...)
+	rr.offset += uint64(length)
+	return dst[:n], nil
+}
+
+// customChunks returns a function filling a buffer with the next chunk found
+// by chunker in r. It returns io.EOF after the last chunk.
+func customChunks(chunker Chunker, r io.Reader, maxSize uint) func(buf []byte) ([]byte, error) {
+	rr := &recordingReader{r: r}
+	boundaries := chunker.Split(rr, maxSize)
+
+	return func(buf []byte) ([]byte, error) {
+		offset, length, err := boundaries.Next()
+		if err == io.EOF {
+			// all the data has to be part of a chunk
+			if n, _ := rr.Read(make([]byte, 1)); n > 0 || len(rr.buf) > 0 {
+				return nil, ErrInvalidChunkBoundary
+			}
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return rr.consume(buf[:maxSize], offset, length)
+	}
+}
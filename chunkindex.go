@@ -8,7 +8,24 @@
 package knoxite
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"sync"
+)
+
+// Error declarations.
+var (
+	ErrIndexCorrupt = errors.New("Chunk-index is corrupt or has been tampered with, recover it from its previous generation")
+)
+
+var (
+	// indexHeader precedes chunk-indexes encrypted with their own key,
+	// followed by their digest
+	indexHeader = []byte("knoxite-index:")
 )
 
 // A ChunkIndexItem links a chunk with one or many snapshots.
@@ -18,126 +35,780 @@ type ChunkIndexItem struct {
 	ParityParts uint     `json:"parity_parts"`
 	Size        int      `json:"size"`
 	Snapshots   []string `json:"snapshots"`
+	Refs        uint     `json:"refs"` // amount of archives referencing the chunk
+
+	// Pack and Offset locate chunks stored in a pack object, see Chunk.Pack.
+	// PackObject is set for the pack objects themselves, which stay
+	// referenced as long as any of their chunks is
+	Pack       string `json:"pack,omitempty"`
+	Offset     int    `json:"offset,omitempty"`
+	PackObject bool   `json:"pack_object,omitempty"`
 }
 
-// A ChunkIndex links chunks with snapshots.
+// A ChunkIndex links chunks with snapshots. It is safe for concurrent use by
+// multiple snapshot operations.
+//
+// It gets stored in parts, each holding the chunks whose hashes start with
+// the same byte, see indexPartPrefix. The stored chunk-index itself only lists
+// the IDs of its parts, so a lazily opened index only needs to load the parts
+// holding the chunks it looks up, and saving it only stores the parts that
+// changed.
 type ChunkIndex struct {
 	Chunks map[string]*ChunkIndexItem `json:"chunks"`
+
+	mut          *sync.Mutex
+	unreferenced map[string]bool      // chunks with a reference count of zero
+	deferred     map[string]*Snapshot // snapshots whose archives get indexed on save
+	lazy         *lazyChunkIndex      // set if the index gets loaded on first use
+	parts        *indexParts          // the parts the index is stored in
+	dirty        *bool                // set while the index has unsaved changes
+	repository   *Repository          // checks whether snapshots can be removed
+}
+
+// lazyChunkIndex tracks the deferred loading of a chunk-index.
+type lazyChunkIndex struct {
+	mut        sync.Mutex
+	repository *Repository
+	loaded     bool
+	err        error
 }
 
-// OpenChunkIndex opens an existing chunkindex.
+// storedIndex is the stored form of a chunk-index, as well as of its parts.
+// Chunk-indexes stored by older versions hold all chunks instead of parts.
+type storedIndex struct {
+	Chunks map[string]*ChunkIndexItem
+	Parts  map[string]string // IDs of the parts, by hash prefix
+}
+
+func newChunkIndex() ChunkIndex {
+	return ChunkIndex{
+		Chunks:       make(map[string]*ChunkIndexItem),
+		mut:          &sync.Mutex{},
+		unreferenced: make(map[string]bool),
+		deferred:     make(map[string]*Snapshot),
+		parts:        newIndexParts(),
+		dirty:        new(bool),
+	}
+}
+
+// OpenChunkIndex opens an existing chunkindex, loading all of its parts.
 func OpenChunkIndex(repository *Repository) (ChunkIndex, error) {
-	index := ChunkIndex{
-		Chunks: make(map[string]*ChunkIndexItem),
+	index := newChunkIndex()
+	index.repository = repository
+	if err := index.load(repository, true); err != nil {
+		return index, err
 	}
+	repository.backend.trackIndex(&index)
+	return index, nil
+}
 
+// OpenChunkIndexLazy returns a chunk-index that only gets loaded once one of
+// its methods needs it, so operations that don't touch it never pay for
+// loading it. Methods looking up single chunks only load the parts holding
+// them, see ChunkIndex. Call Load before accessing Chunks directly, which
+// loads all parts. Errors while loading get returned by Load, Save and Pack.
+func OpenChunkIndexLazy(repository *Repository) ChunkIndex {
+	index := newChunkIndex()
+	index.lazy = &lazyChunkIndex{repository: repository}
+	index.repository = repository
+	repository.backend.trackIndex(&index)
+	return index
+}
+
+// Load loads all parts of a lazily opened chunk-index, if they haven't been
+// loaded yet.
+func (index *ChunkIndex) Load() error {
+	return index.loadParts(nil)
+}
+
+// open reads the stored chunk-index of a lazily opened index, if it hasn't
+// been read yet. Its parts get loaded by loadParts.
+func (index *ChunkIndex) open() error {
+	if index.lazy == nil {
+		return nil
+	}
+
+	index.lazy.mut.Lock()
+	defer index.lazy.mut.Unlock()
+	if !index.lazy.loaded {
+		index.lazy.err = index.load(index.lazy.repository, false)
+		index.lazy.loaded = true
+	}
+	return index.lazy.err
+}
+
+// load reads the chunk-index from repository into index, re-indexing all
+// snapshots if it doesn't exist. Its parts only get loaded if all is set.
+func (index *ChunkIndex) load(repository *Repository, all bool) error {
 	b, err := repository.backend.LoadChunkIndex()
 	if err != nil {
 		if !repository.IsEmpty() {
 			fmt.Println("Chunk-Index is empty, re-indexing all snapshots...")
 			err = index.reindex(repository)
 			if err != nil {
-				return index, err
+				return err
 			}
 			fmt.Println("Successfully re-indexed snapshots.")
 		}
 
-		err = index.Save(repository)
-		return index, err
+		if repository.backend.readOnly {
+			// the re-indexed snapshots only get kept in memory
+			return nil
+		}
+		return index.save(repository)
 	}
 
-	pipe, err := NewDecodingPipeline(CompressionLZMA, EncryptionAES, repository.Key)
+	return index.openStored(repository, b, all)
+}
+
+// openStored adds the chunks of the stored chunk-index b to index, and loads
+// its parts if all is set.
+func (index *ChunkIndex) openStored(repository *Repository, b []byte, all bool) error {
+	stored, err := openIndex(b, repository.Key)
 	if err != nil {
-		return index, err
+		repository.log().Error("Loading chunk-index failed: ", err)
+		return err
+	}
+	if err := index.use(stored.Chunks); err != nil {
+		return err
+	}
+
+	index.parts.mut.Lock()
+	defer index.parts.mut.Unlock()
+	for prefix, id := range stored.Parts {
+		index.parts.stored[prefix] = id
+	}
+	if all {
+		return index.loadStoredParts(repository, nil)
+	}
+	return nil
+}
+
+// use adds the loaded chunks to index.
+func (index *ChunkIndex) use(chunks map[string]*ChunkIndexItem) error {
+	// copies of a lazily opened index share its maps
+	index.mut.Lock()
+	defer index.mut.Unlock()
+	for hash, chunk := range chunks {
+		if chunk == nil || chunk.Hash != hash {
+			return ErrIndexCorrupt
+		}
+		if chunk.Refs == 0 {
+			// indexes written before reference counting only track snapshots
+			chunk.Refs = uint(len(chunk.Snapshots))
+		}
+		if chunk.Refs == 0 {
+			index.unreferenced[hash] = true
+		}
+		index.Chunks[hash] = chunk
 	}
-	err = pipe.Decode(b, &index)
-	return index, err
+	return nil
 }
 
-// Save writes a chunk-index.
+// Save writes a chunk-index. A lazily opened index that never got loaded
+// hasn't changed and doesn't get written.
 func (index *ChunkIndex) Save(repository *Repository) error {
-	pipe, err := NewEncodingPipeline(CompressionLZMA, EncryptionAES, repository.Key)
-	if err != nil {
+	if index.lazy != nil {
+		index.lazy.mut.Lock()
+		loaded, err := index.lazy.loaded, index.lazy.err
+		index.lazy.mut.Unlock()
+		if !loaded {
+			return nil
+		}
+		if err != nil {
+			// don't replace the stored index with an incomplete one
+			return err
+		}
+	}
+	if err := index.parts.failed(); err != nil {
+		return err
+	}
+
+	return index.save(repository)
+}
+
+// save writes the chunk-index, keeping the one it replaces as its previous
+// generation.
+func (index *ChunkIndex) save(repository *Repository) error {
+	return index.store(repository, true)
+}
+
+// store writes the chunk-index, keeping the one it replaces as its previous
+// generation if rotate is set. Parts only used by the generation that gets
+// dropped are deleted afterwards.
+func (index *ChunkIndex) store(repository *Repository, rotate bool) error {
+	if err := index.indexDeferred(); err != nil {
 		return err
 	}
-	b, err := pipe.Encode(index)
+	// changes made while storing remain unsaved
+	index.setDirty(false)
+	parts, err := index.storeParts(repository)
+	var b []byte
+	if err == nil {
+		b, err = sealIndex(repository.Key, storedIndex{Parts: parts})
+	}
+	var stale []string
+	if err == nil {
+		stale = index.parts.stale(repository, parts, rotate)
+		err = repository.backend.saveChunkIndex(b, rotate)
+	}
 	if err != nil {
+		index.setDirty(true)
 		return err
 	}
-	return repository.backend.SaveChunkIndex(b)
+
+	index.parts.commit(parts)
+	for _, id := range stale {
+		// a part that can't be deleted only takes up space
+		_ = repository.backend.deleteIndexPart(id)
+	}
+	return nil
+}
+
+// setDirty marks whether the index has unsaved changes.
+func (index *ChunkIndex) setDirty(dirty bool) {
+	index.mut.Lock()
+	defer index.mut.Unlock()
+
+	*index.dirty = dirty
+}
+
+// changed returns true if the index has unsaved changes.
+func (index *ChunkIndex) changed() bool {
+	index.mut.Lock()
+	defer index.mut.Unlock()
+
+	return *index.dirty
+}
+
+// RecoverChunkIndex replaces a corrupt chunk-index with its previous
+// generation, kept by every save. Snapshots added since then get indexed and
+// the ones removed since then released. If the previous generation is
+// unusable as well, all snapshots get re-indexed.
+func RecoverChunkIndex(repository *Repository) (ChunkIndex, error) {
+	index := newChunkIndex()
+	index.repository = repository
+	b, err := repository.backend.LoadPreviousChunkIndex()
+	if err == nil {
+		err = index.openStored(repository, b, true)
+		if err == nil {
+			err = index.reconcile(repository)
+		}
+	}
+	if err != nil {
+		repository.log().Warn("Previous chunk-index is unusable, re-indexing all snapshots: ", err)
+		index = newChunkIndex()
+		index.repository = repository
+		if err := index.reindex(repository); err != nil {
+			return index, err
+		}
+	}
+
+	repository.backend.trackIndex(&index)
+	if repository.backend.readOnly {
+		// the recovered index only gets kept in memory
+		return index, nil
+	}
+	// the corrupt chunk-index mustn't replace the intact previous one
+	return index, index.store(repository, false)
+}
+
+// deriveIndexKey derives a key for purpose from the repository key.
+func deriveIndexKey(key string, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// indexKeys derives the keys encrypting & authenticating the chunk-index
+// from the repository key, independent from the keys used for chunks &
+// snapshots.
+func indexKeys(key string) (string, []byte) {
+	return hex.EncodeToString(deriveIndexKey(key, "chunk-index:encryption")), deriveIndexKey(key, "chunk-index:digest")
+}
+
+// seal returns the encrypted chunk-index, holding all of its chunks instead
+// of parts.
+func (index *ChunkIndex) seal(key string) ([]byte, error) {
+	index.mut.Lock()
+	defer index.mut.Unlock()
+
+	return sealIndex(key, storedIndex{Chunks: index.Chunks})
+}
+
+// sealIndex returns the encrypted stored chunk-index or part, preceded by the
+// indexHeader and the digest of the encrypted data.
+func sealIndex(key string, stored storedIndex) ([]byte, error) {
+	encryptionKey, digestKey := indexKeys(key)
+	pipe, err := NewEncodingPipeline(CompressionLZMA, EncryptionAES, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := pipe.Encode(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, digestKey)
+	_, _ = mac.Write(b)
+	sealed := append(append([]byte{}, indexHeader...), mac.Sum(nil)...)
+	return append(sealed, b...), nil
+}
+
+// openIndex verifies and decrypts the stored chunk-index or part b. It
+// returns ErrIndexCorrupt if b has been damaged. Chunk-indexes saved by older
+// versions are encrypted with the repository key and have no digest.
+func openIndex(b []byte, key string) (storedIndex, error) {
+	var loaded storedIndex
+	encryptionKey := key
+	if bytes.HasPrefix(b, indexHeader) {
+		var digestKey []byte
+		encryptionKey, digestKey = indexKeys(key)
+		b = b[len(indexHeader):]
+		if len(b) < sha256.Size {
+			return loaded, ErrIndexCorrupt
+		}
+
+		mac := hmac.New(sha256.New, digestKey)
+		_, _ = mac.Write(b[sha256.Size:])
+		if !hmac.Equal(mac.Sum(nil), b[:sha256.Size]) {
+			return loaded, ErrIndexCorrupt
+		}
+		b = b[sha256.Size:]
+	}
+
+	pipe, err := NewDecodingPipeline(CompressionLZMA, EncryptionAES, encryptionKey)
+	if err != nil {
+		return loaded, err
+	}
+	if err := pipe.Decode(b, &loaded); err != nil {
+		return loaded, ErrIndexCorrupt
+	}
+	return loaded, nil
 }
 
-// Pack deletes unreferenced chunks and removes them from the index.
+// Pack deletes unreferenced chunks and removes them from the index. Only
+// chunks with a reference count of zero are visited. All chunks get deleted
+// in batches on backends supporting it. Chunks that couldn't be deleted
+// completely are kept in the index.
 func (index *ChunkIndex) Pack(repository *Repository) (freedSize uint64, err error) {
-	chunks := make(map[string]*ChunkIndexItem)
+	if err := index.Load(); err != nil {
+		return 0, err
+	}
+	if err := index.indexDeferred(); err != nil {
+		return 0, err
+	}
 
-	for _, chunk := range index.Chunks {
-		// fmt.Printf("Chunk %s referenced in Snapshots %+v\n", chunk.Hash, chunk.Snapshots)
-		if len(chunk.Snapshots) == 0 {
-			fmt.Printf("Chunk %s is no longer referenced by any snapshot. Deleting!\n", chunk.Hash)
-
-			for i := uint(0); i < chunk.DataParts+chunk.ParityParts; i++ {
-				err = repository.backend.DeleteChunk(chunk.Hash, i, chunk.DataParts)
-				if err != nil {
-					return
-				}
-				freedSize += uint64(chunk.Size)
+	index.mut.Lock()
+	defer index.mut.Unlock()
+
+	var chunks []*ChunkIndexItem
+	var parts []ChunkPart
+	for hash := range index.unreferenced {
+		chunk, ok := index.Chunks[hash]
+		if !ok || chunk.Refs > 0 {
+			delete(index.unreferenced, hash)
+			continue
+		}
+		chunks = append(chunks, chunk)
+		if chunk.Pack != "" {
+			// stored in a pack object, which gets deleted on its own
+			continue
+		}
+		fmt.Printf("Chunk %s is no longer referenced by any snapshot. Deleting!\n", chunk.Hash)
+
+		for i := uint(0); i < chunk.DataParts+chunk.ParityParts; i++ {
+			parts = append(parts, ChunkPart{Hash: chunk.Hash, Part: i, TotalParts: chunk.DataParts})
+		}
+	}
+	if len(chunks) == 0 {
+		return 0, nil
+	}
+
+	var failed []ChunkPart
+	if len(parts) > 0 {
+		failed, err = repository.backend.DeleteChunks(parts)
+	}
+	kept := make(map[string]bool)
+	for _, p := range failed {
+		kept[p.Hash] = true
+	}
+	deletedPacks := make(map[string]bool)
+	for _, chunk := range chunks {
+		if kept[chunk.Hash] {
+			continue
+		}
+
+		if chunk.Pack == "" {
+			freedSize += uint64(chunk.Size) * uint64(chunk.DataParts+chunk.ParityParts)
+		}
+		if chunk.PackObject {
+			deletedPacks[chunk.Hash] = true
+		}
+		*index.dirty = true
+		delete(index.Chunks, chunk.Hash)
+		delete(index.unreferenced, chunk.Hash)
+	}
+	if len(deletedPacks) > 0 {
+		// chunks still referenced as part of other pack objects can't be
+		// deduplicated against their location in a deleted one anymore
+		for hash, chunk := range index.Chunks {
+			if deletedPacks[chunk.Pack] {
+				delete(index.Chunks, hash)
+				delete(index.unreferenced, hash)
 			}
-		} else {
-			chunks[chunk.Hash] = chunk
 		}
 	}
 
-	index.Chunks = chunks
-	return
+	return freedSize, err
+}
+
+// Unreferenced returns the hashes of all chunks with a reference count of
+// zero, which can be deleted by Pack.
+func (index *ChunkIndex) Unreferenced() []string {
+	_ = index.Load()
+	index.mut.Lock()
+	defer index.mut.Unlock()
+
+	var hashes []string
+	for hash := range index.unreferenced {
+		if c, ok := index.Chunks[hash]; ok && c.Refs == 0 {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	return hashes
 }
 
 func (index *ChunkIndex) reindex(repository *Repository) error {
 	for _, vol := range repository.Volumes {
 		for _, snapshotID := range vol.Snapshots {
-			snapshot, err := vol.LoadSnapshot(snapshotID, repository)
-			if err != nil {
+			if err := index.indexSnapshot(repository, vol, snapshotID); err != nil {
 				return err
 			}
+		}
+	}
 
-			for _, archive := range snapshot.Archives {
-				index.AddArchive(archive, snapshot.ID)
+	return nil
+}
+
+// reconcile indexes the snapshots of repository missing from the index, and
+// releases the snapshots referenced by the index that no longer exist.
+func (index *ChunkIndex) reconcile(repository *Repository) error {
+	index.mut.Lock()
+	indexed := make(map[string]bool)
+	for _, chunk := range index.Chunks {
+		for _, id := range chunk.Snapshots {
+			indexed[id] = true
+		}
+	}
+	index.mut.Unlock()
+
+	for _, vol := range repository.Volumes {
+		for _, snapshotID := range vol.Snapshots {
+			if indexed[snapshotID] {
+				delete(indexed, snapshotID)
+				continue
+			}
+			if err := index.indexSnapshot(repository, vol, snapshotID); err != nil {
+				return err
 			}
 		}
 	}
 
+	index.mut.Lock()
+	defer index.mut.Unlock()
+	for id := range indexed {
+		for hash := range index.Chunks {
+			index.release(hash, id)
+		}
+	}
 	return nil
 }
 
-// AddArchive updates chunk-index with the new chunks.
+// indexSnapshot adds the archives & parity groups of the snapshot with id
+// stored in vol to the index.
+func (index *ChunkIndex) indexSnapshot(repository *Repository, vol *Volume, id string) error {
+	snapshot, err := vol.LoadSnapshot(id, repository)
+	if err != nil {
+		return err
+	}
+
+	err = snapshot.EachArchive(func(archive *Archive) error {
+		index.addArchive(archive, snapshot.ID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, group := range snapshot.ParityGroups {
+		index.addParityGroup(group, snapshot.ID)
+	}
+	return nil
+}
+
+// AddArchive updates chunk-index with the new chunks, incrementing the
+// reference count of every chunk of archive.
 func (index *ChunkIndex) AddArchive(archive *Archive, snapshot string) {
+	index.addArchive(archive, snapshot)
+}
+
+func (index *ChunkIndex) addArchive(archive *Archive, snapshot string) {
+	index.mut.Lock()
+	deferred := index.deferred[snapshot] != nil
+	index.mut.Unlock()
+	if deferred {
+		return
+	}
+
+	// errors get returned by Save
+	hashes := make([]string, 0, len(archive.Chunks))
 	for _, chunk := range archive.Chunks {
-		c, ok := index.Chunks[chunk.Hash]
-		if ok {
-			c.Snapshots = append(c.Snapshots, snapshot)
-		} else {
-			chunkItem := ChunkIndexItem{
-				Hash:        chunk.Hash,
-				DataParts:   chunk.DataParts,
-				ParityParts: chunk.ParityParts,
-				Size:        chunk.Size,
-				Snapshots:   []string{snapshot},
-			}
-			index.Chunks[chunk.Hash] = &chunkItem
+		hashes = append(hashes, chunk.Hash)
+		if chunk.Pack != "" {
+			hashes = append(hashes, chunk.Pack)
+		}
+	}
+	_ = index.loadParts(hashes)
+
+	index.mut.Lock()
+	defer index.mut.Unlock()
+
+	if index.deferred[snapshot] != nil {
+		return
+	}
+	*index.dirty = true
+	for _, chunk := range archive.Chunks {
+		index.addRef(ChunkIndexItem{
+			Hash:        chunk.Hash,
+			DataParts:   chunk.DataParts,
+			ParityParts: chunk.ParityParts,
+			Size:        chunk.Size,
+			Pack:        chunk.Pack,
+			Offset:      chunk.Offset,
+		}, snapshot)
+		if chunk.Pack != "" {
+			index.addRef(ChunkIndexItem{
+				Hash:       chunk.Pack,
+				DataParts:  1,
+				Size:       chunk.Offset + chunk.Size,
+				PackObject: true,
+			}, snapshot)
 		}
 	}
 }
 
-// RemoveSnapshot removes all references to snapshot from the chunk-index.
-func (index *ChunkIndex) RemoveSnapshot(snapshot string) {
+// addRef adds a reference from snapshot to the chunk item, adding the chunk
+// to the index if necessary.
+func (index *ChunkIndex) addRef(item ChunkIndexItem, snapshot string) {
+	c, ok := index.Chunks[item.Hash]
+	if !ok {
+		item.Snapshots = []string{snapshot}
+		item.Refs = 1
+		index.Chunks[item.Hash] = &item
+		return
+	}
+
+	c.Snapshots = append(c.Snapshots, snapshot)
+	c.Refs++
+	delete(index.unreferenced, item.Hash)
+	if item.PackObject && item.Size > c.Size {
+		// only the chunks found so far tell the size of a pack object
+		c.Size = item.Size
+	}
+}
+
+// deferSnapshot defers indexing the archives of snapshot until the index gets
+// saved, so the index doesn't hold an entry for every chunk stored while
+// snapshot is being added, see StoreOptions.DedupWindow.
+func (index *ChunkIndex) deferSnapshot(snapshot *Snapshot) {
+	index.mut.Lock()
+	defer index.mut.Unlock()
+
+	index.deferred[snapshot.ID] = snapshot
+	*index.dirty = true
+}
+
+// indexDeferred adds the archives of all deferred snapshots to the index,
+// including the ones stored in separate segments.
+func (index *ChunkIndex) indexDeferred() error {
+	index.mut.Lock()
+	deferred := make(map[string]*Snapshot, len(index.deferred))
+	for id, snapshot := range index.deferred {
+		deferred[id] = snapshot
+		delete(index.deferred, id)
+	}
+	index.mut.Unlock()
+
+	for id, snapshot := range deferred {
+		snapshot.mut.Lock()
+		err := snapshot.EachArchive(func(arc *Archive) error {
+			index.addArchive(arc, id)
+			return nil
+		})
+		snapshot.mut.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddParityGroup updates chunk-index with the parity parts of group, which
+// are referenced by snapshot.
+func (index *ChunkIndex) AddParityGroup(group ParityGroup, snapshot string) {
+	index.addParityGroup(group, snapshot)
+}
+
+func (index *ChunkIndex) addParityGroup(group ParityGroup, snapshot string) {
+	// errors get returned by Save
+	_ = index.loadParts([]string{group.Hash})
+
+	index.mut.Lock()
+	defer index.mut.Unlock()
+
+	*index.dirty = true
+
+	if c, ok := index.Chunks[group.Hash]; ok {
+		c.Snapshots = append(c.Snapshots, snapshot)
+		c.Refs++
+		delete(index.unreferenced, group.Hash)
+		return
+	}
+
+	chunk := group.parityChunk()
+	index.Chunks[group.Hash] = &ChunkIndexItem{
+		Hash:      chunk.Hash,
+		DataParts: chunk.DataParts,
+		Size:      chunk.Size,
+		Snapshots: []string{snapshot},
+		Refs:      1,
+	}
+}
+
+// ReclaimableSize returns the storage space Pack would free after removing
+// the given snapshots. Chunks shared with any other snapshot are not counted,
+// neither are chunks that are already unreferenced.
+func (index *ChunkIndex) ReclaimableSize(snapshots []string) uint64 {
+	_ = index.Load()
+	index.mut.Lock()
+	defer index.mut.Unlock()
+
+	removed := make(map[string]bool)
+	for _, id := range snapshots {
+		removed[id] = true
+	}
+
+	var size uint64
 	for _, chunk := range index.Chunks {
-		snapshots := []string{}
+		if chunk.Refs == 0 || chunk.Pack != "" {
+			// packed chunks get freed with their pack object
+			continue
+		}
+
+		shared := false
 		for _, s := range chunk.Snapshots {
-			if s != snapshot {
-				snapshots = append(snapshots, s)
+			if !removed[s] {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			size += uint64(chunk.Size) * uint64(chunk.DataParts+chunk.ParityParts)
+		}
+	}
+
+	return size
+}
+
+// RemoveSnapshot removes all references to snapshot from the chunk-index.
+// As it has to visit every chunk of the repository, prefer ReleaseSnapshot
+// when the snapshot's archives are available. Like ReleaseSnapshot, it fails
+// with ErrPinnedSnapshot or ErrImmutableSnapshot for snapshots that can't be
+// removed.
+func (index *ChunkIndex) RemoveSnapshot(snapshot string) error {
+	if index.repository != nil {
+		if err := index.repository.checkRemovable(snapshot); err != nil {
+			return err
+		}
+	}
+
+	_ = index.Load()
+	index.mut.Lock()
+	defer index.mut.Unlock()
+
+	for hash := range index.Chunks {
+		index.release(hash, snapshot)
+	}
+	return nil
+}
+
+// ReleaseSnapshot removes all references to snapshot from the chunks it
+// contains, decrementing their reference counts. Chunks reaching a count of
+// zero become eligible for Pack. The chunks of a pinned or immutable
+// snapshot can't be released and ErrPinnedSnapshot or ErrImmutableSnapshot
+// gets returned.
+func (index *ChunkIndex) ReleaseSnapshot(snapshot *Snapshot) error {
+	if err := snapshot.checkRemovable(); err != nil {
+		return err
+	}
+
+	_ = index.Load()
+	index.mut.Lock()
+	defer index.mut.Unlock()
+
+	if index.deferred[snapshot.ID] != nil {
+		// none of its archives got indexed yet
+		delete(index.deferred, snapshot.ID)
+		return nil
+	}
+
+	snapshot.mut.Lock()
+	defer snapshot.mut.Unlock()
+
+	// archive segments that can't be loaded keep their chunks referenced
+	_ = snapshot.EachArchive(func(arc *Archive) error {
+		for _, chunk := range arc.Chunks {
+			index.release(chunk.Hash, snapshot.ID)
+			if chunk.Pack != "" {
+				index.release(chunk.Pack, snapshot.ID)
 			}
 		}
+		return nil
+	})
+	for _, group := range snapshot.ParityGroups {
+		index.release(group.Hash, snapshot.ID)
+	}
+	return nil
+}
+
+// release removes all references to snapshot from the chunk with hash.
+func (index *ChunkIndex) release(hash string, snapshot string) {
+	chunk, ok := index.Chunks[hash]
+	if !ok {
+		return
+	}
+
+	snapshots := []string{}
+	for _, s := range chunk.Snapshots {
+		if s != snapshot {
+			snapshots = append(snapshots, s)
+		}
+	}
 
-		chunk.Snapshots = snapshots
+	removed := uint(len(chunk.Snapshots) - len(snapshots))
+	if removed == 0 {
+		return
+	}
+	*index.dirty = true
+	chunk.Snapshots = snapshots
+	if removed >= chunk.Refs {
+		chunk.Refs = 0
+	} else {
+		chunk.Refs -= removed
+	}
+	if chunk.Refs == 0 {
+		index.unreferenced[hash] = true
 	}
 }
@@ -8,8 +8,14 @@
 package knoxite
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -123,3 +129,797 @@ func TestChunkIndexPack(t *testing.T) {
 		t.Errorf("Packing chunk index failed: %s", err)
 	}
 }
+
+func TestChunkIndexRefCount(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	shared := filepath.Join(dir, "shared")
+	exclusive := filepath.Join(dir, "exclusive")
+	_ = ioutil.WriteFile(shared, []byte("content shared by all snapshots"), 0600)
+	_ = ioutil.WriteFile(exclusive, []byte("content of the first snapshot only"), 0600)
+
+	r, _ := NewRepository("mem://chunkindex-refcount", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	opts := StoreOptions{
+		CWD:       wd,
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}
+
+	opts.Paths = []string{shared, exclusive}
+	first := storeSnapshot(t, &r, &index, opts)
+
+	// store more snapshots of the shared file concurrently
+	opts.Paths = []string{shared}
+	snapshots := make([]*Snapshot, 4)
+	var wg sync.WaitGroup
+	for i := range snapshots {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			snapshots[i] = storeSnapshot(t, &r, &index, opts)
+		}(i)
+	}
+	wg.Wait()
+
+	sharedHash := first.Archives[shared].Chunks[0].Hash
+	exclusiveHash := first.Archives[exclusive].Chunks[0].Hash
+	if refs := index.Chunks[sharedHash].Refs; refs != 5 {
+		t.Errorf("Expected 5 references to the shared chunk, got %d", refs)
+	}
+	if refs := index.Chunks[exclusiveHash].Refs; refs != 1 {
+		t.Errorf("Expected 1 reference to the exclusive chunk, got %d", refs)
+	}
+
+	index.ReleaseSnapshot(first)
+	if refs := index.Chunks[sharedHash].Refs; refs != 4 {
+		t.Errorf("Expected 4 references to the shared chunk, got %d", refs)
+	}
+	if refs := index.Chunks[exclusiveHash].Refs; refs != 0 {
+		t.Errorf("Expected no references to the exclusive chunk, got %d", refs)
+	}
+	if u := index.Unreferenced(); len(u) != 1 || u[0] != exclusiveHash {
+		t.Errorf("Expected only the exclusive chunk to be unreferenced, got %v", u)
+	}
+
+	// counts survive reopening the index
+	if err := index.Save(&r); err != nil {
+		t.Fatalf("Failed saving chunk-index: %s", err)
+	}
+	index, err = OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed reopening chunk-index: %s", err)
+	}
+	if refs := index.Chunks[sharedHash].Refs; refs != 4 {
+		t.Errorf("Expected 4 references to the shared chunk after reopening, got %d", refs)
+	}
+
+	if _, err := index.Pack(&r); err != nil {
+		t.Fatalf("Packing chunk index failed: %s", err)
+	}
+	if _, ok := index.Chunks[exclusiveHash]; ok {
+		t.Error("Expected unreferenced chunk to be packed")
+	}
+	if _, ok := index.Chunks[sharedHash]; !ok {
+		t.Error("Expected referenced chunk to be kept")
+	}
+
+	for _, snapshot := range snapshots {
+		index.ReleaseSnapshot(snapshot)
+	}
+	if u := index.Unreferenced(); len(u) != 1 || u[0] != sharedHash {
+		t.Errorf("Expected the shared chunk to be unreferenced, got %v", u)
+	}
+}
+
+func TestChunkIndexRefCountUpgrade(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "data")
+	_ = ioutil.WriteFile(file, []byte("some content"), 0600)
+
+	r, _ := NewRepository("mem://chunkindex-refcount-upgrade", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	opts := StoreOptions{
+		CWD:       wd,
+		Paths:     []string{file},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}
+	storeSnapshot(t, &r, &index, opts)
+	storeSnapshot(t, &r, &index, opts)
+
+	// indexes written before reference counting have no counts stored
+	for _, chunk := range index.Chunks {
+		chunk.Refs = 0
+	}
+	_ = index.Save(&r)
+
+	index, err = OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed reopening chunk-index: %s", err)
+	}
+	for _, chunk := range index.Chunks {
+		if chunk.Refs != 2 {
+			t.Errorf("Expected 2 references after upgrading, got %d", chunk.Refs)
+		}
+	}
+	if u := index.Unreferenced(); len(u) != 0 {
+		t.Errorf("Expected no unreferenced chunks, got %v", u)
+	}
+}
+
+// batchBackend deletes chunk parts in batches, counting the requests.
+type batchBackend struct {
+	Backend
+	batches *int
+	deletes *int
+}
+
+func (b batchBackend) DeleteChunk(shasum string, part, totalParts uint) error {
+	*b.deletes++
+	return b.Backend.DeleteChunk(shasum, part, totalParts)
+}
+
+func (b batchBackend) BatchDelete(parts []ChunkPart) ([]ChunkPart, error) {
+	*b.batches++
+	var failed []ChunkPart
+	var err error
+	for _, p := range parts {
+		if derr := b.Backend.DeleteChunk(p.Hash, p.Part, p.TotalParts); derr != nil {
+			failed = append(failed, p)
+			err = derr
+		}
+	}
+	return failed, err
+}
+
+func TestChunkIndexPackBatchDelete(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 10; i++ {
+		_ = ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(i)), []byte("content "+strconv.Itoa(i)), 0600)
+	}
+
+	r, _ := NewRepository("mem://chunkindex-pack-batch", testPassword)
+	var batches, deletes int
+	var be Backend = batchBackend{*r.backend.Backends[0], &batches, &deletes}
+	r.backend.Backends[0] = &be
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:         wd,
+		Paths:       []string{dir},
+		Encrypt:     EncryptionAES,
+		DataParts:   1,
+		ParityParts: 1,
+	})
+	index.ReleaseSnapshot(snapshot)
+
+	if _, err := index.Pack(&r); err != nil {
+		t.Fatalf("Packing chunk index failed: %s", err)
+	}
+	if batches != 1 || deletes != 0 {
+		t.Errorf("Expected a single batched delete, got %d batches and %d single deletes", batches, deletes)
+	}
+	if len(index.Chunks) != 0 {
+		t.Errorf("Expected all chunks to be packed, got %d", len(index.Chunks))
+	}
+
+	for _, arc := range snapshot.Archives {
+		for _, chunk := range arc.Chunks {
+			if _, err := be.LoadChunk(chunk.Hash, 0, chunk.DataParts); err == nil {
+				t.Errorf("Expected chunk %s to be deleted", chunk.Hash)
+			}
+		}
+	}
+}
+
+func TestChunkIndexReclaimableSize(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	files := make(map[string]string)
+	for _, name := range []string{"a", "b", "c"} {
+		files[name] = filepath.Join(dir, name)
+		_ = ioutil.WriteFile(files[name], []byte("content of "+name), 0600)
+	}
+
+	r, _ := NewRepository("mem://chunkindex-reclaimable", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	// overlapping snapshots: first {a, b}, second {b, c}, third {c}
+	var ids []string
+	for _, paths := range [][]string{{"a", "b"}, {"b", "c"}, {"c"}} {
+		opts := StoreOptions{
+			CWD:         wd,
+			Encrypt:     EncryptionAES,
+			DataParts:   1,
+			ParityParts: 1,
+		}
+		for _, p := range paths {
+			opts.Paths = append(opts.Paths, files[p])
+		}
+		ids = append(ids, storeSnapshot(t, &r, &index, opts).ID)
+	}
+
+	if size := index.ReclaimableSize([]string{ids[1]}); size != 0 {
+		t.Errorf("Expected nothing to be reclaimable from a fully shared snapshot, got %d bytes", size)
+	}
+
+	estimate := index.ReclaimableSize(ids[:2])
+	if estimate == 0 {
+		t.Fatal("Expected space to be reclaimable")
+	}
+	if size := index.ReclaimableSize(ids[:1]); size == 0 || size >= estimate {
+		t.Errorf("Expected less space to be reclaimable from the first snapshot alone, got %d of %d bytes", size, estimate)
+	}
+
+	index.RemoveSnapshot(ids[0])
+	index.RemoveSnapshot(ids[1])
+	freed, err := index.Pack(&r)
+	if err != nil {
+		t.Fatalf("Packing chunk index failed: %s", err)
+	}
+	if freed != estimate {
+		t.Errorf("Expected %d bytes to be freed, got %d", estimate, freed)
+	}
+	if size := index.ReclaimableSize(ids[:2]); size != 0 {
+		t.Errorf("Expected nothing reclaimable after packing, got %d bytes", size)
+	}
+}
+
+// indexBackend counts the loads & saves of the chunk-index.
+type indexBackend struct {
+	Backend
+	loads *int
+	saves *int
+}
+
+func (b indexBackend) LoadChunkIndex() ([]byte, error) {
+	*b.loads++
+	return b.Backend.LoadChunkIndex()
+}
+
+func (b indexBackend) SaveChunkIndex(data []byte) error {
+	*b.saves++
+	return b.Backend.SaveChunkIndex(data)
+}
+
+func TestChunkIndexLazy(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "data")
+	_ = ioutil.WriteFile(file, []byte("some content"), 0600)
+
+	r, _ := NewRepository("mem://chunkindex-lazy", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	opts := StoreOptions{
+		CWD:       wd,
+		Paths:     []string{file},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}
+	snapshot := storeSnapshot(t, &r, &index, opts)
+	_ = index.Save(&r)
+
+	var loads, saves int
+	var be Backend = indexBackend{*r.backend.Backends[0], &loads, &saves}
+	r.backend.Backends[0] = &be
+
+	// opening & saving an unused index doesn't touch the backend
+	index = OpenChunkIndexLazy(&r)
+	if err := index.Save(&r); err != nil {
+		t.Fatalf("Failed saving chunk-index: %s", err)
+	}
+	if loads != 0 || saves != 0 {
+		t.Errorf("Expected no loads & saves, got %d loads and %d saves", loads, saves)
+	}
+
+	// the first use loads the index once, for all copies
+	other := index
+	storeSnapshot(t, &r, &index, opts)
+	if loads != 1 {
+		t.Errorf("Expected the chunk-index to be loaded once, got %d loads", loads)
+	}
+	if err := other.Load(); err != nil {
+		t.Fatalf("Failed loading chunk-index: %s", err)
+	}
+	for _, arc := range snapshot.Archives {
+		for _, chunk := range arc.Chunks {
+			if refs := other.Chunks[chunk.Hash].Refs; refs != 2 {
+				t.Errorf("Expected 2 references, got %d", refs)
+			}
+		}
+	}
+	if loads != 1 {
+		t.Errorf("Expected the chunk-index to be loaded once, got %d loads", loads)
+	}
+	if err := index.Save(&r); err != nil || saves != 1 {
+		t.Errorf("Expected the chunk-index to be saved, got %d saves (%v)", saves, err)
+	}
+
+	// an index that failed to load must not replace the stored one
+	_ = be.SaveChunkIndex([]byte("corrupted"))
+	saves = 0
+	index = OpenChunkIndexLazy(&r)
+	index.AddArchive(snapshot.Archives[file], snapshot.ID)
+	if err := index.Save(&r); err == nil || saves != 0 {
+		t.Errorf("Expected saving an index that failed to load to fail, got %d saves (%v)", saves, err)
+	}
+}
+
+// partBackend counts the loads & stores of chunk-index parts.
+type partBackend struct {
+	Backend
+	loads  *int32
+	stores *int32
+}
+
+func (b partBackend) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
+	if strings.HasPrefix(shasum, indexPartIDPrefix) {
+		atomic.AddInt32(b.loads, 1)
+	}
+	return b.Backend.LoadChunk(shasum, part, totalParts)
+}
+
+func (b partBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	if strings.HasPrefix(shasum, indexPartIDPrefix) {
+		atomic.AddInt32(b.stores, 1)
+	}
+	return b.Backend.StoreChunk(shasum, part, totalParts, data)
+}
+
+// testArchive returns an archive with n chunks, which don't exist.
+func testArchive(n int) *Archive {
+	arc := &Archive{}
+	for i := 0; i < n; i++ {
+		arc.Chunks = append(arc.Chunks, Chunk{
+			Hash:      Hash([]byte(strconv.Itoa(i)), HashHighway256),
+			DataParts: 1,
+			Size:      1 << 20,
+		})
+	}
+	return arc
+}
+
+func TestChunkIndexParts(t *testing.T) {
+	r, _ := NewRepository("mem://chunkindex-parts", "this_is_a_password")
+	index, _ := OpenChunkIndex(&r)
+	arc := testArchive(1000)
+	index.AddArchive(arc, "first")
+	if err := index.Save(&r); err != nil {
+		t.Fatalf("Failed saving chunk-index: %s", err)
+	}
+	prefixes := make(map[string]bool)
+	for _, chunk := range arc.Chunks {
+		prefixes[indexPartPrefix(chunk.Hash)] = true
+	}
+	first := index.parts.ids()
+	if len(first) != len(prefixes) {
+		t.Fatalf("Expected the chunk-index to be stored in %d parts, got %d", len(prefixes), len(first))
+	}
+
+	var loads, stores int32
+	var be Backend = partBackend{*r.backend.Backends[0], &loads, &stores}
+	r.backend.Backends[0] = &be
+
+	// looking up a single chunk only loads the part holding it
+	one := &Archive{Chunks: arc.Chunks[:1]}
+	index = OpenChunkIndexLazy(&r)
+	index.AddArchive(one, "second")
+	if loads != 1 {
+		t.Errorf("Expected a single part to be loaded, got %d loads", loads)
+	}
+	if err := index.Save(&r); err != nil || stores != 1 {
+		t.Errorf("Expected only the changed part to be stored, got %d stores (%v)", stores, err)
+	}
+
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed reopening chunk-index: %s", err)
+	}
+	if len(index.Chunks) != len(arc.Chunks) {
+		t.Errorf("Expected %d chunks, got %d", len(arc.Chunks), len(index.Chunks))
+	}
+	if refs := index.Chunks[one.Chunks[0].Hash].Refs; refs != 2 {
+		t.Errorf("Expected 2 references, got %d", refs)
+	}
+
+	// parts only used by the dropped generation get deleted
+	index.AddArchive(one, "third")
+	if err := index.Save(&r); err != nil {
+		t.Fatalf("Failed saving chunk-index: %s", err)
+	}
+	objects := memoryStores["chunkindex-parts"]
+	kept := make(map[string]bool)
+	for _, id := range index.parts.ids() {
+		kept[id] = true
+	}
+	deleted := 0
+	for _, id := range first {
+		if _, ok := objects[chunkKey(id, 0, 1)]; !ok {
+			deleted++
+			if kept[id] {
+				t.Errorf("Expected part %s of the stored chunk-index to be kept", id)
+			}
+		}
+	}
+	if deleted != 1 {
+		t.Errorf("Expected the changed part of the dropped generation to be deleted, got %d deleted", deleted)
+	}
+
+	// a damaged part can't be loaded
+	prefix := indexPartPrefix(one.Chunks[0].Hash)
+	id := index.parts.stored[prefix]
+	objects[chunkKey(id, 0, 1)][len(objects[chunkKey(id, 0, 1)])/2] ^= 0x01
+	index = OpenChunkIndexLazy(&r)
+	index.AddArchive(one, "fourth")
+	if err := index.Save(&r); err != ErrIndexCorrupt {
+		t.Errorf("Expected %v, got %v", ErrIndexCorrupt, err)
+	}
+}
+
+func BenchmarkOpenChunkIndex(b *testing.B) {
+	r, _ := NewRepository("mem://chunkindex-open-benchmark", "this_is_a_password")
+	index, _ := OpenChunkIndex(&r)
+	arc := testArchive(100000)
+	index.AddArchive(arc, "snapshot")
+	if err := index.Save(&r); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	b.Run("eager", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := OpenChunkIndex(&r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("lazy", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			index := OpenChunkIndexLazy(&r)
+			// looks up a single chunk
+			if _, ok := index.packedChunk(arc.Chunks[i%len(arc.Chunks)].Hash); ok {
+				b.Fatal("Expected chunk not to be packed")
+			}
+			if err := index.parts.failed(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// truncatingFS silently stores only half of the data of the staged
+// chunk-indexes written to it, while failures remain.
+type truncatingFS struct {
+	failures *int
+}
+
+type truncatingFile struct {
+	*os.File
+	truncate bool
+}
+
+func (fs truncatingFS) OpenFile(name string, flag int, perm os.FileMode) (localFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	truncate := filepath.Base(name) == ChunkIndexFilename+stagedSuffix && *fs.failures > 0
+	if truncate {
+		*fs.failures--
+	}
+	return truncatingFile{f, truncate}, nil
+}
+
+func (f truncatingFile) Write(data []byte) (int, error) {
+	if f.truncate {
+		_, err := f.File.Write(data[:len(data)/2])
+		return len(data), err
+	}
+	return f.File.Write(data)
+}
+
+func TestChunkIndexSaveInterrupted(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(filepath.Join(dir, "repo"), testPassword)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	var failures int
+	(*r.backend.Backends[0]).(*StorageLocal).fs = truncatingFS{&failures}
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	store := func(name string) {
+		_ = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:       wd,
+			Paths:     []string{filepath.Join(dir, name)},
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+		})
+	}
+	chunks := func() int {
+		index, err := OpenChunkIndex(&r)
+		if err != nil {
+			t.Fatalf("Failed opening chunk-index: %s", err)
+		}
+		return len(index.Chunks)
+	}
+
+	store("old")
+	if err := index.Save(&r); err != nil {
+		t.Fatalf("Failed saving chunk-index: %s", err)
+	}
+	store("new")
+
+	// a single failure gets retried
+	failures = 1
+	if err := index.Save(&r); err != nil {
+		t.Errorf("Expected interrupted save to be retried, got %s", err)
+	}
+	if n := chunks(); n != 2 {
+		t.Errorf("Expected the new chunk-index with 2 chunks, got %d", n)
+	}
+
+	// the stored chunk-index survives a save that never verifies
+	store("newer")
+	failures = retries
+	if err := index.Save(&r); err != ErrStoreChunkIndexFailed {
+		t.Errorf("Expected save to fail with %v, got %v", ErrStoreChunkIndexFailed, err)
+	}
+	if n := chunks(); n != 2 {
+		t.Errorf("Expected the old chunk-index with 2 chunks to survive, got %d", n)
+	}
+
+	if err := index.Save(&r); err != nil {
+		t.Errorf("Failed repeating save: %s", err)
+	}
+	if n := chunks(); n != 3 {
+		t.Errorf("Expected the new chunk-index with 3 chunks, got %d", n)
+	}
+}
+
+func TestChunkIndexPackSharedBucket(t *testing.T) {
+	testPassword := "this_is_a_password"
+	wd, _ := os.Getwd()
+
+	type repo struct {
+		r        Repository
+		vol      *Volume
+		index    ChunkIndex
+		snapshot *Snapshot
+	}
+	repos := make(map[string]*repo)
+	for _, prefix := range []string{"first", "second"} {
+		r, err := NewRepositoryWithOptions("mem://shared-bucket", testPassword, RepositoryOptions{
+			Backend: BackendOptions{Prefix: prefix},
+		})
+		if err != nil {
+			t.Fatalf("Failed creating repository below %s: %s", prefix, err)
+		}
+		vol, _ := NewVolume("test", "")
+		_ = r.AddVolume(vol)
+		index, _ := OpenChunkIndex(&r)
+
+		// both repositories store the same data
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:       wd,
+			Paths:     []string{"snapshot.go"},
+			Compress:  CompressionNone,
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+		})
+		_ = snapshot.Save(&r)
+		_ = vol.AddSnapshot(snapshot.ID)
+		if err := index.Save(&r); err != nil {
+			t.Fatalf("Failed saving chunk-index: %s", err)
+		}
+		if err := r.Save(); err != nil {
+			t.Fatalf("Failed saving repository: %s", err)
+		}
+		repos[prefix] = &repo{r: r, vol: vol, index: index, snapshot: snapshot}
+	}
+
+	objects := func(prefix string) map[string]string {
+		memoryStoresMut.Lock()
+		defer memoryStoresMut.Unlock()
+
+		m := make(map[string]string)
+		for key, data := range memoryStores["shared-bucket"] {
+			if strings.HasPrefix(key, prefix+"/") {
+				m[key] = string(data)
+			}
+		}
+		return m
+	}
+	second := objects("second")
+
+	first := repos["first"]
+	_ = first.vol.RemoveSnapshot(first.snapshot.ID)
+	first.index.RemoveSnapshot(first.snapshot.ID)
+	if _, err := first.index.Pack(&first.r); err != nil {
+		t.Fatalf("Packing chunk index failed: %s", err)
+	}
+
+	for key := range objects("first") {
+		// the parts of the chunk-index are stored next to the chunks
+		if strings.HasPrefix(key, "first/chunks/") && !strings.HasPrefix(key, "first/chunks/"+indexPartIDPrefix) {
+			t.Errorf("Expected unreferenced chunk %s to be deleted", key)
+		}
+	}
+	after := objects("second")
+	if len(after) != len(second) {
+		t.Errorf("Expected %d objects of the other repository, got %d", len(second), len(after))
+	}
+	for key, data := range second {
+		if after[key] != data {
+			t.Errorf("Expected object %s of the other repository to be untouched", key)
+		}
+	}
+
+	r, err := OpenRepositoryWithOptions("mem://shared-bucket", testPassword, RepositoryOptions{
+		Backend: BackendOptions{Prefix: "second"},
+	})
+	if err != nil {
+		t.Fatalf("Failed opening the other repository: %s", err)
+	}
+	progress, err := VerifySnapshot(r, repos["second"].snapshot.ID, 100)
+	if err != nil {
+		t.Fatalf("Failed verifying the other repository: %s", err)
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Expected the other repository to stay intact: %s", p.Error)
+		}
+	}
+}
+
+func TestChunkIndexCorrupt(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository("mem://chunkindex-corrupt", testPassword)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	store := func(name string) *Snapshot {
+		file := filepath.Join(dir, name)
+		_ = ioutil.WriteFile(file, []byte(name), 0644)
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:       wd,
+			Paths:     []string{file},
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+		})
+		_ = snapshot.Save(&r)
+		_ = vol.AddSnapshot(snapshot.ID)
+		if err := index.Save(&r); err != nil {
+			t.Fatalf("Failed saving chunk-index: %s", err)
+		}
+		return snapshot
+	}
+	// the previous generation of the chunk-index only knows the first
+	// snapshot
+	first := store("first")
+	second := store("second")
+
+	// flips a bit of the stored chunk-index or its previous generation
+	be := (*r.backend.Backends[0]).(*memoryBackend)
+	corrupt := func(previous bool) {
+		key := "index"
+		if previous {
+			key += ".previous"
+		}
+		b, err := be.load(key)
+		if err != nil {
+			t.Fatalf("Failed loading chunk-index: %s", err)
+		}
+		b[len(b)/2] ^= 0x01
+		be.save(key, b)
+	}
+	refs := func(index ChunkIndex, snapshot *Snapshot) uint {
+		for _, arc := range snapshot.Archives {
+			if c, ok := index.Chunks[arc.Chunks[0].Hash]; ok {
+				return c.Refs
+			}
+		}
+		return 0
+	}
+
+	b, _ := r.backend.LoadPreviousChunkIndex()
+	previous := newChunkIndex()
+	err = previous.openStored(&r, b, true)
+	if err != nil || refs(previous, first) != 1 || refs(previous, second) != 0 {
+		t.Fatalf("Expected the previous generation to only reference the first snapshot, got %d & %d (%v)",
+			refs(previous, first), refs(previous, second), err)
+	}
+
+	corrupt(false)
+	if _, err := OpenChunkIndex(&r); err != ErrIndexCorrupt {
+		t.Fatalf("Expected %v, got %v", ErrIndexCorrupt, err)
+	}
+
+	recovered, err := RecoverChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed recovering chunk-index: %s", err)
+	}
+	if refs(recovered, first) != 1 || refs(recovered, second) != 1 {
+		t.Errorf("Expected the recovered chunk-index to reference both snapshots once, got %d & %d",
+			refs(recovered, first), refs(recovered, second))
+	}
+	index, err = OpenChunkIndex(&r)
+	if err != nil || refs(index, second) != 1 {
+		t.Errorf("Expected the recovered chunk-index to be saved, got %d references (%v)", refs(index, second), err)
+	}
+	if kept, _ := r.backend.LoadPreviousChunkIndex(); !bytes.Equal(kept, b) {
+		t.Error("Expected the previous generation to be kept by the recovery")
+	}
+
+	// without an intact previous generation, all snapshots get re-indexed
+	corrupt(false)
+	corrupt(true)
+	recovered, err = RecoverChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed re-indexing chunk-index: %s", err)
+	}
+	if refs(recovered, first) != 1 || refs(recovered, second) != 1 {
+		t.Errorf("Expected the re-indexed chunk-index to reference both snapshots once, got %d & %d",
+			refs(recovered, first), refs(recovered, second))
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Error declarations.
+var (
+	ErrArchiveNotFound = errors.New("Archive not found in snapshot")
+)
+
+// ChunkLocation describes where a chunk of a file's content is stored.
+type ChunkLocation struct {
+	Num           uint     // position of the chunk in the file
+	Hash          string   // hash of the encoded chunk
+	DecryptedHash string   // hash of the chunk's content
+	Offset        uint64   // offset of the chunk's content in the file
+	Length        uint64   // amount of bytes of the file in the chunk
+	StorageSize   uint64   // size of the encoded chunk
+	Compression   uint16   // compression type
+	Encryption    uint16   // encryption type
+	Epoch         uint     // data encryption key epoch
+	Salted        bool     // stored without deduplication, see StoreOptions.NoDedup
+	Objects       []string // names of the objects holding the data & parity parts
+}
+
+// ArchiveChunkMap returns the locations of the chunks of the file at path in
+// snapshot, in the order of their content. Backends storing chunks as files
+// keep the objects in subdirectories of their chunk directory, see
+// SubDirForChunk. Only the snapshot's metadata gets read.
+func ArchiveChunkMap(snapshot *Snapshot, path string) ([]ChunkLocation, error) {
+	if err := snapshot.LoadArchives(); err != nil {
+		return nil, err
+	}
+	arc, ok := snapshot.Archives[path]
+	if !ok {
+		return nil, ErrArchiveNotFound
+	}
+
+	var locations []ChunkLocation
+	var offset uint64
+	for i := uint(0); i < uint(len(arc.Chunks)); i++ {
+		idx, err := arc.IndexOfChunk(i)
+		if err != nil {
+			return nil, err
+		}
+
+		chunk := arc.Chunks[idx]
+		l := ChunkLocation{
+			Num:           chunk.Num,
+			Hash:          chunk.Hash,
+			DecryptedHash: chunk.DecryptedHash,
+			Offset:        offset,
+			Length:        uint64(chunk.OriginalSize),
+			StorageSize:   uint64(chunk.Size),
+			Compression:   chunk.compression(arc),
+			Encryption:    arc.Encrypted,
+			Epoch:         chunk.Epoch,
+			Salted:        chunk.Salt != "",
+		}
+		for part := uint(0); part < chunk.DataParts+chunk.ParityParts; part++ {
+			l.Objects = append(l.Objects, chunkObjectName(chunk.Hash, part, chunk.DataParts))
+		}
+
+		locations = append(locations, l)
+		offset += l.Length
+	}
+
+	return locations, nil
+}
+
+// chunkObjectName returns the name backends store a part of a chunk as.
+func chunkObjectName(shasum string, part, totalParts uint) string {
+	return shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+}
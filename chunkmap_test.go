@@ -0,0 +1,81 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveChunkMap(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "data")
+	data := make([]byte, 256*1024)
+	_, _ = rand.Read(data)
+	_ = ioutil.WriteFile(src, data, 0644)
+
+	r, _ := NewRepository("mem://chunk-map", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Compress:  CompressionZstd,
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+		ChunkSize: 64 * 1024,
+	})
+
+	locations, err := ArchiveChunkMap(snapshot, src)
+	if err != nil {
+		t.Fatalf("Failed mapping chunks: %s", err)
+	}
+	if len(locations) < 2 {
+		t.Fatalf("Expected multiple chunks, got %d", len(locations))
+	}
+
+	// the chunks are laid out back to back, covering the entire file
+	var offset uint64
+	for i, l := range locations {
+		if l.Num != uint(i) || l.Offset != offset {
+			t.Fatalf("Expected chunk %d at offset %d, got chunk %d at offset %d", i, offset, l.Num, l.Offset)
+		}
+		if sum := Hash(data[l.Offset:l.Offset+l.Length], HashHighway256); sum != l.DecryptedHash {
+			t.Errorf("Chunk %d doesn't match the file's content at offset %d", i, l.Offset)
+		}
+		if l.Compression != CompressionZstd || l.Encryption != EncryptionAES {
+			t.Errorf("Expected chunk %d to be compressed & encrypted, got %d and %d", i, l.Compression, l.Encryption)
+		}
+
+		memoryStoresMut.Lock()
+		for _, obj := range l.Objects {
+			if _, ok := memoryStores["chunk-map"]["chunks/"+obj]; !ok {
+				t.Errorf("Expected object %s of chunk %d to be stored", obj, i)
+			}
+		}
+		memoryStoresMut.Unlock()
+		offset += l.Length
+	}
+	if offset != uint64(len(data)) {
+		t.Errorf("Expected chunks to cover %d bytes, got %d", len(data), offset)
+	}
+
+	if _, err := ArchiveChunkMap(snapshot, "missing"); err != ErrArchiveNotFound {
+		t.Errorf("Expected %v, got %v", ErrArchiveNotFound, err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/minio/highwayhash"
+)
+
+// ChunkReader decrypts and decompresses the stored data of a chunk while it
+// is being read. Once all data has been read, the plaintext gets verified
+// against the chunk's DecryptedHash.
+type ChunkReader struct {
+	chunk Chunk
+	zr    io.ReadCloser
+	hash  hash.Hash
+}
+
+// NewChunkReader returns a ChunkReader for the stored data of chunk of arc
+// read from r. The data gets decoded just like when restoring arc from
+// repository, honoring the chunk's key epoch, salt and compression as well as
+// the repository's compression dictionaries. For chunks with parity parts, r
+// must provide the already joined data parts. Chunks encrypted by an external
+// encrypter get read completely before being decrypted.
+func NewChunkReader(r io.Reader, repository Repository, arc Archive, chunk Chunk) (*ChunkReader, error) {
+	var b []byte
+	if arc.Encrypted == EncryptionExternal {
+		var err error
+		b, err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b, encryption, key, err := chunkDecryption(repository, arc, chunk, b)
+	if err != nil {
+		return nil, err
+	}
+	if arc.Encrypted == EncryptionExternal {
+		r = bytes.NewReader(b)
+	}
+
+	decryptor, err := NewDecryptor(encryption, key)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := Decompressor{
+		Method: chunk.compression(&arc),
+		Dicts:  repository.CompressionDicts,
+	}.NewReader(decryptor.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	h, err := highwayhash.New(hashkey[:])
+	if err != nil {
+		_ = zr.Close()
+		return nil, err
+	}
+
+	return &ChunkReader{
+		chunk: chunk,
+		zr:    zr,
+		hash:  h,
+	}, nil
+}
+
+// Read reads plaintext data from the chunk. A CheckSumError is returned
+// instead of io.EOF if the data doesn't match the chunk's hash.
+func (c *ChunkReader) Read(p []byte) (int, error) {
+	n, err := c.zr.Read(p)
+	_, _ = c.hash.Write(p[:n])
+
+	if err == io.EOF {
+		hashsum := hex.EncodeToString(c.hash.Sum(nil))
+		if hashsum != c.chunk.DecryptedHash {
+			return n, &CheckSumError{"highwayhash", c.chunk.DecryptedHash, hashsum}
+		}
+	}
+
+	return n, err
+}
+
+// Close releases the resources of the decompressor.
+func (c *ChunkReader) Close() error {
+	return c.zr.Close()
+}
@@ -0,0 +1,149 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkReader(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(filepath.Join(dir, "repo"), testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	file := filepath.Join(dir, "data")
+	data := bytes.Repeat([]byte("some compressible content "), 4096)
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("Failed writing test file: %s", err)
+	}
+
+	for _, compression := range []uint16{CompressionNone, CompressionFlate, CompressionGZip, CompressionLZMA, CompressionZlib, CompressionZstd} {
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:       wd,
+			Paths:     []string{file},
+			Compress:  compression,
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+		})
+		arc := snapshot.Archives[file]
+
+		if restored := readChunks(t, r, *arc); !bytes.Equal(restored, data) {
+			t.Errorf("Compression %d: data mismatch after reading chunks", compression)
+		}
+	}
+}
+
+func TestChunkReaderDecoding(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir for repository: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(filepath.Join(dir, "repo"), testPassword)
+	if err := r.RotateDataKey(); err != nil {
+		t.Fatalf("Failed rotating data key: %s", err)
+	}
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	// a compressible chunk followed by a tiny one stored uncompressed
+	file := filepath.Join(dir, "data")
+	data := append(bytes.Repeat([]byte("some compressible content "), 4096), 'x')
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("Failed writing test file: %s", err)
+	}
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:                  wd,
+		Paths:                []string{file},
+		Compress:             CompressionGZip,
+		Encrypt:              EncryptionAES,
+		DataParts:            1,
+		NoDedup:              true,
+		CompressMinChunkSize: 64,
+		Chunker:              fixedChunker{size: uint(len(data) - 1)},
+	})
+	arc := snapshot.Archives[file]
+	if len(arc.Chunks) != 2 || arc.Chunks[0].Uncompressed || !arc.Chunks[1].Uncompressed {
+		t.Fatalf("Expected a compressed and an uncompressed chunk, got %+v", arc.Chunks)
+	}
+	for _, chunk := range arc.Chunks {
+		if chunk.Epoch != 1 || chunk.Salt == "" {
+			t.Fatalf("Expected chunk keyed with epoch 1 and a salt, got %+v", chunk)
+		}
+	}
+
+	if restored := readChunks(t, r, *arc); !bytes.Equal(restored, data) {
+		t.Errorf("Data mismatch after reading chunks")
+	}
+}
+
+// readChunks reads the chunks of arc with a ChunkReader.
+func readChunks(t *testing.T, r Repository, arc Archive) []byte {
+	var restored bytes.Buffer
+	for _, chunk := range arc.Chunks {
+		b, err := r.backend.LoadChunk(chunk, 0)
+		if err != nil {
+			t.Fatalf("Failed loading chunk: %s", err)
+		}
+
+		cr, err := NewChunkReader(bytes.NewReader(b), r, arc, chunk)
+		if err != nil {
+			t.Fatalf("Failed creating chunk reader: %s", err)
+		}
+		if _, err := restored.ReadFrom(cr); err != nil {
+			t.Errorf("Failed reading chunk %d: %s", chunk.Num, err)
+		}
+		_ = cr.Close()
+	}
+	return restored.Bytes()
+}
+
+func TestChunkReaderChecksum(t *testing.T) {
+	testPassword := "this_is_a_password"
+	data := []byte("1234567890")
+
+	r, _ := NewRepository("mem://chunkreader-checksum", testPassword)
+	pipe, err := NewEncodingPipeline(CompressionGZip, EncryptionAES, r.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pipe.Process(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arc := Archive{Compressed: CompressionGZip, Encrypted: EncryptionAES}
+	chunk := Chunk{DecryptedHash: Hash([]byte("something else"), HashHighway256)}
+	cr, err := NewChunkReader(bytes.NewReader(b), r, arc, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+
+	_, err = ioutil.ReadAll(cr)
+	if _, ok := err.(*CheckSumError); !ok {
+		t.Errorf("Expected CheckSumError, got %v", err)
+	}
+}
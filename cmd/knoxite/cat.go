@@ -43,6 +43,9 @@ func executeCat(snapshotID string, file string) error {
 	if err != nil {
 		return err
 	}
+	if err := snapshot.LoadArchives(); err != nil {
+		return err
+	}
 
 	if archive, ok := snapshot.Archives[file]; ok {
 		b, _, err := knoxite.DecodeArchiveData(repository, *archive)
@@ -0,0 +1,69 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/muesli/gotable"
+	"github.com/spf13/cobra"
+
+	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/cmd/knoxite/utils"
+)
+
+var (
+	chunksCmd = &cobra.Command{
+		Use:   "chunks <snapshot> <file>",
+		Short: "list the chunks of a file",
+		Long:  `The chunks command lists where the chunks of a file are stored, without downloading any of them`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("chunks needs a snapshot ID and filename")
+			}
+			return executeChunks(args[0], args[1])
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(chunksCmd)
+}
+
+func executeChunks(snapshotID string, file string) error {
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	_, snapshot, err := repository.FindSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	locations, err := knoxite.ArchiveChunkMap(snapshot, file)
+	if err != nil {
+		return err
+	}
+
+	tab := gotable.NewTable([]string{"#", "Offset", "Length", "Stored", "Codec", "Objects"},
+		[]int64{-5, 12, 10, 10, -12, -48},
+		"No chunks found.")
+	for _, l := range locations {
+		tab.AppendRow([]interface{}{
+			l.Num,
+			l.Offset,
+			l.Length,
+			l.StorageSize,
+			utils.CompressionText(int(l.Compression)) + "/" + utils.EncryptionText(int(l.Encryption)),
+			strings.Join(l.Objects, " ")})
+	}
+
+	_ = tab.Print()
+	return nil
+}
@@ -76,7 +76,7 @@ func executeClone(snapshotID string, args []string, opts StoreOptions) error {
 	// release the shutdown lock
 	lock()
 
-	err = store(&repository, &chunkIndex, snapshot, targets, opts)
+	err = store(&repository, &chunkIndex, snapshot, nil, targets, opts)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,94 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/muesli/gotable"
+	"github.com/spf13/cobra"
+
+	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/cmd/knoxite/utils"
+)
+
+// CompressionOptions holds all the options that can be set for the
+// 'compression' command.
+type CompressionOptions struct {
+	Excludes   []string
+	SampleSize uint64
+}
+
+var (
+	compressionOpts = CompressionOptions{}
+
+	compressionCmd = &cobra.Command{
+		Use:   "compression <dir/file> [...]",
+		Short: "compare compression algos on a sample of files",
+		Long: `The compression command compresses a sample of the given files with every
+available compression algo and estimates the storage size and time needed for
+all of them`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("compression needs to know which files and/or directories to work on")
+			}
+			return executeCompression(args, compressionOpts)
+		},
+	}
+)
+
+func init() {
+	compressionCmd.Flags().StringArrayVarP(&compressionOpts.Excludes, "excludes", "x", []string{}, "list of excludes")
+	compressionCmd.Flags().Uint64Var(&compressionOpts.SampleSize, "sample-size", 0, "amount of bytes to sample (default 16 MiB)")
+	RootCmd.AddCommand(compressionCmd)
+}
+
+func executeCompression(args []string, opts CompressionOptions) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	targets := []string{}
+	for _, target := range args {
+		if absTarget, err := filepath.Abs(target); err == nil {
+			target = absTarget
+		}
+		targets = append(targets, target)
+	}
+
+	estimates, err := knoxite.EstimateCompression(knoxite.StoreOptions{
+		CWD:      wd,
+		Paths:    targets,
+		Excludes: opts.Excludes,
+	}, opts.SampleSize)
+	if err != nil {
+		return err
+	}
+
+	tab := gotable.NewTable([]string{"Compression", "Ratio", "Est. Storage Size", "Est. Time"},
+		[]int64{-12, 6, 17, 12}, "No files found.")
+	for _, e := range estimates {
+		if e.SampleSize == 0 {
+			continue
+		}
+		tab.AppendRow([]interface{}{
+			utils.CompressionText(int(e.Method)),
+			fmt.Sprintf("%.2f", e.Ratio()),
+			knoxite.SizeToString(e.EstimatedSize),
+			e.EstimatedDuration.Round(time.Millisecond).String()})
+	}
+
+	_ = tab.Print()
+	if len(estimates) > 0 && estimates[0].SampleSize > 0 {
+		fmt.Printf("\nRecommended compression: %s\n", utils.CompressionText(int(estimates[0].Method)))
+	}
+	return nil
+}
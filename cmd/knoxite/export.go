@@ -0,0 +1,77 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/knoxite/knoxite"
+)
+
+// ExportOptions holds all the options that can be set for the 'export' command.
+type ExportOptions struct {
+	Gzip   bool
+	Output string
+}
+
+var (
+	exportOpts = ExportOptions{}
+
+	exportCmd = &cobra.Command{
+		Use:   "export <snapshot>",
+		Short: "export a snapshot as tar archive",
+		Long:  `The export command writes the content of a snapshot as tar archive to stdout or a file`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("export needs to know which snapshot to work on")
+			}
+			return executeExport(args[0], exportOpts)
+		},
+	}
+)
+
+func initExportFlags(f func() *pflag.FlagSet) {
+	f().BoolVarP(&exportOpts.Gzip, "gzip", "z", false, "compress the tar archive with gzip")
+	f().StringVarP(&exportOpts.Output, "output", "o", "", "file to write the tar archive to (default stdout)")
+}
+
+func init() {
+	initExportFlags(exportCmd.Flags)
+	RootCmd.AddCommand(exportCmd)
+}
+
+func executeExport(snapshotID string, opts ExportOptions) error {
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+
+	_, snapshot, err := repository.FindSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if opts.Output != "" {
+		f, err := os.Create(opts.Output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return knoxite.ExportTar(repository, snapshot, w, knoxite.ExportOptions{
+		Gzip: opts.Gzip,
+	})
+}
@@ -51,7 +51,7 @@ func executeLs(snapshotID string) error {
 			return err
 		}
 
-		for _, archive := range snapshot.Archives {
+		err = snapshot.EachArchive(func(archive *knoxite.Archive) error {
 			username := strconv.FormatInt(int64(archive.UID), 10)
 			u, err := user.LookupId(username)
 			if err == nil {
@@ -65,6 +65,10 @@ func executeLs(snapshotID string) error {
 				knoxite.SizeToString(archive.Size),
 				time.Unix(archive.ModTime, 0).Format(timeFormat),
 				archive.Path})
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 
 		_ = tab.Print()
@@ -15,6 +15,7 @@ import (
 	"log"
 	"os"
 	"syscall"
+	"time"
 
 	shutdown "github.com/klauspost/shutdown2"
 	"github.com/spf13/cobra"
@@ -25,6 +26,7 @@ import (
 	_ "github.com/knoxite/knoxite/storage/azure"
 	_ "github.com/knoxite/knoxite/storage/backblaze"
 	_ "github.com/knoxite/knoxite/storage/dropbox"
+	_ "github.com/knoxite/knoxite/storage/exec"
 	_ "github.com/knoxite/knoxite/storage/ftp"
 	_ "github.com/knoxite/knoxite/storage/googlecloud"
 	_ "github.com/knoxite/knoxite/storage/http"
@@ -39,8 +41,17 @@ type GlobalOptions struct {
 	Repo      string
 	Alias     string
 	Password  string
+	Keyfile   string
 	ConfigURL string
+	Prefix    string
 	Verbosity string
+	ReadOnly  bool
+
+	CredentialsFile string
+
+	OperationTimeout time.Duration
+	SlowThreshold    time.Duration
+	MetadataRetries  int
 }
 
 var (
@@ -72,11 +83,20 @@ func main() {
 	RootCmd.PersistentFlags().StringVarP(&globalOpts.Repo, "repo", "r", "", "Repository directory to backup to/restore from (default: current working dir)")
 	RootCmd.PersistentFlags().StringVarP(&globalOpts.Alias, "alias", "R", "", "Repository alias to backup to/restore from")
 	RootCmd.PersistentFlags().StringVar(&globalOpts.Password, "password", "", "Password to use for data encryption")
+	RootCmd.PersistentFlags().StringVar(&globalOpts.Keyfile, "keyfile", "", "Keyfile unlocking the repository, instead of or in addition to the password")
 	RootCmd.PersistentFlags().StringVarP(&globalOpts.ConfigURL, "configURL", "C", config.DefaultPath(), "Path to the configuration file")
 	RootCmd.PersistentFlags().StringVarP(&globalOpts.Verbosity, "verbose", "v", "Warning", "Verbose output: possible levels are Debug, Info and Warning")
+	RootCmd.PersistentFlags().BoolVar(&globalOpts.ReadOnly, "read-only", false, "Never write to the repository, e.g. to restore or verify it from WORM media")
+	RootCmd.PersistentFlags().StringVar(&globalOpts.Prefix, "prefix", "", "Store the repository below this prefix, so several repositories can share a bucket")
+	RootCmd.PersistentFlags().StringVar(&globalOpts.CredentialsFile, "credentials-file", "", "File with the credentials of storage backends")
+	RootCmd.PersistentFlags().DurationVar(&globalOpts.OperationTimeout, "operation-timeout", 0, "Abort and retry chunk transfers taking longer than this, e.g. 5m (default: wait forever)")
+	RootCmd.PersistentFlags().DurationVar(&globalOpts.SlowThreshold, "slow-threshold", 0, "Warn about chunk transfers taking longer than this, e.g. 30s")
+	RootCmd.PersistentFlags().IntVar(&globalOpts.MetadataRetries, "metadata-retries", 0, "How often to attempt saving the repository & chunk-index on flaky backends (default: 3)")
 
 	globalOpts.Repo = os.Getenv("KNOXITE_REPOSITORY")
 	globalOpts.Password = os.Getenv("KNOXITE_PASSWORD")
+	globalOpts.Keyfile = os.Getenv("KNOXITE_KEYFILE")
+	globalOpts.CredentialsFile = os.Getenv("KNOXITE_CREDENTIALS_FILE")
 
 	if err := RootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -56,6 +56,9 @@ func executeMount(snapshotID, mountpoint string) error {
 	if err != nil {
 		return err
 	}
+	if err := snapshot.LoadArchives(); err != nil {
+		return err
+	}
 
 	if _, err := os.Stat(mountpoint); os.IsNotExist(err) {
 		fmt.Printf("Mountpoint %s doesn't exist, creating it\n", mountpoint)
@@ -11,6 +11,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 
 	shutdown "github.com/klauspost/shutdown2"
 	"github.com/muesli/gotable"
@@ -21,6 +22,10 @@ import (
 )
 
 var (
+	repoInitOpts         = knoxite.RepositoryOptions{}
+	repoInitWeakPassword string
+	repoMigrateOpts      = knoxite.MigrateOptions{}
+
 	repoCmd = &cobra.Command{
 		Use:   "repo",
 		Short: "manage repository",
@@ -43,6 +48,14 @@ var (
 			return executeRepoChangePassword()
 		},
 	}
+	repoRotateKeyCmd = &cobra.Command{
+		Use:   "rotate-key",
+		Short: "rotates the data encryption key of a repository",
+		Long:  `The rotate-key command starts a new data encryption key epoch. New data gets encrypted with the new key, existing data stays readable`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return executeRepoRotateKey()
+		},
+	}
 	repoCatCmd = &cobra.Command{
 		Use:   "cat",
 		Short: "display repository information as JSON",
@@ -70,6 +83,18 @@ var (
 			return executeRepoAdd(args[0])
 		},
 	}
+	repoMigrateCmd = &cobra.Command{
+		Use:   "migrate <url>",
+		Short: "copy the repository to another storage backend",
+		Long:  `The migrate command copies the repository including all snapshots to another storage backend`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("migrate needs a URL to migrate to")
+			}
+			repoMigrateOpts.Reshard = cmd.Flags().Changed("data-parts") || cmd.Flags().Changed("parity-parts")
+			return executeRepoMigrate(args[0])
+		},
+	}
 	repoPackCmd = &cobra.Command{
 		Use:   "pack",
 		Short: "pack repository and release redundant data",
@@ -78,15 +103,33 @@ var (
 			return executeRepoPack()
 		},
 	}
+	repoRecoverIndexCmd = &cobra.Command{
+		Use:   "recover-index",
+		Short: "recover a corrupt chunk-index from its previous generation",
+		Long: `The recover-index command replaces a corrupt chunk-index with its previous
+generation, which every save keeps, and indexes the snapshots stored since. All
+snapshots get re-indexed if the previous generation is corrupt as well`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return executeRepoRecoverIndex()
+		},
+	}
 )
 
 func init() {
+	repoInitCmd.Flags().IntVar(&repoInitOpts.SnapshotIDLength, "snapshot-id-length", 0, "length of snapshot IDs (default 8)")
+	repoInitCmd.Flags().StringVar(&repoInitWeakPassword, "weak-password", "", "how to handle weak passwords: warn (default), reject, allow")
+	repoMigrateCmd.Flags().UintVar(&repoMigrateOpts.DataParts, "data-parts", 1, "re-split chunks into n data parts on the new backend")
+	repoMigrateCmd.Flags().UintVar(&repoMigrateOpts.ParityParts, "parity-parts", 0, "re-split chunks with n parity parts on the new backend")
+
 	repoCmd.AddCommand(repoInitCmd)
 	repoCmd.AddCommand(repoChangePasswordCmd)
+	repoCmd.AddCommand(repoRotateKeyCmd)
 	repoCmd.AddCommand(repoCatCmd)
 	repoCmd.AddCommand(repoInfoCmd)
 	repoCmd.AddCommand(repoAddCmd)
+	repoCmd.AddCommand(repoMigrateCmd)
 	repoCmd.AddCommand(repoPackCmd)
+	repoCmd.AddCommand(repoRecoverIndexCmd)
 	RootCmd.AddCommand(repoCmd)
 }
 
@@ -98,12 +141,18 @@ func executeRepoInit() error {
 	}
 	defer lock()
 
-	r, err := newRepository(globalOpts.Repo, globalOpts.Password)
+	policy, err := utils.PasswordPolicyFromString(repoInitWeakPassword)
+	if err != nil {
+		return err
+	}
+	repoInitOpts.PasswordPolicy = policy
+
+	r, err := newRepository(globalOpts.Repo, globalOpts.Password, repoInitOpts)
 	if err != nil {
 		return fmt.Errorf("Creating repository at %s failed: %v", globalOpts.Repo, err)
 	}
 
-	fmt.Printf("Created new repository at %s\n", (*r.BackendManager().Backends[0]).Location())
+	fmt.Printf("Created new repository at %s\n", knoxite.RedactURL((*r.BackendManager().Backends[0]).Location()))
 	return nil
 }
 
@@ -127,6 +176,21 @@ func executeRepoChangePassword() error {
 	return nil
 }
 
+func executeRepoRotateKey() error {
+	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+
+	err = r.RotateDataKey()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rotated data key, new data gets encrypted in epoch %d\n", r.DataEpoch())
+	return nil
+}
+
 func executeRepoAdd(url string) error {
 	// acquire a shutdown lock. we don't want these next calls to be interrupted
 	lock := shutdown.Lock()
@@ -140,7 +204,7 @@ func executeRepoAdd(url string) error {
 		return err
 	}
 
-	backend, err := knoxite.BackendFromURL(url)
+	backend, err := knoxite.BackendFromURLWithOptions(url, backendOptions())
 	if err != nil {
 		return err
 	}
@@ -156,7 +220,39 @@ func executeRepoAdd(url string) error {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Added %s to repository\n", backend.Location())
+	fmt.Printf("Added %s to repository\n", knoxite.RedactURL(backend.Location()))
+	return nil
+}
+
+func executeRepoMigrate(url string) error {
+	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+
+	backend, err := knoxite.BackendFromURLWithOptions(url, backendOptions())
+	if err != nil {
+		return err
+	}
+
+	progress, err := r.MigrateTo(backend, repoMigrateOpts)
+	if err != nil {
+		return err
+	}
+
+	var stats knoxite.Stats
+	for p := range progress {
+		if p.Error != nil {
+			fmt.Printf("'%s' failed to migrate: %v\n", p.Path, p.Error)
+		}
+		stats = p.TotalStatistics
+	}
+
+	fmt.Printf("Migrated %d objects (%s) to %s, %d errors\n",
+		stats.Files, knoxite.SizeToString(stats.Transferred), knoxite.RedactURL(backend.Location()), stats.Errors)
+	if stats.Errors > 0 {
+		return fmt.Errorf("migration incomplete, run migrate again to retry the failed objects")
+	}
 	return nil
 }
 
@@ -198,6 +294,27 @@ func executeRepoPack() error {
 	return nil
 }
 
+func executeRepoRecoverIndex() error {
+	// acquire a shutdown lock. we don't want these next calls to be interrupted
+	lock := shutdown.Lock()
+	if lock == nil {
+		return nil
+	}
+	defer lock()
+
+	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	index, err := knoxite.RecoverChunkIndex(&r)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Recovered chunk-index with %d chunks\n", len(index.Chunks))
+	return nil
+}
+
 func executeRepoInfo() error {
 	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
 	if err != nil {
@@ -211,7 +328,7 @@ func executeRepoInfo() error {
 	for _, be := range r.BackendManager().Backends {
 		space, _ := (*be).AvailableSpace()
 		tab.AppendRow([]interface{}{
-			(*be).Location(),
+			knoxite.RedactURL((*be).Location()),
 			knoxite.SizeToString(space)})
 	}
 
@@ -220,6 +337,19 @@ func executeRepoInfo() error {
 }
 
 func openRepository(path, password string) (knoxite.Repository, error) {
+	opts := knoxite.RepositoryOptions{
+		Keyfile:  globalOpts.Keyfile,
+		Backend:  backendOptions(),
+		ReadOnly: globalOpts.ReadOnly,
+	}
+
+	if password == "" && opts.Keyfile != "" {
+		// the keyfile may be all we need
+		r, err := knoxite.OpenRepositoryWithOptions(path, password, opts)
+		if err != knoxite.ErrPasswordRequired {
+			return r, err
+		}
+	}
 	if password == "" {
 		var err error
 		password, err = utils.ReadPassword("Enter password:")
@@ -228,11 +358,13 @@ func openRepository(path, password string) (knoxite.Repository, error) {
 		}
 	}
 
-	return knoxite.OpenRepository(path, password)
+	return knoxite.OpenRepositoryWithOptions(path, password, opts)
 }
 
-func newRepository(path, password string) (knoxite.Repository, error) {
-	if password == "" {
+func newRepository(path, password string, opts knoxite.RepositoryOptions) (knoxite.Repository, error) {
+	// with a keyfile, the password is optional
+	opts.Keyfile = globalOpts.Keyfile
+	if password == "" && opts.Keyfile == "" {
 		var err error
 		password, err = utils.ReadPasswordTwice("Enter a password to encrypt this repository with:", "Confirm password:")
 		if err != nil {
@@ -240,5 +372,25 @@ func newRepository(path, password string) (knoxite.Repository, error) {
 		}
 	}
 
-	return knoxite.NewRepository(path, password)
+	if opts.PasswordPolicy == knoxite.PasswordWarnWeak && opts.Keyfile == "" {
+		if err := knoxite.CheckPassword(password); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+
+	opts.Backend = backendOptions()
+	return knoxite.NewRepositoryWithOptions(path, password, opts)
+}
+
+// backendOptions returns the storage backend settings given on the command
+// line.
+func backendOptions() knoxite.BackendOptions {
+	return knoxite.BackendOptions{
+		CredentialsFile: globalOpts.CredentialsFile,
+		Prefix:          globalOpts.Prefix,
+
+		OperationTimeout:       globalOpts.OperationTimeout,
+		SlowOperationThreshold: globalOpts.SlowThreshold,
+		MetadataRetries:        globalOpts.MetadataRetries,
+	}
 }
@@ -11,41 +11,71 @@ package main
 import (
 	"errors"
 	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
 
+	humanize "github.com/dustin/go-humanize"
 	"github.com/muesli/goprogressbar"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
 	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/cmd/knoxite/utils"
 )
 
 // Error declarations.
 var (
 	ErrTargetMissing = errors.New("please specify a directory to restore to")
+	ErrTargetGiven   = errors.New("either specify a directory to restore to or --to-original")
+	ErrAborted       = errors.New("restore aborted")
 )
 
 type RestoreOptions struct {
-	Excludes []string
-	Pedantic bool
+	Excludes     []string
+	Pedantic     bool
+	MetadataOnly bool
+	Prefetch     int
+	ReadAhead    uint64
+	Verifiers    int
+	MaxMemory    uint64
+
+	AllowSymlinkEscape bool
+	Manifest           string
+	PreserveTimes      string
+	WindowsAttrs       bool
+	Capabilities       bool
+	ACLs               bool
+	SkipSpaceCheck     bool
+	ToOriginal         bool
+	ForceOverwrite     bool
+	Yes                bool
 }
 
 var (
 	restoreOpts = RestoreOptions{}
 
 	restoreCmd = &cobra.Command{
-		Use:   "restore <snapshot> <destination>",
+		Use:   "restore <snapshot> [<destination>]",
 		Short: "restore a snapshot",
 		Long:  `The restore command restores a snapshot to a directory`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) < 1 {
 				return fmt.Errorf("restore needs to know which snapshot to work on")
 			}
-			if len(args) < 2 {
+			target := ""
+			switch {
+			case len(args) < 2 && !restoreOpts.ToOriginal:
 				return ErrTargetMissing
+			case len(args) >= 2 && restoreOpts.ToOriginal:
+				return ErrTargetGiven
+			case len(args) >= 2:
+				target = args[1]
 			}
 
 			configureRestoreOpts(cmd, &restoreOpts)
-			return executeRestore(args[0], args[1], restoreOpts)
+			return executeRestore(args[0], target, restoreOpts)
 		},
 	}
 )
@@ -68,6 +98,21 @@ func configureRestoreOpts(cmd *cobra.Command, opts *RestoreOptions) {
 func initRestoreFlags(f func() *pflag.FlagSet) {
 	f().StringArrayVarP(&restoreOpts.Excludes, "excludes", "x", []string{}, "list of excludes")
 	f().BoolVar(&restoreOpts.Pedantic, "pedantic", false, "exit on first error")
+	f().BoolVar(&restoreOpts.MetadataOnly, "metadata-only", false, "only restore ownership, modes and times of already existing files")
+	f().IntVar(&restoreOpts.Prefetch, "prefetch", 4, "amount of chunks to load ahead")
+	f().Uint64Var(&restoreOpts.ReadAhead, "read-ahead", 0, "bytes of packed chunks to load with a single range read")
+	f().IntVar(&restoreOpts.Verifiers, "verify-concurrency", runtime.NumCPU(), "amount of chunks to decrypt and verify in parallel")
+	f().Uint64Var(&restoreOpts.MaxMemory, "max-memory", 0, "bytes of chunks to keep in memory at most, limiting --prefetch and --verify-concurrency")
+	f().BoolVar(&restoreOpts.AllowSymlinkEscape, "allow-symlink-escape", false, "allow writing through symlinks pointing outside of the target")
+	f().StringVar(&restoreOpts.Manifest, "manifest", "", "file recording the restore's progress, to resume an interrupted restore")
+	f().StringVar(&restoreOpts.PreserveTimes, "preserve-times", "", "which timestamps to restore: all (default), mtime, none")
+	f().BoolVar(&restoreOpts.WindowsAttrs, "windows-attrs", false, "restore readonly, hidden & system attributes on Windows")
+	f().BoolVar(&restoreOpts.Capabilities, "capabilities", false, "restore file capabilities on Linux, requires root")
+	f().BoolVar(&restoreOpts.ACLs, "acls", false, "restore access & default ACLs on Linux")
+	f().BoolVar(&restoreOpts.SkipSpaceCheck, "skip-space-check", false, "restore even if the target lacks the free space")
+	f().BoolVar(&restoreOpts.ToOriginal, "to-original", false, "restore a snapshot stored with --absolute-paths to the original locations")
+	f().BoolVar(&restoreOpts.ForceOverwrite, "force-overwrite", false, "overwrite existing read-only files, keeping them read-only")
+	f().BoolVarP(&restoreOpts.Yes, "yes", "y", false, "don't ask for confirmation before overwriting the original locations")
 }
 
 func init() {
@@ -76,6 +121,11 @@ func init() {
 }
 
 func executeRestore(snapshotID, target string, opts RestoreOptions) error {
+	preserveTimes, err := utils.PreserveTimesPolicyFromString(opts.PreserveTimes)
+	if err != nil {
+		return err
+	}
+
 	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
 	if err != nil {
 		return err
@@ -85,49 +135,99 @@ func executeRestore(snapshotID, target string, opts RestoreOptions) error {
 	if err != nil {
 		return err
 	}
+	if opts.ToOriginal && !opts.Yes {
+		fmt.Printf("Restoring snapshot %s writes %d files and directories to their original locations, overwriting existing ones. Continue (y/N)?: ",
+			snapshot.ID, snapshot.Stats.Files+snapshot.Stats.Dirs+snapshot.Stats.SymLinks)
+		var buf string
+		_, _ = fmt.Scanln(&buf)
+		if strings.ToLower(strings.TrimSpace(buf)) != "y" {
+			return ErrAborted
+		}
+	}
 
-	progress, err := knoxite.DecodeSnapshot(repository, snapshot, target, opts.Excludes, opts.Pedantic)
+	progress, err := knoxite.DecodeSnapshot(repository, snapshot, target, knoxite.RestoreOptions{
+		Excludes:     opts.Excludes,
+		Pedantic:     opts.Pedantic,
+		MetadataOnly: opts.MetadataOnly,
+		Prefetch:     opts.Prefetch,
+		ReadAhead:    opts.ReadAhead,
+
+		VerifyConcurrency:  opts.Verifiers,
+		MaxMemory:          opts.MaxMemory,
+		AllowSymlinkEscape: opts.AllowSymlinkEscape,
+		Manifest:           opts.Manifest,
+		PreserveTimes:      preserveTimes,
+
+		PreserveWindowsAttrs: opts.WindowsAttrs,
+		PreserveCapabilities: opts.Capabilities,
+		PreserveACLs:         opts.ACLs,
+		SkipSpaceCheck:       opts.SkipSpaceCheck,
+		RestoreToOriginal:    opts.ToOriginal,
+		ForceOverwrite:       opts.ForceOverwrite,
+	})
 	if err != nil {
 		return err
 	}
 
-	pb := &goprogressbar.ProgressBar{Total: 1000, Width: 40}
-	stats := knoxite.Stats{}
+	fileProgressBar := &goprogressbar.ProgressBar{Width: 40}
+	overallProgressBar := &goprogressbar.ProgressBar{Width: 60}
+
+	pb := goprogressbar.MultiProgressBar{}
+	pb.AddProgressBar(fileProgressBar)
+	pb.AddProgressBar(overallProgressBar)
+	var overall knoxite.Progress
+	var failed uint64
 	lastPath := ""
 
 	errs := make(map[string]error)
 	for p := range progress {
+		if p.Warning != nil {
+			// e.g. files that failed to be stored in a partial snapshot
+			fmt.Fprintf(os.Stderr, "\nWarning: %s: %v\n", p.Path, p.Warning)
+			continue
+		}
 		if p.Error != nil {
 			if restoreOpts.Pedantic {
 				fmt.Println()
 				return p.Error
 			}
 			errs[p.Path] = p.Error
-			stats.Errors++
+			failed++
+		} else {
+			overall = p
+		}
+		if p.Path != lastPath && lastPath != "" {
+			// We have just started restoring a new item
+			fmt.Println()
 		}
 
-		pb.Total = int64(p.CurrentItemStats.Size)
-		pb.Current = int64(p.CurrentItemStats.Transferred)
-		pb.PrependText = fmt.Sprintf("%s / %s  %s/s",
-			knoxite.SizeToString(uint64(pb.Current)),
-			knoxite.SizeToString(uint64(pb.Total)),
+		fileProgressBar.Total = int64(p.CurrentItemStats.Size)
+		fileProgressBar.Current = int64(p.CurrentItemStats.Transferred)
+		fileProgressBar.PrependText = fmt.Sprintf("%s / %s  %s/s",
+			knoxite.SizeToString(uint64(fileProgressBar.Current)),
+			knoxite.SizeToString(uint64(fileProgressBar.Total)),
 			knoxite.SizeToString(p.TransferSpeed()))
 
+		overallProgressBar.Total = int64(overall.TotalStatistics.Size)
+		overallProgressBar.Current = int64(overall.TotalStatistics.Transferred)
+		overallProgressBar.PrependText = fmt.Sprintf("%s/s  ETA %s",
+			knoxite.SizeToString(overall.Throughput()),
+			overall.ETA().Round(time.Second))
+		overallProgressBar.Text = fmt.Sprintf("%s / %s (%s of %s files)",
+			knoxite.SizeToString(uint64(overallProgressBar.Current)),
+			knoxite.SizeToString(uint64(overallProgressBar.Total)),
+			humanize.Comma(int64(overall.CompletedFiles)),
+			humanize.Comma(int64(overall.TotalStatistics.Files)))
+
 		if p.Path != lastPath {
-			// We have just started restoring a new item
-			if len(lastPath) > 0 {
-				fmt.Println()
-			}
 			lastPath = p.Path
-			pb.Text = p.Path
-		}
-		if p.CurrentItemStats.Size == p.CurrentItemStats.Transferred {
-			// We have just finished restoring an item
-			stats.Add(p.TotalStatistics)
+			fileProgressBar.Text = p.Path
 		}
 
 		pb.LazyPrint()
 	}
+	stats := overall.TotalStatistics
+	stats.Errors = failed
 	fmt.Println()
 	fmt.Println("Restore done:", stats.String())
 	for file, err := range errs {
@@ -14,9 +14,12 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/cmd/knoxite/utils"
 )
 
 var (
+	snapshotRemoveDryRun bool
+
 	snapshotCmd = &cobra.Command{
 		Use:   "snapshot",
 		Short: "manage snapshots",
@@ -42,18 +45,80 @@ var (
 			if len(args) != 1 {
 				return fmt.Errorf("remove needs a snapshot ID to work on")
 			}
-			return executeSnapshotRemove(args[0])
+			return executeSnapshotRemove(args[0], snapshotRemoveDryRun)
+		},
+	}
+	snapshotDiffCmd = &cobra.Command{
+		Use:   "diff <snapshot> <directory>",
+		Short: "compare a snapshot with a directory",
+		Long:  `The diff command shows which files restoring a snapshot to a directory would add, delete or overwrite`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("diff needs a snapshot ID and a directory to work on")
+			}
+			return executeSnapshotDiff(args[0], args[1])
+		},
+	}
+	snapshotMergeCmd = &cobra.Command{
+		Use:   "merge <volume> <snapshot>...",
+		Short: "merge snapshots into a new one",
+		Long:  `The merge command creates a new snapshot containing the latest state of every file of the given snapshots`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return fmt.Errorf("merge needs a volume ID and the snapshot IDs to work on")
+			}
+			return executeSnapshotMerge(args[0], args[1:])
+		},
+	}
+	snapshotCopyCmd = &cobra.Command{
+		Use:   "copy <snapshot> <volume>",
+		Short: "copy a snapshot to another volume",
+		Long:  `The copy command adds a copy of a snapshot to another volume, sharing all its data with the original snapshot`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("copy needs a snapshot ID and a volume ID to work on")
+			}
+			return executeSnapshotCopy(args[0], args[1])
+		},
+	}
+	snapshotRepairCmd = &cobra.Command{
+		Use:   "repair <snapshot>",
+		Short: "repair damaged chunks of a snapshot",
+		Long:  `The repair command restores missing or damaged chunks of a snapshot from the rest of their parity group`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("repair needs a snapshot ID to work on")
+			}
+			return executeSnapshotRepair(args[0])
+		},
+	}
+	snapshotCompressionCmd = &cobra.Command{
+		Use:   "compression <snapshot>",
+		Short: "show the compression algos used by a snapshot",
+		Long:  `The compression command shows how much of a snapshot got stored with each compression algo`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("compression needs a snapshot ID to work on")
+			}
+			return executeSnapshotCompression(args[0])
 		},
 	}
 )
 
 func init() {
+	snapshotRemoveCmd.Flags().BoolVar(&snapshotRemoveDryRun, "dry-run", false, "only show how much storage space removing the snapshot would free")
+
 	snapshotCmd.AddCommand(snapshotListCmd)
 	snapshotCmd.AddCommand(snapshotRemoveCmd)
+	snapshotCmd.AddCommand(snapshotDiffCmd)
+	snapshotCmd.AddCommand(snapshotMergeCmd)
+	snapshotCmd.AddCommand(snapshotCopyCmd)
+	snapshotCmd.AddCommand(snapshotCompressionCmd)
+	snapshotCmd.AddCommand(snapshotRepairCmd)
 	RootCmd.AddCommand(snapshotCmd)
 }
 
-func executeSnapshotRemove(snapshotID string) error {
+func executeSnapshotRemove(snapshotID string, dryRun bool) error {
 	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
 	if err != nil {
 		return err
@@ -68,12 +133,28 @@ func executeSnapshotRemove(snapshotID string) error {
 		return err
 	}
 
+	if snapshot.Pinned {
+		return knoxite.ErrPinnedSnapshot
+	}
+	if snapshot.Immutable() {
+		return fmt.Errorf("%v until %s", knoxite.ErrImmutableSnapshot, snapshot.ImmutableUntil.Format(timeFormat))
+	}
+
+	if dryRun {
+		fmt.Printf("Removing snapshot %s would free %s of storage space after running 'repo pack'\n",
+			snapshot.ID, knoxite.SizeToString(chunkIndex.ReclaimableSize([]string{snapshot.ID})))
+		return nil
+	}
+
 	err = volume.RemoveSnapshot(snapshot.ID)
 	if err != nil {
 		return err
 	}
 
-	chunkIndex.RemoveSnapshot(snapshot.ID)
+	err = chunkIndex.ReleaseSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
 	err = chunkIndex.Save(&repository)
 	if err != nil {
 		return err
@@ -110,12 +191,19 @@ func executeSnapshotList(volID string) error {
 		if err != nil {
 			return err
 		}
+		description := snapshot.Description
+		if snapshot.Partial {
+			description = "[partial] " + description
+		}
+		if snapshot.Immutable() {
+			description = "[immutable] " + description
+		}
 		tab.AppendRow([]interface{}{
 			snapshot.ID,
 			snapshot.Date.Format(timeFormat),
 			knoxite.SizeToString(snapshot.Stats.Size),
 			knoxite.SizeToString(snapshot.Stats.StorageSize),
-			snapshot.Description})
+			description})
 		totalSize += snapshot.Stats.Size
 		totalStorageSize += snapshot.Stats.StorageSize
 	}
@@ -124,3 +212,150 @@ func executeSnapshotList(volID string) error {
 	_ = tab.Print()
 	return nil
 }
+
+func executeSnapshotDiff(snapshotID, dir string) error {
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+
+	_, snapshot, err := repository.FindSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	diff, err := knoxite.DiffAgainstFilesystem(repository, snapshot, dir)
+	if err != nil {
+		return err
+	}
+	if diff.Empty() {
+		fmt.Printf("%s matches snapshot %s\n", dir, snapshot.ID)
+		return nil
+	}
+
+	// from the perspective of a restore: + gets created, M overwritten and
+	// ? isn't part of the snapshot
+	for _, path := range diff.Removed {
+		fmt.Println("+", path)
+	}
+	for _, change := range diff.Modified {
+		fmt.Printf("M %s (%s)\n", change.Path, change.Reason)
+	}
+	for _, path := range diff.Added {
+		fmt.Println("?", path)
+	}
+	return nil
+}
+
+func executeSnapshotMerge(volID string, snapshotIDs []string) error {
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	chunkIndex, err := knoxite.OpenChunkIndex(&repository)
+	if err != nil {
+		return err
+	}
+
+	volume, err := repository.FindVolume(volID)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := knoxite.MergeSnapshots(&repository, volume, &chunkIndex, snapshotIDs)
+	if err != nil {
+		return err
+	}
+
+	err = chunkIndex.Save(&repository)
+	if err != nil {
+		return err
+	}
+	err = repository.Save()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Merged %d snapshots into snapshot %s: %s\n", len(snapshotIDs), snapshot.ID, snapshot.Stats.String())
+	return nil
+}
+
+func executeSnapshotCopy(snapshotID, volID string) error {
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	chunkIndex, err := knoxite.OpenChunkIndex(&repository)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := knoxite.CloneSnapshotToVolume(&repository, &chunkIndex, snapshotID, volID)
+	if err != nil {
+		return err
+	}
+
+	err = chunkIndex.Save(&repository)
+	if err != nil {
+		return err
+	}
+	err = repository.Save()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Copied snapshot %s to snapshot %s in volume %s\n", snapshotID, snapshot.ID, volID)
+	return nil
+}
+
+func executeSnapshotCompression(snapshotID string) error {
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	_, snapshot, err := repository.FindSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	distribution, err := snapshot.CompressionDistribution()
+	if err != nil {
+		return err
+	}
+
+	tab := gotable.NewTable([]string{"Compression", "Files", "Share", "Size", "Storage Size"},
+		[]int64{-12, 8, 7, 12, 12}, "No files found.")
+	for _, share := range distribution {
+		tab.AppendRow([]interface{}{
+			utils.CompressionText(int(share.Method)),
+			share.Files,
+			fmt.Sprintf("%.1f%%", share.Share*100),
+			knoxite.SizeToString(share.Size),
+			knoxite.SizeToString(share.StorageSize)})
+	}
+
+	_ = tab.Print()
+	return nil
+}
+
+func executeSnapshotRepair(snapshotID string) error {
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	_, snapshot, err := repository.FindSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	repaired, err := snapshot.RepairParityGroups(repository)
+	for _, hash := range repaired {
+		fmt.Println("Repaired chunk", hash)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Repaired %d chunks of snapshot %s\n", len(repaired), snapshot.ID)
+	return nil
+}
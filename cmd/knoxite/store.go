@@ -10,6 +10,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"time"
@@ -32,11 +33,41 @@ var (
 // StoreOptions holds all the options that can be set for the 'store' command.
 type StoreOptions struct {
 	Description      string
+	DescTemplate     string
+	Tags             map[string]string
 	Compression      string
 	Encryption       string
 	FailureTolerance uint
+	ParityGroupSize  uint
+	PackSize         uint
 	Excludes         []string
+	ExcludeCaches    bool
+	OneFileSystem    bool
+	FollowSymlinks   bool
+	MaxFileSize      uint64
+	MinFileSize      uint64
+	OlderThan        time.Duration
+	NewerThan        time.Duration
 	Pedantic         bool
+	SkipUnchanged    bool
+	SpecialFiles     string
+	OverlappingPaths string
+	ExcludeMarker    string
+	NoDedup          bool
+	WindowsAttrs     bool
+	Capabilities     bool
+	ACLs             bool
+	CompressionDict  string
+	CompressMinSize  uint
+	StableChunks     bool
+	LZMAPreset       int
+	LZMADictSize     uint
+	NormalizePaths   string
+	CaseInsensitive  bool
+	AbsolutePaths    bool
+	MaxArchives      int
+	ImmutableFor     time.Duration
+	DedupWindow      int
 }
 
 var (
@@ -86,11 +117,41 @@ func configureStoreOpts(cmd *cobra.Command, opts *StoreOptions) {
 
 func initStoreFlags(f func() *pflag.FlagSet, opts *StoreOptions) {
 	f().StringVarP(&opts.Description, "desc", "d", "", "a description or comment for this volume")
+	f().StringVar(&opts.DescTemplate, "desc-template", "", "a description with the variables {host}, {date}, {time}, {id} and {paths} expanded")
+	f().StringToStringVar(&opts.Tags, "tag", nil, "tag the snapshot, e.g. host=$HOSTNAME, to group snapshots by")
 	f().StringVarP(&opts.Compression, "compression", "c", "", "compression algo to use: none (default), flate, gzip, lzma, zlib, zstd")
 	f().StringVarP(&opts.Encryption, "encryption", "e", "", "encryption algo to use: aes (default), none")
 	f().UintVarP(&opts.FailureTolerance, "tolerance", "t", 0, "failure tolerance against n backend failures")
+	f().UintVar(&opts.ParityGroupSize, "parity-group-size", 0, "let up to n small chunks share their parity parts, to save overhead")
+	f().UintVar(&opts.PackSize, "pack-size", 0, "store chunks without parity parts in pack objects of up to this amount of bytes")
 	f().StringArrayVarP(&opts.Excludes, "excludes", "x", []string{}, "list of excludes")
+	f().BoolVar(&opts.ExcludeCaches, "exclude-caches", false, "skip directories containing a CACHEDIR.TAG file")
+	f().BoolVar(&opts.OneFileSystem, "one-file-system", false, "don't descend into directories on other file systems")
+	f().StringVar(&opts.ExcludeMarker, "exclude-marker", "", "skip files & directories with this extended attribute, e.g. user.backup.excluded")
+	f().BoolVar(&opts.FollowSymlinks, "follow-symlinks", false, "store what symlinks point to instead of the symlinks")
+	f().Uint64Var(&opts.MaxFileSize, "max-file-size", 0, "skip files larger than this amount of bytes")
+	f().Uint64Var(&opts.MinFileSize, "min-file-size", 0, "skip files smaller than this amount of bytes")
+	f().DurationVar(&opts.OlderThan, "exclude-older-than", 0, "skip files last modified longer ago than this, e.g. 720h")
+	f().DurationVar(&opts.NewerThan, "exclude-newer-than", 0, "skip files modified more recently than this, e.g. 1h")
 	f().BoolVar(&opts.Pedantic, "pedantic", false, "exit on first error")
+	f().StringVar(&opts.SpecialFiles, "special-files", "", "how to handle FIFOs, sockets & devices: skip (default), metadata, error")
+	f().StringVar(&opts.OverlappingPaths, "overlapping-paths", "", "how to handle paths given more than once or contained in another: collapse (default), error")
+	f().BoolVar(&opts.SkipUnchanged, "skip-unchanged", false, "don't create a new snapshot if nothing changed since the volume's latest snapshot")
+	f().BoolVar(&opts.NoDedup, "no-dedup", false, "don't share chunks with other snapshots, trading space for privacy")
+	f().BoolVar(&opts.WindowsAttrs, "windows-attrs", false, "record readonly, hidden & system attributes on Windows")
+	f().BoolVar(&opts.Capabilities, "capabilities", false, "record file capabilities on Linux")
+	f().BoolVar(&opts.ACLs, "acls", false, "record access & default ACLs on Linux")
+	f().StringVar(&opts.CompressionDict, "compression-dict", "", "trained zstd dictionary to compress small files with")
+	f().UintVar(&opts.CompressMinSize, "compress-min-chunk-size", 0, "store chunks smaller than n bytes uncompressed")
+	f().BoolVar(&opts.StableChunks, "stable-chunk-boundaries", false, "aim for chunks of half the maximum chunk size, so edits to files change fewer chunks")
+	f().IntVar(&opts.LZMAPreset, "lzma-preset", 0, "lzma preset from 1 (fastest) to 9 (best compression)")
+	f().UintVar(&opts.LZMADictSize, "lzma-dict-size", 0, "size of the lzma dictionary in bytes, overriding the preset's")
+	f().StringVar(&opts.NormalizePaths, "normalize-paths", "", "unicode normalization of stored paths: none (default), nfc, nfd")
+	f().BoolVar(&opts.CaseInsensitive, "case-insensitive-paths", false, "report paths only differing by case as collisions")
+	f().BoolVar(&opts.AbsolutePaths, "absolute-paths", false, "store full paths, so the snapshot can be restored to the original locations")
+	f().IntVar(&opts.MaxArchives, "max-archives-in-memory", 0, "store the snapshot's file metadata in segments of this size, to bound memory use")
+	f().DurationVar(&opts.ImmutableFor, "immutable-for", 0, "protect the snapshot from being removed for this duration")
+	f().IntVar(&opts.DedupWindow, "dedup-window", 0, "only deduplicate against the n most recently stored chunks, to bound memory use")
 }
 
 func init() {
@@ -98,7 +159,7 @@ func init() {
 	RootCmd.AddCommand(storeCmd)
 }
 
-func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snapshot *knoxite.Snapshot, targets []string, opts StoreOptions) error {
+func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snapshot *knoxite.Snapshot, parent *knoxite.Snapshot, targets []string, opts StoreOptions) error {
 	// we want to be notified during the first phase of a shutdown
 	cancel := shutdown.First()
 
@@ -118,6 +179,18 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 	if err != nil {
 		return err
 	}
+	specialFiles, err := utils.SpecialFilesPolicyFromString(opts.SpecialFiles)
+	if err != nil {
+		return err
+	}
+	overlappingPaths, err := utils.OverlappingPathsPolicyFromString(opts.OverlappingPaths)
+	if err != nil {
+		return err
+	}
+	normalizePaths, err := utils.PathNormalizationFromString(opts.NormalizePaths)
+	if err != nil {
+		return err
+	}
 
 	so := knoxite.StoreOptions{
 		CWD:         wd,
@@ -128,6 +201,65 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 		Pedantic:    opts.Pedantic,
 		DataParts:   uint(len(repository.BackendManager().Backends) - int(opts.FailureTolerance)),
 		ParityParts: opts.FailureTolerance,
+
+		ParityGroupSize:  opts.ParityGroupSize,
+		PackSize:         opts.PackSize,
+		SpecialFiles:     specialFiles,
+		OverlappingPaths: overlappingPaths,
+		ExcludeCaches:    opts.ExcludeCaches,
+		OneFileSystem:    opts.OneFileSystem,
+		ExcludeMarker:    opts.ExcludeMarker,
+		FollowSymlinks:   opts.FollowSymlinks,
+		MaxFileSize:      opts.MaxFileSize,
+		MinFileSize:      opts.MinFileSize,
+		NoDedup:          opts.NoDedup,
+
+		CompressMinChunkSize:  opts.CompressMinSize,
+		StableChunkBoundaries: opts.StableChunks,
+
+		PreserveWindowsAttrs: opts.WindowsAttrs,
+		PreserveCapabilities: opts.Capabilities,
+		PreserveACLs:         opts.ACLs,
+		NormalizePaths:       normalizePaths,
+		CaseInsensitivePaths: opts.CaseInsensitive,
+		AbsolutePaths:        opts.AbsolutePaths,
+		MaxArchivesInMemory:  opts.MaxArchives,
+		ImmutableFor:         opts.ImmutableFor,
+		DescriptionTemplate:  opts.DescTemplate,
+		DedupWindow:          opts.DedupWindow,
+
+		LZMA: knoxite.LZMAOptions{
+			Preset:   opts.LZMAPreset,
+			DictSize: opts.LZMADictSize,
+		},
+	}
+	// algos given on the command line or in the config win over the
+	// repository's defaults, even if they disable compression or encryption
+	if opts.Compression != "" {
+		so.Explicit |= knoxite.ExplicitCompress
+	}
+	if opts.Encryption != "" {
+		so.Explicit |= knoxite.ExplicitEncrypt
+	}
+	if opts.CompressionDict != "" {
+		dict, err := ioutil.ReadFile(opts.CompressionDict)
+		if err != nil {
+			return err
+		}
+		so.CompressionDict, err = repository.AddCompressionDict(dict)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.OlderThan > 0 {
+		so.ExcludeOlderThan = time.Now().Add(-opts.OlderThan)
+	}
+	if opts.NewerThan > 0 {
+		so.ExcludeNewerThan = time.Now().Add(-opts.NewerThan)
+	}
+	if parent != nil {
+		so.Parent = parent
+		so.SkipUnchanged = opts.SkipUnchanged
 	}
 
 	startTime := time.Now()
@@ -150,6 +282,7 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 
 	items := int64(1)
 	errs := make(map[string]error)
+	var warnings []error
 	for p := range progress {
 		select {
 		case n := <-cancel:
@@ -166,6 +299,9 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 				errs[p.Path] = p.Error
 				snapshot.Stats.Errors++
 			}
+			if p.Warning != nil {
+				warnings = append(warnings, p.Warning)
+			}
 			if p.Path != lastPath && lastPath != "" {
 				items++
 				fmt.Println()
@@ -193,10 +329,20 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 		}
 	}
 
+	if snapshot.Unchanged() {
+		fmt.Printf("\nNo changes since snapshot %s, skipping\n", parent.ID)
+		return nil
+	}
 	fmt.Printf("\nSnapshot %s created: %s\n", snapshot.ID, snapshot.Stats.String())
+	if snapshot.Partial {
+		fmt.Println("Some files could not be stored, the snapshot is partial")
+	}
 	for file, err := range errs {
 		fmt.Printf("'%s': failed to store: %v\n", file, err)
 	}
+	for _, w := range warnings {
+		fmt.Println(w)
+	}
 	return nil
 }
 
@@ -222,21 +368,32 @@ func executeStore(volumeID string, args []string, opts StoreOptions) error {
 	if err != nil {
 		return err
 	}
-	snapshot, err := knoxite.NewSnapshot(opts.Description)
+	snapshot, err := repository.NewSnapshot(opts.Description)
 	if err != nil {
 		return err
 	}
-	chunkIndex, err := knoxite.OpenChunkIndex(&repository)
-	if err != nil {
-		return err
+	for key, value := range opts.Tags {
+		snapshot.SetTag(key, value)
+	}
+	// only load the index once the first file gets stored
+	chunkIndex := knoxite.OpenChunkIndexLazy(&repository)
+	var parent *knoxite.Snapshot
+	if opts.SkipUnchanged && len(volume.Snapshots) > 0 {
+		parent, err = volume.LoadSnapshot(volume.Snapshots[len(volume.Snapshots)-1], &repository)
+		if err != nil {
+			return err
+		}
 	}
 	// release the shutdown lock
 	lock()
 
-	err = store(&repository, &chunkIndex, snapshot, targets, opts)
+	err = store(&repository, &chunkIndex, snapshot, parent, targets, opts)
 	if err != nil {
 		return err
 	}
+	if snapshot.Unchanged() {
+		return nil
+	}
 
 	// acquire another shutdown lock. we don't want these next calls to be interrupted
 	lock = shutdown.Lock()
@@ -257,5 +414,13 @@ func executeStore(volumeID string, args []string, opts StoreOptions) error {
 	if err != nil {
 		return err
 	}
-	return repository.Save()
+	err = repository.Save()
+	if err != nil {
+		return err
+	}
+
+	bw := repository.BandwidthStats()
+	logger.Infof("Sent %s to and received %s from the storage backends in %d requests",
+		knoxite.SizeToString(bw.Sent), knoxite.SizeToString(bw.Received), bw.Requests)
+	return nil
 }
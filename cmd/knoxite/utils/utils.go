@@ -24,9 +24,14 @@ import (
 )
 
 var (
-	ErrPasswordMismatch   = errors.New("Passwords did not match")
-	ErrEncryptionUnknown  = errors.New("unknown encryption format")
-	ErrCompressionUnknown = errors.New("unknown compression format")
+	ErrPasswordMismatch      = errors.New("Passwords did not match")
+	ErrEncryptionUnknown     = errors.New("unknown encryption format")
+	ErrCompressionUnknown    = errors.New("unknown compression format")
+	ErrSpecialFilesUnknown   = errors.New("unknown special files policy")
+	ErrOverlappingUnknown    = errors.New("unknown overlapping paths policy")
+	ErrPreserveTimesUnknown  = errors.New("unknown time preservation policy")
+	ErrNormalizationUnknown  = errors.New("unknown path normalization form")
+	ErrPasswordPolicyUnknown = errors.New("unknown weak password policy")
 )
 
 func ReadPassword(prompt string) (string, error) {
@@ -145,11 +150,96 @@ func EncryptionText(enum int) string {
 		return "none"
 	case knoxite.EncryptionAES:
 		return "AES"
+	case knoxite.EncryptionExternal:
+		return "external"
 	}
 
 	return "unknown"
 }
 
+// SpecialFilesPolicyFromString returns the special files policy from a user-specified string.
+func SpecialFilesPolicyFromString(s string) (uint16, error) {
+	switch strings.ToLower(s) {
+	case "":
+		// default is skip
+		fallthrough
+	case "skip":
+		return knoxite.SpecialFilesSkip, nil
+	case "metadata":
+		return knoxite.SpecialFilesStoreMetadata, nil
+	case "error":
+		return knoxite.SpecialFilesError, nil
+	}
+
+	return 0, ErrSpecialFilesUnknown
+}
+
+// OverlappingPathsPolicyFromString returns the overlapping paths policy from a user-specified string.
+func OverlappingPathsPolicyFromString(s string) (uint16, error) {
+	switch strings.ToLower(s) {
+	case "":
+		// default is collapse
+		fallthrough
+	case "collapse":
+		return knoxite.OverlappingPathsCollapse, nil
+	case "error":
+		return knoxite.OverlappingPathsError, nil
+	}
+
+	return 0, ErrOverlappingUnknown
+}
+
+// PreserveTimesPolicyFromString returns the time preservation policy from a user-specified string.
+func PreserveTimesPolicyFromString(s string) (uint16, error) {
+	switch strings.ToLower(s) {
+	case "":
+		// default is all
+		fallthrough
+	case "all":
+		return knoxite.PreserveTimesAll, nil
+	case "mtime":
+		return knoxite.PreserveTimesModTime, nil
+	case "none":
+		return knoxite.PreserveTimesNone, nil
+	}
+
+	return 0, ErrPreserveTimesUnknown
+}
+
+// PathNormalizationFromString returns the path normalization form from a user-specified string.
+func PathNormalizationFromString(s string) (uint16, error) {
+	switch strings.ToLower(s) {
+	case "":
+		// default is none
+		fallthrough
+	case "none":
+		return knoxite.PathNormalizationNone, nil
+	case "nfc":
+		return knoxite.PathNormalizationNFC, nil
+	case "nfd":
+		return knoxite.PathNormalizationNFD, nil
+	}
+
+	return 0, ErrNormalizationUnknown
+}
+
+// PasswordPolicyFromString returns the weak password policy from a user-specified string.
+func PasswordPolicyFromString(s string) (uint16, error) {
+	switch strings.ToLower(s) {
+	case "":
+		// default is warn
+		fallthrough
+	case "warn":
+		return knoxite.PasswordWarnWeak, nil
+	case "reject":
+		return knoxite.PasswordRejectWeak, nil
+	case "allow":
+		return knoxite.PasswordAllowWeak, nil
+	}
+
+	return 0, ErrPasswordPolicyUnknown
+}
+
 func isUrl(str string) bool {
 	if _, err := url.Parse(str); err != nil {
 		return false
@@ -19,6 +19,8 @@ import (
 
 type VerifyOptions struct {
 	Percentage int
+	Restore    bool
+	Sizes      bool
 }
 
 var (
@@ -42,6 +44,8 @@ var (
 
 func initVerifyFlags(f func() *pflag.FlagSet) {
 	f().IntVar(&verifyOpts.Percentage, "percentage", 25, "How many archives to be checked between 0 and 100")
+	f().BoolVar(&verifyOpts.Restore, "restore", false, "Restore all files of a snapshot without writing them, verifying their content")
+	f().BoolVar(&verifyOpts.Sizes, "sizes", false, "Only compare the sizes of all stored chunks with the chunk-index, without downloading them")
 }
 
 func init() {
@@ -55,6 +59,10 @@ func executeVerifyRepo(opts VerifyOptions) error {
 		return err
 	}
 
+	if opts.Sizes {
+		return verifySizes(repository)
+	}
+
 	progress, err := knoxite.VerifyRepo(repository, opts.Percentage)
 	if err != nil {
 		return err
@@ -91,6 +99,10 @@ func executeVerifySnapshot(snapshotId string, opts VerifyOptions) error {
 		return err
 	}
 
+	if opts.Restore {
+		return verifyRestore(repository, snapshotId)
+	}
+
 	progress, err := knoxite.VerifySnapshot(repository, snapshotId, opts.Percentage)
 	if err != nil {
 		return err
@@ -103,6 +115,50 @@ func executeVerifySnapshot(snapshotId string, opts VerifyOptions) error {
 	return nil
 }
 
+func verifyRestore(repository knoxite.Repository, snapshotId string) error {
+	_, snapshot, err := repository.FindSnapshot(snapshotId)
+	if err != nil {
+		return err
+	}
+
+	files, err := knoxite.VerifyRestore(repository, snapshot)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, f := range files {
+		if f.Err != nil {
+			fmt.Printf("%s: %v\n", f.Path, f.Err)
+			failed++
+		}
+	}
+
+	fmt.Printf("Verify restore done: %d of %d files failed\n", failed, len(files))
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed to restore", failed, len(files))
+	}
+	return nil
+}
+
+func verifySizes(repository knoxite.Repository) error {
+	index, err := knoxite.OpenChunkIndex(&repository)
+	if err != nil {
+		return err
+	}
+
+	mismatches, err := knoxite.VerifyChunkSizes(repository, &index)
+	if err != nil {
+		return err
+	}
+	for _, m := range mismatches {
+		fmt.Println(m)
+	}
+
+	fmt.Printf("Verify chunk sizes done: %d chunk parts of %d chunks mismatched\n", len(mismatches), len(index.Chunks))
+	return nil
+}
+
 func verify(progress chan knoxite.Progress) []error {
 	var errors []error
 
@@ -120,12 +120,28 @@ func executeVolumeRemove(volumeID string) error {
 		return err
 	}
 
+	snapshots := []*knoxite.Snapshot{}
 	for _, s := range vol.Snapshots {
-		if err := vol.RemoveSnapshot(s); err != nil {
+		snapshot, err := vol.LoadSnapshot(s, &repo)
+		if err != nil {
 			return err
 		}
+		if snapshot.Pinned {
+			return fmt.Errorf("snapshot %s: %v", snapshot.ID, knoxite.ErrPinnedSnapshot)
+		}
+		if snapshot.Immutable() {
+			return fmt.Errorf("snapshot %s: %v", snapshot.ID, knoxite.ErrImmutableSnapshot)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
 
-		chunkIndex.RemoveSnapshot(s)
+	for _, snapshot := range snapshots {
+		if err := vol.RemoveSnapshot(snapshot.ID); err != nil {
+			return err
+		}
+		if err := chunkIndex.ReleaseSnapshot(snapshot); err != nil {
+			return err
+		}
 	}
 
 	if err := repo.RemoveVolume(vol); err != nil {
@@ -99,7 +99,8 @@ func download(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Method == "GET" {
+	// HEAD requests let clients stat chunks without downloading them
+	if r.Method == "GET" || r.Method == "HEAD" {
 		http.ServeFile(w, r, filepath.Join(path, "chunks", r.URL.Path[10:]))
 	}
 }
@@ -12,12 +12,14 @@ import (
 	"compress/flate"
 	"compress/gzip"
 	"compress/zlib"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
 )
 
 // Available compression algos.
@@ -30,9 +32,71 @@ const (
 	CompressionZstd
 )
 
+// Error declarations.
+var (
+	ErrInvalidLZMAPreset = errors.New("LZMA preset must be between 1 and 9")
+)
+
+// lzmaPresets are the dictionary sizes of the LZMA presets 1 to 9. Preset 6
+// matches the default.
+var lzmaPresets = []uint{
+	256 << 10,
+	512 << 10,
+	1 << 20,
+	2 << 20,
+	4 << 20,
+	8 << 20,
+	16 << 20,
+	32 << 20,
+	64 << 20,
+}
+
+// LZMAOptions tunes the LZMA compression. The dictionary size gets recorded
+// in the header of every compressed chunk, so chunks decompress no matter
+// which options they got compressed with.
+type LZMAOptions struct {
+	// Preset trades memory for better compression ratios, from 1 (least
+	// memory) to 9 (best compression), like the presets of xz. Zero keeps
+	// the default of an 8 MiB dictionary
+	Preset int
+	// DictSize is the size of the dictionary in bytes, overriding the one of
+	// the preset. Compressing & decompressing a chunk needs about as much
+	// memory. Once tuned, it never exceeds the size of the chunk
+	DictSize uint
+}
+
+// writerConfig returns the xz writer configuration compressing size bytes.
+func (o LZMAOptions) writerConfig(size int) (xz.WriterConfig, error) {
+	var c xz.WriterConfig
+	if o.Preset < 0 || o.Preset > len(lzmaPresets) {
+		return c, ErrInvalidLZMAPreset
+	}
+	if o == (LZMAOptions{}) {
+		// compress exactly like earlier versions, so chunks still dedupe
+		return c, nil
+	}
+
+	dictSize := o.DictSize
+	if dictSize == 0 && o.Preset > 0 {
+		dictSize = lzmaPresets[o.Preset-1]
+	}
+	if dictSize == 0 || dictSize > uint(size) {
+		// a larger dictionary only wastes memory
+		dictSize = uint(size)
+	}
+	if dictSize < lzma.MinDictCap {
+		dictSize = lzma.MinDictCap
+	}
+	c.DictCap = int(dictSize)
+
+	return c, nil
+}
+
 // Compressor is a pipeline processor that compresses data.
 type Compressor struct {
 	Method uint16
+	Dict   []byte      // Zstd dictionary, ignored by other methods
+	LZMA   LZMAOptions // ignored by other methods
 }
 
 // Process compresses the data.
@@ -49,11 +113,21 @@ func (c Compressor) Process(data []byte) ([]byte, error) {
 	case CompressionGZip:
 		w = gzip.NewWriter(&buf)
 	case CompressionLZMA:
-		w, err = xz.NewWriter(&buf)
+		var cfg xz.WriterConfig
+		cfg, err = c.LZMA.writerConfig(len(data))
+		if err == nil {
+			w, err = cfg.NewWriter(&buf)
+		}
 	case CompressionZlib:
 		w = zlib.NewWriter(&buf)
 	case CompressionZstd:
-		w, err = zstd.NewWriter(&buf)
+		if c.Dict != nil {
+			// the default level doesn't make use of dictionaries
+			w, err = zstd.NewWriter(&buf, zstd.WithEncoderDict(c.Dict),
+				zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+		} else {
+			w, err = zstd.NewWriter(&buf)
+		}
 	}
 	if err != nil {
 		return []byte{}, err
@@ -77,50 +151,52 @@ func (c Compressor) Process(data []byte) ([]byte, error) {
 // Decompressor is a pipeline processor that decompresses data.
 type Decompressor struct {
 	Method uint16
+	Dicts  [][]byte // Zstd dictionaries the data may have been compressed with
 }
 
 // Process decompresses the data.
 func (c Decompressor) Process(data []byte) ([]byte, error) {
-	var zr io.ReadCloser
-	var err error
-
-	switch c.Method {
-	case CompressionNone:
+	if c.Method == CompressionNone {
 		return data, nil
+	}
+
+	zr, err := c.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
 
+	return ioutil.ReadAll(zr)
+}
+
+// NewReader returns a reader that decompresses the data read from r.
+func (c Decompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	switch c.Method {
 	case CompressionFlate:
-		zr = flate.NewReader(bytes.NewReader(data))
+		return flate.NewReader(r), nil
 
 	case CompressionGZip:
-		zr, err = gzip.NewReader(bytes.NewReader(data))
-		if err != nil {
-			return nil, err
-		}
+		return gzip.NewReader(r)
 
 	case CompressionLZMA:
-		zri, err := xz.NewReader(bytes.NewReader(data))
+		zr, err := xz.NewReader(r)
 		if err != nil {
 			return nil, err
 		}
 
-		zr = ioutil.NopCloser(zri)
+		return ioutil.NopCloser(zr), nil
 
 	case CompressionZlib:
-		zr, err = zlib.NewReader(bytes.NewReader(data))
-		if err != nil {
-			return nil, err
-		}
+		return zlib.NewReader(r)
 
 	case CompressionZstd:
-		zri, err := zstd.NewReader(bytes.NewReader(data))
+		zr, err := zstd.NewReader(r, zstd.WithDecoderDicts(c.Dicts...))
 		if err != nil {
 			return nil, err
 		}
 
-		zr = ioutil.NopCloser(zri)
+		return zr.IOReadCloser(), nil
 	}
 
-	defer zr.Close()
-
-	return ioutil.ReadAll(zr)
+	return ioutil.NopCloser(r), nil
 }
@@ -0,0 +1,73 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// chunks smaller than this get compressed with the dictionary
+	compressionDictMaxChunkSize = 128 * 1024
+
+	zstdDictMagic = 0xEC30A437
+)
+
+// Error declarations.
+var (
+	ErrInvalidCompressionDict  = errors.New("Not a Zstd dictionary")
+	ErrCompressionDictNotFound = errors.New("Compression dictionary not found in repository")
+	ErrCompressionDictConflict = errors.New("A different compression dictionary with the same ID already exists")
+)
+
+// compressionDictID returns the ID of the Zstd dictionary dict.
+func compressionDictID(dict []byte) (uint32, error) {
+	if len(dict) < 8 || binary.LittleEndian.Uint32(dict) != zstdDictMagic {
+		return 0, ErrInvalidCompressionDict
+	}
+
+	id := binary.LittleEndian.Uint32(dict[4:])
+	if id == 0 {
+		return 0, ErrInvalidCompressionDict
+	}
+	return id, nil
+}
+
+// AddCompressionDict adds a trained Zstd dictionary, as created by
+// 'zstd --train', to the repository and returns its ID. Restores need it to
+// decompress the chunks it was used for, so it can't be removed again.
+func (r *Repository) AddCompressionDict(dict []byte) (uint32, error) {
+	id, err := compressionDictID(dict)
+	if err != nil {
+		return 0, err
+	}
+
+	d, err := r.compressionDict(id)
+	if err == nil {
+		if !bytes.Equal(d, dict) {
+			return 0, ErrCompressionDictConflict
+		}
+		return id, nil
+	}
+
+	r.CompressionDicts = append(r.CompressionDicts, dict)
+	return id, nil
+}
+
+// compressionDict returns the Zstd dictionary with the given id.
+func (r *Repository) compressionDict(id uint32) ([]byte, error) {
+	for _, dict := range r.CompressionDicts {
+		if did, err := compressionDictID(dict); err == nil && did == id {
+			return dict, nil
+		}
+	}
+
+	return nil, ErrCompressionDictNotFound
+}
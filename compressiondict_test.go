@@ -0,0 +1,128 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// similarJSON returns a small JSON document resembling the samples the
+// dictionary in testdata/zstd.dict was trained with.
+func similarJSON(i int) []byte {
+	n := strconv.Itoa(i)
+	return []byte(`{
+  "id": ` + n + `,
+  "name": "user-` + n + `",
+  "email": "user-` + n + `@example.com",
+  "active": ` + strconv.FormatBool(i%3 != 0) + `,
+  "roles": [
+    "reader"
+  ],
+  "created": "2020-05-` + strconv.Itoa(i%28+10) + `T12:00:00Z",
+  "settings": {
+    "theme": "light",
+    "language": "en",
+    "notifications": {
+      "email": true,
+      "push": ` + strconv.FormatBool(i%5 == 0) + `
+    }
+  }
+}`)
+}
+
+func TestSnapshotCompressionDict(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	dict, err := ioutil.ReadFile(filepath.Join("testdata", "zstd.dict"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	for i := 1000; i < 1200; i++ {
+		if err := ioutil.WriteFile(filepath.Join(src, strconv.Itoa(i)+".json"), similarJSON(i), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, _ := NewRepository(filepath.Join(dir, "repo"), testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	if _, err := r.AddCompressionDict([]byte("not a dictionary")); err != ErrInvalidCompressionDict {
+		t.Errorf("Expected %v, got %v", ErrInvalidCompressionDict, err)
+	}
+	id, err := r.AddCompressionDict(dict)
+	if err != nil {
+		t.Fatalf("Failed adding compression dictionary: %s", err)
+	}
+	if err := r.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := StoreOptions{
+		CWD:         wd,
+		Paths:       []string{src},
+		Compress:    CompressionZstd,
+		Encrypt:     EncryptionAES,
+		DataParts:   1,
+		ParityParts: 0,
+	}
+	plain := storeSnapshot(t, &r, &index, opts)
+	opts.CompressionDict = id
+	compact := storeSnapshot(t, &r, &index, opts)
+
+	if compact.Stats.StorageSize*2 > plain.Stats.StorageSize {
+		t.Errorf("Expected dictionary to at least halve the stored size of %d bytes, got %d bytes",
+			plain.Stats.StorageSize, compact.Stats.StorageSize)
+	}
+
+	// restores need the dictionary stored in the repository
+	r, err = OpenRepository(filepath.Join(dir, "repo"), testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	if errs := restoreSnapshot(t, r, compact, dst, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+	for i := 1000; i < 1200; i++ {
+		b, err := ioutil.ReadFile(filepath.Join(dst, src, strconv.Itoa(i)+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, similarJSON(i)) {
+			t.Errorf("Restored content of %d.json differs", i)
+		}
+	}
+
+	opts.CompressionDict = id + 1
+	snapshot, _ := NewSnapshot("test_snapshot")
+	var found bool
+	for p := range snapshot.Add(r, &index, opts) {
+		if p.Error == ErrCompressionDictNotFound {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected %v for an unknown dictionary", ErrCompressionDictNotFound)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	defaultCompressionSampleSize = 16 * (1 << 20) // 16 MiB
+	minCompressionSampleSize     = 16 * 1024      // read at least this much from a sampled file
+	maxCompressionSampleSize     = 256 * 1024     // read at most this much from a sampled file
+)
+
+// CompressionMethods lists all available compression algos.
+var CompressionMethods = []uint16{
+	CompressionNone,
+	CompressionGZip,
+	CompressionLZMA,
+	CompressionFlate,
+	CompressionZlib,
+	CompressionZstd,
+}
+
+// CompressionEstimate holds the results of compressing a sample of files
+// with one compression algo, extrapolated to all files.
+type CompressionEstimate struct {
+	Method         uint16
+	SampleSize     uint64        // size of the sample
+	CompressedSize uint64        // size of the compressed sample
+	Duration       time.Duration // time spent compressing the sample
+
+	// estimates for all files
+	EstimatedSize     uint64
+	EstimatedDuration time.Duration
+}
+
+// Ratio returns the compressed size relative to the original size.
+func (e CompressionEstimate) Ratio() float64 {
+	if e.SampleSize == 0 {
+		return 1
+	}
+	return float64(e.CompressedSize) / float64(e.SampleSize)
+}
+
+// EstimateCompression compresses a sample of the files in the paths of opts
+// with every available compression algo and returns the estimated storage
+// size and compression time for all files, best ratio first. Up to
+// sampleSize bytes get read, spread across the files. Zero reads 16 MiB.
+func EstimateCompression(opts StoreOptions, sampleSize uint64) ([]CompressionEstimate, error) {
+	if sampleSize == 0 {
+		sampleSize = defaultCompressionSampleSize
+	}
+
+	var files []*Archive
+	var total uint64
+	snapshot := Snapshot{}
+	paths, _ := collapsePaths(opts.Paths)
+	for result := range snapshot.gatherTargetInformation(opts.CWD, paths, opts) {
+		if result.Error != nil || result.Archive.Type != File || result.Archive.Size == 0 {
+			continue
+		}
+		if snapshot.excludeFile(result.Archive, opts) != nil {
+			continue
+		}
+		files = append(files, result.Archive)
+		total += result.Archive.Size
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	samples := sampleFiles(files, sampleSize)
+	var estimates []CompressionEstimate
+	for _, method := range CompressionMethods {
+		e := CompressionEstimate{Method: method}
+		c := Compressor{Method: method}
+		for _, sample := range samples {
+			start := time.Now()
+			b, err := c.Process(sample)
+			if err != nil {
+				return nil, err
+			}
+			e.Duration += time.Since(start)
+			e.SampleSize += uint64(len(sample))
+			e.CompressedSize += uint64(len(b))
+		}
+
+		if e.SampleSize > 0 {
+			scale := float64(total) / float64(e.SampleSize)
+			e.EstimatedSize = uint64(float64(e.CompressedSize) * scale)
+			e.EstimatedDuration = time.Duration(float64(e.Duration) * scale)
+		}
+		estimates = append(estimates, e)
+	}
+
+	sort.SliceStable(estimates, func(i, j int) bool {
+		if estimates[i].CompressedSize != estimates[j].CompressedSize {
+			return estimates[i].CompressedSize < estimates[j].CompressedSize
+		}
+		return estimates[i].Duration < estimates[j].Duration
+	})
+	return estimates, nil
+}
+
+// sampleFiles reads up to size bytes from files, taking the beginning of
+// files spread evenly across the list.
+func sampleFiles(files []*Archive, size uint64) [][]byte {
+	if len(files) == 0 {
+		return nil
+	}
+
+	perFile := size / uint64(len(files))
+	if perFile < minCompressionSampleSize {
+		perFile = minCompressionSampleSize
+	}
+	if perFile > maxCompressionSampleSize {
+		perFile = maxCompressionSampleSize
+	}
+	step := 1
+	if n := int(size / perFile); n > 0 && len(files) > n {
+		step = len(files) / n
+	}
+
+	var samples [][]byte
+	var sampled uint64
+	for i := 0; i < len(files) && sampled < size; i += step {
+		n := files[i].Size
+		if n > perFile {
+			n = perFile
+		}
+		if n > size-sampled {
+			n = size - sampled
+		}
+
+		b, err := readSample(files[i].Path, n)
+		if err != nil {
+			// the file may have been deleted or be inaccessible
+			continue
+		}
+		samples = append(samples, b)
+		sampled += uint64(len(b))
+	}
+
+	return samples
+}
+
+// readSample returns the first n bytes of the file at path.
+func readSample(path string, n uint64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := make([]byte, n)
+	m, err := io.ReadFull(f, b)
+	if err == io.ErrUnexpectedEOF {
+		// the file shrunk since it got scanned
+		err = nil
+	}
+	return b[:m], err
+}
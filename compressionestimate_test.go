@@ -0,0 +1,80 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestEstimateCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	random := filepath.Join(dir, "random")
+	text := filepath.Join(dir, "text")
+	_ = os.Mkdir(random, 0755)
+	_ = os.Mkdir(text, 0755)
+	for i := 0; i < 20; i++ {
+		b := make([]byte, 64*1024)
+		_, _ = rand.Read(b)
+		if err := ioutil.WriteFile(filepath.Join(random, strconv.Itoa(i)), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		b = bytes.Repeat([]byte("knoxite is a secure data storage & backup tool "+strconv.Itoa(i)+"\n"), 1000)
+		if err := ioutil.WriteFile(filepath.Join(text, strconv.Itoa(i)), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, _ := os.Getwd()
+
+	// incompressible data is best stored uncompressed
+	estimates, err := EstimateCompression(StoreOptions{CWD: wd, Paths: []string{random}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(estimates) != len(CompressionMethods) {
+		t.Fatalf("Expected %d estimates, got %d", len(CompressionMethods), len(estimates))
+	}
+	if estimates[0].Method != CompressionNone {
+		t.Errorf("Expected no compression to be recommended for random data, got %d", estimates[0].Method)
+	}
+	if estimates[0].EstimatedSize != 20*64*1024 {
+		t.Errorf("Expected estimated size of %d, got %d", 20*64*1024, estimates[0].EstimatedSize)
+	}
+
+	// only a sample gets read, the estimate covers all files
+	estimates, err = EstimateCompression(StoreOptions{CWD: wd, Paths: []string{random, text}}, 256*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range estimates {
+		if e.SampleSize > 256*1024 {
+			t.Errorf("Expected a sample of at most %d bytes, got %d", 256*1024, e.SampleSize)
+		}
+		if i > 0 && e.CompressedSize < estimates[i-1].CompressedSize {
+			t.Errorf("Expected estimates to be sorted by size")
+		}
+	}
+	if estimates[0].Method == CompressionNone || estimates[len(estimates)-1].Method != CompressionNone {
+		t.Errorf("Expected compression to be recommended for mixed data, got %v", estimates)
+	}
+	if estimates[0].Ratio() >= 1 {
+		t.Errorf("Expected a ratio below 1 for mixed data, got %f", estimates[0].Ratio())
+	}
+}
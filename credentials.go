@@ -0,0 +1,200 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// CredentialsEnvironment is implemented by backend factories whose provider
+// defines its own environment variables for credentials, e.g.
+// AWS_ACCESS_KEY_ID. They are consulted after KNOXITE_<SCHEME>_USERNAME and
+// KNOXITE_<SCHEME>_PASSWORD.
+type CredentialsEnvironment interface {
+	CredentialsEnv() (username, password string)
+}
+
+// CredentialsFactory is implemented by backend factories that connect with
+// credentials given separately from the URL. Credentials resolved from the
+// environment or a credentials file then never become part of the backend's
+// Location, which gets stored in the repository. Other factories only get
+// the credentials contained in the URL.
+type CredentialsFactory interface {
+	// NewBackendWithCredentials returns a backend for u, connecting with the
+	// credentials user instead of the user info of u
+	NewBackendWithCredentials(u url.URL, user *url.Userinfo) (Backend, error)
+}
+
+// resolveCredentials returns the username and password of u, filling in the
+// ones the URL doesn't contain. They are looked up in this order: the
+// environment variables KNOXITE_<SCHEME>_USERNAME and
+// KNOXITE_<SCHEME>_PASSWORD, the provider's own environment variables and
+// finally the credentials file.
+func resolveCredentials(u url.URL, factory BackendFactory, credentialsFile string) (*url.Userinfo, error) {
+	var username, password string
+	var hasPassword bool
+	if u.User != nil {
+		username = u.User.Username()
+		password, hasPassword = u.User.Password()
+	}
+
+	prefix := "KNOXITE_" + envName(u.Scheme) + "_"
+	sources := [][2]string{{prefix + "USERNAME", prefix + "PASSWORD"}}
+	if ce, ok := factory.(CredentialsEnvironment); ok {
+		user, pass := ce.CredentialsEnv()
+		sources = append(sources, [2]string{user, pass})
+	}
+	for _, env := range sources {
+		if username == "" && env[0] != "" {
+			username = os.Getenv(env[0])
+		}
+		if !hasPassword && env[1] != "" {
+			password, hasPassword = os.LookupEnv(env[1])
+		}
+	}
+
+	if (username == "" || !hasPassword) && credentialsFile != "" {
+		user, pass, ok, err := credentialsFromFile(credentialsFile, &u)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if username == "" {
+				username = user
+			}
+			if !hasPassword {
+				password, hasPassword = pass, true
+			}
+		}
+	}
+
+	switch {
+	case hasPassword:
+		return url.UserPassword(username, password), nil
+	case username != "":
+		return url.User(username), nil
+	}
+	return nil, nil
+}
+
+// credentialsFromFile looks up the credentials for u in the file at path.
+// Every line of it contains a URL of the form scheme://host, or just a
+// scheme matching all hosts, followed by the username and the password,
+// separated by whitespace. Empty lines and lines starting with # are
+// ignored. The most specific entry wins.
+func credentialsFromFile(path string, u *url.URL) (username, password string, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", false, err
+	}
+	defer f.Close()
+
+	host := u.Scheme + "://" + u.Host
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != host && fields[0] != u.Scheme) {
+			continue
+		}
+		if ok && fields[0] == u.Scheme {
+			// a host specific entry has already been found
+			continue
+		}
+
+		// passwords may contain whitespace
+		rest := strings.TrimSpace(line[len(fields[0]):])
+		username = fields[1]
+		password = strings.TrimSpace(rest[len(fields[1]):])
+		ok = true
+	}
+
+	return username, password, ok, scanner.Err()
+}
+
+// envName turns s into a valid environment variable name.
+func envName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// RedactURL returns rawurl with the password of its user info replaced, so
+// it can be logged or shown safely.
+func RedactURL(rawurl string) string {
+	scheme := strings.Index(rawurl, "://")
+	if scheme < 0 {
+		return rawurl
+	}
+
+	rest := rawurl[scheme+3:]
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+	at := strings.LastIndex(rest[:end], "@")
+	if at < 0 {
+		return rawurl
+	}
+	colon := strings.Index(rest[:at], ":")
+	if colon < 0 {
+		return rawurl
+	}
+
+	return rawurl[:scheme+3] + rest[:colon] + ":xxxxx" + rest[at:]
+}
+
+// redactedError hides secrets contained in the message of an error.
+type redactedError struct {
+	err     error
+	secrets []string
+}
+
+func (e *redactedError) Error() string {
+	s := e.err.Error()
+	for _, secret := range e.secrets {
+		s = strings.Replace(s, secret, "xxxxx", -1)
+	}
+	return s
+}
+
+// Unwrap returns the original error.
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError hides all occurrences of the password of user in err's
+// message, be it plain or URL-encoded.
+func redactError(err error, user *url.Userinfo) error {
+	if err == nil || user == nil {
+		return err
+	}
+	password, ok := user.Password()
+	if !ok || password == "" {
+		return err
+	}
+
+	return &redactedError{
+		err:     err,
+		secrets: []string{password, url.PathEscape(password), url.QueryEscape(password)},
+	}
+}
@@ -10,7 +10,10 @@ package knoxite
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -65,20 +68,177 @@ func (e *DataReconstructionError) Error() string {
 	return fmt.Sprintf("Could not reconstruct data, got %d out of %d chunks (%d backends missing data)", e.BlocksFound, e.Chunk.DataParts, e.FailedBackends)
 }
 
+// RestoreOptions holds all the settings for a restore operation.
+type RestoreOptions struct {
+	Excludes []string
+	Pedantic bool
+
+	// MetadataOnly applies the stored ownership, mode and modification time
+	// to already existing files, without restoring any content. Missing files
+	// are reported as errors
+	MetadataOnly bool
+
+	// Prefetch is the amount of chunks loaded ahead while the current chunk
+	// is being written. Zero loads chunks one after another
+	Prefetch int
+	// ReadAhead coalesces the loads of chunks stored next to each other in a
+	// pack object into range reads of up to this many bytes, see
+	// StoreOptions.PackSize. Zero loads every chunk with a range read of its
+	// own
+	ReadAhead uint64
+	// VerifyConcurrency is the amount of chunks getting decrypted,
+	// decompressed and verified against their hashes at the same time, while
+	// they still get written in order. Zero or one decodes chunks one after
+	// another, as part of loading them
+	VerifyConcurrency int
+	// MaxMemory caps the memory used by the chunks of a file being restored
+	// to about this many bytes, by loading fewer chunks ahead and verifying
+	// fewer at the same time. Files always get streamed chunk by chunk, so
+	// at least a single chunk is kept in memory. Zero doesn't limit it
+	MaxMemory uint64
+
+	// AllowSymlinkEscape permits writing through symlinks that resolve to a
+	// location outside of the restore target
+	AllowSymlinkEscape bool
+
+	// Manifest is the path of a file recording the restore's progress. When
+	// restoring the same snapshot with the same manifest again, completed
+	// files are skipped and partially written files get verified and resumed.
+	// The manifest is removed once a restore finished without errors
+	Manifest string
+
+	// PreserveTimes is the policy for restoring timestamps. Directory times
+	// get applied after their content has been restored
+	PreserveTimes uint16
+
+	// PreserveWindowsAttrs applies the recorded file attributes on Windows
+	PreserveWindowsAttrs bool
+	// PreserveCapabilities applies the recorded file capabilities on Linux,
+	// which requires the CAP_SETFCAP capability
+	PreserveCapabilities bool
+	// PreserveACLs applies the recorded POSIX ACLs on Linux. Directories get
+	// restored before their content, so files without recorded ACLs inherit
+	// the default ACLs of their directory, like they originally would have
+	PreserveACLs bool
+	// SkipSpaceCheck restores even if the target's file system doesn't have
+	// enough free space for the files left
+	SkipSpaceCheck bool
+
+	// RestoreToOriginal restores the archives to the locations they got
+	// stored from, overwriting whatever is there now. It requires a snapshot
+	// stored with StoreOptions.AbsolutePaths and an empty target. Callers
+	// should get this confirmed by the user
+	RestoreToOriginal bool
+
+	// ForceOverwrite overwrites existing read-only files by making them
+	// writable for the restore, keeping their permissions afterwards.
+	// Without it, they fail with ErrReadOnlyTarget
+	ForceOverwrite bool
+
+	// WriterFactory provides the destination of every file restored by
+	// DecodeSnapshot, which then doesn't touch the file system at all, e.g.
+	// to route files into a database or an HTTP response. It gets called
+	// with the archive path of the file. The writer gets closed once the
+	// file's content has been written and verified, or writing it failed.
+	// Manifest, MetadataOnly and RestoreToOriginal can't be combined with it
+	WriterFactory func(path string, arc Archive) (io.WriteCloser, error)
+	// MetadataHandler gets called for the directories, symlinks and special
+	// files of a restore with a WriterFactory. They get skipped if it's nil
+	MetadataHandler func(path string, arc Archive) error
+}
+
+// Policies for restoring timestamps.
+const (
+	PreserveTimesAll     = iota // Restore modification & access times. Access times default to the modification time if none was recorded
+	PreserveTimesModTime        // Restore modification times, access times are set to the modification time
+	PreserveTimesNone           // Keep the time of the restore
+)
+
+// Error declarations.
+var (
+	ErrSymlinkEscape  = errors.New("Path resolves to a location outside of the restore target")
+	ErrArchiveFailed  = errors.New("Storing the archive failed, its content can't be restored")
+	ErrRelativePaths  = errors.New("Snapshot doesn't contain absolute paths, it can't be restored to the original locations")
+	ErrTargetGiven    = errors.New("Restoring to the original locations doesn't take a target")
+	ErrReadOnlyTarget = errors.New("Target file is read-only")
+	ErrWriterFactory  = errors.New("Restoring with a WriterFactory doesn't support manifests, metadata-only restores or restoring to the original locations")
+
+	// errAbortRestore stops a pedantic restore after the first error
+	errAbortRestore = errors.New("Restore aborted")
+)
+
 // DecodeSnapshot restores an entire snapshot to dst.
-func DecodeSnapshot(repository Repository, snapshot *Snapshot, dst string, excludes []string, pedantic bool) (chan Progress, error) {
+func DecodeSnapshot(repository Repository, snapshot *Snapshot, dst string, opts RestoreOptions) (chan Progress, error) {
+	toWriters := opts.WriterFactory != nil
+	if toWriters && (opts.Manifest != "" || opts.MetadataOnly || opts.RestoreToOriginal) {
+		return nil, ErrWriterFactory
+	}
+	spaceDst := dst
+	if opts.RestoreToOriginal {
+		if !snapshot.AbsolutePaths {
+			return nil, ErrRelativePaths
+		}
+		if dst != "" {
+			return nil, ErrTargetGiven
+		}
+		// joining the empty target with the archives' paths leaves them as
+		// they are, and there's no target for symlinks to escape from
+		var err error
+		spaceDst, err = snapshot.commonDir()
+		if err != nil {
+			return nil, err
+		}
+		opts.AllowSymlinkEscape = true
+	}
+
+	total, err := restoreStats(snapshot, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.SkipSpaceCheck && !opts.MetadataOnly && !toWriters {
+		if err := checkSpace(spaceDst, total.Size); err != nil {
+			return nil, err
+		}
+	}
+
+	var manifest *restoreManifest
+	if opts.Manifest != "" {
+		manifest, err = openRestoreManifest(opts.Manifest, snapshot.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	prog := make(chan Progress)
+	rp := newRestoreProgress(total)
+	log := repository.log()
+	repository.backend.slowHandler = func(w *SlowOperationWarning) {
+		log.Warn(w)
+	}
 	go func() {
-		for _, arc := range snapshot.Archives {
+		if opts.RestoreToOriginal {
+			log.Info("Restoring snapshot ", snapshot.ID, " to its original locations")
+		} else if toWriters {
+			log.Info("Restoring snapshot ", snapshot.ID, " to writers")
+		} else {
+			log.Info("Restoring snapshot ", snapshot.ID, " to ", dst)
+		}
+		failed := false
+		var dirs []*Archive
+		each := snapshot.EachArchive
+		if opts.PreserveACLs {
+			// new files inherit the default ACLs of their directory
+			each = snapshot.eachArchiveDirsFirst
+		}
+		err := each(func(arc *Archive) error {
 			path := filepath.Join(dst, arc.Path)
 
 			match := false
-			for _, exclude := range excludes {
+			for _, exclude := range opts.Excludes {
 				var err error
 				match, err = filepath.Match(strings.ToLower(exclude), strings.ToLower(arc.Path))
 				if err != nil {
-					fmt.Println("Invalid exclude filter:", exclude)
-					return
+					return fmt.Errorf("Invalid exclude filter %s: %v", exclude, err)
 				}
 				if match {
 					break
@@ -86,28 +246,117 @@ func DecodeSnapshot(repository Repository, snapshot *Snapshot, dst string, exclu
 			}
 
 			if match {
-				continue
+				return nil
+			}
+			if arc.Failed {
+				log.Warn(arc.Path, ": skipping, storing it failed")
+				prog <- Progress{Path: arc.Path, Warning: ErrArchiveFailed}
+				return nil
+			}
+			if manifest != nil && manifest.isDone(arc.Path) && isRestored(path, arc) {
+				log.Debug("Skipping already restored ", arc.Path)
+				if arc.Type == Directory {
+					dirs = append(dirs, arc)
+				}
+				rp.skip(arc)
+				return nil
 			}
 
-			err := DecodeArchive(prog, repository, *arc, path)
+			var err error
+			if !opts.AllowSymlinkEscape && !toWriters {
+				err = checkSymlinkEscape(dst, path, arc.Type == SymLink)
+			}
+			if err == nil {
+				if toWriters {
+					err = decodeArchiveToWriter(prog, repository, *arc, opts, rp)
+				} else if opts.MetadataOnly {
+					err = decodeArchiveMetadata(prog, *arc, path, opts, rp)
+				} else {
+					err = decodeArchive(prog, repository, *arc, path, opts, manifest, rp)
+				}
+			}
+			if err == nil && manifest != nil {
+				err = manifest.record(manifestRecord{Path: arc.Path, Done: true})
+			}
 			if err != nil {
+				failed = true
+				log.Error(arc.Path, ": ", err)
 				p := newProgressError(err)
 				p.Path = arc.Path
 				prog <- p
-				if pedantic {
-					break
+				if opts.Pedantic {
+					return errAbortRestore
 				}
-				continue
+				return nil
+			}
+			if arc.Type == Directory && !toWriters {
+				dirs = append(dirs, arc)
+			}
+			return nil
+		})
+		if err != nil && err != errAbortRestore {
+			// the archives couldn't be loaded or an exclude is invalid
+			failed = true
+			log.Error(err)
+			prog <- newProgressError(err)
+		}
+
+		// restoring their content modified the directories' times
+		for _, arc := range dirs {
+			err := restoreTimes(filepath.Join(dst, arc.Path), *arc, opts.PreserveTimes)
+			if err != nil {
+				failed = true
+				log.Error(arc.Path, ": ", err)
+				p := newProgressError(err)
+				p.Path = arc.Path
+				prog <- p
+			}
+		}
+
+		if manifest != nil {
+			// keep the manifest around to resume the restore later on
+			if failed {
+				_ = manifest.close()
+			} else {
+				_ = manifest.remove()
 			}
 		}
+		log.Info("Restored snapshot ", snapshot.ID)
 		close(prog)
 	}()
 
 	return prog, nil
 }
 
+// chunkDecryption returns the encryption method and key the stored data of
+// chunk has to be decrypted with. Chunks encrypted by the repository's
+// external encrypter get decrypted first, in that case the returned method
+// is EncryptionNone.
+func chunkDecryption(repository Repository, archive Archive, chunk Chunk, b []byte) ([]byte, uint16, string, error) {
+	key, err := repository.dataKey(chunk.Epoch)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	encryption := archive.Encrypted
+	if encryption == EncryptionExternal {
+		if repository.encrypter == nil {
+			return nil, 0, "", ErrEncrypterRequired
+		}
+		b, err = repository.encrypter.Decrypt(ChunkMetadata{DecryptedHash: chunk.DecryptedHash, Salt: chunk.Salt}, b)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		encryption = EncryptionNone
+	}
+	return b, encryption, saltedKey(key, chunk.Salt), nil
+}
+
 func decodeChunk(repository Repository, archive Archive, chunk Chunk, b []byte) ([]byte, error) {
-	pipe, err := NewDecodingPipeline(archive.Compressed, archive.Encrypted, repository.Key)
+	b, encryption, key, err := chunkDecryption(repository, archive, chunk, b)
+	if err != nil {
+		return []byte{}, err
+	}
+	pipe, err := newDecodingPipelineWithDicts(chunk.compression(&archive), encryption, key, repository.CompressionDicts)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -125,6 +374,21 @@ func decodeChunk(repository Repository, archive Archive, chunk Chunk, b []byte)
 }
 
 func loadChunk(repository Repository, archive Archive, chunk Chunk) ([]byte, error) {
+	b, err := fetchChunk(repository, chunk)
+	if err != nil {
+		return []byte{}, err
+	}
+	return decodeChunk(repository, archive, chunk, b)
+}
+
+// fetchChunk loads the parts of chunk from the backends and joins them,
+// reconstructing missing parts from parity parts if necessary. Chunks stored
+// in a pack object get loaded from it. The returned data still needs to be
+// decoded with decodeChunk.
+func fetchChunk(repository Repository, chunk Chunk) ([]byte, error) {
+	if chunk.Pack != "" {
+		return repository.backend.LoadChunkRange(chunk.packChunk(), 0, chunk.Offset, chunk.Size)
+	}
 	if chunk.ParityParts > 0 {
 		enc, err := reedsolomon.New(int(chunk.DataParts), int(chunk.ParityParts))
 		if err != nil {
@@ -163,23 +427,138 @@ func loadChunk(repository Repository, archive Archive, chunk Chunk) ([]byte, err
 					continue
 				}
 				_ = w.Flush()
-				return decodeChunk(repository, archive, chunk, b.Bytes())
+				return b.Bytes(), nil
 			}
 		}
 
 		return []byte{}, &DataReconstructionError{chunk, parsFound, chunk.DataParts - parsFound}
 	}
 
-	b, err := repository.backend.LoadChunk(chunk, 0)
+	return repository.backend.LoadChunk(chunk, 0)
+}
+
+// checkSymlinkEscape returns an error if restoring to path would write
+// through a symlink leading outside of root. When restoring a symlink, only
+// the parent directories of path are checked.
+func checkSymlinkEscape(root, path string, symlink bool) error {
+	root = filepath.Clean(root)
+	if !isWithinPath(root, path) {
+		return &os.PathError{Op: "restore", Path: path, Err: ErrSymlinkEscape}
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
 	if err != nil {
-		return []byte{}, err
+		if os.IsNotExist(err) {
+			// nothing has been restored yet
+			return nil
+		}
+		return err
 	}
-	return decodeChunk(repository, archive, chunk, b)
+
+	// path itself may be an existing symlink, as well as any of its parents
+	// inside of root
+	dir := path
+	if symlink {
+		dir = filepath.Dir(path)
+	}
+	for ; dir != root && isWithinPath(root, dir); dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err != nil {
+			continue
+		}
+
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err != nil || !isWithinPath(realRoot, realDir) {
+			// dangling symlinks may point outside of root as well
+			return &os.PathError{Op: "restore", Path: path, Err: ErrSymlinkEscape}
+		}
+		break
+	}
+
+	return nil
+}
+
+// isWithinPath returns true if path is root or located beneath it.
+func isWithinPath(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// RestoreAsOf restores the state of a volume at time t to dst, using the
+// latest snapshot created at or before t.
+func RestoreAsOf(repository Repository, volume *Volume, t time.Time, dst string, opts RestoreOptions) (chan Progress, error) {
+	snapshot, err := volume.SnapshotAsOf(t, &repository)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeSnapshot(repository, snapshot, dst, opts)
 }
 
 // DecodeArchive restores a single archive to path.
 func DecodeArchive(progress chan Progress, repository Repository, arc Archive, path string) error {
-	p := newProgress(&arc)
+	total := Stats{Size: arc.Size, StorageSize: arc.StorageSize}
+	switch arc.Type {
+	case File:
+		total.Files++
+	case Directory:
+		total.Dirs++
+	case SymLink:
+		total.SymLinks++
+	}
+	return decodeArchive(progress, repository, arc, path, RestoreOptions{}, nil, newRestoreProgress(total))
+}
+
+// restoreProgress tracks the progress of an entire restore.
+type restoreProgress struct {
+	started   time.Time
+	total     Stats
+	completed uint64
+}
+
+// newRestoreProgress returns a restoreProgress of restoring the items
+// counted in total.
+func newRestoreProgress(total Stats) *restoreProgress {
+	return &restoreProgress{
+		started: time.Now(),
+		total:   total,
+	}
+}
+
+// item returns the progress of restoring arc, as part of the entire restore.
+func (rp *restoreProgress) item(arc *Archive) Progress {
+	p := newProgress(arc)
+	p.Started = rp.started
+	p.TotalStatistics = rp.total
+	p.CompletedFiles = rp.completed
+	return p
+}
+
+// transferred accounts for n bytes of p's item having been restored.
+func (rp *restoreProgress) transferred(p *Progress, n uint64) {
+	rp.total.Transferred += n
+	p.CurrentItemStats.Transferred += n
+	p.TotalStatistics = rp.total
+}
+
+// complete marks the file of p as completely restored.
+func (rp *restoreProgress) complete(p *Progress) {
+	rp.completed++
+	p.CompletedFiles = rp.completed
+}
+
+// skip accounts for arc as restored by an earlier, interrupted restore.
+func (rp *restoreProgress) skip(arc *Archive) {
+	if arc.Type == File {
+		rp.total.Transferred += arc.Size
+		rp.completed++
+	}
+}
+
+// decodeArchive restores a single archive to path, reporting its progress
+// as part of rp. If manifest is not nil, the progress of restoring a file
+// gets recorded in it and a previously interrupted restore of it is resumed.
+func decodeArchive(progress chan Progress, repository Repository, arc Archive, path string, opts RestoreOptions, manifest *restoreManifest, rp *restoreProgress) error {
+	p := rp.item(&arc)
 
 	if arc.Type == Directory {
 		//fmt.Printf("Creating directory %s\n", path)
@@ -187,23 +566,42 @@ func DecodeArchive(progress chan Progress, repository Repository, arc Archive, p
 		if err != nil {
 			return err
 		}
-		p.TotalStatistics.Dirs++
+		err = restoreTimes(path, arc, opts.PreserveTimes)
+		if err != nil {
+			return err
+		}
 		progress <- p
 	} else if arc.Type == SymLink {
 		//fmt.Printf("Creating symlink %s -> %s\n", path, arc.PointsTo)
-		err := os.Symlink(arc.PointsTo, path)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Symlink(arc.PointsTo, path)
+		if err != nil {
+			return err
+		}
+		progress <- p
+	} else if arc.Type == SpecialFile {
+		//fmt.Printf("Creating special file %s\n", path)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		// creating device nodes requires privileges
+		err = mknod(path, arc.Mode, arc.Rdev)
+		if err != nil {
+			return err
+		}
+		err = restoreTimes(path, arc, opts.PreserveTimes)
 		if err != nil {
 			return err
 		}
-		p.TotalStatistics.SymLinks++
 		progress <- p
 	} else if arc.Type == File {
-		parts := uint(len(arc.Chunks))
+		opts = opts.boundedMemory(arc)
 		//fmt.Printf("Creating file %s (%d chunks).\n", path, parts)
 
-		p.TotalStatistics.Files++
-		p.TotalStatistics.Size = arc.Size
-		p.TotalStatistics.StorageSize = arc.StorageSize
 		progress <- p
 
 		// FIXME: we don't always need to create the path
@@ -213,33 +611,56 @@ func DecodeArchive(progress chan Progress, repository Repository, arc Archive, p
 			return err
 		}
 
-		// write to disk
-		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, arc.Mode)
+		restoreMode, err := prepareOverwrite(path, opts.ForceOverwrite)
 		if err != nil {
 			return err
 		}
-
-		for i := uint(0); i < parts; i++ {
-			idx, err := arc.IndexOfChunk(i)
-			if err != nil {
-				return err
+		defer func() {
+			if restoreMode != nil {
+				_ = restoreMode()
 			}
+		}()
 
-			chunk := arc.Chunks[idx]
-			b, err := loadChunk(repository, arc, chunk)
+		// write to disk. Existing files get truncated, so empty archives
+		// restore as empty files, too
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if manifest != nil {
+			flags = os.O_CREATE | os.O_RDWR
+		}
+		f, err := os.OpenFile(path, flags, arc.Mode)
+		if err != nil {
+			return err
+		}
+
+		// verify the reassembled content, archives of older snapshots have
+		// no HMAC recorded
+		mac := newArchiveHMAC(repository.Key)
+
+		start := uint(0)
+		if manifest != nil {
+			var resumed int64
+			start, resumed, err = resumeFile(f, arc, manifest.writtenChunks(arc.Path), mac)
 			if err != nil {
 				return err
 			}
+			rp.transferred(&p, uint64(resumed))
+		}
 
-			_, err = f.Write(b)
-			if err != nil {
-				return err
+		err = writeChunks(f, repository, arc, start, opts, func(i uint, b []byte) error {
+			_, _ = mac.Write(b)
+			if manifest != nil {
+				err := manifest.record(manifestRecord{Path: arc.Path, Chunks: i + 1})
+				if err != nil {
+					return err
+				}
 			}
 
-			p.TotalStatistics.Transferred += uint64(len(b))
-			p.CurrentItemStats.Transferred += uint64(len(b))
+			rp.transferred(&p, uint64(len(b)))
 			progress <- p
-			// fmt.Printf("Chunk OK: %d bytes, hash: %s\n", size, chunk.DecryptedHash)
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 
 		err = f.Sync()
@@ -250,20 +671,359 @@ func DecodeArchive(progress chan Progress, repository Repository, arc Archive, p
 		if err != nil {
 			return err
 		}
+		if restoreMode != nil {
+			err = restoreMode()
+			restoreMode = nil
+			if err != nil {
+				return err
+			}
+		}
+
+		if arc.HMAC != "" {
+			sum := hex.EncodeToString(mac.Sum(nil))
+			if sum != arc.HMAC {
+				return &CheckSumError{"hmac", arc.HMAC, sum}
+			}
+		}
+
+		err = restoreTimes(path, arc, opts.PreserveTimes)
+		if err != nil {
+			return err
+		}
+		rp.complete(&p)
+		progress <- p
+	}
+
+	if runtime.GOOS == "windows" {
+		if opts.PreserveWindowsAttrs && arc.Type != SymLink {
+			// applied last, as a readonly file can't be modified anymore
+			return setFileAttributes(path, arc.Attributes)
+		}
+		return nil
+	}
+
+	return restoreOwnership(path, arc, opts)
+}
+
+// writeChunks writes the content of the file arc to w, starting with its
+// chunk start. It calls written after every chunk.
+func writeChunks(w io.Writer, repository Repository, arc Archive, start uint, opts RestoreOptions, written func(i uint, b []byte) error) error {
+	parts := uint(len(arc.Chunks))
+	ra := newPackReadAhead(repository, arc, start, opts.ReadAhead)
+	load := func(i uint) ([]byte, error) {
+		idx, err := arc.IndexOfChunk(i)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := ra.fetch(idx)
+		if err != nil || opts.VerifyConcurrency > 1 {
+			// gets decoded by verifyChunks
+			return b, err
+		}
+		return decodeChunk(repository, arc, arc.Chunks[idx], b)
+	}
+	next := load
+	done := make(chan struct{})
+	defer close(done)
+	if opts.Prefetch > 0 {
+		queue := prefetchChunks(func(i uint) ([]byte, error) {
+			return load(start + i)
+		}, parts-start, opts.Prefetch, done)
+		next = func(uint) ([]byte, error) {
+			res, ok := <-queue
+			if !ok {
+				// only happens once done got closed
+				return nil, errAbortRestore
+			}
+			l := <-res
+			return l.data, l.err
+		}
+	}
+	if opts.VerifyConcurrency > 1 {
+		fetch := next
+		queue := verifyChunks(func(i uint) ([]byte, error) {
+			return fetch(start + i)
+		}, func(i uint, b []byte) ([]byte, error) {
+			idx, err := arc.IndexOfChunk(start + i)
+			if err != nil {
+				return nil, err
+			}
+			return decodeChunk(repository, arc, arc.Chunks[idx], b)
+		}, parts-start, opts.VerifyConcurrency, done)
+		next = func(uint) ([]byte, error) {
+			l := <-<-queue
+			return l.data, l.err
+		}
+	}
+
+	for i := start; i < parts; i++ {
+		b, err := next(i)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(b)
+		if err != nil {
+			return err
+		}
+		if err := written(i, b); err != nil {
+			return err
+		}
+		// fmt.Printf("Chunk OK: %d bytes, hash: %s\n", size, chunk.DecryptedHash)
+	}
+
+	return nil
+}
+
+// decodeArchiveToWriter restores a single archive with the WriterFactory or
+// MetadataHandler of opts, reporting its progress as part of rp.
+func decodeArchiveToWriter(progress chan Progress, repository Repository, arc Archive, opts RestoreOptions, rp *restoreProgress) error {
+	p := rp.item(&arc)
+	if arc.Type != File {
+		if opts.MetadataHandler != nil {
+			if err := opts.MetadataHandler(arc.Path, arc); err != nil {
+				return err
+			}
+		}
+		progress <- p
+		return nil
+	}
+
+	opts = opts.boundedMemory(arc)
+	progress <- p
+	w, err := opts.WriterFactory(arc.Path, arc)
+	if err != nil {
+		return err
+	}
+
+	mac := newArchiveHMAC(repository.Key)
+	err = writeChunks(w, repository, arc, 0, opts, func(i uint, b []byte) error {
+		_, _ = mac.Write(b)
+		rp.transferred(&p, uint64(len(b)))
+		progress <- p
+		return nil
+	})
+	if err == nil && arc.HMAC != "" {
+		if sum := hex.EncodeToString(mac.Sum(nil)); sum != arc.HMAC {
+			err = &CheckSumError{"hmac", arc.HMAC, sum}
+		}
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	rp.complete(&p)
+	progress <- p
+	return nil
+}
+
+// boundedMemory returns opts with Prefetch, VerifyConcurrency and ReadAhead
+// reduced, so restoring arc keeps no more than MaxMemory bytes of chunks in
+// memory.
+func (opts RestoreOptions) boundedMemory(arc Archive) RestoreOptions {
+	if opts.MaxMemory == 0 {
+		return opts
+	}
+	if opts.ReadAhead > opts.MaxMemory {
+		opts.ReadAhead = opts.MaxMemory
+	}
+
+	// the stored as well as the decoded data of a chunk
+	var perChunk uint64
+	for _, chunk := range arc.Chunks {
+		if n := uint64(chunk.Size + chunk.OriginalSize); n > perChunk {
+			perChunk = n
+		}
+	}
+	if perChunk == 0 {
+		return opts
+	}
+
+	chunks := int(opts.MaxMemory / perChunk)
+	if opts.VerifyConcurrency > chunks {
+		opts.VerifyConcurrency = chunks
+	}
+	// a chunk is being decoded even without concurrent verification
+	decoding := opts.VerifyConcurrency
+	if decoding < 1 {
+		decoding = 1
+	}
+	if opts.Prefetch > chunks-decoding {
+		opts.Prefetch = chunks - decoding
+		if opts.Prefetch < 0 {
+			opts.Prefetch = 0
+		}
+	}
+
+	return opts
+}
+
+// chunkLoad is the result of loading a single chunk.
+type chunkLoad struct {
+	data []byte
+	err  error
+}
+
+// prefetchChunks calls load for chunks 0 to parts-1 in the background,
+// keeping up to window chunks ahead of the consumer. The results are queued
+// in order. Closing done stops loading further chunks.
+func prefetchChunks(load func(i uint) ([]byte, error), parts uint, window int, done <-chan struct{}) <-chan chan chunkLoad {
+	queue := make(chan chan chunkLoad, window-1)
+
+	go func() {
+		defer close(queue)
+
+		for i := uint(0); i < parts; i++ {
+			res := make(chan chunkLoad, 1)
+			go func(i uint) {
+				b, err := load(i)
+				res <- chunkLoad{b, err}
+			}(i)
+
+			select {
+			case queue <- res:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return queue
+}
+
+// verifyChunks calls fetch for chunks 0 to parts-1 in order and decodes the
+// fetched data with decode in the background, with up to workers chunks being
+// decoded at the same time. The results are queued in order. Closing done
+// stops fetching further chunks.
+func verifyChunks(fetch func(i uint) ([]byte, error), decode func(i uint, b []byte) ([]byte, error), parts uint, workers int, done <-chan struct{}) <-chan chan chunkLoad {
+	queue := make(chan chan chunkLoad, workers-1)
+
+	go func() {
+		defer close(queue)
+
+		for i := uint(0); i < parts; i++ {
+			res := make(chan chunkLoad, 1)
+			b, err := fetch(i)
+			if err != nil {
+				res <- chunkLoad{nil, err}
+			} else {
+				go func(i uint) {
+					b, err := decode(i, b)
+					res <- chunkLoad{b, err}
+				}(i)
+			}
+
+			select {
+			case queue <- res:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return queue
+}
+
+// decodeArchiveMetadata applies an archive's metadata to the already existing
+// file at path, reporting its progress as part of rp.
+func decodeArchiveMetadata(progress chan Progress, arc Archive, path string, opts RestoreOptions, rp *restoreProgress) error {
+	p := rp.item(&arc)
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if isSymLink(fi) != (arc.Type == SymLink) || fi.IsDir() != (arc.Type == Directory) {
+		return &os.PathError{Op: "restore", Path: path, Err: errors.New("file type differs from snapshot")}
+	}
 
-		// Restore modification time
-		err = os.Chtimes(path, time.Unix(arc.ModTime, 0), time.Unix(arc.ModTime, 0))
+	if arc.Type != SymLink {
+		err = os.Chmod(path, arc.Mode)
 		if err != nil {
 			return err
 		}
+		err = restoreTimes(path, arc, opts.PreserveTimes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if arc.Type == File {
+		rp.transferred(&p, arc.Size)
+		rp.complete(&p)
 	}
+	progress <- p
 
 	if runtime.GOOS == "windows" {
+		if opts.PreserveWindowsAttrs && arc.Type != SymLink {
+			return setFileAttributes(path, arc.Attributes)
+		}
+		return nil
+	}
+
+	return restoreOwnership(path, arc, opts)
+}
+
+// prepareOverwrite checks whether the file at path can be overwritten. An
+// existing read-only file fails with ErrReadOnlyTarget, unless force makes
+// it writable. In that case it returns a func restoring its permissions.
+func prepareOverwrite(path string, force bool) (func() error, error) {
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() || fi.Mode().Perm()&0200 != 0 {
+		// missing files get created
+		return nil, nil
+	}
+	if !force {
+		return nil, &os.PathError{Op: "restore", Path: path, Err: ErrReadOnlyTarget}
+	}
+
+	err = os.Chmod(path, fi.Mode()|0200)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		return os.Chmod(path, fi.Mode())
+	}, nil
+}
+
+// restoreOwnership applies the recorded owner of arc to path, followed by
+// its ACLs and capabilities, as changing the owner of a file clears the
+// latter.
+func restoreOwnership(path string, arc Archive, opts RestoreOptions) error {
+	err := os.Lchown(path, int(arc.UID), int(arc.GID))
+	if err != nil {
+		return err
+	}
+	if opts.PreserveACLs && arc.Type != SymLink {
+		if err := setFileACLs(path, arc.ACL, arc.DefaultACL); err != nil {
+			return err
+		}
+	}
+	if !opts.PreserveCapabilities || len(arc.Capability) == 0 {
 		return nil
 	}
 
-	// Restore ownerships
-	return os.Lchown(path, int(arc.UID), int(arc.GID))
+	return setFileCapability(path, arc.Capability)
+}
+
+// restoreTimes applies the recorded timestamps of arc to path, according to
+// the preserveTimes policy.
+func restoreTimes(path string, arc Archive, preserveTimes uint16) error {
+	if preserveTimes == PreserveTimesNone {
+		return nil
+	}
+
+	mtime := time.Unix(arc.ModTime, 0)
+	atime := mtime
+	if preserveTimes == PreserveTimesAll && arc.AccessTime != 0 {
+		atime = time.Unix(arc.AccessTime, 0)
+	}
+
+	return os.Chtimes(path, atime, mtime)
 }
 
 var (
@@ -280,6 +1040,9 @@ func DecodeArchiveData(repository Repository, arc Archive) ([]byte, Stats, error
 	var b []byte
 	var stats Stats
 
+	if arc.Failed {
+		return b, stats, ErrArchiveFailed
+	}
 	if arc.Type == File {
 		parts := uint(len(arc.Chunks))
 
@@ -306,6 +1069,15 @@ func DecodeArchiveData(repository Repository, arc Archive) ([]byte, Stats, error
 			b = append(b, cd...)
 		}
 
+		if arc.HMAC != "" {
+			mac := newArchiveHMAC(repository.Key)
+			_, _ = mac.Write(b)
+			sum := hex.EncodeToString(mac.Sum(nil))
+			if sum != arc.HMAC {
+				return b, stats, &CheckSumError{"hmac", arc.HMAC, sum}
+			}
+		}
+
 		stats.StorageSize += arc.StorageSize
 		stats.Size += arc.Size
 		stats.Transferred += arc.Size
@@ -345,6 +1117,10 @@ func readArchiveChunk(repository Repository, arc Archive, chunkNum uint) (*[]byt
 func ReadArchive(repository Repository, arc Archive, offset int, size int) (*[]byte, error) {
 	var b []byte
 
+	if arc.Failed {
+		return &b, ErrArchiveFailed
+	}
+
 	// fmt.Println("Read req:", offset, size)
 	if arc.Type == File {
 		neededPart, internalOffset, err := arc.ChunkForOffset(offset)
@@ -0,0 +1,969 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// restoreSnapshot restores snapshot to dst and returns all errors reported.
+func restoreSnapshot(t *testing.T, r Repository, snapshot *Snapshot, dst string, opts RestoreOptions) []error {
+	progress, err := DecodeSnapshot(r, snapshot, dst, opts)
+	if err != nil {
+		t.Fatalf("Failed restoring snapshot: %s", err)
+	}
+
+	var errs []error
+	for p := range progress {
+		if p.Error != nil {
+			errs = append(errs, p.Error)
+		}
+	}
+
+	return errs
+}
+
+func TestDecodeSnapshotMetadataOnly(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	for _, name := range []string{"a", "b"} {
+		_ = ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0640)
+		_ = os.Chmod(filepath.Join(src, name), 0640)
+	}
+
+	r, _ := NewRepository("mem://decode-metadata-only", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	})
+
+	target := filepath.Join(dir, "target")
+	if errs := restoreSnapshot(t, r, snapshot, target, RestoreOptions{}); len(errs) > 0 {
+		t.Errorf("Failed restoring snapshot: %v", errs)
+	}
+
+	restoredA := filepath.Join(target, src, "a")
+	restoredB := filepath.Join(target, src, "b")
+	_ = os.Chmod(restoredA, 0600)
+	_ = os.Remove(restoredB)
+
+	errs := restoreSnapshot(t, r, snapshot, target, RestoreOptions{MetadataOnly: true})
+	if len(errs) != 1 || !os.IsNotExist(errs[0]) {
+		t.Errorf("Expected missing file to be reported, got %v", errs)
+	}
+
+	fi, err := os.Stat(restoredA)
+	if err != nil {
+		t.Errorf("Failed to stat restored file: %s", err)
+		return
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode %v, got %v", os.FileMode(0640), fi.Mode().Perm())
+	}
+	if _, err := os.Stat(restoredB); !os.IsNotExist(err) {
+		t.Errorf("Expected missing file not to be created, got %v", err)
+	}
+}
+
+func TestDecodeSnapshotArchiveHMAC(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "data")
+	data := make([]byte, 256*1024)
+	_, _ = rand.Read(data)
+	_ = ioutil.WriteFile(src, data, 0640)
+
+	r, _ := NewRepository("mem://decode-archive-hmac", testPassword)
+	// force the file to be split into multiple chunks
+	r.BackendManager().SetOptions(BackendOptions{MaxObjectSize: 64 * 1024})
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	})
+	arc := snapshot.Archives[src]
+	if arc.HMAC == "" || len(arc.Chunks) < 2 {
+		t.Fatalf("Expected an archive with HMAC and multiple chunks, got %d chunks", len(arc.Chunks))
+	}
+
+	if errs := restoreSnapshot(t, r, snapshot, filepath.Join(dir, "good"), RestoreOptions{}); len(errs) > 0 {
+		t.Errorf("Failed restoring snapshot: %v", errs)
+	}
+
+	// every chunk is still intact, but they get reassembled in the wrong order
+	arc.Chunks[0].Num, arc.Chunks[1].Num = arc.Chunks[1].Num, arc.Chunks[0].Num
+
+	errs := restoreSnapshot(t, r, snapshot, filepath.Join(dir, "bad"), RestoreOptions{})
+	if len(errs) != 1 {
+		t.Fatalf("Expected one error, got %v", errs)
+	}
+	if cerr, ok := errs[0].(*CheckSumError); !ok || cerr.Method != "hmac" {
+		t.Errorf("Expected hmac CheckSumError, got %v", errs[0])
+	}
+}
+
+// latencyBackend delays every chunk load, simulating a remote backend.
+type latencyBackend struct {
+	Backend
+	latency time.Duration
+}
+
+func (b latencyBackend) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
+	time.Sleep(b.latency)
+	return b.Backend.LoadChunk(shasum, part, totalParts)
+}
+
+// storeMultiChunkFile stores a file of size bytes split into many chunks and
+// returns the repository with the given chunk load latency.
+func storeMultiChunkFile(tb testing.TB, url string, size int, latency time.Duration) (Repository, *Snapshot, []byte, string) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		tb.Fatalf("Failed creating temporary dir: %s", err)
+	}
+
+	src := filepath.Join(dir, "data")
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	_ = ioutil.WriteFile(src, data, 0640)
+
+	r, _ := NewRepository(url, testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot, _ := NewSnapshot("test_snapshot")
+	for p := range snapshot.Add(r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+		ChunkSize: 64 * 1024,
+	}) {
+		if p.Error != nil {
+			tb.Fatalf("Failed adding to snapshot: %s", p.Error)
+		}
+	}
+
+	var be Backend = latencyBackend{*r.backend.Backends[0], latency}
+	r.backend.Backends[0] = &be
+
+	return r, snapshot, data, dir
+}
+
+func TestDecodeSnapshotPrefetch(t *testing.T) {
+	r, snapshot, data, dir := storeMultiChunkFile(t, "mem://decode-prefetch", 512*1024, 0)
+	defer os.RemoveAll(dir)
+
+	for _, prefetch := range []int{0, 1, 4} {
+		target := filepath.Join(dir, "target"+strconv.Itoa(prefetch))
+		if errs := restoreSnapshot(t, r, snapshot, target, RestoreOptions{Prefetch: prefetch}); len(errs) > 0 {
+			t.Errorf("Failed restoring snapshot: %v", errs)
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(target, dir, "data"))
+		if err != nil {
+			t.Fatalf("Failed reading restored file: %s", err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("Prefetch %d: restored data differs from original", prefetch)
+		}
+	}
+}
+
+func BenchmarkDecodeSnapshotPrefetch(b *testing.B) {
+	r, snapshot, _, dir := storeMultiChunkFile(b, "mem://decode-prefetch-bench", 1024*1024, 5*time.Millisecond)
+	defer os.RemoveAll(dir)
+
+	for _, prefetch := range []int{0, 1, 4, 16} {
+		b.Run("prefetch-"+strconv.Itoa(prefetch), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				target := filepath.Join(dir, "target", strconv.Itoa(prefetch), strconv.Itoa(i))
+				progress, err := DecodeSnapshot(r, snapshot, target, RestoreOptions{Prefetch: prefetch})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for p := range progress {
+					if p.Error != nil {
+						b.Fatal(p.Error)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeSnapshotVerifyConcurrency(t *testing.T) {
+	r, snapshot, data, dir := storeMultiChunkFile(t, "mem://decode-verify", 512*1024, 0)
+	defer os.RemoveAll(dir)
+
+	for _, opts := range []RestoreOptions{
+		{VerifyConcurrency: 4},
+		{VerifyConcurrency: 4, Prefetch: 4},
+	} {
+		target := filepath.Join(dir, "target"+strconv.Itoa(opts.Prefetch))
+		if errs := restoreSnapshot(t, r, snapshot, target, opts); len(errs) > 0 {
+			t.Errorf("Failed restoring snapshot: %v", errs)
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(target, dir, "data"))
+		if err != nil {
+			t.Fatalf("Failed reading restored file: %s", err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("Options %+v: restored data differs from original", opts)
+		}
+	}
+
+	// corrupt a chunk in the middle of the file
+	chunk := snapshot.Archives[filepath.Join(dir, "data")].Chunks[3]
+	memoryStoresMut.Lock()
+	memoryStores["decode-verify"][chunkKey(chunk.Hash, 0, chunk.DataParts)][0] ^= 0xff
+	memoryStoresMut.Unlock()
+
+	errs := restoreSnapshot(t, r, snapshot, filepath.Join(dir, "corrupted"), RestoreOptions{VerifyConcurrency: 4})
+	if len(errs) != 1 {
+		t.Errorf("Expected the corrupted chunk to be detected, got %v", errs)
+	}
+}
+
+func BenchmarkDecodeSnapshotVerifyConcurrency(b *testing.B) {
+	r, snapshot, _, dir := storeMultiChunkFile(b, "mem://decode-verify-bench", 16*1024*1024, 0)
+	defer os.RemoveAll(dir)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run("workers-"+strconv.Itoa(workers), func(b *testing.B) {
+			b.SetBytes(16 * 1024 * 1024)
+			for i := 0; i < b.N; i++ {
+				target := filepath.Join(dir, "target", strconv.Itoa(workers), strconv.Itoa(i))
+				progress, err := DecodeSnapshot(r, snapshot, target, RestoreOptions{VerifyConcurrency: workers})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for p := range progress {
+					if p.Error != nil {
+						b.Fatal(p.Error)
+					}
+				}
+				_ = os.RemoveAll(target)
+			}
+		})
+	}
+}
+
+func TestDecodeSnapshotSymlinkEscape(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository("mem://decode-symlink-escape", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	opts := StoreOptions{
+		CWD:       wd,
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}
+
+	outside := filepath.Join(dir, "outside")
+	_ = os.Mkdir(outside, 0755)
+
+	// the first snapshot contains a symlink pointing outside of the target,
+	// the second one a file that would be written through it
+	link := filepath.Join(dir, "src", "link")
+	_ = os.Mkdir(filepath.Dir(link), 0755)
+	if err := os.Symlink(outside, link); err != nil {
+		t.Skipf("Can't create symlink: %s", err)
+	}
+	opts.Paths = []string{link}
+	linkSnapshot := storeSnapshot(t, &r, &index, opts)
+
+	_ = os.Remove(link)
+	_ = os.Mkdir(link, 0755)
+	_ = ioutil.WriteFile(filepath.Join(link, "victim"), []byte("malicious"), 0644)
+	opts.Paths = []string{link}
+	fileSnapshot := storeSnapshot(t, &r, &index, opts)
+
+	target := filepath.Join(dir, "target")
+	if errs := restoreSnapshot(t, r, linkSnapshot, target, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+
+	errs := restoreSnapshot(t, r, fileSnapshot, target, RestoreOptions{})
+	if len(errs) == 0 {
+		t.Error("Expected restoring through the symlink to fail")
+	}
+	for _, err := range errs {
+		if !errors.Is(err, ErrSymlinkEscape) {
+			t.Errorf("Expected %v, got %v", ErrSymlinkEscape, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "victim")); !os.IsNotExist(err) {
+		t.Error("File outside of the restore target has been written")
+	}
+
+	// opting out allows writing through the symlink
+	if errs := restoreSnapshot(t, r, fileSnapshot, target, RestoreOptions{AllowSymlinkEscape: true}); len(errs) > 0 {
+		t.Errorf("Failed restoring snapshot: %v", errs)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "victim")); err != nil {
+		t.Errorf("Expected file to be written through the symlink: %s", err)
+	}
+}
+
+// flakyBackend counts successful chunk loads and fails every load once limit
+// loads succeeded. A negative limit never fails.
+type flakyBackend struct {
+	Backend
+	loads *int32
+	limit *int32
+}
+
+func (b flakyBackend) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
+	if *b.limit >= 0 && atomic.LoadInt32(b.loads) >= *b.limit {
+		return nil, errors.New("backend unavailable")
+	}
+
+	atomic.AddInt32(b.loads, 1)
+	return b.Backend.LoadChunk(shasum, part, totalParts)
+}
+
+func TestDecodeSnapshotResume(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0700)
+	files := make(map[string][]byte)
+	for _, name := range []string{"a", "b", "c"} {
+		data := make([]byte, 256*1024)
+		_, _ = rand.Read(data)
+		files[name] = data
+		_ = ioutil.WriteFile(filepath.Join(src, name), data, 0600)
+	}
+
+	r, _ := NewRepository("mem://decode-resume", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+		ChunkSize: 64 * 1024,
+	})
+
+	total := int32(0)
+	for _, arc := range snapshot.Archives {
+		total += int32(len(arc.Chunks))
+	}
+
+	var loads int32
+	limit := total / 2
+	var be Backend = flakyBackend{*r.backend.Backends[0], &loads, &limit}
+	r.backend.Backends[0] = &be
+
+	// interrupt the restore halfway through
+	target := filepath.Join(dir, "target")
+	manifest := filepath.Join(dir, "manifest")
+	opts := RestoreOptions{Pedantic: true, Manifest: manifest}
+	if errs := restoreSnapshot(t, r, snapshot, target, opts); len(errs) != 1 {
+		t.Fatalf("Expected the restore to be interrupted, got %v", errs)
+	}
+	if _, err := os.Stat(manifest); err != nil {
+		t.Fatalf("Expected manifest to be kept after an interrupted restore: %s", err)
+	}
+
+	loads = 0
+	limit = -1
+	if errs := restoreSnapshot(t, r, snapshot, target, opts); len(errs) > 0 {
+		t.Fatalf("Failed resuming restore: %v", errs)
+	}
+	if loads != total-total/2 {
+		t.Errorf("Expected %d chunks to be loaded when resuming, got %d", total-total/2, loads)
+	}
+
+	for name, data := range files {
+		b, err := ioutil.ReadFile(filepath.Join(target, src, name))
+		if err != nil {
+			t.Fatalf("Failed reading restored file: %s", err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("%s: restored data differs from original", name)
+		}
+	}
+	if _, err := os.Stat(manifest); !os.IsNotExist(err) {
+		t.Errorf("Expected manifest to be removed after a complete restore, got %v", err)
+	}
+}
+
+func TestDecodeSnapshotPreserveTimes(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	sub := filepath.Join(src, "sub")
+	file := filepath.Join(sub, "data")
+	_ = os.MkdirAll(sub, 0755)
+	_ = ioutil.WriteFile(file, []byte("some content"), 0640)
+
+	mtime := time.Unix(1500000000, 0)
+	atime := time.Unix(1500001234, 0)
+	for _, path := range []string{file, sub, src} {
+		if err := os.Chtimes(path, atime, mtime); err != nil {
+			t.Fatalf("Failed setting times: %s", err)
+		}
+	}
+
+	r, _ := NewRepository("mem://decode-preserve-times", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	})
+
+	tests := []struct {
+		policy uint16
+		mtime  bool
+		atime  bool
+	}{
+		{PreserveTimesAll, true, true},
+		{PreserveTimesModTime, true, false},
+		{PreserveTimesNone, false, false},
+	}
+	for _, tt := range tests {
+		target := filepath.Join(dir, "target"+strconv.Itoa(int(tt.policy)))
+		if errs := restoreSnapshot(t, r, snapshot, target, RestoreOptions{PreserveTimes: tt.policy}); len(errs) > 0 {
+			t.Errorf("Policy %d: failed restoring snapshot: %v", tt.policy, errs)
+			continue
+		}
+
+		for _, path := range []string{file, sub, src} {
+			fi, err := os.Stat(filepath.Join(target, path))
+			if err != nil {
+				t.Errorf("Policy %d: failed to stat restored path: %s", tt.policy, err)
+				continue
+			}
+			if fi.ModTime().Equal(mtime) != tt.mtime {
+				t.Errorf("Policy %d: %s has mtime %v, expected preserved: %v", tt.policy, path, fi.ModTime(), tt.mtime)
+			}
+
+			statT, ok := toStatT(fi.Sys())
+			if !ok || statT.atime() == 0 {
+				continue
+			}
+			if (statT.atime() == atime.Unix()) != tt.atime {
+				t.Errorf("Policy %d: %s has atime %v, expected preserved: %v", tt.policy, path, time.Unix(statT.atime(), 0), tt.atime)
+			}
+		}
+	}
+}
+
+func TestDecodeSnapshotToOriginal(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	// the sandbox the files get restored to
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	_ = ioutil.WriteFile(filepath.Join(src, "a"), []byte("a"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(src, "sub", "b"), []byte("b"), 0644)
+
+	r, _ := NewRepository("mem://decode-original", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	opts := StoreOptions{
+		CWD:           dir,
+		Paths:         []string{src},
+		Encrypt:       EncryptionAES,
+		DataParts:     1,
+		AbsolutePaths: true,
+	}
+	snapshot := storeSnapshot(t, &r, &index, opts)
+	if !snapshot.AbsolutePaths {
+		t.Errorf("Expected snapshot to record absolute paths")
+	}
+	for path := range snapshot.Archives {
+		if !filepath.IsAbs(path) {
+			t.Errorf("Expected absolute path, got %s", path)
+		}
+	}
+
+	// mixing relative paths into the snapshot fails
+	opts.AbsolutePaths = false
+	var errs []error
+	for p := range snapshot.Add(r, &index, opts) {
+		if p.Error != nil {
+			errs = append(errs, p.Error)
+		}
+	}
+	if len(errs) != 1 || errs[0] != ErrMixedPaths {
+		t.Errorf("Expected ErrMixedPaths, got %v", errs)
+	}
+
+	if _, err := DecodeSnapshot(r, snapshot, dir, RestoreOptions{RestoreToOriginal: true}); err != ErrTargetGiven {
+		t.Errorf("Expected ErrTargetGiven, got %v", err)
+	}
+	relative := storeSnapshot(t, &r, &index, opts)
+	if _, err := DecodeSnapshot(r, relative, "", RestoreOptions{RestoreToOriginal: true}); err != ErrRelativePaths {
+		t.Errorf("Expected ErrRelativePaths, got %v", err)
+	}
+
+	_ = os.RemoveAll(src)
+	if errs := restoreSnapshot(t, r, snapshot, "", RestoreOptions{RestoreToOriginal: true}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+	for name, content := range map[string]string{"a": "a", "sub/b": "b"} {
+		b, err := ioutil.ReadFile(filepath.Join(src, name))
+		if err != nil || string(b) != content {
+			t.Errorf("Expected %s to be restored to its original location: %v", name, err)
+		}
+	}
+}
+
+func TestDecodeSnapshotEmptyFiles(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	modes := map[string]os.FileMode{"empty": 0644, "sentinel": 0600, ".lock": 0444}
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for name, mode := range modes {
+		path := filepath.Join(src, name)
+		_ = ioutil.WriteFile(path, nil, mode)
+		_ = os.Chmod(path, mode)
+		_ = os.Chtimes(path, mtime, mtime)
+	}
+
+	r, _ := NewRepository("mem://decode-empty-files", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	})
+	for name := range modes {
+		arc, ok := snapshot.Archives[filepath.Join(src, name)]
+		if !ok || arc.Type != File || arc.Size != 0 || len(arc.Chunks) != 0 {
+			t.Fatalf("Expected %s to be stored as an empty file, got %+v", name, arc)
+		}
+	}
+
+	// files existing at the destination get emptied
+	dst := filepath.Join(dir, "dst")
+	_ = os.MkdirAll(filepath.Join(dst, src), 0755)
+	_ = ioutil.WriteFile(filepath.Join(dst, src, "sentinel"), []byte("stale"), 0600)
+	if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+	for name, mode := range modes {
+		fi, err := os.Stat(filepath.Join(dst, src, name))
+		if err != nil {
+			t.Errorf("Expected %s to be restored: %s", name, err)
+			continue
+		}
+		if !fi.Mode().IsRegular() || fi.Size() != 0 || fi.Mode().Perm() != mode {
+			t.Errorf("Expected %s to be an empty file with mode %v, got %v with %d bytes", name, mode, fi.Mode(), fi.Size())
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("Expected %s to be modified at %s, got %s", name, mtime, fi.ModTime())
+		}
+	}
+}
+
+func TestDecodeSnapshotReadOnlyTarget(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	_ = ioutil.WriteFile(filepath.Join(src, "data"), []byte("knoxite"), 0644)
+
+	r, _ := NewRepository("mem://decode-read-only-target", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	})
+
+	// a previous restore left a read-only file behind
+	dst := filepath.Join(dir, "dst")
+	target := filepath.Join(dst, src, "data")
+	_ = os.MkdirAll(filepath.Dir(target), 0755)
+	_ = ioutil.WriteFile(target, []byte("stale"), 0444)
+	_ = os.Chmod(target, 0444)
+
+	errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{})
+	if len(errs) != 1 || !errors.Is(errs[0], ErrReadOnlyTarget) {
+		t.Errorf("Expected %v, got %v", ErrReadOnlyTarget, errs)
+	}
+	if b, _ := ioutil.ReadFile(target); string(b) != "stale" {
+		t.Errorf("Expected read-only file to be left alone, got %q", b)
+	}
+
+	if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{ForceOverwrite: true}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+	if b, _ := ioutil.ReadFile(target); string(b) != "knoxite" {
+		t.Errorf("Expected read-only file to be overwritten, got %q", b)
+	}
+	if fi, err := os.Stat(target); err != nil {
+		t.Errorf("Failed reading restored file: %s", err)
+	} else if fi.Mode().Perm() != 0444 {
+		t.Errorf("Expected file to stay read-only, got %v", fi.Mode())
+	}
+}
+
+func TestDecodeSnapshotProgress(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.MkdirAll(filepath.Join(src, "dir"), 0755)
+	sizes := map[string]int{"large": 300 * 1024, "small": 7, "empty": 0, filepath.Join("dir", "nested"): 100 * 1024}
+	var total uint64
+	for name, size := range sizes {
+		data := make([]byte, size)
+		_, _ = rand.Read(data)
+		_ = ioutil.WriteFile(filepath.Join(src, name), data, 0644)
+		total += uint64(size)
+	}
+
+	r, _ := NewRepository("mem://decode-progress", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+		ChunkSize: 64 * 1024,
+	})
+
+	progress, err := DecodeSnapshot(r, snapshot, filepath.Join(dir, "dst"), RestoreOptions{})
+	if err != nil {
+		t.Fatalf("Failed restoring snapshot: %s", err)
+	}
+
+	var last Progress
+	for p := range progress {
+		if p.Error != nil {
+			t.Fatalf("Failed restoring snapshot: %s", p.Error)
+		}
+		if p.TotalStatistics.Files != uint64(len(sizes)) || p.TotalStatistics.Size != total {
+			t.Errorf("Expected totals of %d files with %d bytes, got %d files with %d bytes",
+				len(sizes), total, p.TotalStatistics.Files, p.TotalStatistics.Size)
+		}
+		if p.TotalStatistics.Transferred < last.TotalStatistics.Transferred || p.CompletedFiles < last.CompletedFiles {
+			t.Errorf("Expected progress to increase, got %d bytes & %d files after %d bytes & %d files",
+				p.TotalStatistics.Transferred, p.CompletedFiles, last.TotalStatistics.Transferred, last.CompletedFiles)
+		}
+		if p.CurrentItemStats.Transferred > p.CurrentItemStats.Size {
+			t.Errorf("Expected at most %d bytes of %s, got %d", p.CurrentItemStats.Size, p.Path, p.CurrentItemStats.Transferred)
+		}
+		last = p
+	}
+
+	if last.CompletedFiles != uint64(len(sizes)) {
+		t.Errorf("Expected %d completed files, got %d", len(sizes), last.CompletedFiles)
+	}
+	if last.TotalStatistics.Transferred != total {
+		t.Errorf("Expected %d restored bytes, got %d", total, last.TotalStatistics.Transferred)
+	}
+	if eta := last.ETA(); eta != 0 {
+		t.Errorf("Expected no time left once everything got restored, got %s", eta)
+	}
+	if last.Started.IsZero() || last.Throughput() == 0 {
+		t.Errorf("Expected the throughput of the restore, got %d bytes/s", last.Throughput())
+	}
+}
+
+func TestDecodeSnapshotMaxMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Restoring a huge file takes a while")
+	}
+	testPassword := "this_is_a_password"
+
+	r, _ := NewRepository("mem://decode-max-memory", testPassword)
+
+	// a huge file made of the same chunk over and over, which only gets
+	// stored once
+	const chunkSize = 1 << 20
+	const chunks = 2048
+	data := bytes.Repeat([]byte("knoxite!"), chunkSize/8)
+	pipe, _ := NewEncodingPipeline(CompressionNone, EncryptionAES, r.Key)
+	b, _ := pipe.Process(data)
+	chunk := Chunk{
+		Hash:          Hash(b, HashHighway256),
+		DecryptedHash: Hash(data, HashHighway256),
+		DataParts:     1,
+		OriginalSize:  len(data),
+		Size:          len(b),
+		Data:          &[][]byte{b},
+	}
+	if _, err := r.backend.StoreChunk(chunk); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	chunk.Data = nil
+
+	const size = int64(chunkSize) * int64(chunks)
+	arc := &Archive{Path: "huge", Type: File, Mode: 0600, Size: uint64(size), Encrypted: EncryptionAES}
+	for i := uint(0); i < chunks; i++ {
+		chunk.Num = i
+		arc.Chunks = append(arc.Chunks, chunk)
+	}
+	snapshot, _ := NewSnapshot("test_snapshot")
+	snapshot.AddArchive(arc)
+
+	// collect garbage early, so the heap reflects what's actually in use
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapAlloc
+
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peak {
+				peak = stats.HeapAlloc
+			}
+		}
+	}()
+
+	// discard the restored data instead of writing gigabytes to disk
+	var restored int64
+	errs := restoreSnapshot(t, r, snapshot, "", RestoreOptions{
+		Prefetch:          32,
+		VerifyConcurrency: 8,
+		MaxMemory:         4 * chunkSize,
+		WriterFactory: func(path string, arc Archive) (io.WriteCloser, error) {
+			return &discardCounter{n: &restored}, nil
+		},
+	})
+	close(done)
+	<-sampled
+	if len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+
+	if restored != size {
+		t.Fatalf("Expected restored file of %d bytes, got %d", size, restored)
+	}
+	if peak > baseline && peak-baseline > 16*chunkSize {
+		t.Errorf("Expected restore to use less than %d bytes of memory, used %d", 16*chunkSize, peak-baseline)
+	}
+}
+
+// discardCounter discards the data written to it, counting its size.
+type discardCounter struct {
+	n *int64
+}
+
+func (d *discardCounter) Write(p []byte) (int, error) {
+	*d.n += int64(len(p))
+	return len(p), nil
+}
+
+func (d *discardCounter) Close() error {
+	return nil
+}
+
+// bufferCloser collects the data written to it, and records getting closed.
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestDecodeSnapshotWriterFactory(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	files := map[string][]byte{
+		filepath.Join(src, "a"):        []byte("some content"),
+		filepath.Join(src, "sub", "b"): make([]byte, 3*64*1024+123),
+		filepath.Join(src, "sub", "c"): {},
+	}
+	_, _ = rand.Read(files[filepath.Join(src, "sub", "b")])
+	for path, data := range files {
+		_ = os.MkdirAll(filepath.Dir(path), 0755)
+		_ = ioutil.WriteFile(path, data, 0644)
+	}
+
+	r, _ := NewRepository("mem://writer-factory", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		ChunkSize: 64 * 1024,
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	})
+
+	written := make(map[string]*bufferCloser)
+	var dirs []string
+	dst := filepath.Join(dir, "dst")
+	errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{
+		Prefetch: 2,
+		WriterFactory: func(path string, arc Archive) (io.WriteCloser, error) {
+			if arc.Type != File || arc.Path != path {
+				t.Errorf("Expected a writer to be requested for file %s, got %s", arc.Path, path)
+			}
+			w := &bufferCloser{}
+			written[path] = w
+			return w, nil
+		},
+		MetadataHandler: func(path string, arc Archive) error {
+			if arc.Type == Directory {
+				dirs = append(dirs, path)
+			}
+			return nil
+		},
+	})
+	if len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+
+	if len(written) != len(files) {
+		t.Errorf("Expected %d files to be written, got %d", len(files), len(written))
+	}
+	for path, data := range files {
+		w, ok := written[path]
+		if !ok {
+			t.Errorf("Expected %s to be written", path)
+			continue
+		}
+		if !bytes.Equal(w.Bytes(), data) || !w.closed {
+			t.Errorf("Expected %s to be written completely and closed", path)
+		}
+	}
+	sort.Strings(dirs)
+	if len(dirs) != 2 || dirs[0] != src || dirs[1] != filepath.Join(src, "sub") {
+		t.Errorf("Expected directories %s and its sub directory, got %v", src, dirs)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be restored to %s, got %v", dst, err)
+	}
+
+	_, err = DecodeSnapshot(r, snapshot, dst, RestoreOptions{
+		WriterFactory: func(path string, arc Archive) (io.WriteCloser, error) { return &bufferCloser{}, nil },
+		MetadataOnly:  true,
+	})
+	if err != ErrWriterFactory {
+		t.Errorf("Expected %v, got %v", ErrWriterFactory, err)
+	}
+}
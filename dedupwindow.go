@@ -0,0 +1,69 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"container/list"
+	"sync"
+)
+
+// dedupWindow remembers the hashes of the chunks most recently stored by a
+// snapshot, see StoreOptions.DedupWindow. It is safe for concurrent use.
+type dedupWindow struct {
+	mut    sync.Mutex
+	size   int
+	hashes map[string]*list.Element
+	recent *list.List // front is the most recently used hash
+}
+
+func newDedupWindow(size int) *dedupWindow {
+	return &dedupWindow{
+		size:   size,
+		hashes: make(map[string]*list.Element, size),
+		recent: list.New(),
+	}
+}
+
+// contains reports whether hash is in the window, marking it as recently
+// used.
+func (w *dedupWindow) contains(hash string) bool {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	e, ok := w.hashes[hash]
+	if ok {
+		w.recent.MoveToFront(e)
+	}
+	return ok
+}
+
+// add adds hash to the window, evicting the least recently used hash once
+// the window is full.
+func (w *dedupWindow) add(hash string) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if e, ok := w.hashes[hash]; ok {
+		w.recent.MoveToFront(e)
+		return
+	}
+	if w.recent.Len() >= w.size {
+		oldest := w.recent.Back()
+		w.recent.Remove(oldest)
+		delete(w.hashes, oldest.Value.(string))
+	}
+	w.hashes[hash] = w.recent.PushFront(hash)
+}
+
+// len returns the amount of hashes in the window.
+func (w *dedupWindow) len() int {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	return w.recent.Len()
+}
@@ -0,0 +1,89 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Error declarations.
+var (
+	ErrDescriptionTemplate = errors.New("Invalid snapshot description template")
+
+	// hostname returns the name of the host, tests replace it
+	hostname = os.Hostname
+)
+
+// DescriptionTemplateError records an unknown variable or an unclosed brace
+// in a StoreOptions.DescriptionTemplate.
+type DescriptionTemplateError struct {
+	Template string
+	Variable string // empty for an unclosed brace
+}
+
+func (e *DescriptionTemplateError) Error() string {
+	if e.Variable == "" {
+		return fmt.Sprintf("Description template %q has an unclosed brace", e.Template)
+	}
+	return fmt.Sprintf("Description template %q has an unknown variable {%s}", e.Template, e.Variable)
+}
+
+// Is lets errors.Is match a DescriptionTemplateError with
+// ErrDescriptionTemplate.
+func (e *DescriptionTemplateError) Is(target error) bool {
+	return target == ErrDescriptionTemplate
+}
+
+// expandDescription returns tmpl with its variables replaced by the values of
+// snapshot, which stores paths:
+//
+//	{host}  name of the host
+//	{date}  date of the snapshot, e.g. 2020-06-30
+//	{time}  time of the snapshot, e.g. 17:04:05
+//	{id}    ID of the snapshot
+//	{paths} the paths, separated by spaces
+func expandDescription(tmpl string, snapshot *Snapshot, paths []string) (string, error) {
+	var b strings.Builder
+	rest := tmpl
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			b.WriteString(rest)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", &DescriptionTemplateError{Template: tmpl}
+		}
+		b.WriteString(rest[:start])
+
+		variable := rest[start+1 : start+end]
+		switch variable {
+		case "host":
+			host, err := hostname()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(host)
+		case "date":
+			b.WriteString(snapshot.Date.Format("2006-01-02"))
+		case "time":
+			b.WriteString(snapshot.Date.Format("15:04:05"))
+		case "id":
+			b.WriteString(snapshot.ID)
+		case "paths":
+			b.WriteString(strings.Join(paths, " "))
+		default:
+			return "", &DescriptionTemplateError{Template: tmpl, Variable: variable}
+		}
+		rest = rest[start+end+1:]
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotDescriptionTemplate(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "data")
+	_ = ioutil.WriteFile(file, []byte("some content"), 0644)
+
+	hostname = func() (string, error) { return "backup-host", nil }
+	defer func() {
+		hostname = os.Hostname
+	}()
+
+	now := time.Date(2020, 6, 30, 17, 4, 5, 0, time.Local)
+	r, _ := NewRepositoryWithOptions("mem://description-template", testPassword, RepositoryOptions{
+		clock: func() time.Time { return now },
+	})
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	store := func(tmpl string) (*Snapshot, error) {
+		snapshot, _ := r.NewSnapshot("nightly")
+		var err error
+		for p := range snapshot.Add(r, &index, StoreOptions{
+			CWD:                 wd,
+			Paths:               []string{file},
+			Encrypt:             EncryptionAES,
+			DataParts:           1,
+			DescriptionTemplate: tmpl,
+		}) {
+			if p.Error != nil && err == nil {
+				err = p.Error
+			}
+		}
+		return snapshot, err
+	}
+
+	snapshot, err := store("{host}: {paths} on {date} at {time}")
+	if err != nil {
+		t.Fatalf("Failed storing snapshot: %s", err)
+	}
+	expected := "backup-host: " + file + " on 2020-06-30 at 17:04:05"
+	if snapshot.Description != expected {
+		t.Errorf("Expected description %q, got %q", expected, snapshot.Description)
+	}
+
+	snapshot, err = store("{id}")
+	if err != nil || snapshot.Description != snapshot.ID {
+		t.Errorf("Expected the snapshot's ID as description, got %q (%v)", snapshot.Description, err)
+	}
+
+	for _, tmpl := range []string{"{hots} on {date}", "{host"} {
+		snapshot, err = store(tmpl)
+		if !errors.Is(err, ErrDescriptionTemplate) {
+			t.Errorf("Expected %v for %q, got %v", ErrDescriptionTemplate, tmpl, err)
+		}
+		if snapshot.Description != "nightly" || len(snapshot.Archives) > 0 {
+			t.Errorf("Expected %q not to store anything, got description %q", tmpl, snapshot.Description)
+		}
+	}
+	var te *DescriptionTemplateError
+	if _, err := store("{hots}"); !errors.As(err, &te) || te.Variable != "hots" {
+		t.Errorf("Expected unknown variable hots, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Reasons for a path to be modified.
+const (
+	ChangedType    = "type"    // The path is of a different type, e.g. a directory instead of a file
+	ChangedSize    = "size"    // The file's size differs
+	ChangedContent = "content" // The file's content differs
+	ChangedTarget  = "target"  // The symlink points somewhere else
+)
+
+// PathChange describes a path that exists in both the snapshot and the
+// filesystem, but differs.
+type PathChange struct {
+	Path   string
+	Reason string
+}
+
+// FilesystemDiff holds the differences between a snapshot and a directory on
+// the filesystem. All paths are relative to that directory.
+type FilesystemDiff struct {
+	Added    []string     // paths only found in the filesystem
+	Removed  []string     // paths only found in the snapshot
+	Modified []PathChange // paths that differ
+}
+
+// Empty returns true if the filesystem matches the snapshot.
+func (d FilesystemDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// DiffAgainstFilesystem compares the archives of snapshot with the directory
+// root, as if the snapshot got restored to it. Files of the same size get
+// compared by their content hash, or by their HMAC if no content hash has
+// been recorded, which requires reading them entirely. Apart from archive
+// segments, nothing gets loaded from the repository's backends.
+func DiffAgainstFilesystem(repository Repository, snapshot *Snapshot, root string) (FilesystemDiff, error) {
+	var diff FilesystemDiff
+	if err := snapshot.LoadArchives(); err != nil {
+		return diff, err
+	}
+
+	// directories leading to archives don't have to be part of the snapshot
+	parents := make(map[string]bool)
+	for path := range snapshot.Archives {
+		for dir := filepath.Dir(path); dir != "." && !parents[dir]; dir = filepath.Dir(dir) {
+			parents[dir] = true
+			if dir == string(filepath.Separator) {
+				break
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		// absolute archive paths get restored below root, too
+		abs := string(filepath.Separator) + rel
+
+		arc, ok := snapshot.Archives[rel]
+		if !ok {
+			arc, ok = snapshot.Archives[abs]
+		}
+		if !ok {
+			if fi.IsDir() && (parents[rel] || parents[abs]) {
+				return nil
+			}
+			diff.Added = append(diff.Added, rel)
+			return nil
+		}
+
+		seen[arc.Path] = true
+		reason, err := compareArchive(repository, arc, path, fi)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			diff.Modified = append(diff.Modified, PathChange{rel, reason})
+		}
+		return nil
+	})
+	if err != nil {
+		return diff, err
+	}
+
+	for path := range snapshot.Archives {
+		if seen[path] {
+			continue
+		}
+		if filepath.IsAbs(path) {
+			path, _ = filepath.Rel(string(filepath.Separator), path)
+		}
+		diff.Removed = append(diff.Removed, path)
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Modified, func(i, j int) bool {
+		return diff.Modified[i].Path < diff.Modified[j].Path
+	})
+	return diff, nil
+}
+
+// compareArchive returns why the file at path with the info fi differs from
+// arc, or an empty string if they match.
+func compareArchive(repository Repository, arc *Archive, path string, fi os.FileInfo) (string, error) {
+	var typ uint8
+	switch {
+	case fi.IsDir():
+		typ = Directory
+	case fi.Mode()&os.ModeSymlink != 0:
+		typ = SymLink
+	case fi.Mode().IsRegular():
+		typ = File
+	default:
+		typ = SpecialFile
+	}
+	if typ != arc.Type {
+		return ChangedType, nil
+	}
+
+	switch typ {
+	case SymLink:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if target != arc.PointsTo {
+			return ChangedTarget, nil
+		}
+
+	case File:
+		if uint64(fi.Size()) != arc.Size {
+			return ChangedSize, nil
+		}
+		if arc.Failed {
+			// there's no content to compare with
+			return "", nil
+		}
+
+		same, err := sameContent(repository, arc, path)
+		if err != nil {
+			return "", err
+		}
+		if !same {
+			return ChangedContent, nil
+		}
+	}
+
+	return "", nil
+}
+
+// sameContent returns true if the content of the file at path matches arc.
+func sameContent(repository Repository, arc *Archive, path string) (bool, error) {
+	if arc.ContentHash != "" {
+		h, err := contentHashFile(path)
+		return h == arc.ContentHash, err
+	}
+	if arc.HMAC == "" {
+		// nothing to compare with, only the size is known
+		return true, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	mac := newArchiveHMAC(repository.Key)
+	if _, err := io.Copy(mac, f); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(mac.Sum(nil)) == arc.HMAC, nil
+}
@@ -0,0 +1,101 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestDiffAgainstFilesystem(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	for name, content := range map[string]string{
+		"same":       "unchanged",
+		"content":    "original",
+		"size":       "original",
+		"deleted":    "deleted",
+		"type":       "file",
+		"sub/nested": "nested",
+	} {
+		_ = ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644)
+	}
+	_ = os.Symlink("same", filepath.Join(src, "link"))
+
+	for i, contentHash := range []bool{false, true} {
+		r, err := NewRepository("mem://diff"+strconv.Itoa(i), testPassword)
+		if err != nil {
+			t.Fatalf("Failed creating repository: %s", err)
+		}
+		index, _ := OpenChunkIndex(&r)
+		wd, _ := os.Getwd()
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:               wd,
+			Paths:             []string{src},
+			Encrypt:           EncryptionAES,
+			DataParts:         1,
+			RecordContentHash: contentHash,
+		})
+
+		dst := filepath.Join(dir, "dst")
+		_ = os.RemoveAll(dst)
+		if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{}); len(errs) > 0 {
+			t.Fatalf("Failed restoring snapshot: %v", errs)
+		}
+
+		diff, err := DiffAgainstFilesystem(r, snapshot, dst)
+		if err != nil {
+			t.Fatalf("Failed comparing snapshot: %s", err)
+		}
+		if !diff.Empty() {
+			t.Errorf("Expected no differences after restoring, got %+v", diff)
+		}
+
+		restored := filepath.Join(dst, src)
+		_ = ioutil.WriteFile(filepath.Join(restored, "content"), []byte("modified"), 0644)
+		_ = ioutil.WriteFile(filepath.Join(restored, "size"), []byte("grown file"), 0644)
+		_ = ioutil.WriteFile(filepath.Join(restored, "sub", "new"), []byte("new"), 0644)
+		_ = os.Remove(filepath.Join(restored, "deleted"))
+		_ = os.Remove(filepath.Join(restored, "type"))
+		_ = os.Mkdir(filepath.Join(restored, "type"), 0755)
+		_ = os.Remove(filepath.Join(restored, "link"))
+		_ = os.Symlink("content", filepath.Join(restored, "link"))
+
+		diff, err = DiffAgainstFilesystem(r, snapshot, dst)
+		if err != nil {
+			t.Fatalf("Failed comparing snapshot: %s", err)
+		}
+
+		rel, _ := filepath.Rel("/", src)
+		expected := FilesystemDiff{
+			Added:   []string{filepath.Join(rel, "sub", "new")},
+			Removed: []string{filepath.Join(rel, "deleted")},
+			Modified: []PathChange{
+				{filepath.Join(rel, "content"), ChangedContent},
+				{filepath.Join(rel, "link"), ChangedTarget},
+				{filepath.Join(rel, "size"), ChangedSize},
+				{filepath.Join(rel, "type"), ChangedType},
+			},
+		}
+		if !reflect.DeepEqual(diff, expected) {
+			t.Errorf("Content hash %v: expected diff %+v, got %+v", contentHash, expected, diff)
+		}
+	}
+}
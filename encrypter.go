@@ -0,0 +1,86 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+)
+
+// Error declarations.
+var (
+	ErrEncrypterRequired  = errors.New("Repository encrypts data with an external encrypter, which has not been provided")
+	ErrEncrypterMismatch  = errors.New("Repository encrypts data with a different external encrypter")
+	ErrExternalEncryption = errors.New("Data encrypted by an external encrypter can't be processed by a pipeline")
+)
+
+// defaultEncrypterOverhead is how many bytes an Encrypter is assumed to add
+// at most, unless it's an OverheadEncrypter. It covers a nonce and a MAC.
+const defaultEncrypterOverhead = 64
+
+// ChunkMetadata describes the chunk an Encrypter encrypts or decrypts.
+type ChunkMetadata struct {
+	DecryptedHash string // hash of the chunk's plaintext
+	Salt          string // set for chunks of snapshots stored without deduplication
+}
+
+// An Encrypter encrypts and decrypts the data of chunks in place of the
+// built-in AES encryption, e.g. with per-chunk data keys supplied by an HSM
+// or a key management service. Chunking, compression and deduplication are
+// still handled by knoxite. Chunks only get deduplicated if encrypting the
+// same chunk always results in the same data.
+type Encrypter interface {
+	// Name identifies the encrypter. It gets recorded in the repository, which
+	// can't be opened without an Encrypter of the same name
+	Name() string
+	// Encrypt encrypts the compressed data of chunk
+	Encrypt(chunk ChunkMetadata, data []byte) ([]byte, error)
+	// Decrypt decrypts the data of chunk
+	Decrypt(chunk ChunkMetadata, data []byte) ([]byte, error)
+}
+
+// OverheadEncrypter is implemented by Encrypters that know how many bytes
+// encrypting a chunk adds at most, e.g. for a nonce and a MAC. Chunks then
+// get sized to stay within BackendOptions.MaxObjectSize once encrypted.
+type OverheadEncrypter interface {
+	Overhead() uint
+}
+
+// checkEncrypter returns an error unless e is the external encrypter the
+// repository has been created with.
+func (r *Repository) checkEncrypter(e Encrypter) error {
+	switch {
+	case e == nil && r.Encrypter != "":
+		return ErrEncrypterRequired
+	case e != nil && e.Name() != r.Encrypter:
+		return ErrEncrypterMismatch
+	}
+
+	r.encrypter = e
+	return nil
+}
+
+// withEncrypter makes opts encrypt chunks with the external Encrypter e,
+// unless encryption is disabled.
+func (opts StoreOptions) withEncrypter(e Encrypter) StoreOptions {
+	if e != nil && opts.Encrypt != EncryptionNone {
+		opts.Encrypt = EncryptionExternal
+		opts.encrypter = e
+	}
+
+	return opts
+}
+
+// pipelineEncryption returns the encryption method of the pipelines
+// processing chunks, which leave external encryption to the Encrypter.
+func (opts StoreOptions) pipelineEncryption() uint16 {
+	if opts.Encrypt == EncryptionExternal {
+		return EncryptionNone
+	}
+
+	return opts.Encrypt
+}
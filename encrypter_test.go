@@ -0,0 +1,133 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeKMS hands out a random data key for every chunk, like a key management
+// service would.
+type fakeKMS struct {
+	mut  sync.Mutex
+	keys map[string][]byte
+}
+
+func (kms *fakeKMS) Name() string {
+	return "fake-kms"
+}
+
+func (kms *fakeKMS) dataKey(chunk ChunkMetadata, create bool) (cipher.Stream, error) {
+	kms.mut.Lock()
+	defer kms.mut.Unlock()
+
+	id := chunk.DecryptedHash + chunk.Salt
+	key, ok := kms.keys[id]
+	if !ok {
+		if !create {
+			return nil, ErrOpenRepositoryFailed
+		}
+		key = make([]byte, 32)
+		_, _ = rand.Read(key)
+		kms.keys[id] = key
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	// every key only ever encrypts the same data
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize)), nil
+}
+
+func (kms *fakeKMS) Encrypt(chunk ChunkMetadata, data []byte) ([]byte, error) {
+	s, err := kms.dataKey(chunk, true)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, len(data))
+	s.XORKeyStream(b, data)
+	return b, nil
+}
+
+func (kms *fakeKMS) Decrypt(chunk ChunkMetadata, data []byte) ([]byte, error) {
+	s, err := kms.dataKey(chunk, false)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, len(data))
+	s.XORKeyStream(b, data)
+	return b, nil
+}
+
+func TestExternalEncrypter(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("knoxite "), 4096)
+	file := filepath.Join(dir, "data")
+	_ = ioutil.WriteFile(file, data, 0644)
+
+	kms := &fakeKMS{keys: make(map[string][]byte)}
+	r, err := NewRepositoryWithOptions("mem://external-encrypter", testPassword, RepositoryOptions{Encrypter: kms})
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{file},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	})
+	if arc := snapshot.Archives[file]; arc.Encrypted != EncryptionExternal {
+		t.Errorf("Expected file to be encrypted externally, got encryption %d", arc.Encrypted)
+	}
+	if len(kms.keys) == 0 {
+		t.Fatal("Expected encrypter to supply data keys")
+	}
+	for key, b := range memoryStores["external-encrypter"] {
+		if bytes.Contains(b, data[:64]) {
+			t.Errorf("Expected %s to be encrypted", key)
+		}
+	}
+	if err := r.Save(); err != nil {
+		t.Fatalf("Failed saving repository: %s", err)
+	}
+
+	if _, err := OpenRepository("mem://external-encrypter", testPassword); err != ErrEncrypterRequired {
+		t.Errorf("Expected %v, got %v", ErrEncrypterRequired, err)
+	}
+
+	r, err = OpenRepositoryWithOptions("mem://external-encrypter", testPassword, RepositoryOptions{Encrypter: kms})
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	b, _, err := DecodeArchiveData(r, *snapshot.Archives[file])
+	if err != nil {
+		t.Fatalf("Failed decoding archive: %s", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("Decoded data differs from the original")
+	}
+}
@@ -12,12 +12,14 @@ import (
 	"crypto/cipher"
 	"crypto/sha256"
 	"errors"
+	"io"
 )
 
 // Available encryption algos.
 const (
 	EncryptionNone = iota
 	EncryptionAES
+	EncryptionExternal // encrypted by the repository's Encrypter
 )
 
 // Error declarations.
@@ -38,6 +40,9 @@ func NewEncryptor(method uint16, password string) (Encryptor, error) {
 	e := Encryptor{
 		Method: method,
 	}
+	if method == EncryptionExternal {
+		return e, ErrExternalEncryption
+	}
 	if method == EncryptionAES {
 		if len(password) == 0 {
 			return e, ErrInvalidPassword
@@ -82,6 +87,9 @@ func NewDecryptor(method uint16, password string) (Decryptor, error) {
 	e := Decryptor{
 		Method: method,
 	}
+	if method == EncryptionExternal {
+		return e, ErrExternalEncryption
+	}
 	if method == EncryptionAES {
 		if len(password) == 0 {
 			return e, ErrInvalidPassword
@@ -112,3 +120,15 @@ func (e Decryptor) Process(data []byte) ([]byte, error) {
 
 	return b, nil
 }
+
+// NewReader returns a reader that decrypts the data read from r.
+func (e Decryptor) NewReader(r io.Reader) io.Reader {
+	if e.Method == EncryptionNone {
+		return r
+	}
+
+	return &cipher.StreamReader{
+		S: cipher.NewCFBDecrypter(e.block, e.iv),
+		R: r,
+	}
+}
@@ -0,0 +1,20 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// hasExcludeMarker reports whether path has the extended attribute marker,
+// see StoreOptions.ExcludeMarker. Paths whose attributes can't be read count
+// as unmarked, so they get stored.
+func hasExcludeMarker(path, marker string) bool {
+	_, err := unix.Lgetxattr(path, marker, nil)
+	return err == nil
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+// hasExcludeMarker reports no markers, as they're only supported on Linux.
+func hasExcludeMarker(path, marker string) bool {
+	return false
+}
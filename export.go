@@ -0,0 +1,128 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportOptions holds all the settings for exporting a snapshot.
+type ExportOptions struct {
+	// Gzip compresses the exported tar archive
+	Gzip bool
+}
+
+// ExportTar writes the content of a snapshot as a tar archive to w. Modes,
+// modification times, ownerships and symlinks are preserved. Device nodes
+// can't be exported and are skipped.
+func ExportTar(repository Repository, snapshot *Snapshot, w io.Writer, opts ExportOptions) error {
+	var gw *gzip.Writer
+	if opts.Gzip {
+		gw = gzip.NewWriter(w)
+		w = gw
+	}
+
+	if err := snapshot.LoadArchives(); err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	paths := make([]string, 0, len(snapshot.Archives))
+	for path := range snapshot.Archives {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		arc := snapshot.Archives[path]
+
+		hdr := &tar.Header{
+			Name:    strings.TrimPrefix(filepath.ToSlash(arc.Path), "/"),
+			Mode:    int64(arc.Mode.Perm()),
+			ModTime: time.Unix(arc.ModTime, 0),
+			Uid:     int(arc.UID),
+			Gid:     int(arc.GID),
+			Format:  tar.FormatPAX,
+		}
+		switch arc.Type {
+		case Directory:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case SymLink:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = arc.PointsTo
+		case File:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(arc.Size)
+		case SpecialFile:
+			if arc.Mode&os.ModeNamedPipe == 0 {
+				continue
+			}
+			hdr.Typeflag = tar.TypeFifo
+		default:
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if arc.Type == File {
+			if err := writeArchiveData(tw, repository, *arc); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gw != nil {
+		return gw.Close()
+	}
+
+	return nil
+}
+
+// writeArchiveData writes the reassembled content of an archive to w and
+// verifies it.
+func writeArchiveData(w io.Writer, repository Repository, arc Archive) error {
+	mac := newArchiveHMAC(repository.Key)
+	for i := uint(0); i < uint(len(arc.Chunks)); i++ {
+		idx, err := arc.IndexOfChunk(i)
+		if err != nil {
+			return err
+		}
+
+		b, err := loadChunk(repository, arc, arc.Chunks[idx])
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		_, _ = mac.Write(b)
+	}
+
+	if arc.HMAC != "" {
+		sum := hex.EncodeToString(mac.Sum(nil))
+		if sum != arc.HMAC {
+			return &CheckSumError{"hmac", arc.HMAC, sum}
+		}
+	}
+
+	return nil
+}
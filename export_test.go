@@ -0,0 +1,114 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportTar(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.MkdirAll(filepath.Join(src, "sub"), 0750)
+	_ = ioutil.WriteFile(filepath.Join(src, "sub", "file"), []byte("some content"), 0640)
+	_ = os.Chmod(filepath.Join(src, "sub", "file"), 0640)
+	if err := os.Symlink("sub/file", filepath.Join(src, "link")); err != nil {
+		t.Skipf("Can't create symlink: %s", err)
+	}
+
+	r, _ := NewRepository("mem://export-tar", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	})
+
+	target := filepath.Join(dir, "target")
+	if errs := restoreSnapshot(t, r, snapshot, target, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+
+	var buf bytes.Buffer
+	if err := ExportTar(r, snapshot, &buf, ExportOptions{Gzip: true}); err != nil {
+		t.Fatalf("Failed exporting snapshot: %s", err)
+	}
+
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Failed opening gzip stream: %s", err)
+	}
+	tr := tar.NewReader(gr)
+
+	entries := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed reading tar archive: %s", err)
+		}
+		entries++
+
+		restored := filepath.Join(target, filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/")))
+		fi, err := os.Lstat(restored)
+		if err != nil {
+			t.Errorf("Exported %s has no restored counterpart: %s", hdr.Name, err)
+			continue
+		}
+		// directories may get created before they're restored, so their
+		// modes can't be compared reliably
+		if hdr.Typeflag == tar.TypeReg && os.FileMode(hdr.Mode).Perm() != fi.Mode().Perm() {
+			t.Errorf("%s: expected mode %v, got %v", hdr.Name, fi.Mode().Perm(), os.FileMode(hdr.Mode).Perm())
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if !fi.IsDir() {
+				t.Errorf("%s: expected a directory", hdr.Name)
+			}
+		case tar.TypeSymlink:
+			target, _ := os.Readlink(restored)
+			if hdr.Linkname != target {
+				t.Errorf("%s: expected symlink to %s, got %s", hdr.Name, target, hdr.Linkname)
+			}
+		case tar.TypeReg:
+			exported, _ := ioutil.ReadAll(tr)
+			b, _ := ioutil.ReadFile(restored)
+			if !bytes.Equal(exported, b) {
+				t.Errorf("%s: exported content differs from restored file", hdr.Name)
+			}
+		default:
+			t.Errorf("%s: unexpected type %c", hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	if entries != len(snapshot.Archives) {
+		t.Errorf("Expected %d entries, got %d", len(snapshot.Archives), entries)
+	}
+}
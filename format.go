@@ -0,0 +1,85 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Error declarations.
+var (
+	ErrUnsupportedFormat = errors.New("Repository format is not supported by this version of Knoxite")
+
+	// formatHeader precedes the metadata of repositories in a format newer
+	// than headerlessVersion, followed by the format version as a 4 byte big
+	// endian integer. It can be read without unlocking the repository, so
+	// clients recognize formats they don't understand before trying to
+	// decrypt the metadata
+	formatHeader = []byte("knoxite-format:")
+)
+
+const (
+	// headerlessVersion is the last repository version written without a
+	// format header, which clients before its introduction can still open
+	headerlessVersion = 4
+)
+
+// UnsupportedFormatError records a repository stored in a newer format than
+// this version of Knoxite understands.
+type UnsupportedFormatError struct {
+	Version   uint // format of the repository
+	Supported uint // newest format supported, RepositoryVersion
+}
+
+func (e *UnsupportedFormatError) Error() string {
+	return fmt.Sprintf("Repository format version %d requires a newer version of Knoxite, this one supports up to version %d",
+		e.Version, e.Supported)
+}
+
+// Is lets errors.Is match an UnsupportedFormatError with
+// ErrUnsupportedFormat.
+func (e *UnsupportedFormatError) Is(target error) bool {
+	return target == ErrUnsupportedFormat
+}
+
+// checkFormat returns an UnsupportedFormatError if the repository format
+// version is newer than the supported one.
+func checkFormat(version, supported uint) error {
+	if version > supported {
+		return &UnsupportedFormatError{Version: version, Supported: supported}
+	}
+	return nil
+}
+
+// addFormatHeader prepends the header recording the format version to the
+// repository metadata b.
+func addFormatHeader(b []byte, version uint) []byte {
+	if version <= headerlessVersion {
+		return b
+	}
+
+	header := make([]byte, len(formatHeader)+4)
+	copy(header, formatHeader)
+	binary.BigEndian.PutUint32(header[len(formatHeader):], uint32(version))
+	return append(header, b...)
+}
+
+// stripFormatHeader returns the format version recorded in the header of the
+// repository metadata b, and the metadata following it. Metadata without a
+// header reports version 0, as only the decrypted metadata knows it.
+func stripFormatHeader(b []byte) (uint, []byte) {
+	if !bytes.HasPrefix(b, formatHeader) || len(b) < len(formatHeader)+4 {
+		return 0, b
+	}
+
+	version := binary.BigEndian.Uint32(b[len(formatHeader):])
+	return uint(version), b[len(formatHeader)+4:]
+}
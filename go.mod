@@ -11,7 +11,7 @@ require (
 	github.com/go-ini/ini v1.51.1 // indirect
 	github.com/google/readahead v0.0.0-20161222183148-eaceba169032 // indirect
 	github.com/jlaffaye/ftp v0.0.0-20200331144919-d4caf6ffcab8
-	github.com/klauspost/compress v1.10.11
+	github.com/klauspost/compress v1.11.13
 	github.com/klauspost/reedsolomon v1.9.9
 	github.com/klauspost/shutdown2 v1.1.0
 	github.com/minio/highwayhash v1.0.0
@@ -41,6 +41,7 @@ require (
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
 	golang.org/x/net v0.0.0-20200520182314-0ba52f642ac2
 	golang.org/x/sys v0.0.0-20200523222454-059865788121
+	golang.org/x/text v0.3.2
 	google.golang.org/api v0.28.0
 	gopkg.in/ini.v1 v1.51.1 // indirect
 	gopkg.in/kothar/go-backblaze.v0 v0.0.0-20191215213626-7594ed38700f
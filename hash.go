@@ -8,8 +8,14 @@
 package knoxite
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
 
 	"github.com/minio/highwayhash"
 )
@@ -35,3 +41,49 @@ func Hash(b []byte, hashtype uint8) string {
 
 	return hex.EncodeToString(data[:])
 }
+
+// ContentHash returns the canonical hash of all data read from r. It's used
+// to detect content changes of files between snapshots.
+func ContentHash(r io.Reader) (string, error) {
+	h, err := highwayhash.New(hashkey[:])
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newArchiveHMAC returns the HMAC used to authenticate the entire content of
+// an archive.
+func newArchiveHMAC(key string) hash.Hash {
+	return hmac.New(sha256.New, []byte(key))
+}
+
+// metadataDigest returns the HMAC authenticating the metadata v stored as
+// the object id. v gets compared as it decodes from the storage, so ptr must
+// point to a zero value of its type.
+func metadataDigest(key, id string, v, ptr interface{}) (string, error) {
+	// gob drops empty slices & maps, and the order of maps, so only the
+	// decoded value marshals deterministically
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return "", err
+	}
+	err = gob.NewDecoder(&buf).Decode(ptr)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(ptr)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte("metadata:"+key))
+	_, _ = mac.Write([]byte(id))
+	_, _ = mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
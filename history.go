@@ -0,0 +1,115 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"sort"
+	"time"
+)
+
+// A StatsHistoryEntry describes the size of a repository right after a
+// snapshot got created. Physical sizes are the sizes of the encoded chunks.
+type StatsHistoryEntry struct {
+	Date       time.Time
+	SnapshotID string
+
+	// LogicalSize is the original size of all files in the snapshot
+	LogicalSize uint64
+	// AddedSize is the physical size of the chunks first stored by the snapshot
+	AddedSize uint64
+	// ExclusiveSize is the physical size of the chunks referenced by no other
+	// snapshot, which would be freed by removing it
+	ExclusiveSize uint64
+
+	// TotalLogicalSize is the logical size of this and all earlier snapshots
+	TotalLogicalSize uint64
+	// TotalPhysicalSize is the physical size of this and all earlier snapshots
+	TotalPhysicalSize uint64
+}
+
+// RepositoryStatsHistory returns the growth of a repository as a series of
+// entries, one per snapshot, ordered by the snapshots' dates.
+func RepositoryStatsHistory(repository *Repository, index *ChunkIndex) ([]StatsHistoryEntry, error) {
+	if err := index.Load(); err != nil {
+		return nil, err
+	}
+
+	var snapshots []*Snapshot
+	for _, volume := range repository.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshot, err := volume.LoadSnapshot(id, repository)
+			if err != nil {
+				return nil, err
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Date.Before(snapshots[j].Date)
+	})
+
+	var history []StatsHistoryEntry
+	var totalLogical, totalPhysical uint64
+	stored := make(map[string]bool)
+	for _, snapshot := range snapshots {
+		entry := StatsHistoryEntry{
+			Date:       snapshot.Date,
+			SnapshotID: snapshot.ID,
+		}
+
+		counted := make(map[string]bool)
+		err := snapshot.EachArchive(func(arc *Archive) error {
+			entry.LogicalSize += arc.Size
+
+			for _, chunk := range arc.Chunks {
+				if counted[chunk.Hash] {
+					continue
+				}
+				counted[chunk.Hash] = true
+
+				if !stored[chunk.Hash] {
+					stored[chunk.Hash] = true
+					entry.AddedSize += uint64(chunk.Size)
+				}
+				if index.exclusiveTo(chunk.Hash, snapshot.ID) {
+					entry.ExclusiveSize += uint64(chunk.Size)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		totalLogical += entry.LogicalSize
+		totalPhysical += entry.AddedSize
+		entry.TotalLogicalSize = totalLogical
+		entry.TotalPhysicalSize = totalPhysical
+
+		history = append(history, entry)
+	}
+
+	return history, nil
+}
+
+// exclusiveTo returns true if the chunk with the given hash is referenced by
+// snapshot only.
+func (index *ChunkIndex) exclusiveTo(hash string, snapshot string) bool {
+	c, ok := index.Chunks[hash]
+	if !ok {
+		return false
+	}
+
+	for _, s := range c.Snapshots {
+		if s != snapshot {
+			return false
+		}
+	}
+
+	return len(c.Snapshots) > 0
+}
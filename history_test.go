@@ -0,0 +1,100 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRepositoryStatsHistory(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository("mem://repository-stats-history", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	wd, _ := os.Getwd()
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0700)
+
+	// every snapshot adds another file, but they're stored in reverse order
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		data := make([]byte, 64*1024*(i+1))
+		_, _ = rand.Read(data)
+		_ = ioutil.WriteFile(filepath.Join(src, name), data, 0600)
+
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:       wd,
+			Paths:     []string{src},
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+		})
+		snapshot.Date = now.Add(time.Duration(i) * time.Hour)
+		if err := snapshot.Save(&r); err != nil {
+			t.Fatalf("Failed saving snapshot: %s", err)
+		}
+		vol.Snapshots = append([]string{snapshot.ID}, vol.Snapshots...)
+	}
+
+	history, err := RepositoryStatsHistory(&r, &index)
+	if err != nil {
+		t.Fatalf("Failed computing stats history: %s", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(history))
+	}
+
+	var physical uint64
+	for i, entry := range history {
+		if i > 0 {
+			prev := history[i-1]
+			if !entry.Date.After(prev.Date) {
+				t.Errorf("Entry %d: expected entries to be ordered by date", i)
+			}
+			if entry.LogicalSize <= prev.LogicalSize || entry.TotalLogicalSize <= prev.TotalLogicalSize {
+				t.Errorf("Entry %d: expected logical size to grow", i)
+			}
+			if entry.TotalPhysicalSize <= prev.TotalPhysicalSize {
+				t.Errorf("Entry %d: expected physical size to grow", i)
+			}
+		}
+
+		if entry.AddedSize == 0 {
+			t.Errorf("Entry %d: expected chunks to be added", i)
+		}
+		// later snapshots still reference all earlier files
+		exclusive := uint64(0)
+		if i == len(history)-1 {
+			exclusive = entry.AddedSize
+		}
+		if entry.ExclusiveSize != exclusive {
+			t.Errorf("Entry %d: expected exclusive size %d, got %d", i, exclusive, entry.ExclusiveSize)
+		}
+		physical += entry.AddedSize
+		if entry.TotalPhysicalSize != physical {
+			t.Errorf("Entry %d: expected total physical size %d, got %d", i, physical, entry.TotalPhysicalSize)
+		}
+	}
+	if history[0].LogicalSize != 64*1024 || history[2].LogicalSize != 6*64*1024 {
+		t.Errorf("Unexpected logical sizes: %d, %d", history[0].LogicalSize, history[2].LogicalSize)
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+)
+
+// Error declarations.
+var (
+	ErrUnsupportedEntry = errors.New("Unsupported entry type in imported archive")
+)
+
+// entryIterator returns the next entry of an imported archive and a reader
+// for its content, if it's a file. It returns io.EOF after the last entry.
+// Errors returned alongside an Archive only concern that entry, all others
+// end the import.
+type entryIterator func() (*Archive, io.ReadCloser, error)
+
+// AddTar adds all entries of the tar archive read from r to a snapshot,
+// preserving their paths and metadata. Only the storage settings, Pedantic,
+// SpecialFiles and ProgressInterval of opts are used.
+func (snapshot *Snapshot) AddTar(repository Repository, chunkIndex *ChunkIndex, r io.Reader, opts StoreOptions) chan Progress {
+	tr := tar.NewReader(r)
+
+	return snapshot.addEntries(repository, chunkIndex, func() (*Archive, io.ReadCloser, error) {
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			name := importPath(hdr.Name)
+			if name == "" || hdr.Typeflag == tar.TypeXGlobalHeader {
+				continue
+			}
+
+			archive := &Archive{
+				Path:    name,
+				Mode:    hdr.FileInfo().Mode(),
+				ModTime: hdr.ModTime.Unix(),
+				UID:     uint32(hdr.Uid),
+				GID:     uint32(hdr.Gid),
+			}
+			if !hdr.AccessTime.IsZero() {
+				archive.AccessTime = hdr.AccessTime.Unix()
+			}
+
+			switch hdr.Typeflag {
+			case tar.TypeDir:
+				archive.Type = Directory
+				return archive, nil, nil
+			case tar.TypeReg, tar.TypeRegA:
+				archive.Type = File
+				archive.Size = uint64(hdr.Size)
+				return archive, ioutil.NopCloser(tr), nil
+			case tar.TypeSymlink:
+				archive.Type = SymLink
+				archive.PointsTo = hdr.Linkname
+				return archive, nil, nil
+			case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+				archive, err = importSpecialFile(archive, opts.SpecialFiles)
+				if archive == nil {
+					continue
+				}
+				return archive, nil, err
+			default:
+				return archive, nil, &os.PathError{Op: "import", Path: name, Err: ErrUnsupportedEntry}
+			}
+		}
+	}, opts)
+}
+
+// AddZip adds all entries of the zip archive of size bytes read from r to a
+// snapshot, preserving their paths and metadata. As zip archives don't record
+// ownerships, all entries are owned by the current user. Only the storage
+// settings, Pedantic, SpecialFiles and ProgressInterval of opts are used.
+func (snapshot *Snapshot) AddZip(repository Repository, chunkIndex *ChunkIndex, r io.ReaderAt, size int64, opts StoreOptions) chan Progress {
+	zr, err := zip.NewReader(r, size)
+	i := 0
+
+	return snapshot.addEntries(repository, chunkIndex, func() (*Archive, io.ReadCloser, error) {
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i < len(zr.File) {
+			f := zr.File[i]
+			i++
+
+			name := importPath(f.Name)
+			if name == "" {
+				continue
+			}
+
+			archive := &Archive{
+				Path:    name,
+				Mode:    f.Mode(),
+				ModTime: f.Modified.Unix(),
+				UID:     uint32(os.Getuid()),
+				GID:     uint32(os.Getgid()),
+			}
+
+			switch {
+			case archive.Mode.IsDir():
+				archive.Type = Directory
+				return archive, nil, nil
+			case archive.Mode.IsRegular():
+				archive.Type = File
+				archive.Size = f.UncompressedSize64
+				rc, err := f.Open()
+				return archive, rc, err
+			case archive.Mode&os.ModeSymlink != 0:
+				// the symlink's target is stored as its content
+				archive.Type = SymLink
+				rc, err := f.Open()
+				if err != nil {
+					return archive, nil, err
+				}
+				target, err := ioutil.ReadAll(rc)
+				_ = rc.Close()
+				archive.PointsTo = string(target)
+				return archive, nil, err
+			case archive.Mode&(os.ModeNamedPipe|os.ModeDevice) != 0:
+				archive, err := importSpecialFile(archive, opts.SpecialFiles)
+				if archive == nil {
+					continue
+				}
+				return archive, nil, err
+			default:
+				return archive, nil, &os.PathError{Op: "import", Path: name, Err: ErrUnsupportedEntry}
+			}
+		}
+
+		return nil, nil, io.EOF
+	}, opts)
+}
+
+// importPath returns the relative, cleaned path of an imported entry. Paths
+// can't point outside of the archive's root.
+func importPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// importSpecialFile applies the specialFiles policy to an imported FIFO or
+// device node. It returns nil if the entry should be skipped. As device
+// numbers aren't portable between platforms, only FIFOs can be stored.
+func importSpecialFile(archive *Archive, specialFiles uint16) (*Archive, error) {
+	switch specialFiles {
+	case SpecialFilesStoreMetadata:
+		if archive.Mode&os.ModeNamedPipe == 0 {
+			return archive, &os.PathError{Op: "import", Path: archive.Path, Err: ErrUnsupportedEntry}
+		}
+		archive.Type = SpecialFile
+		return archive, nil
+	case SpecialFilesError:
+		return archive, &os.PathError{Op: "import", Path: archive.Path, Err: ErrSpecialFile}
+	default:
+		return nil, nil
+	}
+}
+
+// addEntries adds all entries returned by next to a snapshot.
+func (snapshot *Snapshot) addEntries(repository Repository, chunkIndex *ChunkIndex, next entryIterator, opts StoreOptions) chan Progress {
+	progress := make(chan Progress)
+	log := repository.log()
+
+	opts = opts.withDefaults(repository.Config).withEncrypter(repository.encrypter)
+	if opts.NoDedup {
+		opts.salt = snapshot.dedupSalt()
+	}
+	opts.DataParts = uint(math.Max(1, float64(opts.DataParts)))
+
+	go func() {
+		defer close(progress)
+
+		log.Info("Importing into snapshot ", snapshot.ID)
+		for {
+			archive, r, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				p := newProgressError(err)
+				if archive != nil {
+					p.Path = archive.Path
+				}
+				log.Warn(p.Path, ": ", p.Error)
+				progress <- p
+				if archive == nil || opts.Pedantic {
+					return
+				}
+				continue
+			}
+
+			// update statistics
+			snapshot.mut.Lock()
+			snapshot.Stats.Size += archive.Size
+			switch archive.Type {
+			case Directory:
+				snapshot.Stats.Dirs++
+			case File:
+				snapshot.Stats.Files++
+			case SymLink:
+				snapshot.Stats.SymLinks++
+			}
+			p := newProgress(archive)
+			p.TotalStatistics = snapshot.Stats
+			snapshot.mut.Unlock()
+			progress <- p
+
+			if archive.Type == File {
+				log.Debug("Importing file ", archive.Path)
+				mac := newArchiveHMAC(repository.Key)
+				chunks := chunkReader(r, opts.chunkKey(repository.currentDataKey()), repository.backend.maxChunkSize(opts), mac, opts)
+				if !snapshot.storeChunks(repository, chunkIndex, archive, chunks, p, progress, opts) {
+					return
+				}
+				archive.HMAC = hex.EncodeToString(mac.Sum(nil))
+			}
+
+			snapshot.AddArchive(archive)
+			chunkIndex.AddArchive(archive, snapshot.ID)
+		}
+		if err := snapshot.flushParityGroup(repository, chunkIndex, opts); err != nil {
+			log.Error("Storing parity of snapshot ", snapshot.ID, " failed: ", err)
+			progress <- newProgressError(err)
+		}
+		log.Info("Imported into snapshot ", snapshot.ID, ": ", snapshot.Stats.String())
+	}()
+
+	if opts.ProgressInterval > 0 {
+		return coalesceProgress(progress, opts.ProgressInterval)
+	}
+	return progress
+}
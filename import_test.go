@@ -0,0 +1,117 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotAddTar(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"dir/a":      "first file",
+		"dir/sub/b":  "second file",
+		"../escaped": "can't escape the archive's root",
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"dir/", "dir/sub/"} {
+		_ = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     name,
+			Mode:     0750,
+			ModTime:  modTime,
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+		})
+	}
+	for name, content := range files {
+		_ = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0640,
+			Size:     int64(len(content)),
+			ModTime:  modTime,
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+		})
+		_, _ = tw.Write([]byte(content))
+	}
+	_ = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     "dir/link",
+		Linkname: "sub/b",
+		ModTime:  modTime,
+		Uid:      os.Getuid(),
+		Gid:      os.Getgid(),
+	})
+	_ = tw.Close()
+
+	r, _ := NewRepository("mem://snapshot-add-tar", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	snapshot, _ := NewSnapshot("test_snapshot")
+	for p := range snapshot.AddTar(r, &index, &buf, StoreOptions{
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}) {
+		if p.Error != nil {
+			t.Errorf("Failed importing tar archive: %s", p.Error)
+		}
+	}
+	if snapshot.Stats.Files != 3 || snapshot.Stats.Dirs != 2 || snapshot.Stats.SymLinks != 1 {
+		t.Errorf("Unexpected statistics: %s", snapshot.Stats.String())
+	}
+
+	target := filepath.Join(dir, "target")
+	if errs := restoreSnapshot(t, r, snapshot, target, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+
+	files["escaped"] = files["../escaped"]
+	delete(files, "../escaped")
+	for name, content := range files {
+		path := filepath.Join(target, filepath.FromSlash(name))
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("Failed reading restored file: %s", err)
+			continue
+		}
+		if string(b) != content {
+			t.Errorf("%s: expected content %q, got %q", name, content, b)
+		}
+
+		fi, _ := os.Stat(path)
+		if fi.Mode().Perm() != 0640 {
+			t.Errorf("%s: expected mode %v, got %v", name, os.FileMode(0640), fi.Mode().Perm())
+		}
+		if !fi.ModTime().Equal(modTime) {
+			t.Errorf("%s: expected mtime %v, got %v", name, modTime, fi.ModTime())
+		}
+	}
+
+	link, err := os.Readlink(filepath.Join(target, "dir", "link"))
+	if err != nil || link != "sub/b" {
+		t.Errorf("Expected symlink to sub/b, got %q (%v)", link, err)
+	}
+}
@@ -0,0 +1,313 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+const (
+	// indexPartLoaders is the amount of parts of a chunk-index loaded in
+	// parallel
+	indexPartLoaders = 8
+
+	// indexPartIDPrefix tells the parts of a chunk-index apart from chunks
+	indexPartIDPrefix = "index-"
+)
+
+// indexParts tracks the parts a chunk-index is stored in, see ChunkIndex.
+type indexParts struct {
+	mut    sync.Mutex
+	stored map[string]string // IDs of the stored parts, by hash prefix
+	loaded map[string]bool   // prefixes whose stored part got loaded
+	err    error             // set if a part failed to load
+}
+
+func newIndexParts() *indexParts {
+	return &indexParts{
+		stored: make(map[string]string),
+		loaded: make(map[string]bool),
+	}
+}
+
+// indexPartPrefix returns the prefix of the part of the chunk-index holding
+// the chunk with hash: the first byte of the hash.
+func indexPartPrefix(hash string) string {
+	if len(hash) < 2 {
+		return hash
+	}
+	return hash[:2]
+}
+
+// indexPartID returns the ID of the part of the chunk-index holding chunks,
+// which it gets stored as next to the chunks. It only depends on the content
+// of the part, so unchanged parts keep their ID and don't need to be stored
+// again.
+func indexPartID(key string, chunks map[string]*ChunkIndexItem) (string, error) {
+	// unlike gob, JSON encodes maps in a stable order. Gob doesn't tell empty
+	// and missing slices apart, though
+	items := make(map[string]ChunkIndexItem, len(chunks))
+	for hash, chunk := range chunks {
+		item := *chunk
+		if len(item.Snapshots) == 0 {
+			item.Snapshots = nil
+		}
+		items[hash] = item
+	}
+	b, err := json.Marshal(items)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, deriveIndexKey(key, "chunk-index:part"))
+	_, _ = mac.Write(b)
+	return indexPartIDPrefix + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// failed returns the error a part failed to load with, if any.
+func (parts *indexParts) failed() error {
+	parts.mut.Lock()
+	defer parts.mut.Unlock()
+
+	return parts.err
+}
+
+// ids returns the IDs of all stored parts.
+func (parts *indexParts) ids() []string {
+	parts.mut.Lock()
+	defer parts.mut.Unlock()
+
+	var ids []string
+	for _, id := range parts.stored {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// stale returns the IDs of the parts only used by the generation of the
+// chunk-index that gets dropped by storing one with the given parts. Without
+// a previous generation being kept, that's the currently stored one.
+func (parts *indexParts) stale(repository *Repository, stored map[string]string, rotate bool) []string {
+	if !rotate {
+		// the stored generation is corrupt and only gets replaced
+		return nil
+	}
+
+	used := make(map[string]bool)
+	for _, id := range stored {
+		used[id] = true
+	}
+	parts.mut.Lock()
+	dropped := make(map[string]string, len(parts.stored))
+	for prefix, id := range parts.stored {
+		dropped[prefix] = id
+	}
+	parts.mut.Unlock()
+
+	if repository.backend.rotatesIndex() {
+		// the stored generation becomes the previous one
+		for _, id := range dropped {
+			used[id] = true
+		}
+		dropped = nil
+		if b, err := repository.backend.LoadPreviousChunkIndex(); err == nil {
+			if previous, err := openIndex(b, repository.Key); err == nil {
+				dropped = previous.Parts
+			}
+		}
+	}
+
+	var ids []string
+	for _, id := range dropped {
+		if !used[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// loadParts loads the parts of a lazily opened chunk-index holding the chunks
+// with hashes, or all of its parts if hashes is nil.
+func (index *ChunkIndex) loadParts(hashes []string) error {
+	if err := index.open(); err != nil {
+		return err
+	}
+
+	index.parts.mut.Lock()
+	defer index.parts.mut.Unlock()
+	if index.parts.err != nil {
+		return index.parts.err
+	}
+	index.parts.err = index.loadStoredParts(index.repository, hashes)
+	return index.parts.err
+}
+
+// loadStoredParts loads the parts holding the chunks with hashes, or all
+// parts if hashes is nil, unless they've been loaded already. The caller must
+// hold the lock of index.parts.
+func (index *ChunkIndex) loadStoredParts(repository *Repository, hashes []string) error {
+	var prefixes []string
+	if hashes == nil {
+		for prefix := range index.parts.stored {
+			prefixes = append(prefixes, prefix)
+		}
+	} else {
+		for _, hash := range hashes {
+			prefixes = append(prefixes, indexPartPrefix(hash))
+		}
+	}
+
+	pending := make(map[string]string)
+	for _, prefix := range prefixes {
+		if id, ok := index.parts.stored[prefix]; ok && !index.parts.loaded[prefix] {
+			pending[prefix] = id
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	type loadedPart struct {
+		prefix string
+		chunks map[string]*ChunkIndexItem
+		err    error
+	}
+	queue := make(chan string)
+	results := make(chan loadedPart)
+	workers := indexPartLoaders
+	if len(pending) < workers {
+		workers = len(pending)
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for prefix := range queue {
+				chunks, err := loadIndexPart(repository, prefix, pending[prefix])
+				results <- loadedPart{prefix, chunks, err}
+			}
+		}()
+	}
+	go func() {
+		for prefix := range pending {
+			queue <- prefix
+		}
+		close(queue)
+	}()
+
+	var err error
+	for range pending {
+		part := <-results
+		if part.err == nil {
+			part.err = index.use(part.chunks)
+		}
+		if part.err != nil {
+			err = part.err
+			continue
+		}
+		index.parts.loaded[part.prefix] = true
+	}
+	return err
+}
+
+// loadIndexPart loads and verifies the part of the chunk-index with id,
+// holding the chunks with prefix.
+func loadIndexPart(repository *Repository, prefix, id string) (map[string]*ChunkIndexItem, error) {
+	b, err := repository.backend.loadIndexPart(id)
+	if err != nil {
+		repository.log().Error("Loading chunk-index part ", id, " failed: ", err)
+		return nil, err
+	}
+	part, err := openIndex(b, repository.Key)
+	if err != nil {
+		repository.log().Error("Loading chunk-index part ", id, " failed: ", err)
+		return nil, err
+	}
+
+	// the stored chunk-index pins the content of its parts
+	if pid, err := indexPartID(repository.Key, part.Chunks); err != nil || pid != id {
+		return nil, ErrIndexCorrupt
+	}
+	for hash := range part.Chunks {
+		if indexPartPrefix(hash) != prefix {
+			return nil, ErrIndexCorrupt
+		}
+	}
+	return part.Chunks, nil
+}
+
+// storeParts stores the parts of the index that changed, and returns the IDs
+// of all of its parts. Parts that never got loaded remain unchanged. Once the
+// chunk-index listing them got stored, the IDs need to be committed.
+func (index *ChunkIndex) storeParts(repository *Repository) (map[string]string, error) {
+	index.parts.mut.Lock()
+	defer index.parts.mut.Unlock()
+
+	index.mut.Lock()
+	byPrefix := make(map[string]map[string]*ChunkIndexItem)
+	for hash, chunk := range index.Chunks {
+		prefix := indexPartPrefix(hash)
+		if byPrefix[prefix] == nil {
+			byPrefix[prefix] = make(map[string]*ChunkIndexItem)
+		}
+		byPrefix[prefix][hash] = chunk
+	}
+
+	ids := make(map[string]string)
+	for prefix, id := range index.parts.stored {
+		if !index.parts.loaded[prefix] {
+			ids[prefix] = id
+		}
+	}
+	changed := make(map[string][]byte)
+	var err error
+	for prefix, chunks := range byPrefix {
+		var id string
+		id, err = indexPartID(repository.Key, chunks)
+		if err != nil {
+			break
+		}
+		ids[prefix] = id
+		if id == index.parts.stored[prefix] {
+			continue
+		}
+		changed[id], err = sealIndex(repository.Key, storedIndex{Chunks: chunks})
+		if err != nil {
+			break
+		}
+	}
+	index.mut.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	for id, b := range changed {
+		if err := repository.backend.storeIndexPart(id, b); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// commit records the IDs of the parts of the stored chunk-index. Parts that
+// got stored from memory mustn't be loaded again.
+func (parts *indexParts) commit(stored map[string]string) {
+	parts.mut.Lock()
+	defer parts.mut.Unlock()
+
+	for prefix, id := range stored {
+		if parts.stored[prefix] != id {
+			parts.loaded[prefix] = true
+		}
+	}
+	parts.stored = stored
+}
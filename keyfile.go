@@ -0,0 +1,96 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+)
+
+// Methods of unlocking a repository. A repository requires all methods it
+// has been created with.
+const (
+	UnlockPassword = 1 << iota // The repository password
+	UnlockKeyfile              // The content of a keyfile
+)
+
+// Error declarations.
+var (
+	ErrEmptyKeyfile     = errors.New("Keyfile is empty")
+	ErrKeyfileRequired  = errors.New("Repository can only be unlocked with a keyfile")
+	ErrPasswordRequired = errors.New("Repository can only be unlocked with a password")
+	ErrNoUnlockMethod   = errors.New("Repository needs a password, a keyfile or both")
+
+	// unlockHeader precedes the encrypted metadata of repositories not
+	// unlocked by a password alone, followed by a byte of unlock methods
+	unlockHeader = []byte("knoxite-unlock:")
+)
+
+// readKeyfile returns the hash of the keyfile at path.
+func readKeyfile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if len(b) == 0 {
+		return "", ErrEmptyKeyfile
+	}
+
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// unlockMethods returns the methods unlocking a repository with password and
+// the keyfile hash keyfile.
+func unlockMethods(password, keyfile string) uint8 {
+	var methods uint8
+	if password != "" {
+		methods |= UnlockPassword
+	}
+	if keyfile != "" {
+		methods |= UnlockKeyfile
+	}
+	return methods
+}
+
+// unlockSecret combines password and the keyfile hash keyfile to the secret
+// the repository metadata gets encrypted with. Password-only repositories
+// use the password itself, so they stay compatible with older versions.
+func unlockSecret(password, keyfile string) string {
+	switch unlockMethods(password, keyfile) {
+	case UnlockKeyfile:
+		return "keyfile:" + keyfile
+	case UnlockPassword | UnlockKeyfile:
+		return "keyfile:" + keyfile + ":" + password
+	}
+	return password
+}
+
+// addUnlockHeader prepends the header recording methods to the encrypted
+// repository metadata b.
+func addUnlockHeader(b []byte, methods uint8) []byte {
+	if methods == UnlockPassword {
+		return b
+	}
+
+	header := append(append([]byte{}, unlockHeader...), methods)
+	return append(header, b...)
+}
+
+// stripUnlockHeader returns the unlock methods recorded in the header of the
+// repository metadata b, and the encrypted metadata following it.
+func stripUnlockHeader(b []byte) (uint8, []byte) {
+	if !bytes.HasPrefix(b, unlockHeader) || len(b) <= len(unlockHeader) {
+		return UnlockPassword, b
+	}
+
+	return b[len(unlockHeader)], b[len(unlockHeader)+1:]
+}
@@ -0,0 +1,48 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import "time"
+
+// A Limiter bounds the amount of chunk operations in flight on the storage
+// backends. Share one between snapshots stored at the same time, so together
+// they don't overwhelm the backends, see StoreOptions.Limiter.
+type Limiter struct {
+	slots chan struct{}
+}
+
+// NewLimiter returns a Limiter allowing up to n operations at once.
+func NewLimiter(n int) *Limiter {
+	if n < 1 {
+		n = 1
+	}
+	return &Limiter{slots: make(chan struct{}, n)}
+}
+
+// acquire blocks until another operation may start, or until abort fires,
+// returning false then. A nil abort never fires and a nil Limiter doesn't
+// limit anything.
+func (l *Limiter) acquire(abort <-chan time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-abort:
+		return false
+	}
+}
+
+// release marks an operation started with acquire as done.
+func (l *Limiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
@@ -14,6 +14,24 @@ import (
 	"os"
 )
 
+// LogHandler receives the diagnostics of repository operations. Inject an
+// implementation with RepositoryOptions to route them into your own logging
+// framework. Logger implements it.
+type LogHandler interface {
+	Debug(v ...interface{})
+	Info(v ...interface{})
+	Warn(v ...interface{})
+	Error(v ...interface{})
+}
+
+// noopLogger discards all messages.
+type noopLogger struct{}
+
+func (noopLogger) Debug(v ...interface{}) {}
+func (noopLogger) Info(v ...interface{})  {}
+func (noopLogger) Warn(v ...interface{})  {}
+func (noopLogger) Error(v ...interface{}) {}
+
 type Logger struct {
 	VerbosityLevel Verbosity
 	w              io.Writer
@@ -31,6 +49,14 @@ func (l *Logger) WithWriter(w io.Writer) *Logger {
 	return l
 }
 
+func (l Logger) Error(v ...interface{}) {
+	l.log(LogLevelError, v...)
+}
+
+func (l Logger) Errorf(format string, v ...interface{}) {
+	l.logf(LogLevelError, format, v...)
+}
+
 func (l Logger) Warn(v ...interface{}) {
 	l.log(LogLevelWarning, v...)
 }
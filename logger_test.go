@@ -0,0 +1,98 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// capturingLogger records all messages it receives.
+type capturingLogger struct {
+	mut      sync.Mutex
+	messages []string
+}
+
+func (l *capturingLogger) record(level string, v ...interface{}) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.messages = append(l.messages, level+": "+fmt.Sprint(v...))
+}
+
+func (l *capturingLogger) Debug(v ...interface{}) { l.record("Debug", v...) }
+func (l *capturingLogger) Info(v ...interface{})  { l.record("Info", v...) }
+func (l *capturingLogger) Warn(v ...interface{})  { l.record("Warn", v...) }
+func (l *capturingLogger) Error(v ...interface{}) { l.record("Error", v...) }
+
+func (l *capturingLogger) contains(s string) bool {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	for _, m := range l.messages {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestLogHandler(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "data")
+	_ = ioutil.WriteFile(file, []byte("some content"), 0600)
+
+	logger := &capturingLogger{}
+	r, err := NewRepositoryWithOptions("mem://log-handler", testPassword, RepositoryOptions{Logger: logger})
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{file},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	})
+	if err := snapshot.Save(&r); err != nil {
+		t.Fatalf("Failed saving snapshot: %s", err)
+	}
+
+	for _, expected := range []string{
+		"Info: Created repository at mem://log-handler",
+		"Info: Adding to snapshot " + snapshot.ID,
+		"Debug: Storing file " + file,
+		"Info: Added to snapshot " + snapshot.ID,
+		"Debug: Saving snapshot " + snapshot.ID,
+	} {
+		if !logger.contains(expected) {
+			t.Errorf("Expected %q to be logged, got %v", expected, logger.messages)
+		}
+	}
+
+	// a repository without a logger must not fail
+	r, err = OpenRepository("mem://log-handler", testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	r.log().Info("discarded")
+}
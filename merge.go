@@ -0,0 +1,107 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Error declarations.
+var (
+	ErrNothingToMerge = errors.New("No snapshots to merge")
+)
+
+// MergeSnapshots creates a new snapshot in volume from the union of the
+// archives of the snapshots with ids. If a path is contained in more than one
+// of them, the archive of the most recent snapshot wins, so the merged
+// snapshot reflects the latest state of every path. No chunks get stored, the
+// merged snapshot references the chunks of the merged snapshots, which can
+// be removed afterwards. The merged snapshot gets the date of the most recent
+// one. It gets saved, but the chunk-index and the repository need to be
+// saved afterwards.
+func MergeSnapshots(repository *Repository, volume *Volume, index *ChunkIndex, ids []string) (*Snapshot, error) {
+	if len(ids) == 0 {
+		return nil, ErrNothingToMerge
+	}
+
+	snapshots := []*Snapshot{}
+	for _, id := range ids {
+		snapshot, err := volume.LoadSnapshot(id, repository)
+		if err != nil {
+			return nil, err
+		}
+		if len(snapshots) > 0 && snapshot.AbsolutePaths != snapshots[0].AbsolutePaths {
+			return nil, ErrMixedPaths
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Date.Before(snapshots[j].Date)
+	})
+
+	latest := snapshots[len(snapshots)-1]
+	merged, err := repository.NewSnapshot("Merged from " + strings.Join(ids, ", "))
+	if err != nil {
+		return nil, err
+	}
+	merged.Date = latest.Date
+	merged.AbsolutePaths = latest.AbsolutePaths
+
+	// later snapshots overwrite the archives of earlier ones
+	for _, snapshot := range snapshots {
+		err := snapshot.EachArchive(func(arc *Archive) error {
+			a := *arc
+			merged.AddArchive(&a)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	chunks := make(map[string]bool)
+	for _, arc := range merged.Archives {
+		for _, chunk := range arc.Chunks {
+			chunks[chunk.Hash] = true
+		}
+		switch arc.Type {
+		case File:
+			merged.Stats.Files++
+		case Directory:
+			merged.Stats.Dirs++
+		case SymLink:
+			merged.Stats.SymLinks++
+		}
+		merged.Stats.Size += arc.Size
+		if arc.Failed {
+			merged.Partial = true
+		}
+		index.AddArchive(arc, merged.ID)
+	}
+
+	// keep the parity groups whose chunks are all still referenced
+	for _, snapshot := range snapshots {
+		for _, group := range snapshot.ParityGroups {
+			referenced := true
+			for _, m := range group.Members {
+				referenced = referenced && chunks[m.Hash]
+			}
+			if referenced {
+				merged.ParityGroups = append(merged.ParityGroups, group)
+				index.AddParityGroup(group, merged.ID)
+			}
+		}
+	}
+
+	if err := merged.Save(repository); err != nil {
+		return nil, err
+	}
+	return merged, volume.AddSnapshot(merged.ID)
+}
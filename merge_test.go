@@ -0,0 +1,104 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMergeSnapshots(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository("mem://merge", testPassword)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+
+	// every snapshot of the chain only stores what changed
+	chain := []map[string]string{
+		{"a": "a1", "b": "b1"},
+		{"b": "b2", "c": "c2"},
+		{"a": "a3"},
+	}
+	var ids []string
+	date := time.Now().Add(-time.Hour)
+	for i, files := range chain {
+		var paths []string
+		for name, content := range files {
+			path := filepath.Join(src, name)
+			_ = ioutil.WriteFile(path, []byte(content), 0644)
+			paths = append(paths, path)
+		}
+
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:       wd,
+			Paths:     paths,
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+		})
+		snapshot.Date = date.Add(time.Duration(i) * time.Minute)
+		_ = snapshot.Save(&r)
+		_ = vol.AddSnapshot(snapshot.ID)
+		ids = append(ids, snapshot.ID)
+	}
+
+	// the order of ids doesn't matter, the snapshots' dates do
+	merged, err := MergeSnapshots(&r, vol, &index, []string{ids[2], ids[0], ids[1]})
+	if err != nil {
+		t.Fatalf("Failed merging snapshots: %s", err)
+	}
+	if !merged.Date.Equal(date.Add(2*time.Minute)) || merged.Stats.Files != 3 {
+		t.Errorf("Expected merged snapshot of 3 files with the latest date, got %+v at %s", merged.Stats, merged.Date)
+	}
+
+	// the merged snapshot stays restorable once the chain is gone
+	for _, id := range ids {
+		snapshot, _ := vol.LoadSnapshot(id, &r)
+		_ = vol.RemoveSnapshot(id)
+		_ = index.ReleaseSnapshot(snapshot)
+	}
+	if unreferenced := index.Unreferenced(); len(unreferenced) != 2 {
+		t.Errorf("Expected the chunks of the 2 outdated files to be unreferenced, got %d", len(unreferenced))
+	}
+
+	merged, err = openSnapshot(merged.ID, &r)
+	if err != nil {
+		t.Fatalf("Failed opening merged snapshot: %s", err)
+	}
+	dst := filepath.Join(dir, "dst")
+	if errs := restoreSnapshot(t, r, merged, dst, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring merged snapshot: %v", errs)
+	}
+	for name, expected := range map[string]string{"a": "a3", "b": "b2", "c": "c2"} {
+		b, err := ioutil.ReadFile(filepath.Join(dst, src, name))
+		if err != nil || string(b) != expected {
+			t.Errorf("Expected %s to contain %q, got %q (%v)", name, expected, b, err)
+		}
+	}
+
+	if _, err := MergeSnapshots(&r, vol, &index, nil); err != ErrNothingToMerge {
+		t.Errorf("Expected %v, got %v", ErrNothingToMerge, err)
+	}
+}
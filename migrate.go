@@ -0,0 +1,369 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Error declarations.
+var (
+	ErrMigrationVerifyFailed = errors.New("Migrated object does not match its source")
+)
+
+// MigrateOptions holds the settings for Repository.MigrateTo.
+type MigrateOptions struct {
+	// Reshard splits the chunks into DataParts data parts and ParityParts
+	// parity parts on the destination, instead of copying their parts as
+	// they are, e.g. to add parity parts when moving to a single backend.
+	// Without ParityParts, chunks get stored as a single part. Chunks
+	// protected by a ParityGroup keep their parts
+	Reshard     bool
+	DataParts   uint
+	ParityParts uint
+}
+
+// MigrateTo copies all objects of a repository (repository metadata,
+// snapshots, chunk-index and chunks) to the backend dst. Unlike Migrate,
+// which upgrades the repository format in place, it moves the repository to
+// another storage backend.
+// Objects that already exist on dst with the same content are skipped, so an
+// interrupted migration can simply be started again. Every copied object gets
+// read back from dst and compared to its source. When re-sharding, the
+// snapshots and the chunk-index get re-encoded and are stored again on every
+// run, with the chunk-index holding all of its chunks instead of parts until
+// it gets saved on dst.
+//
+// The last Progress sent on the channel contains the totals: Files is the
+// amount of migrated objects, Errors the amount of objects that failed to
+// migrate or verify.
+func (r *Repository) MigrateTo(dst Backend, opts MigrateOptions) (chan Progress, error) {
+	if opts.Reshard {
+		if opts.ParityParts == 0 {
+			opts.DataParts = 1
+		} else if _, err := reedsolomon.New(int(opts.DataParts), int(opts.ParityParts)); err != nil {
+			return nil, err
+		}
+	}
+
+	err := dst.InitRepository()
+	if err != nil && err != ErrRepositoryExists {
+		return nil, err
+	}
+
+	index, err := OpenChunkIndex(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// chunks protected by parity groups get repaired by their hash & part 0,
+	// and pack objects get loaded in ranges, so they have to keep their parts
+	grouped := make(map[string]bool)
+	if opts.Reshard {
+		grouped = r.parityGroupChunks()
+		for _, chunk := range index.Chunks {
+			if chunk.PackObject {
+				grouped[chunk.Hash] = true
+			}
+		}
+	}
+	reshards := func(hash string) bool {
+		return opts.Reshard && !grouped[hash]
+	}
+
+	prog := make(chan Progress)
+	go func() {
+		var stats Stats
+		report := func(path string, size int, err error) {
+			p := Progress{Path: path}
+			if err != nil {
+				p.Error = err
+				stats.Errors++
+			} else {
+				stats.Files++
+				stats.Size += uint64(size)
+				stats.Transferred += uint64(size)
+				p.CurrentItemStats.Size = uint64(size)
+				p.CurrentItemStats.Transferred = uint64(size)
+			}
+			p.TotalStatistics = stats
+			prog <- p
+		}
+
+		for _, chunk := range index.Chunks {
+			if chunk.Pack != "" {
+				// migrated as part of its pack object
+				continue
+			}
+			if reshards(chunk.Hash) {
+				r.reshardChunk(dst, chunk, opts, report)
+				continue
+			}
+
+			c := Chunk{Hash: chunk.Hash, DataParts: chunk.DataParts}
+			for i := uint(0); i < chunk.DataParts+chunk.ParityParts; i++ {
+				path := fmt.Sprintf("chunk %s.%d_%d", chunk.Hash, i, chunk.DataParts)
+
+				b, err := r.backend.LoadChunk(c, i)
+				if err != nil {
+					report(path, 0, err)
+					continue
+				}
+				err = migrateObject(b,
+					func() ([]byte, error) { return dst.LoadChunk(chunk.Hash, i, chunk.DataParts) },
+					func() error {
+						_, serr := dst.StoreChunk(chunk.Hash, i, chunk.DataParts, b)
+						return serr
+					})
+				report(path, len(b), err)
+			}
+		}
+
+		for _, volume := range r.Volumes {
+			for _, snapshotID := range volume.Snapshots {
+				if opts.Reshard {
+					r.reshardSnapshot(dst, snapshotID, opts, reshards, report)
+					continue
+				}
+
+				ids := []string{snapshotID}
+				if snapshot, err := openSnapshot(snapshotID, r); err == nil {
+					// the snapshot's archive segments are stored separately
+					for n := uint(0); n < snapshot.ArchiveSegments; n++ {
+						ids = append(ids, snapshot.archiveSegmentID(n))
+					}
+				}
+
+				for _, id := range ids {
+					path := "snapshot " + id
+
+					b, err := r.backend.LoadSnapshot(id)
+					if err != nil {
+						report(path, 0, err)
+						continue
+					}
+					err = migrateObject(b,
+						func() ([]byte, error) { return dst.LoadSnapshot(id) },
+						func() error { return dst.SaveSnapshot(id, b) })
+					report(path, len(b), err)
+				}
+			}
+		}
+
+		if !opts.Reshard {
+			// the chunk-index only lists its parts, which have to be there
+			// first
+			for _, id := range index.parts.ids() {
+				id := id
+				path := "chunk-index part " + id
+
+				b, err := r.backend.loadIndexPart(id)
+				if err != nil {
+					report(path, 0, err)
+					continue
+				}
+				err = migrateObject(b,
+					func() ([]byte, error) { return dst.LoadChunk(id, 0, 1) },
+					func() error {
+						_, err := dst.StoreChunk(id, 0, 1, b)
+						return err
+					})
+				report(path, len(b), err)
+			}
+		}
+
+		b, err := r.backend.LoadChunkIndex()
+		if err == nil && opts.Reshard {
+			b, err = opts.reshardIndex(&index, reshards).seal(r.Key)
+		}
+		if err != nil {
+			report("chunk-index", 0, err)
+		} else {
+			err = migrateObject(b, dst.LoadChunkIndex, func() error { return dst.SaveChunkIndex(b) })
+			report("chunk-index", len(b), err)
+		}
+
+		// the repository metadata needs to point to the new location
+		b, err = r.encodeForLocations([]string{dst.Location()})
+		if err != nil {
+			report("repository", 0, err)
+		} else {
+			err = migrateObject(b, dst.LoadRepository, func() error { return dst.SaveRepository(b) })
+			report("repository", len(b), err)
+		}
+
+		close(prog)
+	}()
+
+	return prog, nil
+}
+
+// parityGroupChunks returns the hashes of the parity groups of all
+// snapshots and of the chunks they protect.
+func (r *Repository) parityGroupChunks() map[string]bool {
+	grouped := make(map[string]bool)
+	for _, volume := range r.Volumes {
+		for _, snapshotID := range volume.Snapshots {
+			snapshot, err := openSnapshot(snapshotID, r)
+			if err != nil {
+				// reported when migrating the snapshot
+				continue
+			}
+			for _, group := range snapshot.ParityGroups {
+				grouped[group.Hash] = true
+				for _, m := range group.Members {
+					grouped[m.Hash] = true
+				}
+			}
+		}
+	}
+
+	return grouped
+}
+
+// reshardChunk splits chunk into the parts set by opts and stores them on
+// dst.
+func (r *Repository) reshardChunk(dst Backend, chunk *ChunkIndexItem, opts MigrateOptions, report func(string, int, error)) {
+	b, err := fetchChunk(*r, Chunk{
+		Hash:        chunk.Hash,
+		DataParts:   chunk.DataParts,
+		ParityParts: chunk.ParityParts,
+		Size:        chunk.Size,
+	})
+	if err != nil {
+		report("chunk "+chunk.Hash, 0, err)
+		return
+	}
+
+	pars := [][]byte{b}
+	if opts.ParityParts > 0 {
+		pars, err = redundantData(b, int(opts.DataParts), int(opts.ParityParts))
+		if err != nil {
+			report("chunk "+chunk.Hash, 0, err)
+			return
+		}
+	}
+
+	for i, part := range pars {
+		i, part := uint(i), part
+		err := migrateObject(part,
+			func() ([]byte, error) { return dst.LoadChunk(chunk.Hash, i, opts.DataParts) },
+			func() error {
+				_, serr := dst.StoreChunk(chunk.Hash, i, opts.DataParts, part)
+				return serr
+			})
+		report(fmt.Sprintf("chunk %s.%d_%d", chunk.Hash, i, opts.DataParts), len(part), err)
+	}
+}
+
+// reshardSnapshot stores the snapshot id and its archive segments on dst,
+// referring to the chunks with the parts set by opts.
+func (r *Repository) reshardSnapshot(dst Backend, id string, opts MigrateOptions, reshards func(hash string) bool, report func(string, int, error)) {
+	snapshot, err := openSnapshot(id, r)
+	if err != nil {
+		report("snapshot "+id, 0, err)
+		return
+	}
+	pipe, err := NewEncodingPipeline(CompressionLZMA, EncryptionAES, r.Key)
+	if err != nil {
+		report("snapshot "+id, 0, err)
+		return
+	}
+
+	store := func(id string, v interface{}) {
+		b, err := pipe.Encode(v)
+		if err == nil {
+			err = migrateObject(b,
+				func() ([]byte, error) { return dst.LoadSnapshot(id) },
+				func() error { return dst.SaveSnapshot(id, b) })
+		}
+		report("snapshot "+id, len(b), err)
+	}
+
+	for n := uint(0); n < snapshot.ArchiveSegments; n++ {
+		segmentID := snapshot.archiveSegmentID(n)
+		archives, err := snapshot.loadArchiveSegment(n)
+		if err == nil {
+			opts.reshardArchives(archives, reshards)
+			if snapshot.Digest != "" {
+				snapshot.SegmentDigests[n], err = segmentDigest(r.Key, segmentID, archives)
+			}
+		}
+		if err != nil {
+			report("snapshot "+segmentID, 0, err)
+			continue
+		}
+		store(segmentID, archives)
+	}
+
+	opts.reshardArchives(snapshot.sortedArchives(), reshards)
+	if snapshot.Digest != "" {
+		snapshot.Digest, err = snapshot.digest(r.Key)
+		if err != nil {
+			report("snapshot "+id, 0, err)
+			return
+		}
+	}
+	store(id, snapshot)
+}
+
+// reshardArchives updates the parts of the archives' chunks to the ones set
+// by opts.
+func (opts MigrateOptions) reshardArchives(archives []*Archive, reshards func(hash string) bool) {
+	for _, arc := range archives {
+		for i := range arc.Chunks {
+			if arc.Chunks[i].Pack == "" && reshards(arc.Chunks[i].Hash) {
+				arc.Chunks[i].DataParts = opts.DataParts
+				arc.Chunks[i].ParityParts = opts.ParityParts
+			}
+		}
+	}
+}
+
+// reshardIndex returns a copy of index with the parts of its chunks updated
+// to the ones set by opts.
+func (opts MigrateOptions) reshardIndex(index *ChunkIndex, reshards func(hash string) bool) *ChunkIndex {
+	resharded := newChunkIndex()
+	for hash, chunk := range index.Chunks {
+		c := *chunk
+		if c.Pack == "" && reshards(hash) {
+			c.DataParts = opts.DataParts
+			c.ParityParts = opts.ParityParts
+		}
+		resharded.Chunks[hash] = &c
+	}
+
+	return &resharded
+}
+
+// migrateObject stores b using store, unless load already returns identical
+// data. The stored object is read back and verified afterwards.
+func migrateObject(b []byte, load func() ([]byte, error), store func() error) error {
+	hashsum := Hash(b, HashHighway256)
+	if eb, err := load(); err == nil && Hash(eb, HashHighway256) == hashsum {
+		// already migrated
+		return nil
+	}
+
+	if err := store(); err != nil {
+		return err
+	}
+
+	eb, err := load()
+	if err != nil {
+		return err
+	}
+	if Hash(eb, HashHighway256) != hashsum {
+		return ErrMigrationVerifyFailed
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var migrateTestPaths = []string{"snapshot_test.go", "snapshot.go", "migrate.go"}
+
+// storeMigrateTestRepository creates a repository url with a single
+// snapshot of migrateTestPaths.
+func storeMigrateTestRepository(t *testing.T, url, password string) (Repository, *Snapshot, ChunkIndex) {
+	r, err := NewRepository(url, password)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+
+	snapshot, _ := NewSnapshot("test_snapshot")
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+	wd, _ := os.Getwd()
+
+	opts := StoreOptions{
+		CWD:                 wd,
+		Paths:               migrateTestPaths,
+		Compress:            CompressionGZip,
+		Encrypt:             EncryptionAES,
+		DataParts:           1,
+		ParityParts:         0,
+		MaxArchivesInMemory: 2,
+	}
+	for p := range snapshot.Add(r, &index, opts) {
+		if p.Error != nil {
+			t.Errorf("Failed adding to snapshot: %s", p.Error)
+		}
+	}
+	_ = snapshot.Save(&r)
+	_ = vol.AddSnapshot(snapshot.ID)
+	_ = index.Save(&r)
+	_ = r.Save()
+	if snapshot.ArchiveSegments == 0 {
+		t.Fatalf("Expected archives to be stored in segments")
+	}
+
+	return r, snapshot, index
+}
+
+// migrateTestRepository migrates r to dst and returns the totals.
+func migrateTestRepository(t *testing.T, r Repository, dst Backend, opts MigrateOptions) Stats {
+	progress, err := r.MigrateTo(dst, opts)
+	if err != nil {
+		t.Fatalf("Failed migrating repository: %s", err)
+	}
+
+	var last Progress
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed migrating %s: %s", p.Path, p.Error)
+		}
+		last = p
+	}
+	return last.TotalStatistics
+}
+
+// verifyMigratedSnapshot restores the snapshot id from the repository url
+// and compares it to migrateTestPaths.
+func verifyMigratedSnapshot(t *testing.T, url, password, id string) {
+	nr, err := OpenRepository(url, password)
+	if err != nil {
+		t.Fatalf("Failed opening migrated repository: %s", err)
+	}
+
+	_, s, err := nr.FindSnapshot(id)
+	if err != nil {
+		t.Fatalf("Failed finding snapshot in migrated repository: %s", err)
+	}
+
+	targetdir, err := ioutil.TempDir("", "knoxite.target")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir for restore: %s", err)
+	}
+	defer os.RemoveAll(targetdir)
+
+	progress, err := DecodeSnapshot(nr, s, targetdir, RestoreOptions{})
+	if err != nil {
+		t.Fatalf("Failed restoring snapshot: %s", err)
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed restoring snapshot: %s", p.Error)
+		}
+	}
+
+	for _, path := range migrateTestPaths {
+		hash1, _ := hashFile(path)
+		hash2, err := hashFile(filepath.Join(targetdir, path))
+		if err != nil || hash1 != hash2 {
+			t.Errorf("Failed verifying restored file %s: %v", path, err)
+		}
+	}
+}
+
+func TestRepositoryMigrateTo(t *testing.T) {
+	testPassword := "this_is_a_password"
+	r, snapshot, index := storeMigrateTestRepository(t, "mem://migrate-src", testPassword)
+
+	dst, err := BackendFromURL("mem://migrate-dst")
+	if err != nil {
+		t.Fatalf("Failed creating destination backend: %s", err)
+	}
+
+	// migrating twice must be safe and skip already existing objects
+	for i := 0; i < 2; i++ {
+		stats := migrateTestRepository(t, r, dst, MigrateOptions{})
+		// chunks, one snapshot & its archive segments, the chunk-index & its
+		// parts and the repository
+		expected := uint64(len(index.Chunks)+3) + uint64(snapshot.ArchiveSegments) + uint64(len(index.parts.ids()))
+		if stats.Files != expected {
+			t.Errorf("Expected %d migrated objects, got %d", expected, stats.Files)
+		}
+	}
+
+	nr, err := OpenRepository("mem://migrate-dst", testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening migrated repository: %s", err)
+	}
+	if len(nr.Paths) != 1 || nr.Paths[0] != dst.Location() {
+		t.Errorf("Expected migrated repository to point to %s, got %v", dst.Location(), nr.Paths)
+	}
+
+	verifyMigratedSnapshot(t, "mem://migrate-dst", testPassword, snapshot.ID)
+}
+
+func TestRepositoryMigrateToReshard(t *testing.T) {
+	testPassword := "this_is_a_password"
+	r, snapshot, index := storeMigrateTestRepository(t, "mem://reshard-src", testPassword)
+
+	dst, err := BackendFromURL("mem://reshard-dst")
+	if err != nil {
+		t.Fatalf("Failed creating destination backend: %s", err)
+	}
+
+	opts := MigrateOptions{
+		Reshard:     true,
+		DataParts:   2,
+		ParityParts: 1,
+	}
+	stats := migrateTestRepository(t, r, dst, opts)
+	expected := uint64(len(index.Chunks)*3+3) + uint64(snapshot.ArchiveSegments)
+	if stats.Files != expected {
+		t.Errorf("Expected %d migrated objects, got %d", expected, stats.Files)
+	}
+
+	// every chunk must survive the loss of a part
+	for _, chunk := range index.Chunks {
+		if err := dst.DeleteChunk(chunk.Hash, 0, opts.DataParts); err != nil {
+			t.Errorf("Failed deleting part of chunk %s: %s", chunk.Hash, err)
+		}
+	}
+
+	nr, err := OpenRepository("mem://reshard-dst", testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening migrated repository: %s", err)
+	}
+	nindex, err := OpenChunkIndex(&nr)
+	if err != nil {
+		t.Fatalf("Failed opening migrated chunk-index: %s", err)
+	}
+	for _, chunk := range nindex.Chunks {
+		if chunk.DataParts != opts.DataParts || chunk.ParityParts != opts.ParityParts {
+			t.Errorf("Expected chunk %s to have %d+%d parts, got %d+%d", chunk.Hash,
+				opts.DataParts, opts.ParityParts, chunk.DataParts, chunk.ParityParts)
+		}
+	}
+
+	verifyMigratedSnapshot(t, "mem://reshard-dst", testPassword, snapshot.ID)
+}
@@ -0,0 +1,16 @@
+// +build darwin dragonfly linux netbsd openbsd solaris
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import "syscall"
+
+func sysMknod(path string, mode uint32, dev uint64) error {
+	return syscall.Mknod(path, mode, int(dev))
+}
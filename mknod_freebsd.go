@@ -0,0 +1,16 @@
+// +build freebsd
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import "syscall"
+
+func sysMknod(path string, mode uint32, dev uint64) error {
+	return syscall.Mknod(path, mode, dev)
+}
@@ -0,0 +1,37 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"os"
+	"syscall"
+)
+
+// mknod creates a FIFO or device node at path.
+func mknod(path string, mode os.FileMode, dev uint64) error {
+	m := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		m |= syscall.S_IFIFO
+	case mode&os.ModeCharDevice != 0:
+		m |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		m |= syscall.S_IFBLK
+	default:
+		return &os.PathError{Op: "mknod", Path: path, Err: ErrSpecialFile}
+	}
+
+	if err := sysMknod(path, m, dev); err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+
+	// mknod is subject to the umask
+	return os.Chmod(path, mode.Perm())
+}
@@ -0,0 +1,20 @@
+// +build windows
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"os"
+	"syscall"
+)
+
+// mknod is not supported on Windows.
+func mknod(path string, mode os.FileMode, dev uint64) error {
+	return &os.PathError{Op: "mknod", Path: path, Err: syscall.EWINDOWS}
+}
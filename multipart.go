@@ -0,0 +1,103 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"sync"
+)
+
+// MultipartUpload tracks the upload of a chunk part in pieces. Backends may
+// keep their own state of the upload in ID.
+type MultipartUpload struct {
+	Hash       string
+	Part       uint
+	TotalParts uint
+	ID         string
+	// Exists gets set by BeginUpload if the chunk part is already stored,
+	// which skips the upload
+	Exists bool
+	// Pieces holds the pieces that have been stored completely, in order
+	Pieces []UploadedPiece
+
+	mut sync.Mutex // held while the upload is in progress
+}
+
+// UploadedPiece identifies a stored piece of a MultipartUpload.
+type UploadedPiece struct {
+	Number int // starting at 1
+	ETag   string
+}
+
+// MultipartUploader is implemented by backends that can store a chunk part
+// in pieces, e.g. with S3 multipart uploads. Chunk parts larger than a piece
+// get stored that way, so retrying an interrupted upload resumes after the
+// last piece that got stored, instead of transferring all data again.
+type MultipartUploader interface {
+	// MultipartPieceSize returns the size of the pieces. Zero disables
+	// multipart uploads
+	MultipartPieceSize() int
+	// BeginUpload starts a new upload and sets its ID, or Exists
+	BeginUpload(upload *MultipartUpload) error
+	// UploadPiece stores the piece number of an upload
+	UploadPiece(upload *MultipartUpload, number int, data []byte) (UploadedPiece, error)
+	// CompleteUpload assembles the stored pieces to the chunk part
+	CompleteUpload(upload *MultipartUpload) error
+	// AbortUpload discards the stored pieces of an upload
+	AbortUpload(upload *MultipartUpload) error
+}
+
+// storeMultipart stores data with uploader, continuing upload after its
+// last stored piece. The pieces sent get recorded in bw.
+func storeMultipart(uploader MultipartUploader, upload *MultipartUpload, data []byte, bw *bandwidth) (uint64, error) {
+	// an attempt aborted by a timeout keeps running in the background
+	upload.mut.Lock()
+	defer upload.mut.Unlock()
+
+	if upload.ID == "" {
+		bw.send(0)
+		if err := uploader.BeginUpload(upload); err != nil {
+			return 0, err
+		}
+	}
+	if upload.Exists {
+		return 0, nil
+	}
+
+	size := uploader.MultipartPieceSize()
+	for offset := len(upload.Pieces) * size; offset < len(data); offset += size {
+		end := offset + size
+		if end > len(data) {
+			end = len(data)
+		}
+
+		bw.send(end - offset)
+		piece, err := uploader.UploadPiece(upload, len(upload.Pieces)+1, data[offset:end])
+		if err != nil {
+			return 0, err
+		}
+		upload.Pieces = append(upload.Pieces, piece)
+	}
+
+	bw.send(0)
+	if err := uploader.CompleteUpload(upload); err != nil {
+		return 0, err
+	}
+	return uint64(len(data)), nil
+}
+
+// multipartUploader returns be as a MultipartUploader, if it supports
+// storing data of size in pieces.
+func multipartUploader(be Backend, size int) (MultipartUploader, bool) {
+	uploader, ok := be.(MultipartUploader)
+	if !ok {
+		return nil, false
+	}
+
+	pieceSize := uploader.MultipartPieceSize()
+	return uploader, pieceSize > 0 && size > pieceSize
+}
@@ -0,0 +1,193 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// pendingPack collects the chunks of a pack object while storing a snapshot.
+type pendingPack struct {
+	id      string
+	data    []byte
+	offsets map[string]int // of the chunks in data, by hash
+}
+
+// packs returns whether chunk gets stored in a pack object instead of an
+// object of its own.
+func (opts StoreOptions) packs(chunk Chunk) bool {
+	return opts.PackSize > 0 && chunk.ParityParts == 0 && uint(chunk.Size) < opts.PackSize
+}
+
+// packChunk returns the chunk the pack object holding chunk is stored as.
+func (chunk Chunk) packChunk() Chunk {
+	return Chunk{
+		Hash:      chunk.Pack,
+		DataParts: 1,
+	}
+}
+
+// packedChunk returns the chunk with hash, if it's stored in a pack object
+// that's still referenced.
+func (index *ChunkIndex) packedChunk(hash string) (ChunkIndexItem, bool) {
+	_ = index.loadParts([]string{hash})
+	index.mut.Lock()
+	c, ok := index.Chunks[hash]
+	index.mut.Unlock()
+	if !ok || c.Pack == "" {
+		return ChunkIndexItem{}, false
+	}
+
+	_ = index.loadParts([]string{c.Pack})
+	index.mut.Lock()
+	defer index.mut.Unlock()
+	if p, ok := index.Chunks[c.Pack]; !ok || p.Refs == 0 {
+		// gets deleted by the next Pack
+		return ChunkIndexItem{}, false
+	}
+	return *c, true
+}
+
+// addToPack adds chunk to the pending pack object of the snapshot and sets
+// its location. Chunks already stored in a pack object keep their location.
+// Once the pack object is full, it gets stored. It returns the amount of
+// bytes added to the pack object.
+func (snapshot *Snapshot) addToPack(repository Repository, chunkIndex *ChunkIndex, chunk *Chunk, opts StoreOptions) (uint64, error) {
+	if c, ok := chunkIndex.packedChunk(chunk.Hash); ok {
+		chunk.Pack, chunk.Offset = c.Pack, c.Offset
+		return 0, nil
+	}
+	if offset, ok := snapshot.pendingPack.offsets[chunk.Hash]; ok {
+		chunk.Pack, chunk.Offset = snapshot.pendingPack.id, offset
+		return 0, nil
+	}
+
+	data := (*chunk.Data)[0]
+	if uint(len(snapshot.pendingPack.data)+len(data)) > opts.PackSize {
+		if err := snapshot.flushPack(repository); err != nil {
+			return 0, err
+		}
+	}
+
+	pending := &snapshot.pendingPack
+	if pending.id == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return 0, err
+		}
+		pending.id = hex.EncodeToString(b)
+		pending.offsets = make(map[string]int)
+	}
+	chunk.Pack, chunk.Offset = pending.id, len(pending.data)
+	pending.offsets[chunk.Hash] = chunk.Offset
+	pending.data = append(pending.data, data...)
+
+	return uint64(len(data)), nil
+}
+
+// flushPack stores the pending pack object of the snapshot, even if it isn't
+// full yet.
+func (snapshot *Snapshot) flushPack(repository Repository) error {
+	pending := snapshot.pendingPack
+	snapshot.pendingPack = pendingPack{}
+	if len(pending.data) == 0 {
+		return nil
+	}
+
+	_, err := repository.backend.StoreChunk(Chunk{
+		Hash:      pending.id,
+		DataParts: 1,
+		Size:      len(pending.data),
+		Data:      &[][]byte{pending.data},
+	})
+	return err
+}
+
+// packReadAhead loads the chunks of an archive, coalescing the loads of
+// consecutive chunks stored next to each other in the same pack object into
+// range reads of up to limit bytes, see RestoreOptions.ReadAhead. It's safe
+// for concurrent use, so chunks may get fetched out of order by prefetching
+// workers, but loads packed chunks one range read at a time.
+type packReadAhead struct {
+	mut        sync.Mutex
+	repository Repository
+	chunks     []Chunk
+	first      int // index of the first chunk getting fetched
+	limit      int
+	requested  map[int]bool   // chunks fetched or read ahead, by index
+	loaded     map[int][]byte // chunks read ahead, by index
+}
+
+// newPackReadAhead returns a packReadAhead for the chunks of arc, starting
+// with its chunk start.
+func newPackReadAhead(repository Repository, arc Archive, start uint, limit uint64) *packReadAhead {
+	first, err := arc.IndexOfChunk(start)
+	if err != nil {
+		first = 0
+	}
+
+	return &packReadAhead{
+		repository: repository,
+		chunks:     arc.Chunks,
+		first:      first,
+		limit:      int(limit),
+		requested:  make(map[int]bool),
+		loaded:     make(map[int][]byte),
+	}
+}
+
+// contiguous returns whether the chunk with index j is stored in the same pack
+// object right after the chunk with index i.
+func (ra *packReadAhead) contiguous(i, j int) bool {
+	return ra.chunks[j].Pack == ra.chunks[i].Pack && ra.chunks[j].Offset == ra.chunks[i].Offset+ra.chunks[i].Size
+}
+
+// fetch loads the chunk with index idx, like fetchChunk.
+func (ra *packReadAhead) fetch(idx int) ([]byte, error) {
+	chunk := ra.chunks[idx]
+	if chunk.Pack == "" || ra.limit == 0 {
+		return fetchChunk(ra.repository, chunk)
+	}
+
+	ra.mut.Lock()
+	defer ra.mut.Unlock()
+	if b, ok := ra.loaded[idx]; ok {
+		delete(ra.loaded, idx)
+		return b, nil
+	}
+
+	// extend the range read to the neighbouring chunks nobody asked for yet,
+	// in both directions as workers may fetch a later chunk first
+	ra.requested[idx] = true
+	begin, end := idx, idx+1
+	length := chunk.Size
+	for begin > ra.first && !ra.requested[begin-1] && ra.contiguous(begin-1, begin) && length+ra.chunks[begin-1].Size <= ra.limit {
+		begin--
+		length += ra.chunks[begin].Size
+	}
+	for end < len(ra.chunks) && !ra.requested[end] && ra.contiguous(end-1, end) && length+ra.chunks[end].Size <= ra.limit {
+		length += ra.chunks[end].Size
+		end++
+	}
+
+	offset := ra.chunks[begin].Offset
+	b, err := ra.repository.backend.LoadChunkRange(chunk.packChunk(), 0, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	for i := begin; i < end; i++ {
+		c := ra.chunks[i]
+		if i != idx {
+			ra.requested[i] = true
+			ra.loaded[i] = b[c.Offset-offset : c.Offset-offset+c.Size]
+		}
+	}
+	return b[chunk.Offset-offset : chunk.Offset-offset+chunk.Size], nil
+}
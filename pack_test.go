@@ -0,0 +1,127 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// rangeCountingBackend counts the range reads of a backend.
+type rangeCountingBackend struct {
+	Backend
+	reads *int32
+}
+
+func (b rangeCountingBackend) LoadChunkRange(shasum string, part, totalParts uint, offset, length uint64) ([]byte, error) {
+	atomic.AddInt32(b.reads, 1)
+	data, err := b.Backend.LoadChunk(shasum, part, totalParts)
+	if err != nil {
+		return nil, err
+	}
+	return data[offset : offset+length], nil
+}
+
+func TestPackReadAhead(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	data := make([]byte, 8*16*1024)
+	_, _ = rand.Read(data)
+	_ = ioutil.WriteFile(filepath.Join(src, "file"), data, 0644)
+
+	r, _ := NewRepository("mem://pack-read-ahead", testPassword)
+	var reads int32
+	var be Backend = rangeCountingBackend{*r.backend.Backends[0], &reads}
+	r.backend.Backends[0] = &be
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	opts := StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+		ChunkSize: 16 * 1024,
+		PackSize:  1024 * 1024,
+	}
+	snapshot := storeSnapshot(t, &r, &index, opts)
+
+	chunks := snapshot.Archives[filepath.Join(src, "file")].Chunks
+	if len(chunks) < 2 {
+		t.Fatalf("Expected the file to be split into several chunks, got %d", len(chunks))
+	}
+	pack := chunks[0].Pack
+	for _, chunk := range chunks {
+		if chunk.Pack == "" || chunk.Pack != pack {
+			t.Fatalf("Expected all chunks to be stored in pack object %s, got %q", pack, chunk.Pack)
+		}
+	}
+	objects := memoryStores["pack-read-ahead"]
+	if _, ok := objects[chunkKey(chunks[0].Hash, 0, 1)]; ok {
+		t.Error("Expected packed chunk not to be stored in an object of its own")
+	}
+
+	for _, ropts := range []RestoreOptions{
+		{ReadAhead: 1024 * 1024},
+		{ReadAhead: 1024 * 1024, Prefetch: 4, VerifyConcurrency: 4},
+	} {
+		atomic.StoreInt32(&reads, 0)
+		dst := filepath.Join(dir, "dst")
+		if errs := restoreSnapshot(t, r, snapshot, dst, ropts); len(errs) > 0 {
+			t.Fatalf("Failed restoring snapshot: %v", errs)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dst, src, "file"))
+		if err != nil || !bytes.Equal(b, data) {
+			t.Errorf("Expected file to be restored intact: %v", err)
+		}
+		if n := atomic.LoadInt32(&reads); n != 1 {
+			t.Errorf("Expected contiguous chunks to be fetched in a single range read, got %d reads", n)
+		}
+		_ = os.RemoveAll(dst)
+	}
+
+	// a second snapshot reuses the pack object
+	second := storeSnapshot(t, &r, &index, opts)
+	for _, chunk := range second.Archives[filepath.Join(src, "file")].Chunks {
+		if chunk.Pack != pack {
+			t.Fatalf("Expected chunk to be deduplicated into pack object %s, got %q", pack, chunk.Pack)
+		}
+	}
+
+	// the pack object gets deleted once none of its chunks is referenced
+	index.ReleaseSnapshot(snapshot)
+	if _, err := index.Pack(&r); err != nil {
+		t.Fatalf("Packing chunk index failed: %s", err)
+	}
+	if _, ok := objects[chunkKey(pack, 0, 1)]; !ok {
+		t.Fatal("Expected pack object referenced by the second snapshot to be kept")
+	}
+	index.ReleaseSnapshot(second)
+	if _, err := index.Pack(&r); err != nil {
+		t.Fatalf("Packing chunk index failed: %s", err)
+	}
+	if _, ok := objects[chunkKey(pack, 0, 1)]; ok {
+		t.Error("Expected unreferenced pack object to be deleted")
+	}
+	if _, ok := index.Chunks[chunks[0].Hash]; ok {
+		t.Error("Expected chunks of the deleted pack object to be dropped from the index")
+	}
+}
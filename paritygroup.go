@@ -0,0 +1,257 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	// chunks smaller than this share parity groups, see
+	// StoreOptions.ParityGroupSize
+	maxParityGroupChunkSize = 256 << 10
+	// Reed-Solomon codes are limited to this amount of data & parity parts
+	maxParityShards = 256
+)
+
+// Error declarations.
+var (
+	ErrParityGroupTooLarge = errors.New("Parity groups are limited to 256 chunks and parity parts")
+	ErrParityRepairFailed  = errors.New("Not enough intact chunks & parity parts to repair the parity group")
+)
+
+// A ParityGroup protects many small chunks with a single set of parity parts,
+// instead of every chunk getting parity parts of its own. The parity parts
+// get stored like the data parts of a chunk with the group's hash.
+type ParityGroup struct {
+	Hash        string         `json:"hash"`
+	Members     []ParityMember `json:"members"`
+	ParityParts uint           `json:"parity_parts"`
+	ShardSize   int            `json:"shard_size"` // size of every parity part
+}
+
+// A ParityMember is a chunk protected by a ParityGroup.
+type ParityMember struct {
+	Hash string `json:"hash"`
+	Size int    `json:"size"`
+	Salt string `json:"salt,omitempty"`
+}
+
+// ParityGroupError records a parity group that couldn't be repaired.
+type ParityGroupError struct {
+	Hash    string
+	Damaged int // amount of missing or damaged chunks & parity parts
+}
+
+func (e *ParityGroupError) Error() string {
+	return fmt.Sprintf("Could not repair parity group %s, %d chunks & parity parts are missing or damaged", e.Hash, e.Damaged)
+}
+
+// Is lets errors.Is match a ParityGroupError with ErrParityRepairFailed.
+func (e *ParityGroupError) Is(target error) bool {
+	return target == ErrParityRepairFailed
+}
+
+// pendingParityGroup collects the chunks of a parity group while storing a
+// snapshot.
+type pendingParityGroup struct {
+	members []ParityMember
+	data    [][]byte
+}
+
+// groupsParity returns whether a chunk of size bytes gets protected by a
+// parity group instead of parity parts of its own.
+func (opts StoreOptions) groupsParity(size int) bool {
+	return opts.ParityGroupSize > 0 && opts.ParityParts > 0 && size < maxParityGroupChunkSize
+}
+
+// verify returns whether b is the intact data of the member.
+func (m ParityMember) verify(b []byte) bool {
+	if len(b) != m.Size {
+		return false
+	}
+	if m.Salt != "" {
+		b = append([]byte(m.Salt), b...)
+	}
+	return Hash(b, HashHighway256) == m.Hash
+}
+
+// parityChunk returns the chunk the parity parts of the group are stored as.
+func (group ParityGroup) parityChunk() Chunk {
+	return Chunk{
+		Hash:      group.Hash,
+		DataParts: group.ParityParts,
+		Size:      group.ShardSize,
+	}
+}
+
+// addToParityGroup adds chunk with data to the pending parity group of the
+// snapshot. Once it's full, its parity parts get stored.
+func (snapshot *Snapshot) addToParityGroup(repository Repository, chunkIndex *ChunkIndex, chunk Chunk, data []byte, opts StoreOptions) error {
+	snapshot.pendingParity.members = append(snapshot.pendingParity.members, ParityMember{
+		Hash: chunk.Hash,
+		Size: len(data),
+		Salt: chunk.Salt,
+	})
+	snapshot.pendingParity.data = append(snapshot.pendingParity.data, data)
+
+	if uint(len(snapshot.pendingParity.members)) < opts.ParityGroupSize {
+		return nil
+	}
+	return snapshot.flushParityGroup(repository, chunkIndex, opts)
+}
+
+// flushParityGroup stores the parity parts of the pending parity group, even
+// if it isn't full yet.
+func (snapshot *Snapshot) flushParityGroup(repository Repository, chunkIndex *ChunkIndex, opts StoreOptions) error {
+	pending := snapshot.pendingParity
+	snapshot.pendingParity = pendingParityGroup{}
+	if len(pending.members) == 0 {
+		return nil
+	}
+
+	group := ParityGroup{
+		Members:     pending.members,
+		ParityParts: opts.ParityParts,
+	}
+	for _, b := range pending.data {
+		if len(b) > group.ShardSize {
+			group.ShardSize = len(b)
+		}
+	}
+	shards := make([][]byte, len(pending.data)+int(group.ParityParts))
+	for i, b := range pending.data {
+		shards[i] = make([]byte, group.ShardSize)
+		copy(shards[i], b)
+	}
+	for i := len(pending.data); i < len(shards); i++ {
+		shards[i] = make([]byte, group.ShardSize)
+	}
+
+	enc, err := reedsolomon.New(len(pending.data), int(group.ParityParts))
+	if err != nil {
+		return err
+	}
+	if err := enc.Encode(shards); err != nil {
+		return err
+	}
+
+	parity := shards[len(pending.data):]
+	var all []byte
+	for _, b := range parity {
+		all = append(all, b...)
+	}
+	group.Hash = Hash(all, HashHighway256)
+
+	chunk := group.parityChunk()
+	chunk.Data = &parity
+	n, err := repository.backend.StoreChunk(chunk)
+	if err != nil {
+		return err
+	}
+
+	snapshot.mut.Lock()
+	snapshot.ParityGroups = append(snapshot.ParityGroups, group)
+	snapshot.Stats.StorageSize += n
+	snapshot.mut.Unlock()
+	chunkIndex.AddParityGroup(group, snapshot.ID)
+	return nil
+}
+
+// RepairParityGroups restores the chunks protected by the snapshot's parity
+// groups that are missing or damaged on the backends from the rest of their
+// group, as well as missing parity parts. It returns the hashes of the
+// restored chunks. Groups with more damaged chunks & parity parts than they
+// have parity parts fail with a ParityGroupError.
+func (snapshot *Snapshot) RepairParityGroups(repository Repository) ([]string, error) {
+	var repaired []string
+	var failed error
+	for _, group := range snapshot.ParityGroups {
+		hashes, err := repairParityGroup(repository, group)
+		repaired = append(repaired, hashes...)
+		if err != nil && failed == nil {
+			failed = err
+		}
+	}
+
+	return repaired, failed
+}
+
+// repairParityGroup restores the missing or damaged chunks & parity parts of
+// group.
+func repairParityGroup(repository Repository, group ParityGroup) ([]string, error) {
+	members := len(group.Members)
+	shards := make([][]byte, members+int(group.ParityParts))
+	var damaged []int
+	for i, m := range group.Members {
+		b, err := repository.backend.LoadChunk(Chunk{Hash: m.Hash, DataParts: 1}, 0)
+		if err != nil || !m.verify(b) {
+			damaged = append(damaged, i)
+			continue
+		}
+		shards[i] = make([]byte, group.ShardSize)
+		copy(shards[i], b)
+	}
+	parityDamaged := false
+	for i := 0; i < int(group.ParityParts); i++ {
+		b, err := repository.backend.LoadChunk(group.parityChunk(), uint(i))
+		if err != nil || len(b) != group.ShardSize {
+			parityDamaged = true
+			continue
+		}
+		shards[members+i] = b
+	}
+	if len(damaged) == 0 && !parityDamaged {
+		return nil, nil
+	}
+
+	missing := 0
+	for _, s := range shards {
+		if s == nil {
+			missing++
+		}
+	}
+	enc, err := reedsolomon.New(members, int(group.ParityParts))
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.Reconstruct(shards); err != nil {
+		return nil, &ParityGroupError{group.Hash, missing}
+	}
+
+	var repaired []string
+	for _, i := range damaged {
+		m := group.Members[i]
+		b := shards[i][:m.Size]
+		if !m.verify(b) {
+			// some parity parts are damaged, too
+			return repaired, &ParityGroupError{group.Hash, missing}
+		}
+
+		// damaged chunks of the same size wouldn't get overwritten
+		_ = repository.backend.DeleteChunk(m.Hash, 0, 1)
+		if _, err := repository.backend.StoreChunk(Chunk{Hash: m.Hash, DataParts: 1, Size: m.Size, Data: &[][]byte{b}}); err != nil {
+			return repaired, err
+		}
+		repaired = append(repaired, m.Hash)
+	}
+
+	if parityDamaged {
+		chunk := group.parityChunk()
+		parity := shards[members:]
+		chunk.Data = &parity
+		if _, err := repository.backend.StoreChunk(chunk); err != nil {
+			return repaired, err
+		}
+	}
+
+	return repaired, nil
+}
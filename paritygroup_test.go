@@ -0,0 +1,107 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParityGroupRepair(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	files := make(map[string][]byte)
+	for i := 0; i < 40; i++ {
+		name := strconv.Itoa(i)
+		data := make([]byte, 512+rand.Intn(4096))
+		_, _ = rand.Read(data)
+		_ = ioutil.WriteFile(filepath.Join(src, name), data, 0644)
+		files[name] = data
+	}
+
+	r, _ := NewRepository("mem://parity-group", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:             wd,
+		Paths:           []string{src},
+		Encrypt:         EncryptionAES,
+		DataParts:       1,
+		ParityParts:     2,
+		ParityGroupSize: 16,
+	})
+
+	if len(snapshot.ParityGroups) != 3 {
+		t.Fatalf("Expected 40 chunks in 3 parity groups, got %d groups", len(snapshot.ParityGroups))
+	}
+	for _, arc := range snapshot.Archives {
+		for _, chunk := range arc.Chunks {
+			if chunk.ParityParts != 0 {
+				t.Errorf("Expected chunk of %s without parity parts of its own, got %d", arc.Path, chunk.ParityParts)
+			}
+		}
+	}
+	if _, ok := index.Chunks[snapshot.ParityGroups[0].Hash]; !ok {
+		t.Error("Expected parity parts to be indexed")
+	}
+
+	// lose two chunks of the first group, damage one chunk of the second
+	// and lose a chunk as well as a parity part of the last one
+	objects := memoryStores["parity-group"]
+	groups := snapshot.ParityGroups
+	delete(objects, chunkKey(groups[0].Members[0].Hash, 0, 1))
+	delete(objects, chunkKey(groups[0].Members[5].Hash, 0, 1))
+	objects[chunkKey(groups[1].Members[3].Hash, 0, 1)][0] ^= 0xff
+	delete(objects, chunkKey(groups[2].Members[7].Hash, 0, 1))
+	delete(objects, chunkKey(groups[2].Hash, 1, groups[2].ParityParts))
+
+	repaired, err := snapshot.RepairParityGroups(r)
+	if err != nil {
+		t.Fatalf("Failed repairing parity groups: %s", err)
+	}
+	if len(repaired) != 4 {
+		t.Errorf("Expected 4 repaired chunks, got %d", len(repaired))
+	}
+	if _, ok := objects[chunkKey(groups[2].Hash, 1, groups[2].ParityParts)]; !ok {
+		t.Error("Expected lost parity part to be restored")
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring repaired snapshot: %v", errs)
+	}
+	for name, data := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dst, src, name))
+		if err != nil || !bytes.Equal(b, data) {
+			t.Errorf("Expected %s to be restored intact: %v", name, err)
+		}
+	}
+
+	// more damage than parity parts can't be repaired
+	for _, m := range groups[1].Members[:3] {
+		delete(objects, chunkKey(m.Hash, 0, 1))
+	}
+	if _, err := snapshot.RepairParityGroups(r); !errors.Is(err, ErrParityRepairFailed) {
+		t.Errorf("Expected %v, got %v", ErrParityRepairFailed, err)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"unicode"
+)
+
+// Policies for weak passwords of new repositories.
+const (
+	PasswordWarnWeak   = iota // Log a warning and create the repository anyway
+	PasswordRejectWeak        // Fail with a WeakPasswordError
+	PasswordAllowWeak         // Don't check the password, e.g. for passwords read from keyfiles
+)
+
+// Const declarations.
+const (
+	minPasswordLength  = 12
+	minPasswordEntropy = 60 // bits
+)
+
+// Error declarations.
+var (
+	ErrWeakPassword = errors.New("Password is weak")
+)
+
+// WeakPasswordError records why a password is considered weak.
+type WeakPasswordError struct {
+	Reason string
+}
+
+func (e *WeakPasswordError) Error() string {
+	return fmt.Sprintf("Password is weak: %s", e.Reason)
+}
+
+// Is lets errors.Is match a WeakPasswordError with ErrWeakPassword.
+func (e *WeakPasswordError) Is(target error) bool {
+	return target == ErrWeakPassword
+}
+
+// CheckPassword returns a WeakPasswordError if password is short or easy to
+// guess. The entropy gets estimated from the amount of distinct characters
+// and the character classes in use, so repeating characters doesn't make a
+// password any stronger.
+func CheckPassword(password string) error {
+	runes := []rune(password)
+	if len(runes) < minPasswordLength {
+		return &WeakPasswordError{fmt.Sprintf("shorter than %d characters", minPasswordLength)}
+	}
+
+	distinct := make(map[rune]bool)
+	var lower, upper, digit, other bool
+	for _, r := range runes {
+		distinct[r] = true
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	for _, c := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {other, 33}} {
+		if c.used {
+			pool += c.size
+		}
+	}
+
+	entropy := float64(len(distinct)) * math.Log2(float64(pool))
+	if entropy < minPasswordEntropy {
+		return &WeakPasswordError{fmt.Sprintf("estimated entropy of %.0f bits is below %d bits", entropy, minPasswordEntropy)}
+	}
+	return nil
+}
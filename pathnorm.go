@@ -0,0 +1,84 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Unicode normalization forms for stored paths.
+const (
+	PathNormalizationNone = iota // Store paths as they are found
+	PathNormalizationNFC         // Store composed paths, as used by Windows & Linux
+	PathNormalizationNFD         // Store decomposed paths, as used by macOS
+)
+
+// Error declarations.
+var (
+	ErrPathCollision = errors.New("Path collides with another path of the snapshot")
+)
+
+// PathCollisionError records two paths that are stored as the same archive,
+// or can't be restored side by side on a case-insensitive file system.
+type PathCollisionError struct {
+	Path  string
+	Other string
+}
+
+func (e *PathCollisionError) Error() string {
+	return fmt.Sprintf("Path %s collides with %s", e.Path, e.Other)
+}
+
+// Is lets errors.Is match a PathCollisionError with ErrPathCollision.
+func (e *PathCollisionError) Is(target error) bool {
+	return target == ErrPathCollision
+}
+
+// normalizePath returns path in the unicode normalization form policy.
+func normalizePath(path string, policy uint16) string {
+	switch policy {
+	case PathNormalizationNFC:
+		return norm.NFC.String(path)
+	case PathNormalizationNFD:
+		return norm.NFD.String(path)
+	}
+
+	return path
+}
+
+// pathCollisions detects paths colliding with the paths seen before.
+type pathCollisions struct {
+	caseInsensitive bool
+	seen            map[string]string
+}
+
+func newPathCollisions(caseInsensitive bool) *pathCollisions {
+	return &pathCollisions{
+		caseInsensitive: caseInsensitive,
+		seen:            make(map[string]string),
+	}
+}
+
+// add records path, which has been stored as normalized. It returns a
+// PathCollisionError if another path has been stored the same way before.
+func (c *pathCollisions) add(path, normalized string) error {
+	key := normalized
+	if c.caseInsensitive {
+		key = cases.Fold().String(normalized)
+	}
+
+	if other, ok := c.seen[key]; ok && other != path {
+		return &PathCollisionError{Path: path, Other: other}
+	}
+	c.seen[key] = path
+	return nil
+}
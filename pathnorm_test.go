@@ -0,0 +1,97 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotPathNormalization(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	nfc := "caf\u00e9"
+	nfd := "cafe\u0301"
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	for _, name := range []string{nfc, nfd, "Readme", "README"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, _ := ioutil.ReadDir(src)
+	if len(entries) != 4 {
+		t.Skip("File system normalizes paths or isn't case-sensitive")
+	}
+
+	r, _ := NewRepository("mem://snapshot-path-normalization", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	tests := []struct {
+		normalize       uint16
+		caseInsensitive bool
+		expected        []string
+		collisions      int
+	}{
+		{PathNormalizationNone, false, []string{nfc, nfd, "Readme", "README"}, 0},
+		{PathNormalizationNFC, false, []string{nfc, "Readme", "README"}, 1},
+		{PathNormalizationNFD, false, []string{nfd, "Readme", "README"}, 1},
+		{PathNormalizationNFC, true, []string{nfc}, 2},
+	}
+
+	for _, tt := range tests {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		var collisions int
+		for p := range snapshot.Add(r, &index, StoreOptions{
+			CWD:                  wd,
+			Paths:                []string{src},
+			DataParts:            1,
+			NormalizePaths:       tt.normalize,
+			CaseInsensitivePaths: tt.caseInsensitive,
+		}) {
+			if p.Error != nil {
+				if !errors.Is(p.Error, ErrPathCollision) {
+					t.Errorf("Expected %v, got %v", ErrPathCollision, p.Error)
+				}
+				collisions++
+			}
+		}
+
+		if collisions != tt.collisions {
+			t.Errorf("Expected %d collisions with normalization %d, got %d", tt.collisions, tt.normalize, collisions)
+		}
+		for _, name := range tt.expected {
+			arc, ok := snapshot.Archives[filepath.Join(src, name)]
+			if !ok {
+				t.Errorf("Expected %q to be stored with normalization %d", name, tt.normalize)
+				continue
+			}
+			// the content of the first file found gets stored
+			if tt.collisions == 0 && arc.Size != uint64(len(name)) {
+				t.Errorf("Expected %q to be stored with its own content", name)
+			}
+		}
+		if tt.caseInsensitive {
+			readme := snapshot.Archives[filepath.Join(src, "Readme")] != nil
+			if readme == (snapshot.Archives[filepath.Join(src, "README")] != nil) {
+				t.Error("Expected only one of Readme & README to be stored")
+			}
+		}
+	}
+}
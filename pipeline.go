@@ -24,6 +24,12 @@ type Pipeline struct {
 
 // NewEncodingPipeline returns a new pipeline consisting of a compressor and an encryptor.
 func NewEncodingPipeline(compression, encryption uint16, password string) (Pipeline, error) {
+	return newEncodingPipelineWithCompressor(Compressor{Method: compression}, encryption, password)
+}
+
+// newEncodingPipelineWithCompressor returns a new encoding pipeline,
+// compressing with compressor, e.g. to use a Zstd dictionary.
+func newEncodingPipelineWithCompressor(compressor Compressor, encryption uint16, password string) (Pipeline, error) {
 	encryptor, err := NewEncryptor(encryption, password)
 	if err != nil {
 		return Pipeline{}, err
@@ -31,9 +37,7 @@ func NewEncodingPipeline(compression, encryption uint16, password string) (Pipel
 
 	return Pipeline{
 		Processors: []PipelineProcessor{
-			Compressor{
-				Method: compression,
-			},
+			compressor,
 			encryptor,
 		},
 	}, nil
@@ -41,6 +45,12 @@ func NewEncodingPipeline(compression, encryption uint16, password string) (Pipel
 
 // NewDecodingPipeline returns a new pipeline consisting of a decryptor and a decompressor.
 func NewDecodingPipeline(compression, encryption uint16, password string) (Pipeline, error) {
+	return newDecodingPipelineWithDicts(compression, encryption, password, nil)
+}
+
+// newDecodingPipelineWithDicts returns a new decoding pipeline, which can
+// decompress data compressed with any of the Zstd dictionaries dicts.
+func newDecodingPipelineWithDicts(compression, encryption uint16, password string, dicts [][]byte) (Pipeline, error) {
 	decryptor, err := NewDecryptor(encryption, password)
 	if err != nil {
 		return Pipeline{}, err
@@ -51,6 +61,7 @@ func NewDecodingPipeline(compression, encryption uint16, password string) (Pipel
 			decryptor,
 			Decompressor{
 				Method: compression,
+				Dicts:  dicts,
 			},
 		},
 	}, nil
@@ -0,0 +1,205 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxConnections = 4
+)
+
+// Error declarations.
+var (
+	ErrPoolClosed = errors.New("Connection pool has been closed")
+)
+
+// ConnectionPool keeps connections to a storage backend open, so they can be
+// reused by subsequent operations.
+type ConnectionPool struct {
+	dial   func() (io.Closer, error)
+	broken func(err error) bool // see DiscardOn
+
+	mut         sync.Mutex
+	cond        *sync.Cond
+	maxConns    int
+	idleTimeout time.Duration
+	idle        []idleConnection
+	open        int
+	closed      bool
+}
+
+type idleConnection struct {
+	conn  io.Closer
+	since time.Time
+}
+
+// NewConnectionPool returns a new ConnectionPool. dial gets called whenever a
+// new connection needs to be established.
+func NewConnectionPool(dial func() (io.Closer, error)) *ConnectionPool {
+	p := &ConnectionPool{
+		dial:     dial,
+		maxConns: defaultMaxConnections,
+	}
+	p.cond = sync.NewCond(&p.mut)
+
+	return p
+}
+
+// SetOptions applies the connection settings from opts to the pool.
+func (p *ConnectionPool) SetOptions(opts BackendOptions) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	p.maxConns = defaultMaxConnections
+	if opts.MaxConnections > 0 {
+		p.maxConns = opts.MaxConnections
+	}
+	p.idleTimeout = opts.IdleTimeout
+	p.cond.Broadcast()
+}
+
+// DiscardOn sets the function deciding whether an error returned by an
+// operation means its connection is broken, see Release. By default, every
+// error but os.ErrNotExist does. Errors the server replied with, like a
+// missing file, should leave the connection usable.
+func (p *ConnectionPool) DiscardOn(broken func(err error) bool) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	p.broken = broken
+}
+
+// Get returns an idle connection or establishes a new one. It blocks while
+// the maximum amount of connections is in use.
+// Connections must be handed back with Put or Discard.
+func (p *ConnectionPool) Get() (io.Closer, error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	for {
+		if p.closed {
+			return nil, ErrPoolClosed
+		}
+
+		p.closeExpired()
+		if len(p.idle) > 0 {
+			c := p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			return c.conn, nil
+		}
+
+		if p.open < p.maxConns {
+			break
+		}
+		p.cond.Wait()
+	}
+
+	// reserve the slot while we're dialing
+	p.open++
+	p.mut.Unlock()
+	conn, err := p.dial()
+	p.mut.Lock()
+	if err != nil {
+		p.open--
+		p.cond.Signal()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Put hands a connection back to the pool.
+func (p *ConnectionPool) Put(conn io.Closer) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if p.closed || p.open > p.maxConns {
+		p.open--
+		_ = conn.Close()
+	} else {
+		p.idle = append(p.idle, idleConnection{conn: conn, since: time.Now()})
+	}
+	p.cond.Signal()
+}
+
+// Discard closes a broken connection instead of handing it back to the pool.
+func (p *ConnectionPool) Discard(conn io.Closer) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	p.open--
+	_ = conn.Close()
+	p.cond.Signal()
+}
+
+// Release hands a connection back to the pool, unless err means that the
+// connection may be broken, see DiscardOn. Then it gets discarded.
+func (p *ConnectionPool) Release(conn io.Closer, err error) {
+	if err != nil && p.isBroken(err) {
+		p.Discard(conn)
+		return
+	}
+	p.Put(conn)
+}
+
+// isBroken returns whether err means that a connection may be broken.
+func (p *ConnectionPool) isBroken(err error) bool {
+	p.mut.Lock()
+	broken := p.broken
+	p.mut.Unlock()
+
+	if broken != nil {
+		return broken(err)
+	}
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// Close closes all idle connections. Connections still in use get closed
+// when they are handed back.
+func (p *ConnectionPool) Close() error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	var err error
+	for _, c := range p.idle {
+		if cerr := c.conn.Close(); cerr != nil {
+			err = cerr
+		}
+		p.open--
+	}
+	p.idle = nil
+	p.closed = true
+	p.cond.Broadcast()
+
+	return err
+}
+
+// closeExpired closes all connections that have been idle for longer than
+// the idle timeout. The caller must hold the lock.
+func (p *ConnectionPool) closeExpired() {
+	if p.idleTimeout <= 0 {
+		return
+	}
+
+	idle := p.idle[:0]
+	for _, c := range p.idle {
+		if time.Since(c.since) > p.idleTimeout {
+			_ = c.conn.Close()
+			p.open--
+			continue
+		}
+		idle = append(idle, c)
+	}
+	p.idle = idle
+}
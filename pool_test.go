@@ -0,0 +1,188 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errReply = errors.New("server replied with an error")
+
+type countingConn struct {
+	closed *int32
+}
+
+func (c countingConn) Close() error {
+	atomic.AddInt32(c.closed, 1)
+	return nil
+}
+
+func countingPool() (*ConnectionPool, *int32, *int32) {
+	var dialed, closed int32
+	p := NewConnectionPool(func() (io.Closer, error) {
+		atomic.AddInt32(&dialed, 1)
+		return countingConn{closed: &closed}, nil
+	})
+
+	return p, &dialed, &closed
+}
+
+func TestConnectionPoolReuse(t *testing.T) {
+	p, dialed, _ := countingPool()
+
+	for i := 0; i < 10; i++ {
+		c, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Put(c)
+	}
+
+	if *dialed != 1 {
+		t.Errorf("Expected 1 connection, got %d", *dialed)
+	}
+}
+
+func TestConnectionPoolMaxConnections(t *testing.T) {
+	p, dialed, _ := countingPool()
+	p.SetOptions(BackendOptions{MaxConnections: 2})
+
+	var wg sync.WaitGroup
+	var inUse, maxInUse int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := p.Get()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n := atomic.AddInt32(&inUse, 1)
+			for {
+				m := atomic.LoadInt32(&maxInUse)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInUse, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&inUse, -1)
+			p.Put(c)
+		}()
+	}
+	wg.Wait()
+
+	if maxInUse > 2 {
+		t.Errorf("Expected at most 2 connections in use, got %d", maxInUse)
+	}
+	if *dialed > 2 {
+		t.Errorf("Expected at most 2 connections, got %d", *dialed)
+	}
+}
+
+func TestConnectionPoolIdleTimeout(t *testing.T) {
+	p, dialed, closed := countingPool()
+	p.SetOptions(BackendOptions{IdleTimeout: 10 * time.Millisecond})
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c)
+	time.Sleep(20 * time.Millisecond)
+
+	c, err = p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c)
+
+	if *dialed != 2 {
+		t.Errorf("Expected 2 connections, got %d", *dialed)
+	}
+	if *closed != 1 {
+		t.Errorf("Expected 1 expired connection to be closed, got %d", *closed)
+	}
+}
+
+func TestConnectionPoolRelease(t *testing.T) {
+	p, dialed, closed := countingPool()
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release(c, nil)
+
+	// a connection released after an error may be broken and gets replaced
+	c, err = p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release(c, io.ErrUnexpectedEOF)
+	if *closed != 1 {
+		t.Errorf("Expected the failed connection to be closed, got %d closed", *closed)
+	}
+
+	c, err = p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release(c, nil)
+	if *dialed != 2 {
+		t.Errorf("Expected 2 connections, got %d", *dialed)
+	}
+
+	// a missing file doesn't break the connection
+	c, err = p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release(c, &os.PathError{Op: "open", Path: "missing", Err: os.ErrNotExist})
+	if *closed != 1 {
+		t.Errorf("Expected the connection to be kept, got %d closed", *closed)
+	}
+
+	p.DiscardOn(func(err error) bool {
+		return err != errReply
+	})
+	c, err = p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release(c, errReply)
+	if *dialed != 2 || *closed != 1 {
+		t.Errorf("Expected the connection to be kept, got %d connections and %d closed", *dialed, *closed)
+	}
+}
+
+func TestConnectionPoolClose(t *testing.T) {
+	p, _, closed := countingPool()
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c)
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if *closed != 1 {
+		t.Errorf("Expected idle connection to be closed, got %d closed", *closed)
+	}
+	if _, err := p.Get(); err != ErrPoolClosed {
+		t.Errorf("Expected ErrPoolClosed, got %v", err)
+	}
+}
@@ -16,6 +16,18 @@ type Progress struct {
 	CurrentItemStats Stats
 	TotalStatistics  Stats
 	Error            error
+	// Warning reports a problem that didn't fail the item, e.g. a
+	// SlowOperationWarning, a FileSizeError, FileAgeError or
+	// UnsupportedFileError of a skipped file, ErrFileVanished for a file
+	// deleted before it could be read, an OverlappingPathError,
+	// ErrSymlinkLoop or an IneffectiveStorageWarning
+	Warning error
+
+	// Started is when the entire operation started. Restores report it
+	// together with the totals of the snapshot in TotalStatistics, of which
+	// Transferred bytes and CompletedFiles files have been restored so far
+	Started        time.Time
+	CompletedFiles uint64
 }
 
 func newProgress(archive *Archive) Progress {
@@ -43,3 +55,58 @@ func newProgressError(err error) Progress {
 func (p Progress) TransferSpeed() uint64 {
 	return uint64(float64(p.CurrentItemStats.Transferred) / time.Since(p.Timer).Seconds())
 }
+
+// Throughput returns the average transfer speed of the entire operation in
+// bytes per second.
+func (p Progress) Throughput() uint64 {
+	elapsed := time.Since(p.Started).Seconds()
+	if p.Started.IsZero() || elapsed <= 0 {
+		return 0
+	}
+	return uint64(float64(p.TotalStatistics.Transferred) / elapsed)
+}
+
+// ETA estimates how long it takes until all of TotalStatistics.Size has been
+// transferred, based on the throughput so far. It returns zero until
+// anything has been transferred.
+func (p Progress) ETA() time.Duration {
+	done := p.TotalStatistics.Transferred
+	if p.Started.IsZero() || done == 0 || done >= p.TotalStatistics.Size {
+		return 0
+	}
+
+	left := float64(p.TotalStatistics.Size - done)
+	return time.Duration(float64(time.Since(p.Started)) * left / float64(done))
+}
+
+// coalesceProgress forwards the progress updates received on in, but at most
+// one per interval. Errors, warnings and the final update are always
+// forwarded.
+func coalesceProgress(in chan Progress, interval time.Duration) chan Progress {
+	out := make(chan Progress)
+	go func() {
+		var last time.Time
+		var pending *Progress
+
+		for p := range in {
+			if p.Error == nil && p.Warning == nil && time.Since(last) < interval {
+				p := p
+				pending = &p
+				continue
+			}
+
+			out <- p
+			pending = nil
+			if p.Error == nil && p.Warning == nil {
+				last = time.Now()
+			}
+		}
+
+		if pending != nil {
+			out <- *pending
+		}
+		close(out)
+	}()
+
+	return out
+}
@@ -9,6 +9,10 @@ package knoxite
 
 import (
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -36,3 +40,53 @@ func TestProgressError(t *testing.T) {
 		t.Errorf("Expected error, got %s", p.Error)
 	}
 }
+
+func TestProgressInterval(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 100; i++ {
+		_ = ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(i)), []byte("data"), 0600)
+	}
+
+	r, _ := NewRepository("mem://progress-interval", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	for _, interval := range []time.Duration{0, time.Hour} {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		opts := StoreOptions{
+			CWD:              wd,
+			Paths:            []string{dir},
+			Encrypt:          EncryptionAES,
+			DataParts:        1,
+			ProgressInterval: interval,
+		}
+
+		events := 0
+		var last Progress
+		for p := range snapshot.Add(r, &index, opts) {
+			if p.Error != nil {
+				t.Errorf("Failed adding to snapshot: %s", p.Error)
+			}
+			events++
+			last = p
+		}
+
+		if interval == 0 && events < 200 {
+			t.Errorf("Expected at least %d progress events, got %d", 200, events)
+		}
+		if interval > 0 && events > 2 {
+			t.Errorf("Expected at most %d progress events, got %d", 2, events)
+		}
+		if last.TotalStatistics.Files != 100 {
+			t.Errorf("Expected final progress to report %d files, got %d", 100, last.TotalStatistics.Files)
+		}
+	}
+}
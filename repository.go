@@ -11,23 +11,40 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 )
 
 // A Repository is a collection of backup snapshots.
 type Repository struct {
-	Version uint      `json:"version"`
-	Volumes []*Volume `json:"volumes"`
-	Paths   []string  `json:"storage"`
-	Key     string    `json:"key"` // key for encrypting data stored with knoxite
+	Version          uint             `json:"version"`
+	Volumes          []*Volume        `json:"volumes"`
+	Paths            []string         `json:"storage"`
+	Key              string           `json:"key"`              // key for encrypting data stored with knoxite
+	SnapshotIDLength int              `json:"snapshotidlength"` // length of new snapshot IDs, 0 means default
+	Config           RepositoryConfig `json:"config"`           // default settings for new snapshots
+	DataKeys         []string         `json:"datakeys"`         // data encryption keys of all epochs after the first, which uses Key
+	CompressionDicts [][]byte         `json:"compressiondicts"` // Zstd dictionaries used to compress small chunks
+	Encrypter        string           `json:"encrypter"`        // name of the external Encrypter of the chunks, if any
 	// Owner   string    `json:"owner"`
 
 	backend  BackendManager
-	password string // password for knoxite repository file
+	password string           // password for knoxite repository file
+	keyfile  string           // hash of the keyfile for the repository file, if any
+	logger   LogHandler       // receives diagnostics, may be nil
+	clock    func() time.Time // returns the current time, may be nil
+
+	encrypter Encrypter // encrypts chunks instead of the built-in AES encryption
 }
 
 // Const declarations.
 const (
-	RepositoryVersion   = 4
+	// RepositoryVersion is the newest repository format. Version 5 seals the
+	// chunk-index with its own keys and stores it in parts, and introduced
+	// parity groups, pack objects, key epochs, compression dictionaries and
+	// external encrypters, none of which older clients understand
+	RepositoryVersion   = 5
 	repositoryKeyLength = 32
 )
 
@@ -38,10 +55,110 @@ var (
 	ErrVolumeNotFound          = errors.New("Volume not found")
 	ErrSnapshotNotFound        = errors.New("Snapshot not found")
 	ErrGenerateRandomKeyFailed = errors.New("Failed to generate a random encryption key for new repository")
+	ErrInvalidSnapshotIDLength = fmt.Errorf("Snapshot ID length must be between %d and %d", minSnapshotIDLength, maxSnapshotIDLength)
+	ErrAmbiguousSnapshotID     = errors.New("Snapshot ID is ambiguous")
+	ErrUnknownKeyEpoch         = errors.New("Data was encrypted with a key of an unknown epoch")
+	ErrRepositoryClosed        = errors.New("Repository has been closed")
+	ErrReadOnlyRepository      = errors.New("Repository has been opened read-only")
 )
 
+// AmbiguousSnapshotIDError records a snapshot ID prefix matching more than
+// one snapshot.
+type AmbiguousSnapshotIDError struct {
+	ID         string
+	Candidates []string
+}
+
+func (e *AmbiguousSnapshotIDError) Error() string {
+	return fmt.Sprintf("Snapshot ID %s is ambiguous, candidates: %s", e.ID, strings.Join(e.Candidates, ", "))
+}
+
+// Is lets errors.Is match an AmbiguousSnapshotIDError with ErrAmbiguousSnapshotID.
+func (e *AmbiguousSnapshotIDError) Is(target error) bool {
+	return target == ErrAmbiguousSnapshotID
+}
+
+// RepositoryConfig holds the default storage settings of a repository.
+// Snapshot.Add uses them for all settings not set in its StoreOptions.
+type RepositoryConfig struct {
+	Compress    uint16 `json:"compress"`
+	Encrypt     uint16 `json:"encrypt"`
+	DataParts   uint   `json:"data_parts"`
+	ParityParts uint   `json:"parity_parts"`
+	ChunkSize   uint   `json:"chunk_size"` // maximum size of a chunk, 0 means default
+}
+
+// RepositoryOptions holds the settings for creating or opening a repository.
+type RepositoryOptions struct {
+	// SnapshotIDLength is the amount of hex characters in new snapshot IDs.
+	// Zero uses the default length. It's ignored when opening a repository
+	SnapshotIDLength int
+	// Logger receives diagnostics of repository operations. Messages are
+	// discarded if it's nil
+	Logger LogHandler
+	// Backend configures all storage backends of the repository, including
+	// where to look up credentials missing from their URLs
+	Backend BackendOptions
+	// PasswordPolicy decides what happens if the password of a new
+	// repository is weak, see CheckPassword. It's ignored when opening a
+	// repository
+	PasswordPolicy uint16
+	// Keyfile is the path of a file whose content unlocks the repository,
+	// either instead of or in addition to the password
+	Keyfile string
+	// ReadOnly guarantees nothing gets written to the storage backends.
+	// Operations that would write fail with ErrReadOnlyRepository, and older
+	// repositories only get migrated in memory. It's ignored when creating a
+	// repository
+	ReadOnly bool
+	// Encrypter encrypts chunks in place of the built-in AES encryption, e.g.
+	// with data keys supplied by a key management service. A repository
+	// created with an Encrypter records its name and can only be opened with
+	// the same Encrypter. Nil uses the built-in encryption
+	Encrypter Encrypter
+
+	// clock returns the current time in place of time.Now, if set
+	clock func() time.Time
+}
+
 // NewRepository returns a new repository.
 func NewRepository(path, password string) (Repository, error) {
+	return NewRepositoryWithOptions(path, password, RepositoryOptions{})
+}
+
+// NewRepositoryWithKeyfile returns a new repository unlocked by the content
+// of keyfile. If password isn't empty, both are required to unlock it.
+func NewRepositoryWithKeyfile(path, password, keyfile string) (Repository, error) {
+	return NewRepositoryWithOptions(path, password, RepositoryOptions{Keyfile: keyfile})
+}
+
+// NewRepositoryWithOptions returns a new repository configured with opts.
+func NewRepositoryWithOptions(path, password string, opts RepositoryOptions) (Repository, error) {
+	if opts.SnapshotIDLength != 0 &&
+		(opts.SnapshotIDLength < minSnapshotIDLength || opts.SnapshotIDLength > maxSnapshotIDLength) {
+		return Repository{}, ErrInvalidSnapshotIDLength
+	}
+	var keyfile string
+	if opts.Keyfile != "" {
+		var err error
+		keyfile, err = readKeyfile(opts.Keyfile)
+		if err != nil {
+			return Repository{}, err
+		}
+	}
+	if unlockMethods(password, keyfile) == 0 {
+		return Repository{}, ErrNoUnlockMethod
+	}
+
+	var weak error
+	// a keyfile makes up for a weak password
+	if opts.PasswordPolicy != PasswordAllowWeak && keyfile == "" {
+		weak = CheckPassword(password)
+		if weak != nil && opts.PasswordPolicy == PasswordRejectWeak {
+			return Repository{}, weak
+		}
+	}
+
 	// A random key of 32 is considered safe right now and may be increased later
 	key, err := generateRandomKey(repositoryKeyLength)
 	if err != nil {
@@ -51,16 +168,33 @@ func NewRepository(path, password string) (Repository, error) {
 	repository := Repository{
 		Version:  RepositoryVersion,
 		password: password,
+		keyfile:  keyfile,
 		Key:      key,
+
+		SnapshotIDLength: opts.SnapshotIDLength,
+
+		logger:    opts.Logger,
+		clock:     opts.clock,
+		encrypter: opts.Encrypter,
+	}
+	if opts.Encrypter != nil {
+		repository.Encrypter = opts.Encrypter.Name()
+	}
+	if weak != nil {
+		repository.log().Warn(weak)
 	}
 
-	backend, err := BackendFromURL(path)
+	backend, err := BackendFromURLWithOptions(path, opts.Backend)
 	if err != nil {
 		return repository, err
 	}
 	repository.backend.AddBackend(&backend)
+	repository.backend.SetOptions(opts.Backend)
 
 	err = repository.init()
+	if err == nil {
+		repository.log().Info("Created repository at ", RedactURL(path))
+	}
 	return repository, err
 }
 
@@ -78,11 +212,40 @@ func generateRandomKey(length int) (string, error) {
 
 // OpenRepository opens an existing repository and migrates it if possible.
 func OpenRepository(path, password string) (Repository, error) {
+	return OpenRepositoryWithOptions(path, password, RepositoryOptions{})
+}
+
+// OpenRepositoryWithKeyfile opens an existing repository unlocked by the
+// content of keyfile, and by password if it's not empty.
+func OpenRepositoryWithKeyfile(path, password, keyfile string) (Repository, error) {
+	return OpenRepositoryWithOptions(path, password, RepositoryOptions{Keyfile: keyfile})
+}
+
+// OpenRepositoryReadOnly opens an existing repository without ever writing
+// to its storage backends, e.g. to restore or verify it from WORM media.
+func OpenRepositoryReadOnly(path, password string) (Repository, error) {
+	return OpenRepositoryWithOptions(path, password, RepositoryOptions{ReadOnly: true})
+}
+
+// OpenRepositoryWithOptions opens an existing repository configured with
+// opts and migrates it if possible. Repositories in a newer format than
+// RepositoryVersion fail with an UnsupportedFormatError.
+func OpenRepositoryWithOptions(path, password string, opts RepositoryOptions) (Repository, error) {
 	repository := Repository{
 		password: password,
+		logger:   opts.Logger,
+		clock:    opts.clock,
+	}
+	repository.backend.readOnly = opts.ReadOnly
+	if opts.Keyfile != "" {
+		var err error
+		repository.keyfile, err = readKeyfile(opts.Keyfile)
+		if err != nil {
+			return repository, err
+		}
 	}
 
-	backend, err := BackendFromURL(path)
+	backend, err := BackendFromURLWithOptions(path, opts.Backend)
 	if err != nil {
 		return repository, err
 	}
@@ -91,7 +254,19 @@ func OpenRepository(path, password string) (Repository, error) {
 		return repository, err
 	}
 
-	pipe, err := NewDecodingPipeline(CompressionNone, EncryptionAES, password)
+	version, b := stripFormatHeader(b)
+	if err := checkFormat(version, RepositoryVersion); err != nil {
+		return repository, err
+	}
+	methods, b := stripUnlockHeader(b)
+	if methods&UnlockKeyfile != 0 && repository.keyfile == "" {
+		return repository, ErrKeyfileRequired
+	}
+	if methods&UnlockPassword != 0 && password == "" {
+		return repository, ErrPasswordRequired
+	}
+
+	pipe, err := NewDecodingPipeline(CompressionNone, EncryptionAES, unlockSecret(password, repository.keyfile))
 	if err != nil {
 		return repository, err
 	}
@@ -99,27 +274,46 @@ func OpenRepository(path, password string) (Repository, error) {
 	if err != nil {
 		return repository, ErrOpenRepositoryFailed
 	}
-	if repository.Version < RepositoryVersion {
-		// migrate to current version
-		err = repository.Migrate()
+	if err := checkFormat(repository.Version, RepositoryVersion); err != nil {
+		return repository, err
+	}
+	if err := repository.checkEncrypter(opts.Encrypter); err != nil {
+		return repository, err
+	}
+
+	for _, url := range repository.Paths {
+		backend, err := BackendFromURLWithOptions(url, opts.Backend)
 		if err != nil {
 			return repository, err
 		}
+		repository.backend.AddBackend(&backend)
 	}
+	repository.backend.SetOptions(opts.Backend)
 
-	for _, url := range repository.Paths {
-		backend, err := BackendFromURL(url)
+	if repository.Version < RepositoryVersion {
+		// migrate to current version
+		repository.log().Info("Migrating repository from version ", repository.Version, " to ", RepositoryVersion)
+		if opts.ReadOnly {
+			err = repository.migrate()
+		} else {
+			err = repository.Migrate()
+		}
 		if err != nil {
 			return repository, err
 		}
-		repository.backend.AddBackend(&backend)
 	}
 
+	for _, volume := range repository.Volumes {
+		volume.repository = &repository
+	}
+
+	repository.log().Info("Opened repository at ", RedactURL(path))
 	return repository, err
 }
 
 // AddVolume adds a volume to a repository.
 func (r *Repository) AddVolume(volume *Volume) error {
+	volume.repository = r
 	r.Volumes = append(r.Volumes, volume)
 	return nil
 }
@@ -150,7 +344,27 @@ func (r *Repository) FindVolume(id string) (*Volume, error) {
 	return &Volume{}, ErrVolumeNotFound
 }
 
-// FindSnapshot finds a snapshot within a repository.
+// EachSnapshot calls fn for every snapshot of every volume, loading one
+// snapshot's metadata at a time. It stops at the first error returned by fn
+// or occurring while loading a snapshot and returns it.
+func (r *Repository) EachSnapshot(fn func(volume *Volume, snapshot *Snapshot) error) error {
+	for _, volume := range r.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshot, err := volume.LoadSnapshot(id, r)
+			if err != nil {
+				return err
+			}
+			if err := fn(volume, snapshot); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// FindSnapshot finds a snapshot within a repository. It fails with
+// ErrSnapshotTampered if the snapshot has been tampered with.
 func (r *Repository) FindSnapshot(id string) (*Volume, *Snapshot, error) {
 	if id == "latest" {
 		latestVolume := &Volume{}
@@ -159,6 +373,9 @@ func (r *Repository) FindSnapshot(id string) (*Volume, *Snapshot, error) {
 		for _, volume := range r.Volumes {
 			for _, snapshotID := range volume.Snapshots {
 				snapshot, err := volume.LoadSnapshot(snapshotID, r)
+				if err == ErrSnapshotTampered {
+					return &Volume{}, &Snapshot{}, err
+				}
 				if err == nil {
 					if !found || snapshot.Date.Sub(latestSnapshot.Date) > 0 {
 						latestSnapshot = snapshot
@@ -178,12 +395,103 @@ func (r *Repository) FindSnapshot(id string) (*Volume, *Snapshot, error) {
 			if err == nil {
 				return volume, snapshot, err
 			}
+			if err == ErrSnapshotTampered {
+				return &Volume{}, &Snapshot{}, err
+			}
+		}
+
+		// fall back to finding a snapshot by an unambiguous ID prefix
+		var candidates []string
+		var candidateVolume *Volume
+		for _, volume := range r.Volumes {
+			for _, snapshotID := range volume.Snapshots {
+				if strings.HasPrefix(snapshotID, id) {
+					candidates = append(candidates, snapshotID)
+					candidateVolume = volume
+				}
+			}
+		}
+		if len(candidates) > 1 {
+			return &Volume{}, &Snapshot{}, &AmbiguousSnapshotIDError{id, candidates}
+		}
+		if len(candidates) == 1 {
+			snapshot, err := candidateVolume.LoadSnapshot(candidates[0], r)
+			if err == nil || err == ErrSnapshotTampered {
+				return candidateVolume, snapshot, err
+			}
 		}
 	}
 
 	return &Volume{}, &Snapshot{}, ErrSnapshotNotFound
 }
 
+// checkRemovable returns ErrPinnedSnapshot or ErrImmutableSnapshot if the
+// snapshot id can't be removed. Snapshots that can't be opened can always be
+// removed.
+func (r *Repository) checkRemovable(id string) error {
+	snapshot, err := openSnapshot(id, r)
+	if err != nil {
+		return nil
+	}
+	return snapshot.checkRemovable()
+}
+
+// SetDefaults sets the default storage settings for new snapshots. Call
+// Save to persist them.
+func (r *Repository) SetDefaults(cfg RepositoryConfig) {
+	r.Config = cfg
+}
+
+// NewSnapshot creates a new snapshot, using the repository's snapshot ID
+// length and clock.
+func (r *Repository) NewSnapshot(description string) (*Snapshot, error) {
+	length := r.SnapshotIDLength
+	if length == 0 {
+		length = defaultSnapshotIDLength
+	}
+
+	snapshot, err := newSnapshot(description, length, r.now())
+	snapshot.repository = r
+	return snapshot, err
+}
+
+// RotateDataKey starts a new epoch with a freshly generated data encryption
+// key and saves the repository. New chunks get encrypted with the new key,
+// while existing chunks stay readable with the key of their epoch.
+func (r *Repository) RotateDataKey() error {
+	key, err := generateRandomKey(repositoryKeyLength)
+	if err != nil {
+		return ErrGenerateRandomKeyFailed
+	}
+
+	r.DataKeys = append(r.DataKeys, key)
+	r.log().Info("Rotated data key, starting epoch ", r.DataEpoch())
+	return r.Save()
+}
+
+// DataEpoch returns the current data encryption epoch.
+func (r *Repository) DataEpoch() uint {
+	return uint(len(r.DataKeys))
+}
+
+// currentDataKey returns the data encryption key of the current epoch.
+func (r *Repository) currentDataKey() string {
+	key, _ := r.dataKey(r.DataEpoch())
+	return key
+}
+
+// dataKey returns the data encryption key of epoch.
+func (r *Repository) dataKey(epoch uint) (string, error) {
+	if epoch == 0 {
+		return r.Key, nil
+	}
+	if epoch > uint(len(r.DataKeys)) {
+		return "", ErrUnknownKeyEpoch
+	}
+
+	return r.DataKeys[epoch-1], nil
+}
+
 // IsEmpty returns true if there a no snapshots stored in a repository.
 func (r *Repository) IsEmpty() bool {
 	for _, volume := range r.Volumes {
@@ -195,11 +503,55 @@ func (r *Repository) IsEmpty() bool {
 	return true
 }
 
+// log returns the repository's LogHandler.
+func (r *Repository) log() LogHandler {
+	if r.logger == nil {
+		return noopLogger{}
+	}
+
+	return r.logger
+}
+
+// now returns the current time.
+func (r *Repository) now() time.Time {
+	if r.clock == nil {
+		return time.Now()
+	}
+
+	return r.clock()
+}
+
 // BackendManager returns the repository's BackendManager.
 func (r *Repository) BackendManager() *BackendManager {
 	return &r.backend
 }
 
+// Close saves the pending changes of all chunk-indexes opened for the
+// repository and releases the connections and file handles of all storage
+// backends. Unsaved changes of the repository's metadata get lost, so call
+// Save first. The repository can't be used anymore afterwards, neither
+// through this nor any other copy of it, its operations return
+// ErrRepositoryClosed.
+func (r *Repository) Close() error {
+	r.log().Debug("Closing repository")
+
+	var err error
+	if !r.backend.readOnly {
+		for _, index := range r.backend.trackedIndexes() {
+			if !index.changed() {
+				continue
+			}
+			if serr := index.Save(r); serr != nil && err == nil {
+				err = serr
+			}
+		}
+	}
+	if cerr := r.backend.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
 // Init creates a new repository.
 func (r *Repository) init() error {
 	err := r.backend.InitRepository()
@@ -214,18 +566,34 @@ func (r *Repository) init() error {
 func (r *Repository) Save() error {
 	r.Paths = r.backend.Locations()
 
-	pipe, err := NewEncodingPipeline(CompressionNone, EncryptionAES, r.password)
+	b, err := r.encodeForLocations(r.Paths)
 	if err != nil {
 		return err
 	}
-	b, err := pipe.Encode(r)
+	r.log().Debug("Saving repository")
+	return r.backend.SaveRepository(b)
+}
+
+// encodeForLocations returns the encrypted repository metadata, referencing
+// the storage backends found at paths.
+func (r *Repository) encodeForLocations(paths []string) ([]byte, error) {
+	rc := *r
+	rc.Paths = paths
+
+	pipe, err := NewEncodingPipeline(CompressionNone, EncryptionAES, unlockSecret(r.password, r.keyfile))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return r.backend.SaveRepository(b)
+	b, err := pipe.Encode(rc)
+	if err != nil {
+		return nil, err
+	}
+	b = addUnlockHeader(b, unlockMethods(r.password, r.keyfile))
+	return addFormatHeader(b, r.Version), nil
 }
 
-// Changes password of repository.
+// Changes password of repository. A repository unlocked by a keyfile keeps
+// requiring it.
 func (r *Repository) ChangePassword(newPassword string) error {
 	r.password = newPassword
 
@@ -234,6 +602,14 @@ func (r *Repository) ChangePassword(newPassword string) error {
 
 // Migrates a repository to the current version, if possible.
 func (r *Repository) Migrate() error {
+	if err := r.migrate(); err != nil {
+		return err
+	}
+	return r.Save()
+}
+
+// migrate migrates a repository to the current version in memory.
+func (r *Repository) migrate() error {
 	switch v := r.Version; {
 	case v < 3:
 		return ErrRepositoryIncompatible
@@ -246,8 +622,12 @@ func (r *Repository) Migrate() error {
 			r.Key = r.password
 			r.Version = 4
 
-			return r.Save()
+			return r.migrate()
 		}
+	case v == 4:
+		// nothing changes until the chunk-index gets saved, which seals it
+		r.Version = 5
+		return nil
 	}
 	return ErrRepositoryIncompatible
 }
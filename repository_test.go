@@ -8,8 +8,14 @@
 package knoxite
 
 import (
+	"bytes"
+	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -115,3 +121,609 @@ func TestRepositoryChangePassword(t *testing.T) {
 	}
 
 }
+
+func TestRepositorySnapshotIDLength(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	_, err := NewRepositoryWithOptions("mem://snapshot-id-invalid", testPassword, RepositoryOptions{SnapshotIDLength: 2})
+	if err != ErrInvalidSnapshotIDLength {
+		t.Errorf("Expected %v, got %v", ErrInvalidSnapshotIDLength, err)
+	}
+
+	_, err = NewRepositoryWithOptions("mem://snapshot-id-length", testPassword, RepositoryOptions{SnapshotIDLength: 12})
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	r, err := OpenRepository("mem://snapshot-id-length", testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+
+	snapshot, err := r.NewSnapshot("test_snapshot")
+	if err != nil {
+		t.Fatalf("Failed creating snapshot: %s", err)
+	}
+	if len(snapshot.ID) != 12 {
+		t.Errorf("Expected snapshot ID of length 12, got %s", snapshot.ID)
+	}
+}
+
+func TestRepositoryFindSnapshotPrefix(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	r, err := NewRepository("mem://snapshot-prefix", testPassword)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+
+	for _, id := range []string{"abcd1234", "abcd5678", "ef001122"} {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		snapshot.ID = id
+		if err := snapshot.Save(&r); err != nil {
+			t.Fatalf("Failed saving snapshot: %s", err)
+		}
+		_ = vol.AddSnapshot(snapshot.ID)
+	}
+
+	for prefix, expected := range map[string]string{
+		"abcd1234": "abcd1234",
+		"abcd5":    "abcd5678",
+		"ef":       "ef001122",
+	} {
+		_, snapshot, err := r.FindSnapshot(prefix)
+		if err != nil {
+			t.Errorf("Failed finding snapshot %s: %s", prefix, err)
+			continue
+		}
+		if snapshot.ID != expected {
+			t.Errorf("Expected snapshot %s for prefix %s, got %s", expected, prefix, snapshot.ID)
+		}
+	}
+
+	_, _, err = r.FindSnapshot("abcd")
+	if !errors.Is(err, ErrAmbiguousSnapshotID) {
+		t.Errorf("Expected %v, got %v", ErrAmbiguousSnapshotID, err)
+	}
+	if aerr, ok := err.(*AmbiguousSnapshotIDError); !ok || len(aerr.Candidates) != 2 {
+		t.Errorf("Expected 2 candidates, got %v", err)
+	}
+
+	_, _, err = r.FindSnapshot("ff")
+	if err != ErrSnapshotNotFound {
+		t.Errorf("Expected %v, got %v", ErrSnapshotNotFound, err)
+	}
+}
+
+func TestRepositoryEachSnapshot(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	r, err := NewRepository("mem://each-snapshot", testPassword)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+
+	expected := make(map[string]string)
+	for v, ids := range [][]string{{"abcd1234", "abcd5678"}, {"ef001122"}} {
+		vol, _ := NewVolume("test"+strconv.Itoa(v), "")
+		_ = r.AddVolume(vol)
+		for _, id := range ids {
+			snapshot, _ := NewSnapshot("test_snapshot")
+			snapshot.ID = id
+			_ = snapshot.Save(&r)
+			_ = vol.AddSnapshot(snapshot.ID)
+			expected[id] = vol.ID
+		}
+	}
+
+	visited := make(map[string]int)
+	err = r.EachSnapshot(func(volume *Volume, snapshot *Snapshot) error {
+		visited[snapshot.ID]++
+		if expected[snapshot.ID] != volume.ID {
+			t.Errorf("Expected snapshot %s in volume %s, got %s", snapshot.ID, expected[snapshot.ID], volume.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed iterating snapshots: %s", err)
+	}
+	for id := range expected {
+		if visited[id] != 1 {
+			t.Errorf("Expected snapshot %s to be visited once, got %d", id, visited[id])
+		}
+	}
+
+	stop := errors.New("stop")
+	var n int
+	err = r.EachSnapshot(func(volume *Volume, snapshot *Snapshot) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("Expected iteration to stop after the first snapshot, got %d visits: %v", n, err)
+	}
+}
+
+func TestRepositoryRotateDataKey(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	repoDir := filepath.Join(dir, "repo")
+	r, err := NewRepository(repoDir, testPassword)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	contents := []string{"stored before the rotation", "stored after the rotation"}
+	var snapshots []*Snapshot
+	for i, content := range contents {
+		if i == 1 {
+			if err := r.RotateDataKey(); err != nil {
+				t.Fatalf("Failed rotating data key: %s", err)
+			}
+		}
+
+		src := filepath.Join(dir, "src"+string(rune('a'+i)))
+		_ = ioutil.WriteFile(src, []byte(content), 0600)
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:       wd,
+			Paths:     []string{src},
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+		})
+		if epoch := snapshot.Archives[src].Chunks[0].Epoch; epoch != uint(i) {
+			t.Errorf("Expected chunk to be stored in epoch %d, got %d", i, epoch)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	// the rotated key must have been persisted
+	r, err = OpenRepository(repoDir, testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	if r.DataEpoch() != 1 {
+		t.Errorf("Expected data epoch 1, got %d", r.DataEpoch())
+	}
+
+	for i, snapshot := range snapshots {
+		target := filepath.Join(dir, "target")
+		if errs := restoreSnapshot(t, r, snapshot, target, RestoreOptions{}); len(errs) > 0 {
+			t.Fatalf("Failed restoring snapshot of epoch %d: %v", i, errs)
+		}
+
+		src := filepath.Join(dir, "src"+string(rune('a'+i)))
+		b, _ := ioutil.ReadFile(filepath.Join(target, src))
+		if string(b) != contents[i] {
+			t.Errorf("Expected content %q, got %q", contents[i], b)
+		}
+	}
+}
+
+// closingBackend counts how often it got closed.
+type closingBackend struct {
+	Backend
+	closed *int
+}
+
+func (b closingBackend) Close() error {
+	*b.closed++
+	return b.Backend.Close()
+}
+
+func TestRepositoryClose(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	goroutines := runtime.NumGoroutine()
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Failed closing repository: %s", err)
+	}
+
+	r, err = OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	var closed int
+	mem, err := BackendFromURL("mem://close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var be Backend = closingBackend{mem, &closed}
+	r.BackendManager().AddBackend(&be)
+	snapshot, err := r.NewSnapshot("test_snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Failed closing repository: %s", err)
+	}
+	if closed != 1 {
+		t.Errorf("Expected backend to be closed once, got %d", closed)
+	}
+
+	if err := r.Save(); err != ErrRepositoryClosed {
+		t.Errorf("Expected %v saving a closed repository, got %v", ErrRepositoryClosed, err)
+	}
+	if err := snapshot.Save(&r); err != ErrRepositoryClosed {
+		t.Errorf("Expected %v saving a snapshot to a closed repository, got %v", ErrRepositoryClosed, err)
+	}
+	if _, err := OpenChunkIndex(&r); err != ErrRepositoryClosed {
+		t.Errorf("Expected %v opening the chunk index of a closed repository, got %v", ErrRepositoryClosed, err)
+	}
+	if err := r.Close(); err != ErrRepositoryClosed {
+		t.Errorf("Expected %v closing a repository twice, got %v", ErrRepositoryClosed, err)
+	}
+	if closed != 1 {
+		t.Errorf("Expected backend to be closed once, got %d", closed)
+	}
+
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("Expected no leaked goroutines, got %d more", n-goroutines)
+	}
+}
+
+func TestRepositoryCloseSavesIndex(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir for repository: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+	index.AddArchive(&Archive{Chunks: []Chunk{{Hash: "0123456789abcdef", DataParts: 1}}}, "snapshot")
+
+	// closing a copy closes the repository, saving the pending changes
+	c := r
+	if err := c.Close(); err != nil {
+		t.Fatalf("Failed closing repository: %s", err)
+	}
+	if err := r.Save(); err != ErrRepositoryClosed {
+		t.Errorf("Expected %v saving a copy of a closed repository, got %v", ErrRepositoryClosed, err)
+	}
+	if err := r.Close(); err != ErrRepositoryClosed {
+		t.Errorf("Expected %v closing a copy of a closed repository, got %v", ErrRepositoryClosed, err)
+	}
+
+	r, err = OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	defer r.Close()
+	index, err = OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+	if _, ok := index.Chunks["0123456789abcdef"]; !ok {
+		t.Error("Expected the pending chunk-index changes to be saved on close")
+	}
+}
+
+func TestRepositoryWeakPassword(t *testing.T) {
+	for _, password := range []string{"", "secret", "aaaaaaaaaaaaaaaaaaaa", "password1234"} {
+		if err := CheckPassword(password); !errors.Is(err, ErrWeakPassword) {
+			t.Errorf("Expected password %q to be weak, got %v", password, err)
+		}
+	}
+	for _, password := range []string{"correct horse battery staple", "Xk9#mP2$vL7@qR4!"} {
+		if err := CheckPassword(password); err != nil {
+			t.Errorf("Expected password %q to be strong, got %v", password, err)
+		}
+	}
+
+	tests := []struct {
+		url      string
+		password string
+		policy   uint16
+		warning  bool
+		err      error
+	}{
+		{"mem://password-weak-warn", "secret", PasswordWarnWeak, true, nil},
+		{"mem://password-weak-reject", "secret", PasswordRejectWeak, false, ErrWeakPassword},
+		{"mem://password-weak-allow", "secret", PasswordAllowWeak, false, nil},
+		{"mem://password-strong", "correct horse battery staple", PasswordRejectWeak, false, nil},
+	}
+	for _, tt := range tests {
+		logger := &capturingLogger{}
+		_, err := NewRepositoryWithOptions(tt.url, tt.password, RepositoryOptions{
+			Logger:         logger,
+			PasswordPolicy: tt.policy,
+		})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected error %v, got %v", tt.url, tt.err, err)
+		}
+		if warned := logger.contains("Warn: Password is weak"); warned != tt.warning {
+			t.Errorf("%s: expected warning %v, got %v", tt.url, tt.warning, logger.messages)
+		}
+	}
+}
+
+func TestRepositoryKeyfile(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyfile := filepath.Join(dir, "key")
+	otherKeyfile := filepath.Join(dir, "otherkey")
+	_ = ioutil.WriteFile(keyfile, []byte("some random key material"), 0600)
+	_ = ioutil.WriteFile(otherKeyfile, []byte("some other key material"), 0600)
+
+	tests := []struct {
+		name     string
+		password string
+		keyfile  string
+		methods  uint8
+	}{
+		{"password", testPassword, "", UnlockPassword},
+		{"keyfile", "", keyfile, UnlockKeyfile},
+		{"combined", testPassword, keyfile, UnlockPassword | UnlockKeyfile},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		_, err := NewRepositoryWithKeyfile(path, tt.password, tt.keyfile)
+		if err != nil {
+			t.Fatalf("%s: failed creating repository: %s", tt.name, err)
+		}
+
+		b, _ := ioutil.ReadFile(filepath.Join(path, RepoFilename))
+		_, b = stripFormatHeader(b)
+		if methods, _ := stripUnlockHeader(b); methods != tt.methods {
+			t.Errorf("%s: expected unlock methods %d in header, got %d", tt.name, tt.methods, methods)
+		}
+
+		if _, err := OpenRepositoryWithKeyfile(path, tt.password, tt.keyfile); err != nil {
+			t.Errorf("%s: failed opening repository: %s", tt.name, err)
+		}
+
+		// pairs of password and keyfile
+		failures := [][2]string{
+			{"", ""},
+			{"wrong_password", tt.keyfile},
+			{tt.password, otherKeyfile},
+		}
+		if tt.methods&UnlockPassword != 0 {
+			failures = append(failures, [2]string{"", tt.keyfile})
+		}
+		if tt.methods&UnlockKeyfile != 0 {
+			failures = append(failures, [2]string{tt.password, ""})
+		}
+		for _, f := range failures {
+			if _, err := OpenRepositoryWithKeyfile(path, f[0], f[1]); err == nil {
+				t.Errorf("%s: opened repository with password %q and keyfile %q", tt.name, f[0], f[1])
+			}
+		}
+	}
+}
+
+// writeRecordingBackend counts the writes to a backend.
+type writeRecordingBackend struct {
+	Backend
+	writes *int
+}
+
+func (b writeRecordingBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	*b.writes++
+	return b.Backend.StoreChunk(shasum, part, totalParts, data)
+}
+
+func (b writeRecordingBackend) DeleteChunk(shasum string, part, totalParts uint) error {
+	*b.writes++
+	return b.Backend.DeleteChunk(shasum, part, totalParts)
+}
+
+func (b writeRecordingBackend) SaveSnapshot(id string, data []byte) error {
+	*b.writes++
+	return b.Backend.SaveSnapshot(id, data)
+}
+
+func (b writeRecordingBackend) SaveChunkIndex(data []byte) error {
+	*b.writes++
+	return b.Backend.SaveChunkIndex(data)
+}
+
+func (b writeRecordingBackend) InitRepository() error {
+	*b.writes++
+	return b.Backend.InitRepository()
+}
+
+func (b writeRecordingBackend) SaveRepository(data []byte) error {
+	*b.writes++
+	return b.Backend.SaveRepository(data)
+}
+
+func TestRepositoryReadOnly(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	_ = ioutil.WriteFile(filepath.Join(src, "data"), []byte("data"), 0644)
+
+	path := filepath.Join(dir, "repo")
+	r, _ := NewRepository(path, testPassword)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	opts := StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}
+	snapshot := storeSnapshot(t, &r, &index, opts)
+	_ = snapshot.Save(&r)
+	_ = vol.AddSnapshot(snapshot.ID)
+	_ = index.Save(&r)
+	_ = r.Save()
+
+	r, err = OpenRepositoryReadOnly(path, testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository read-only: %s", err)
+	}
+	var writes int
+	var be Backend = writeRecordingBackend{*r.backend.Backends[0], &writes}
+	r.backend.Backends[0] = &be
+
+	// restoring & verifying works as usual
+	index, err = OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+	snapshot, err = r.Volumes[0].LoadSnapshot(snapshot.ID, &r)
+	if err != nil {
+		t.Fatalf("Failed loading snapshot: %s", err)
+	}
+	dst := filepath.Join(dir, "dst")
+	if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dst, src, "data")); string(b) != "data" {
+		t.Errorf("Expected restored file to contain %q, got %q", "data", b)
+	}
+	progress, err := VerifySnapshot(r, snapshot.ID, 100)
+	if err != nil {
+		t.Fatalf("Failed verifying snapshot: %s", err)
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed verifying snapshot: %s", p.Error)
+		}
+	}
+
+	// anything writing gets rejected
+	s, _ := r.NewSnapshot("test_snapshot")
+	var errs []error
+	for p := range s.Add(r, &index, opts) {
+		if p.Error != nil {
+			errs = append(errs, p.Error)
+		}
+	}
+	if len(errs) != 1 || errs[0] != ErrReadOnlyRepository {
+		t.Errorf("Expected %v storing a snapshot, got %v", ErrReadOnlyRepository, errs)
+	}
+	if err := s.Save(&r); err != ErrReadOnlyRepository {
+		t.Errorf("Expected %v saving a snapshot, got %v", ErrReadOnlyRepository, err)
+	}
+	if err := index.Save(&r); err != ErrReadOnlyRepository {
+		t.Errorf("Expected %v saving the chunk-index, got %v", ErrReadOnlyRepository, err)
+	}
+	if err := r.Save(); err != ErrReadOnlyRepository {
+		t.Errorf("Expected %v saving the repository, got %v", ErrReadOnlyRepository, err)
+	}
+	if _, err := index.Pack(&r); err != nil && err != ErrReadOnlyRepository {
+		t.Errorf("Expected %v packing the repository, got %v", ErrReadOnlyRepository, err)
+	}
+	if writes != 0 {
+		t.Errorf("Expected no writes to the backend, got %d", writes)
+	}
+}
+
+func TestRepositoryUnsupportedFormat(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	repoFile := filepath.Join(dir, RepoFilename)
+	current, _ := ioutil.ReadFile(repoFile)
+	version, _ := stripFormatHeader(current)
+	if version != RepositoryVersion {
+		t.Fatalf("Expected the format header to record version %d, got %d", RepositoryVersion, version)
+	}
+
+	// a client only supporting the last headerless version refuses it, as
+	// it can't read the sealed chunk-index
+	var fe *UnsupportedFormatError
+	if err := checkFormat(version, headerlessVersion); !errors.As(err, &fe) || fe.Supported != headerlessVersion {
+		t.Errorf("Expected %v for a version %d client, got %v", ErrUnsupportedFormat, headerlessVersion, err)
+	}
+
+	// a future client writing a newer format
+	r.Version = RepositoryVersion + 1
+	if err := r.Save(); err != nil {
+		t.Fatalf("Failed saving repository: %s", err)
+	}
+	_, err = OpenRepository(dir, testPassword)
+	if !errors.As(err, &fe) || fe.Version != RepositoryVersion+1 || fe.Supported != RepositoryVersion {
+		t.Fatalf("Expected %v for version %d, got %v", ErrUnsupportedFormat, RepositoryVersion+1, err)
+	}
+	if !errors.Is(err, ErrUnsupportedFormat) || !strings.Contains(err.Error(), strconv.Itoa(RepositoryVersion+1)) {
+		t.Errorf("Expected the error to name the required version, got %q", err)
+	}
+
+	// the format gets refused before decrypting the metadata, which a newer
+	// format may have changed
+	b := append(addFormatHeader(nil, 42), current...)
+	_ = ioutil.WriteFile(repoFile, b, 0600)
+	if _, err := OpenRepository(dir, "wrong_password"); !errors.As(err, &fe) || fe.Version != 42 {
+		t.Errorf("Expected %v for version 42, got %v", ErrUnsupportedFormat, err)
+	}
+
+	_ = ioutil.WriteFile(repoFile, current, 0600)
+	if _, err := OpenRepository(dir, testPassword); err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+	}
+
+	// repositories of the last headerless version get migrated
+	r.Version = headerlessVersion
+	if err := r.Save(); err != nil {
+		t.Fatalf("Failed saving repository: %s", err)
+	}
+	if b, _ := ioutil.ReadFile(repoFile); bytes.HasPrefix(b, formatHeader) {
+		t.Errorf("Expected version %d repositories to be written without a format header", headerlessVersion)
+	}
+	r, err = OpenRepository(dir, testPassword)
+	if err != nil || r.Version != RepositoryVersion {
+		t.Errorf("Expected repository to be migrated to version %d, got %d (%v)", RepositoryVersion, r.Version, err)
+	}
+	if b, _ := ioutil.ReadFile(repoFile); !bytes.HasPrefix(b, formatHeader) {
+		t.Error("Expected the migrated repository to be written with a format header")
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// Error declarations.
+var (
+	ErrManifestMismatch = errors.New("Restore manifest belongs to a different snapshot")
+)
+
+// restoreManifest records the progress of a restore, so an interrupted
+// restore can be resumed. Records get appended to the manifest file, one
+// JSON object per line.
+type restoreManifest struct {
+	mut    sync.Mutex
+	path   string
+	f      *os.File
+	done   map[string]bool
+	chunks map[string]uint
+}
+
+// manifestRecord is a single line of a restore manifest.
+type manifestRecord struct {
+	Snapshot string `json:"snapshot,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Chunks   uint   `json:"chunks,omitempty"` // amount of chunks written to a file
+	Done     bool   `json:"done,omitempty"`   // the archive has been restored completely
+}
+
+// openRestoreManifest opens the manifest at path for a restore of snapshot,
+// creating it if it doesn't exist yet.
+func openRestoreManifest(path string, snapshot string) (*restoreManifest, error) {
+	m := &restoreManifest{
+		path:   path,
+		done:   make(map[string]bool),
+		chunks: make(map[string]uint),
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	m.f = f
+
+	scanner := bufio.NewScanner(f)
+	empty := true
+	for scanner.Scan() {
+		var r manifestRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// empty or truncated by an interruption. As every record starts
+			// on a new line, the following records are still intact
+			continue
+		}
+		empty = false
+
+		switch {
+		case r.Snapshot != "":
+			if r.Snapshot != snapshot {
+				_ = f.Close()
+				return nil, ErrManifestMismatch
+			}
+		case r.Done:
+			m.done[r.Path] = true
+		default:
+			m.chunks[r.Path] = r.Chunks
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if empty {
+		return m, m.record(manifestRecord{Snapshot: snapshot})
+	}
+	return m, nil
+}
+
+// record appends r to the manifest on a new line.
+func (m *restoreManifest) record(r manifestRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	_, err = m.f.Write(append([]byte("\n"), b...))
+	return err
+}
+
+// isDone returns true if the archive at path has been restored completely.
+func (m *restoreManifest) isDone(path string) bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.done[path]
+}
+
+// writtenChunks returns the amount of chunks written to the file at path.
+func (m *restoreManifest) writtenChunks(path string) uint {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.chunks[path]
+}
+
+// close closes the manifest file.
+func (m *restoreManifest) close() error {
+	return m.f.Close()
+}
+
+// resumeFile verifies the content of the first chunks of arc written to f by
+// an interrupted restore. It truncates f behind the last intact chunk and
+// returns the amount of intact chunks and their size. Their content gets
+// written to mac.
+func resumeFile(f *os.File, arc Archive, chunks uint, mac io.Writer) (uint, int64, error) {
+	var size int64
+	i := uint(0)
+	for ; i < chunks; i++ {
+		idx, err := arc.IndexOfChunk(i)
+		if err != nil {
+			break
+		}
+		chunk := arc.Chunks[idx]
+
+		b := make([]byte, chunk.OriginalSize)
+		if _, err := io.ReadFull(f, b); err != nil {
+			break
+		}
+		if Hash(b, HashHighway256) != chunk.DecryptedHash {
+			break
+		}
+		_, _ = mac.Write(b)
+		size += int64(len(b))
+	}
+
+	if err := f.Truncate(size); err != nil {
+		return 0, 0, err
+	}
+	_, err := f.Seek(size, io.SeekStart)
+	return i, size, err
+}
+
+// isRestored returns true if the archive arc has been restored to path.
+func isRestored(path string, arc *Archive) bool {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	if arc.Type == File {
+		return fi.Mode().IsRegular() && uint64(fi.Size()) == arc.Size
+	}
+
+	return true
+}
+
+// remove closes and deletes the manifest file.
+func (m *restoreManifest) remove() error {
+	_ = m.f.Close()
+	return os.Remove(m.path)
+}
@@ -0,0 +1,128 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RetentionPolicy describes which snapshots of a volume to keep.
+// A snapshot is kept if any of the rules selects it. Pinned and immutable
+// snapshots are always kept.
+type RetentionPolicy struct {
+	KeepLast    int // keep the n most recent snapshots
+	KeepDaily   int // keep the most recent snapshot for each of the last n days
+	KeepWeekly  int // keep the most recent snapshot for each of the last n weeks
+	KeepMonthly int // keep the most recent snapshot for each of the last n months
+
+	// GroupByTag applies the rules separately to the snapshots of every value
+	// of this tag, e.g. "host" keeps the last n snapshots of every host in a
+	// shared repository. Snapshots without the tag form a group of their own
+	GroupByTag string
+}
+
+// ApplyRetention removes all snapshots from volume that aren't kept by
+// policy and returns the IDs of the removed snapshots. The chunk-index and
+// the repository need to be saved afterwards.
+func ApplyRetention(repository *Repository, volume *Volume, index *ChunkIndex, policy RetentionPolicy) ([]string, error) {
+	snapshots := []*Snapshot{}
+	for _, id := range volume.Snapshots {
+		snapshot, err := volume.LoadSnapshot(id, repository)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	keep := policy.keep(snapshots)
+
+	removed := []string{}
+	for _, snapshot := range snapshots {
+		if keep[snapshot.ID] {
+			continue
+		}
+
+		if err := volume.RemoveSnapshot(snapshot.ID); err != nil {
+			return removed, err
+		}
+		if err := index.ReleaseSnapshot(snapshot); err != nil {
+			return removed, err
+		}
+		removed = append(removed, snapshot.ID)
+	}
+
+	return removed, nil
+}
+
+// keep returns the IDs of all snapshots selected by the policy.
+func (policy RetentionPolicy) keep(snapshots []*Snapshot) map[string]bool {
+	if policy.GroupByTag == "" {
+		return policy.keepGroup(snapshots)
+	}
+
+	groups := make(map[string][]*Snapshot)
+	for _, snapshot := range snapshots {
+		tag := snapshot.Tags[policy.GroupByTag]
+		groups[tag] = append(groups[tag], snapshot)
+	}
+
+	keep := make(map[string]bool)
+	for _, group := range groups {
+		for id := range policy.keepGroup(group) {
+			keep[id] = true
+		}
+	}
+	return keep
+}
+
+// keepGroup returns the IDs of the snapshots selected by the policy's rules
+// among snapshots.
+func (policy RetentionPolicy) keepGroup(snapshots []*Snapshot) map[string]bool {
+	sorted := make([]*Snapshot, len(snapshots))
+	copy(sorted, snapshots)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Date.After(sorted[j].Date)
+	})
+
+	keep := make(map[string]bool)
+	for i, snapshot := range sorted {
+		if snapshot.Pinned || snapshot.Immutable() || i < policy.KeepLast {
+			keep[snapshot.ID] = true
+		}
+	}
+
+	buckets := []struct {
+		n   int
+		key func(s *Snapshot) string
+	}{
+		{policy.KeepDaily, func(s *Snapshot) string { return s.Date.Format("2006-01-02") }},
+		{policy.KeepWeekly, func(s *Snapshot) string {
+			y, w := s.Date.ISOWeek()
+			return fmt.Sprintf("%d-%d", y, w)
+		}},
+		{policy.KeepMonthly, func(s *Snapshot) string { return s.Date.Format("2006-01") }},
+	}
+	for _, b := range buckets {
+		seen := make(map[string]bool)
+		for _, snapshot := range sorted {
+			if len(seen) >= b.n {
+				break
+			}
+
+			k := b.key(snapshot)
+			if !seen[k] {
+				// the first snapshot we see per period is the most recent one
+				seen[k] = true
+				keep[snapshot.ID] = true
+			}
+		}
+	}
+
+	return keep
+}
@@ -0,0 +1,213 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionPinned(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	r, err := NewRepository("mem://retention-pinned", testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	index, _ := OpenChunkIndex(&r)
+
+	var ids []string
+	var pinned *Snapshot
+	now := time.Now()
+	for i := 3; i > 0; i-- {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		snapshot.Date = now.Add(-time.Duration(i) * time.Hour)
+		if i == 3 {
+			// the oldest snapshot is our known-good baseline
+			snapshot.SetPinned(true)
+			pinned = snapshot
+		}
+		_ = snapshot.Save(&r)
+		_ = vol.AddSnapshot(snapshot.ID)
+		ids = append(ids, snapshot.ID)
+	}
+	_ = r.Save()
+
+	r, err = OpenRepository("mem://retention-pinned", testPassword)
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+		return
+	}
+	vol, _ = r.FindVolume(vol.ID)
+
+	removed, err := ApplyRetention(&r, vol, &index, RetentionPolicy{KeepLast: 1})
+	if err != nil {
+		t.Errorf("Failed applying retention policy: %s", err)
+		return
+	}
+	if len(removed) != 1 || removed[0] != ids[1] {
+		t.Errorf("Expected snapshot %s to be removed, got %v", ids[1], removed)
+	}
+
+	if len(vol.Snapshots) != 2 || vol.Snapshots[0] != ids[0] || vol.Snapshots[1] != ids[2] {
+		t.Errorf("Expected snapshots %s and %s to be kept, got %v", ids[0], ids[2], vol.Snapshots)
+	}
+
+	if err := index.ReleaseSnapshot(pinned); err != ErrPinnedSnapshot {
+		t.Errorf("Expected %v releasing a pinned snapshot, got %v", ErrPinnedSnapshot, err)
+	}
+	if err := vol.RemoveSnapshot(pinned.ID); err != ErrPinnedSnapshot {
+		t.Errorf("Expected %v removing a pinned snapshot from its volume, got %v", ErrPinnedSnapshot, err)
+	}
+}
+
+func TestRetentionPeriods(t *testing.T) {
+	day := 24 * time.Hour
+	base := time.Date(2020, 6, 30, 12, 0, 0, 0, time.UTC)
+
+	var snapshots []*Snapshot
+	for i := 0; i < 60; i++ {
+		// two snapshots per day
+		for _, h := range []time.Duration{0, 6 * time.Hour} {
+			snapshot, _ := NewSnapshot("")
+			snapshot.Date = base.Add(-time.Duration(i)*day - h)
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	tests := []struct {
+		policy   RetentionPolicy
+		expected int
+	}{
+		{RetentionPolicy{}, 0},
+		{RetentionPolicy{KeepLast: 3}, 3},
+		{RetentionPolicy{KeepDaily: 7}, 7},
+		{RetentionPolicy{KeepMonthly: 2}, 2},
+		{RetentionPolicy{KeepLast: 1, KeepDaily: 7}, 7},
+	}
+	for _, tt := range tests {
+		keep := tt.policy.keep(snapshots)
+		if len(keep) != tt.expected {
+			t.Errorf("Policy %+v: expected %d snapshots to be kept, got %d", tt.policy, tt.expected, len(keep))
+		}
+	}
+}
+
+func TestRetentionImmutable(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	now := time.Date(2020, 6, 30, 12, 0, 0, 0, time.UTC)
+	r, err := NewRepositoryWithOptions("mem://retention-immutable", testPassword, RepositoryOptions{
+		clock: func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	index, _ := OpenChunkIndex(&r)
+
+	var snapshots []*Snapshot
+	for i := 2; i > 0; i-- {
+		snapshot, _ := r.NewSnapshot("test_snapshot")
+		snapshot.Date = now.Add(-time.Duration(i) * time.Hour)
+		// every snapshot references a chunk of its own
+		snapshot.AddArchive(&Archive{Path: "data", Chunks: []Chunk{{Hash: snapshot.ID, Size: 1024, DataParts: 1}}})
+		if i == 2 {
+			snapshot.ImmutableUntil = now.Add(24 * time.Hour)
+		}
+		index.AddArchive(snapshot.Archives["data"], snapshot.ID)
+		_ = snapshot.Save(&r)
+		_ = vol.AddSnapshot(snapshot.ID)
+		snapshots = append(snapshots, snapshot)
+	}
+	immutable := snapshots[0]
+
+	if err := index.ReleaseSnapshot(immutable); err != ErrImmutableSnapshot {
+		t.Errorf("Expected %v releasing an immutable snapshot, got %v", ErrImmutableSnapshot, err)
+	}
+	if err := index.RemoveSnapshot(immutable.ID); err != ErrImmutableSnapshot {
+		t.Errorf("Expected %v removing an immutable snapshot from the index, got %v", ErrImmutableSnapshot, err)
+	}
+	if err := vol.RemoveSnapshot(immutable.ID); err != ErrImmutableSnapshot {
+		t.Errorf("Expected %v removing an immutable snapshot from its volume, got %v", ErrImmutableSnapshot, err)
+	}
+	removed, err := ApplyRetention(&r, vol, &index, RetentionPolicy{KeepLast: 1})
+	if err != nil {
+		t.Fatalf("Failed applying retention policy: %s", err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("Expected immutable snapshot to be kept, got %v removed", removed)
+	}
+	if len(index.Unreferenced()) != 0 {
+		t.Errorf("Expected chunks of the immutable snapshot to stay referenced, got %v", index.Unreferenced())
+	}
+
+	// once the immutability window has passed, the snapshot can be removed
+	now = now.Add(25 * time.Hour)
+	removed, err = ApplyRetention(&r, vol, &index, RetentionPolicy{KeepLast: 1})
+	if err != nil {
+		t.Fatalf("Failed applying retention policy: %s", err)
+	}
+	if len(removed) != 1 || removed[0] != immutable.ID {
+		t.Errorf("Expected snapshot %s to be removed, got %v", immutable.ID, removed)
+	}
+	if unreferenced := index.Unreferenced(); len(unreferenced) != 1 || unreferenced[0] != immutable.ID {
+		t.Errorf("Expected chunk %s to be unreferenced, got %v", immutable.ID, unreferenced)
+	}
+}
+
+func TestRetentionGroupByTag(t *testing.T) {
+	day := 24 * time.Hour
+	base := time.Date(2020, 6, 30, 12, 0, 0, 0, time.UTC)
+
+	// a busy host storing hourly, and one storing daily that stopped a
+	// while ago
+	var snapshots []*Snapshot
+	hosts := make(map[string]string)
+	for i := 0; i < 10*24; i++ {
+		snapshot, _ := NewSnapshot("")
+		snapshot.Date = base.Add(-time.Duration(i) * time.Hour)
+		snapshot.SetTag("host", "busy")
+		snapshots = append(snapshots, snapshot)
+		hosts[snapshot.ID] = "busy"
+	}
+	for i := 20; i < 30; i++ {
+		snapshot, _ := NewSnapshot("")
+		snapshot.Date = base.Add(-time.Duration(i) * day)
+		snapshot.SetTag("host", "quiet")
+		snapshots = append(snapshots, snapshot)
+		hosts[snapshot.ID] = "quiet"
+	}
+
+	tests := []struct {
+		policy   RetentionPolicy
+		expected map[string]int
+	}{
+		{RetentionPolicy{KeepDaily: 7}, map[string]int{"busy": 7}},
+		{RetentionPolicy{KeepDaily: 7, GroupByTag: "host"}, map[string]int{"busy": 7, "quiet": 7}},
+		{RetentionPolicy{KeepLast: 3, GroupByTag: "host"}, map[string]int{"busy": 3, "quiet": 3}},
+	}
+	for _, tt := range tests {
+		kept := make(map[string]int)
+		for id := range tt.policy.keep(snapshots) {
+			kept[hosts[id]]++
+		}
+		for host, n := range tt.expected {
+			if kept[host] != n {
+				t.Errorf("Policy %+v: expected %d snapshots of %s to be kept, got %d", tt.policy, n, host, kept[host])
+			}
+		}
+		if len(kept) != len(tt.expected) {
+			t.Errorf("Policy %+v: expected snapshots of %d hosts to be kept, got %v", tt.policy, len(tt.expected), kept)
+		}
+	}
+}
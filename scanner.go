@@ -10,19 +10,121 @@ package knoxite
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
-func findFiles(rootPath string, excludes []string) chan ArchiveResult {
+// Error declarations.
+var (
+	ErrSpecialFile     = errors.New("Special files are not permitted")
+	ErrSymlinkLoop     = errors.New("Symlink leads to a directory that's already being stored, not following it")
+	ErrUnsupportedFile = errors.New("File type is not supported on this platform")
+)
+
+// UnsupportedFileError records a path that didn't get stored, as the
+// platform can't read its metadata or doesn't know its type.
+type UnsupportedFileError struct {
+	Path   string
+	Reason string
+}
+
+func (e *UnsupportedFileError) Error() string {
+	return fmt.Sprintf("%s: %s, skipped", e.Path, e.Reason)
+}
+
+// Is lets errors.Is match an UnsupportedFileError with ErrUnsupportedFile.
+func (e *UnsupportedFileError) Is(target error) bool {
+	return target == ErrUnsupportedFile
+}
+
+// Const declarations.
+const (
+	cacheDirTag       = "CACHEDIR.TAG"
+	cacheDirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// collapsePaths drops the paths that are given more than once or contained
+// in another one, so every tree gets walked once. It returns the remaining
+// paths in their original order.
+func collapsePaths(paths []string) ([]string, []*OverlappingPathError) {
+	abs := make([]string, len(paths))
+	for i, path := range paths {
+		var err error
+		abs[i], err = filepath.Abs(path)
+		if err != nil {
+			abs[i] = filepath.Clean(path)
+		}
+	}
+
+	// outer paths first, so they contain all later ones
+	order := make([]int, len(paths))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return len(abs[order[i]]) < len(abs[order[j]])
+	})
+
+	dropped := make([]bool, len(paths))
+	var overlaps []*OverlappingPathError
+	var kept []int
+	for _, i := range order {
+		for _, k := range kept {
+			if abs[i] == abs[k] || strings.HasPrefix(abs[i], strings.TrimSuffix(abs[k], string(filepath.Separator))+string(filepath.Separator)) {
+				dropped[i] = true
+				overlaps = append(overlaps, &OverlappingPathError{Path: paths[i], Within: paths[k]})
+				break
+			}
+		}
+		if !dropped[i] {
+			kept = append(kept, i)
+		}
+	}
+
+	var collapsed []string
+	for i, path := range paths {
+		if !dropped[i] {
+			collapsed = append(collapsed, path)
+		}
+	}
+	return collapsed, overlaps
+}
+
+// findFiles walks the tree at rootPath, reporting all paths opts doesn't
+// exclude, see StoreOptions.Excludes, ExcludeCaches, ExcludeMarker,
+// OneFileSystem, FollowSymlinks, SpecialFiles and Inaccessible.
+func findFiles(rootPath string, opts StoreOptions) chan ArchiveResult {
+	inaccessible := opts.inaccessiblePolicy()
 	c := make(chan ArchiveResult)
 	go func() {
-		err := filepath.Walk(rootPath, func(path string, fi os.FileInfo, err error) error {
+		var rootDev uint64
+		// devices & inodes of the directories walked so far, so following
+		// symlinks can't lead into an endless loop
+		visited := make(map[[2]uint64]bool)
+
+		// walk walks the tree at realRoot, reporting its paths below root,
+		// which differ when following a symlink
+		var walkFn filepath.WalkFunc
+		walk := func(root, realRoot string) error {
+			return filepath.Walk(realRoot, func(path string, fi os.FileInfo, err error) error {
+				path = root + path[len(realRoot):]
+				return walkFn(path, fi, err)
+			})
+		}
+
+		walkFn = func(path string, fi os.FileInfo, err error) error {
 			if err != nil {
 				if os.IsNotExist(err) {
 					return nil
 				}
+				if os.IsPermission(err) && inaccessible == InaccessibleWarn {
+					// report the path and continue with the rest of the tree
+					c <- ArchiveResult{Archive: &Archive{Path: path}, Error: err}
+					return nil
+				}
 				// fmt.Fprintf(os.Stderr, "Could not find %s\n", path)
 				return err
 			}
@@ -30,9 +132,12 @@ func findFiles(rootPath string, excludes []string) chan ArchiveResult {
 				// fmt.Fprintf(os.Stderr, "Could not read %s\n", path)
 				return fmt.Errorf("%s: could not read", path)
 			}
+			if opts.scanned != nil {
+				fi = opts.scanned(path, fi)
+			}
 
 			match := false
-			for _, exclude := range excludes {
+			for _, exclude := range opts.Excludes {
 				// fmt.Println("Matching", path, filepath.Base(path), exclude)
 				match, err = filepath.Match(strings.ToLower(exclude), strings.ToLower(path))
 				if err != nil {
@@ -54,25 +159,72 @@ func findFiles(rootPath string, excludes []string) chan ArchiveResult {
 				}
 				return nil
 			}
+			if opts.ExcludeCaches && fi.IsDir() && isCacheDir(path) {
+				return filepath.SkipDir
+			}
+			if opts.ExcludeMarker != "" && hasExcludeMarker(path, opts.ExcludeMarker) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			var warning error
+			if opts.FollowSymlinks && isSymLink(fi) {
+				if target, tfi, err := resolveSymlink(path); err == nil {
+					key, ok := inode(tfi)
+					switch {
+					case !tfi.IsDir():
+						fi = tfi
+					case ok && visited[key]:
+						warning = &os.PathError{Op: "follow", Path: path, Err: ErrSymlinkLoop}
+					default:
+						return walk(path, target)
+					}
+				}
+			}
+			if key, ok := inode(fi); ok && fi.IsDir() {
+				visited[key] = true
+			}
 
+			// skip what the platform can't store, instead of aborting the walk
+			unsupported := func(reason string) error {
+				c <- ArchiveResult{Archive: &Archive{Path: path}, Error: &UnsupportedFileError{path, reason}}
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if reason := unsupportedType(fi); reason != "" {
+				return unsupported(reason)
+			}
 			statT, ok := toStatT(fi.Sys())
 			if !ok {
-				return &os.PathError{Op: "stat", Path: path, Err: errors.New("error reading metadata")}
+				return unsupported("can't read metadata")
+			}
+			// the mount point itself gets stored as an empty directory, but
+			// none of its content
+			crossesDevice := false
+			if path == rootPath {
+				rootDev = statT.dev()
+			} else if opts.OneFileSystem && fi.IsDir() && statT.dev() != rootDev {
+				crossesDevice = true
 			}
+
 			archive := Archive{
-				Path:    path,
-				Mode:    fi.Mode(),
-				ModTime: fi.ModTime().Unix(),
-				UID:     statT.uid(),
-				GID:     statT.gid(),
+				Path:       path,
+				Mode:       fi.Mode(),
+				ModTime:    fi.ModTime().Unix(),
+				AccessTime: statT.atime(),
+				UID:        statT.uid(),
+				GID:        statT.gid(),
 				// AbsPath: path,
 				// FileInfo: fi,
 			}
 			if isSymLink(fi) {
 				symlink, err := os.Readlink(path)
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "\n\nerror resolving symlink for: %v - %v\n\n", path, err)
-					return nil
+					return unsupported("can't read symlink: " + err.Error())
 				}
 
 				archive.Type = SymLink
@@ -83,13 +235,30 @@ func findFiles(rootPath string, excludes []string) chan ArchiveResult {
 				archive.Type = File
 				archive.Size = uint64(fi.Size())
 			} else {
-				return nil
+				switch opts.SpecialFiles {
+				case SpecialFilesStoreMetadata:
+					if !isDeviceOrFIFO(fi) {
+						// sockets can't be recreated meaningfully
+						return nil
+					}
+					archive.Type = SpecialFile
+					archive.Rdev = statT.rdev()
+				case SpecialFilesError:
+					c <- ArchiveResult{Archive: &archive, Error: &os.PathError{Op: "store", Path: path, Err: ErrSpecialFile}}
+					return nil
+				default:
+					return nil
+				}
 			}
 
-			c <- ArchiveResult{Archive: &archive, Error: nil}
+			c <- ArchiveResult{Archive: &archive, Error: nil, Warning: warning}
+			if crossesDevice {
+				return filepath.SkipDir
+			}
 			return nil
-		})
+		}
 
+		err := walk(rootPath, rootPath)
 		if err != nil {
 			c <- ArchiveResult{Archive: nil, Error: err}
 		}
@@ -98,6 +267,58 @@ func findFiles(rootPath string, excludes []string) chan ArchiveResult {
 	return c
 }
 
+// resolveSymlink returns the path the symlink at path eventually points to,
+// as well as its FileInfo.
+func resolveSymlink(path string) (string, os.FileInfo, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", nil, err
+	}
+	fi, err := os.Lstat(target)
+	return target, fi, err
+}
+
+// inode returns the device & inode of fi, if the platform provides them.
+func inode(fi os.FileInfo) ([2]uint64, bool) {
+	statT, ok := toStatT(fi.Sys())
+	if !ok || statT.ino() == 0 {
+		return [2]uint64{}, false
+	}
+	return [2]uint64{statT.dev(), statT.ino()}, true
+}
+
+// unsupportedType returns why the type of fi isn't supported, or an empty
+// string if it's one knoxite knows how to handle.
+func unsupportedType(fi os.FileInfo) string {
+	mode := fi.Mode()
+	switch {
+	case mode&os.ModeIrregular != 0:
+		return "irregular file"
+	case mode.IsDir(), isSymLink(fi), isRegularFile(fi):
+		return ""
+	case mode&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0:
+		// see StoreOptions.SpecialFiles
+		return ""
+	}
+	return "unknown file type"
+}
+
+// isCacheDir returns true if the directory at path contains a CACHEDIR.TAG
+// file starting with the standard signature.
+func isCacheDir(path string) bool {
+	f, err := os.Open(filepath.Join(path, cacheDirTag))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	b := make([]byte, len(cacheDirSignature))
+	if _, err := io.ReadFull(f, b); err != nil {
+		return false
+	}
+	return string(b) == cacheDirSignature
+}
+
 func isSpecialPath(path string) bool {
 	return path == "." || path == ".."
 }
@@ -106,6 +327,10 @@ func isSymLink(fi os.FileInfo) bool {
 	return fi != nil && fi.Mode()&os.ModeSymlink != 0
 }
 
+func isDeviceOrFIFO(fi os.FileInfo) bool {
+	return fi != nil && fi.Mode()&(os.ModeDevice|os.ModeNamedPipe) != 0
+}
+
 func isRegularFile(fi os.FileInfo) bool {
 	return fi != nil && fi.Mode()&(os.ModeType|os.ModeCharDevice|os.ModeSymlink) == 0
 }
@@ -0,0 +1,171 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSnapshotOneFileSystem(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Mounting file systems requires root")
+	}
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	mnt := filepath.Join(src, "mnt")
+	_ = os.MkdirAll(mnt, 0755)
+	_ = ioutil.WriteFile(filepath.Join(src, "file"), []byte("file"), 0644)
+	if err := syscall.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("Can't mount a tmpfs: %s", err)
+	}
+	defer syscall.Unmount(mnt, 0)
+	_ = os.MkdirAll(filepath.Join(mnt, "nested"), 0755)
+	_ = ioutil.WriteFile(filepath.Join(mnt, "nested", "mounted"), []byte("mounted"), 0644)
+
+	for i, oneFileSystem := range []bool{false, true} {
+		r, _ := NewRepository("mem://one-file-system"+strconv.Itoa(i), testPassword)
+		index, _ := OpenChunkIndex(&r)
+		wd, _ := os.Getwd()
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:           wd,
+			Paths:         []string{src},
+			Encrypt:       EncryptionAES,
+			DataParts:     1,
+			OneFileSystem: oneFileSystem,
+		})
+
+		for path, expected := range map[string]bool{
+			filepath.Join(src, "file"):              true,
+			mnt:                                     true,
+			filepath.Join(mnt, "nested"):            !oneFileSystem,
+			filepath.Join(mnt, "nested", "mounted"): !oneFileSystem,
+		} {
+			if _, ok := snapshot.Archives[path]; ok != expected {
+				t.Errorf("One file system %v: expected %s to be stored: %v, got %v", oneFileSystem, path, expected, ok)
+			}
+		}
+	}
+}
+
+func TestRestoreOneFileSystemMountPoint(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Mounting file systems requires root")
+	}
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	mnt := filepath.Join(src, "sub", "mnt")
+	_ = os.MkdirAll(mnt, 0755)
+	_ = ioutil.WriteFile(filepath.Join(src, "sub", "file"), []byte("file"), 0644)
+	if err := syscall.Mount("tmpfs", mnt, "tmpfs", 0, "mode=0750"); err != nil {
+		t.Skipf("Can't mount a tmpfs: %s", err)
+	}
+	defer syscall.Unmount(mnt, 0)
+	_ = os.MkdirAll(filepath.Join(mnt, "nested"), 0755)
+	_ = ioutil.WriteFile(filepath.Join(mnt, "nested", "mounted"), []byte("mounted"), 0644)
+
+	r, _ := NewRepository("mem://mount-points", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:           wd,
+		Paths:         []string{src},
+		Encrypt:       EncryptionAES,
+		DataParts:     1,
+		OneFileSystem: true,
+	})
+
+	dst := filepath.Join(dir, "dst")
+	if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+	if _, err := os.Stat(filepath.Join(dst, src, "sub", "file")); err != nil {
+		t.Errorf("Expected the file next to the mount point to be restored: %s", err)
+	}
+
+	restored := filepath.Join(dst, mnt)
+	fi, err := os.Stat(restored)
+	if err != nil || !fi.IsDir() {
+		t.Fatalf("Expected the mount point to be restored as a directory: %v", err)
+	}
+	if fi.Mode().Perm() != 0750 {
+		t.Errorf("Expected the mount point to be restored with mode %v, got %v", os.FileMode(0750), fi.Mode().Perm())
+	}
+	if entries, _ := ioutil.ReadDir(restored); len(entries) > 0 {
+		t.Errorf("Expected the mount point to be restored empty, got %d entries", len(entries))
+	}
+}
+
+func TestSnapshotExcludeMarker(t *testing.T) {
+	testPassword := "this_is_a_password"
+	marker := "user.backup.excluded"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.MkdirAll(filepath.Join(src, "marked-dir"), 0755)
+	for _, name := range []string{"marked", "unmarked", filepath.Join("marked-dir", "file")} {
+		_ = ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644)
+	}
+	for _, name := range []string{"marked", "marked-dir"} {
+		if err := unix.Setxattr(filepath.Join(src, name), marker, []byte("1"), 0); err != nil {
+			t.Skipf("Can't set extended attributes: %s", err)
+		}
+	}
+
+	for i, excludeMarker := range []string{"", marker} {
+		r, _ := NewRepository("mem://exclude-marker"+strconv.Itoa(i), testPassword)
+		index, _ := OpenChunkIndex(&r)
+		wd, _ := os.Getwd()
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:           wd,
+			Paths:         []string{src},
+			Encrypt:       EncryptionAES,
+			DataParts:     1,
+			ExcludeMarker: excludeMarker,
+		})
+
+		for path, expected := range map[string]bool{
+			filepath.Join(src, "unmarked"):           true,
+			filepath.Join(src, "marked"):             excludeMarker == "",
+			filepath.Join(src, "marked-dir"):         excludeMarker == "",
+			filepath.Join(src, "marked-dir", "file"): excludeMarker == "",
+		} {
+			if _, ok := snapshot.Archives[path]; ok != expected {
+				t.Errorf("Exclude marker %q: expected %s to be stored: %v, got %v", excludeMarker, path, expected, ok)
+			}
+		}
+		if excludeMarker != "" && snapshot.Stats.Files != 1 {
+			t.Errorf("Expected only the unmarked file to be counted, got %d files", snapshot.Stats.Files)
+		}
+	}
+}
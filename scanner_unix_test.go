@@ -0,0 +1,213 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSpecialFilesPolicy(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(filepath.Join(dir, "repo"), testPassword)
+	index, _ := OpenChunkIndex(&r)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0700)
+	if err := syscall.Mkfifo(filepath.Join(src, "fifo"), 0640); err != nil {
+		t.Skipf("Can't create FIFO: %s", err)
+	}
+
+	for _, policy := range []uint16{SpecialFilesSkip, SpecialFilesStoreMetadata, SpecialFilesError} {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		var errs []error
+		for p := range snapshot.Add(r, &index, StoreOptions{
+			CWD:          src,
+			Paths:        []string{src},
+			Encrypt:      EncryptionAES,
+			DataParts:    1,
+			SpecialFiles: policy,
+		}) {
+			if p.Error != nil {
+				errs = append(errs, p.Error)
+			}
+		}
+
+		arc, stored := snapshot.Archives["fifo"]
+		switch policy {
+		case SpecialFilesSkip:
+			if stored || len(errs) > 0 {
+				t.Errorf("Expected FIFO to be skipped, got archive %v and errors %v", stored, errs)
+			}
+
+		case SpecialFilesError:
+			if stored {
+				t.Error("Expected FIFO not to be stored")
+			}
+			if len(errs) != 1 || !errors.Is(errs[0], ErrSpecialFile) {
+				t.Errorf("Expected %v, got %v", ErrSpecialFile, errs)
+			}
+
+		case SpecialFilesStoreMetadata:
+			if !stored || arc.Type != SpecialFile || len(errs) > 0 {
+				t.Fatalf("Expected FIFO to be stored as special file, got errors %v", errs)
+			}
+
+			dst := filepath.Join(dir, "dst")
+			if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{}); len(errs) > 0 {
+				t.Fatalf("Failed restoring snapshot: %v", errs)
+			}
+			fi, err := os.Lstat(filepath.Join(dst, "fifo"))
+			if err != nil {
+				t.Fatalf("FIFO was not restored: %s", err)
+			}
+			if fi.Mode()&os.ModeNamedPipe == 0 || fi.Mode().Perm() != 0640 {
+				t.Errorf("Expected restored FIFO with mode %v, got %v", arc.Mode, fi.Mode())
+			}
+		}
+	}
+}
+
+func TestInaccessiblePolicy(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Permissions are not enforced for root")
+	}
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(filepath.Join(dir, "repo"), testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	src := filepath.Join(dir, "src")
+	locked := filepath.Join(src, "locked")
+	_ = os.MkdirAll(locked, 0700)
+	_ = ioutil.WriteFile(filepath.Join(locked, "secret"), []byte("secret"), 0600)
+	for _, name := range []string{"a", "z"} {
+		_ = ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0600)
+	}
+	_ = os.Chmod(locked, 0)
+	defer os.Chmod(locked, 0700)
+
+	for _, pedantic := range []bool{false, true} {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		var errs, warnings []error
+		for p := range snapshot.Add(r, &index, StoreOptions{
+			CWD:       wd,
+			Paths:     []string{src},
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+			Pedantic:  pedantic,
+		}) {
+			if p.Error != nil {
+				errs = append(errs, p.Error)
+			}
+			if p.Warning != nil {
+				warnings = append(warnings, p.Warning)
+			}
+		}
+
+		if pedantic {
+			if len(errs) != 1 || !os.IsPermission(errs[0]) {
+				t.Fatalf("Expected a permission error, got %v", errs)
+			}
+			continue
+		}
+		if len(errs) != 0 {
+			t.Errorf("Expected no errors, got %v", errs)
+		}
+		if len(warnings) != 1 || !os.IsPermission(warnings[0]) {
+			t.Fatalf("Expected a permission warning, got %v", warnings)
+		}
+		for _, name := range []string{"a", "z"} {
+			if _, ok := snapshot.Archives[filepath.Join(src, name)]; !ok {
+				t.Errorf("Expected %s to be stored despite the inaccessible dir", name)
+			}
+		}
+		if _, ok := snapshot.Archives[filepath.Join(locked, "secret")]; ok {
+			t.Error("Didn't expect the content of the inaccessible dir to be stored")
+		}
+		if snapshot.Stats.Inaccessible != 1 {
+			t.Errorf("Expected 1 inaccessible path, got %d", snapshot.Stats.Inaccessible)
+		}
+	}
+}
+
+func TestFollowSymlinksLoop(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(filepath.Join(dir, "repo"), testPassword)
+	index, _ := OpenChunkIndex(&r)
+
+	src := filepath.Join(dir, "src")
+	_ = os.MkdirAll(filepath.Join(src, "dir"), 0700)
+	_ = ioutil.WriteFile(filepath.Join(src, "file"), []byte("knoxite"), 0600)
+	_ = os.Symlink("file", filepath.Join(src, "filelink"))
+	_ = os.Symlink("..", filepath.Join(src, "dir", "loop"))
+	other := filepath.Join(dir, "other")
+	_ = os.Mkdir(other, 0700)
+	_ = ioutil.WriteFile(filepath.Join(other, "inner"), []byte("knoxite"), 0600)
+	_ = os.Symlink(other, filepath.Join(src, "dirlink"))
+
+	wd, _ := os.Getwd()
+	snapshot, _ := NewSnapshot("test_snapshot")
+	var warnings []error
+	for p := range snapshot.Add(r, &index, StoreOptions{
+		CWD:            wd,
+		Paths:          []string{src},
+		Encrypt:        EncryptionAES,
+		DataParts:      1,
+		FollowSymlinks: true,
+	}) {
+		if p.Error != nil {
+			t.Errorf("Failed storing %s: %s", p.Path, p.Error)
+		}
+		if p.Warning != nil {
+			warnings = append(warnings, p.Warning)
+		}
+	}
+
+	if len(warnings) != 1 || !errors.Is(warnings[0], ErrSymlinkLoop) {
+		t.Fatalf("Expected %v, got %v", ErrSymlinkLoop, warnings)
+	}
+	if arc := snapshot.Archives[filepath.Join(src, "dir", "loop")]; arc == nil || arc.Type != SymLink {
+		t.Errorf("Expected looping symlink to be stored as symlink, got %v", arc)
+	}
+	if arc := snapshot.Archives[filepath.Join(src, "filelink")]; arc == nil || arc.Type != File || arc.Size != 7 {
+		t.Errorf("Expected symlinked file to be stored as file, got %v", arc)
+	}
+	if arc := snapshot.Archives[filepath.Join(src, "dirlink", "inner")]; arc == nil || arc.Type != File {
+		t.Errorf("Expected content of symlinked directory to be stored, got %v", arc)
+	}
+}
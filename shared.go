@@ -0,0 +1,133 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import "sync"
+
+// SharedRepository is a Repository handle that can safely be used by
+// multiple goroutines, e.g. in a long-running server.
+//
+// Restore and Read run concurrently with each other. Store and Write are
+// serialized: they wait for all running reads to finish and block new ones
+// until they are done. The wrapped Repository must not be accessed directly
+// while it's being shared.
+type SharedRepository struct {
+	mut        sync.RWMutex
+	repository *Repository
+}
+
+// NewSharedRepository returns a SharedRepository wrapping repository.
+func NewSharedRepository(repository *Repository) *SharedRepository {
+	return &SharedRepository{
+		repository: repository,
+	}
+}
+
+// Read calls fn with the repository, allowing other reads to run
+// concurrently. fn must not modify the repository.
+func (s *SharedRepository) Read(fn func(repository *Repository) error) error {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	return fn(s.repository)
+}
+
+// Write calls fn with exclusive access to the repository.
+func (s *SharedRepository) Write(fn func(repository *Repository) error) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return fn(s.repository)
+}
+
+// Restore restores the snapshot with the given id to dst. The repository
+// stays locked for reading until the returned channel has been drained.
+func (s *SharedRepository) Restore(snapshotID, dst string, opts RestoreOptions) (chan Progress, error) {
+	s.mut.RLock()
+
+	_, snapshot, err := s.repository.FindSnapshot(snapshotID)
+	if err != nil {
+		s.mut.RUnlock()
+		return nil, err
+	}
+	progress, err := DecodeSnapshot(*s.repository, snapshot, dst, opts)
+	if err != nil {
+		s.mut.RUnlock()
+		return nil, err
+	}
+
+	prog := make(chan Progress)
+	go func() {
+		defer s.mut.RUnlock()
+		defer close(prog)
+
+		for p := range progress {
+			prog <- p
+		}
+	}()
+
+	return prog, nil
+}
+
+// Store adds the paths in opts to snapshot and saves it in the volume with
+// the given id. The repository stays locked for writing until the returned
+// channel has been drained.
+func (s *SharedRepository) Store(volumeID string, snapshot *Snapshot, opts StoreOptions) (chan Progress, error) {
+	s.mut.Lock()
+
+	volume, err := s.repository.FindVolume(volumeID)
+	if err != nil {
+		s.mut.Unlock()
+		return nil, err
+	}
+	index, err := OpenChunkIndex(s.repository)
+	if err != nil {
+		s.mut.Unlock()
+		return nil, err
+	}
+
+	progress := snapshot.Add(*s.repository, &index, opts)
+
+	prog := make(chan Progress)
+	go func() {
+		defer s.mut.Unlock()
+		defer close(prog)
+
+		for p := range progress {
+			prog <- p
+		}
+		if snapshot.Unchanged() {
+			return
+		}
+
+		if err := s.saveSnapshot(volume, snapshot, &index); err != nil {
+			prog <- newProgressError(err)
+		}
+	}()
+
+	return prog, nil
+}
+
+// saveSnapshot stores a snapshot's metadata in volume. The caller must hold
+// the write lock.
+func (s *SharedRepository) saveSnapshot(volume *Volume, snapshot *Snapshot, index *ChunkIndex) error {
+	err := snapshot.Save(s.repository)
+	if err != nil {
+		return err
+	}
+	err = volume.AddSnapshot(snapshot.ID)
+	if err != nil {
+		return err
+	}
+	err = index.Save(s.repository)
+	if err != nil {
+		return err
+	}
+
+	return s.repository.Save()
+}
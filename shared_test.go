@@ -0,0 +1,122 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func drainProgress(progress chan Progress) []error {
+	var errs []error
+	for p := range progress {
+		if p.Error != nil {
+			errs = append(errs, p.Error)
+		}
+	}
+
+	return errs
+}
+
+func TestSharedRepositoryConcurrentAccess(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository("mem://shared-repository", testPassword)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	shared := NewSharedRepository(&r)
+	wd, _ := os.Getwd()
+
+	data := make([]byte, 1024*1024)
+	_, _ = rand.Read(data)
+	for _, name := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatalf("Failed writing test file: %s", err)
+		}
+	}
+	opts := StoreOptions{
+		CWD:       wd,
+		Paths:     []string{filepath.Join(dir, "first")},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}
+
+	first, _ := NewSnapshot("first")
+	progress, err := shared.Store(vol.ID, first, opts)
+	if err != nil {
+		t.Fatalf("Failed storing snapshot: %s", err)
+	}
+	if errs := drainProgress(progress); len(errs) > 0 {
+		t.Fatalf("Failed storing snapshot: %v", errs)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			target := filepath.Join(dir, "target"+strconv.Itoa(i))
+			progress, err := shared.Restore(first.ID, target, RestoreOptions{})
+			if err != nil {
+				t.Errorf("Failed restoring snapshot: %s", err)
+				return
+			}
+			if errs := drainProgress(progress); len(errs) > 0 {
+				t.Errorf("Failed restoring snapshot: %v", errs)
+				return
+			}
+
+			b, err := ioutil.ReadFile(filepath.Join(target, dir, "first"))
+			if err != nil || !bytes.Equal(b, data) {
+				t.Errorf("Restored data differs from original: %v", err)
+			}
+		}(i)
+	}
+
+	second, _ := NewSnapshot("second")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		opts.Paths = []string{filepath.Join(dir, "second")}
+		progress, err := shared.Store(vol.ID, second, opts)
+		if err != nil {
+			t.Errorf("Failed storing snapshot: %s", err)
+			return
+		}
+		if errs := drainProgress(progress); len(errs) > 0 {
+			t.Errorf("Failed storing snapshot: %v", errs)
+		}
+	}()
+	wg.Wait()
+
+	err = shared.Read(func(r *Repository) error {
+		_, snapshot, err := r.FindSnapshot(second.ID)
+		if err == nil && len(snapshot.Archives) != 1 {
+			t.Errorf("Expected 1 archive in second snapshot, got %d", len(snapshot.Archives))
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Failed finding second snapshot: %s", err)
+	}
+}
@@ -8,6 +8,11 @@
 package knoxite
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"math"
 	"os"
 	"path/filepath"
@@ -27,9 +32,155 @@ type Snapshot struct {
 	Description string              `json:"description"`
 	Stats       Stats               `json:"stats"`
 	Archives    map[string]*Archive `json:"items"`
+	Pinned      bool                `json:"pinned"`
+	Partial     bool                `json:"partial,omitempty"` // some archives failed to store, see Archive.Failed
+	Tags        map[string]string   `json:"tags,omitempty"`    // e.g. the host a snapshot got stored on, see SetTag
+
+	// AbsolutePaths is set if the archives got stored with
+	// StoreOptions.AbsolutePaths
+	AbsolutePaths bool `json:"absolutepaths,omitempty"`
+	// ArchiveSegments is the amount of archive segments stored separately
+	// from the snapshot's metadata, see StoreOptions.MaxArchivesInMemory
+	ArchiveSegments uint `json:"archive_segments,omitempty"`
+	// ImmutableUntil protects the snapshot from being removed before this
+	// time, see StoreOptions.ImmutableFor
+	ImmutableUntil time.Time `json:"immutable_until"`
+	// Digest authenticates all other metadata of the snapshot, including
+	// SegmentDigests, which authenticate the archive segments. Snapshots
+	// saved by older versions have none
+	Digest         string   `json:"digest,omitempty"`
+	SegmentDigests []string `json:"segment_digests,omitempty"`
+	// ParityGroups protect the small chunks stored by the snapshot, see
+	// StoreOptions.ParityGroupSize
+	ParityGroups []ParityGroup `json:"parity_groups,omitempty"`
+
+	repository *Repository // loads the archive segments
+
+	unchanged bool
+	salt      string // keys the chunks of a NoDedup snapshot
+
+	effectiveness storageEffectiveness // gathered while adding to the snapshot
+	pendingParity pendingParityGroup   // small chunks waiting for their parity
+	pendingPack   pendingPack          // chunks waiting for their pack object
+}
+
+// Const declarations.
+const (
+	defaultSnapshotIDLength = 8
+	minSnapshotIDLength     = 4
+	maxSnapshotIDLength     = 32
+
+	// amount of chunks whose existence gets checked with a single request
+	existenceBatchSize = 16
+)
+
+// Policies for special files (FIFOs, sockets and device nodes).
+const (
+	SpecialFilesSkip          = iota // Ignore special files
+	SpecialFilesStoreMetadata        // Store FIFOs & device nodes without content, so they can be recreated
+	SpecialFilesError                // Report an error for every special file
+)
+
+// Settings of StoreOptions that got set explicitly, so they win over the
+// repository's defaults even when set to zero, see StoreOptions.Explicit.
+const (
+	ExplicitCompress = 1 << iota
+	ExplicitEncrypt
+	ExplicitDataParts
+	ExplicitParityParts
+	ExplicitChunkSize
+)
+
+// Policies for paths that can't be accessed due to missing permissions.
+const (
+	InaccessibleWarn  = iota // Report the path on the progress channel and continue with the rest of the tree
+	InaccessibleAbort        // Abort the walk
+)
+
+// Policies for paths to store that are given more than once, or contained
+// in another one.
+const (
+	OverlappingPathsCollapse = iota // Walk every tree once, reporting the dropped paths as warnings
+	OverlappingPathsError           // Abort the snapshot
+)
+
+// Error declarations.
+var (
+	ErrSnapshotUnchanged = errors.New("Snapshot is identical to its parent")
+	ErrMixedPaths        = errors.New("Snapshot can't mix absolute and relative paths")
+	ErrImmutableSnapshot = errors.New("Snapshot is immutable and can't be removed yet")
+	ErrPinnedSnapshot    = errors.New("Snapshot is pinned and can't be removed")
+	ErrFileSizeExcluded  = errors.New("File excluded due to its size")
+	ErrFileAgeExcluded   = errors.New("File excluded due to its modification time")
+	ErrFileVanished      = errors.New("File vanished before it could be read")
+	ErrSnapshotTampered  = errors.New("Snapshot metadata has been tampered with")
+	ErrOverlappingPaths  = errors.New("Paths to store overlap")
+)
+
+// FileSizeError records a file that didn't get stored, as its size is
+// outside of StoreOptions.MinFileSize and StoreOptions.MaxFileSize.
+type FileSizeError struct {
+	Path  string
+	Size  uint64
+	Limit uint64
+}
+
+func (e *FileSizeError) Error() string {
+	if e.Size > e.Limit {
+		return fmt.Sprintf("%s: file size of %s exceeds the maximum of %s, skipped", e.Path, SizeToString(e.Size), SizeToString(e.Limit))
+	}
+	return fmt.Sprintf("%s: file size of %s is below the minimum of %s, skipped", e.Path, SizeToString(e.Size), SizeToString(e.Limit))
+}
+
+// Is lets errors.Is match a FileSizeError with ErrFileSizeExcluded.
+func (e *FileSizeError) Is(target error) bool {
+	return target == ErrFileSizeExcluded
+}
+
+// FileAgeError records a file that didn't get stored, as it was last
+// modified before StoreOptions.ExcludeOlderThan or after
+// StoreOptions.ExcludeNewerThan.
+type FileAgeError struct {
+	Path    string
+	ModTime time.Time
+	Cutoff  time.Time
+}
+
+func (e *FileAgeError) Error() string {
+	if e.ModTime.Before(e.Cutoff) {
+		return fmt.Sprintf("%s: last modified %s, before %s, skipped", e.Path, e.ModTime.Format(time.RFC3339), e.Cutoff.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s: last modified %s, after %s, skipped", e.Path, e.ModTime.Format(time.RFC3339), e.Cutoff.Format(time.RFC3339))
+}
+
+// Is lets errors.Is match a FileAgeError with ErrFileAgeExcluded.
+func (e *FileAgeError) Is(target error) bool {
+	return target == ErrFileAgeExcluded
+}
+
+// OverlappingPathError records a path to store that is contained in another
+// one, see StoreOptions.OverlappingPaths.
+type OverlappingPathError struct {
+	Path   string
+	Within string
+}
+
+func (e *OverlappingPathError) Error() string {
+	if e.Path == e.Within {
+		return fmt.Sprintf("%s: given more than once, skipped", e.Path)
+	}
+	return fmt.Sprintf("%s: already contained in %s, skipped", e.Path, e.Within)
+}
+
+// Is lets errors.Is match an OverlappingPathError with ErrOverlappingPaths.
+func (e *OverlappingPathError) Is(target error) bool {
+	return target == ErrOverlappingPaths
 }
 
 // StoreOptions holds all the storage settings for a snapshot operation.
+// Compress, Encrypt, DataParts, ParityParts and ChunkSize inherit the
+// repository's defaults (see RepositoryConfig) when left at zero, unless
+// marked in Explicit.
 type StoreOptions struct {
 	CWD         string
 	Paths       []string
@@ -39,12 +190,184 @@ type StoreOptions struct {
 	Pedantic    bool
 	DataParts   uint
 	ParityParts uint
+	// ParityGroupSize lets up to this many chunks smaller than 256 KiB share
+	// a parity group of ParityParts parity parts, instead of every chunk
+	// getting parity parts of its own, which saves lots of overhead for
+	// small files. Damaged chunks can be restored with RepairParityGroups.
+	// Zero disables parity groups
+	ParityGroupSize uint
+	// PackSize stores chunks without parity parts together in pack objects
+	// of up to this many bytes, in the order they got stored, instead of
+	// every chunk getting an object of its own. This saves lots of requests
+	// for small files, and restores load chunks stored next to each other
+	// with a single range read, see RestoreOptions.ReadAhead. Zero disables
+	// packing
+	PackSize uint
+	// ChunkSize is the maximum size of a chunk. Zero uses the default size
+	ChunkSize uint
+	// Explicit marks settings that don't inherit the repository's defaults,
+	// even if they're zero, e.g. ExplicitCompress to store a snapshot
+	// uncompressed in a repository defaulting to a compression algo
+	Explicit uint16
+	// Chunker divides files into chunks. Nil uses the built-in
+	// content-defined chunker
+	Chunker Chunker
+	// StableChunkBoundaries makes the built-in chunker aim for chunks of
+	// about half of ChunkSize, so nearly all of them end at content-defined
+	// boundaries instead of being cut at ChunkSize. Data inserted into a file
+	// then only changes the chunks around it, even with a small ChunkSize.
+	// Files get divided differently than without it, so they don't
+	// deduplicate with chunks stored without it
+	StableChunkBoundaries bool
+	// LZMA tunes the compression if Compress is CompressionLZMA. Chunks get
+	// compressed in parallel, see ChunkWorkers
+	LZMA LZMAOptions
+	// SpecialFiles is the policy for FIFOs, sockets and device nodes
+	SpecialFiles uint16
+	// ExcludeCaches skips directories tagged as caches by a CACHEDIR.TAG
+	// file, see https://bford.info/cachedir/
+	ExcludeCaches bool
+	// ExcludeMarker skips files & directories that have the extended
+	// attribute of this name, e.g. user.backup.excluded, which lets another
+	// backup tool mark the files it takes care of. Only supported on Linux.
+	// Empty disables it
+	ExcludeMarker string
+	// OneFileSystem doesn't descend into directories on other file systems
+	// than the one the path to store is on, like mounts of /proc or network
+	// shares. The mount points get stored as empty directories with their
+	// metadata, so restores recreate them
+	OneFileSystem bool
+	// FollowSymlinks stores the files & directories symlinks point to instead
+	// of the symlinks themselves. Symlinks leading to a directory that's
+	// already being stored, e.g. one of their parents, are stored as symlinks
+	// and reported as a warning
+	FollowSymlinks bool
+	// MaxFileSize skips files larger than this amount of bytes, MinFileSize
+	// files smaller than it. Skipped files get reported as a FileSizeError
+	// warning. Zero disables the limit
+	MaxFileSize uint64
+	MinFileSize uint64
+	// ExcludeOlderThan skips files last modified before this time,
+	// ExcludeNewerThan files modified after it. Skipped files get reported
+	// as a FileAgeError warning. The zero time disables the cutoff
+	ExcludeOlderThan time.Time
+	ExcludeNewerThan time.Time
+	// Inaccessible is the policy for paths that can't be read due to missing
+	// permissions. Pedantic runs always abort
+	Inaccessible uint16
+	// OverlappingPaths is the policy for Paths given more than once or
+	// contained in another one, which would otherwise get stored twice
+	OverlappingPaths uint16
+
+	// Parent is the previous snapshot of the same paths. Files that did not
+	// change since then reuse the parent's chunks instead of being stored again
+	Parent *Snapshot
+	// RecordContentHash stores a hash of each file's content. When a Parent is
+	// set, files get compared by content hash instead of their size & mtime,
+	// which also detects files that have been moved or renamed
+	RecordContentHash bool
+	// SkipUnchanged discards the snapshot if its archives are identical to
+	// the Parent's. Leave it unset to force storing a new snapshot
+	SkipUnchanged bool
+
+	// ProgressInterval limits progress updates to one per interval. Errors
+	// and the final update are always sent. Zero sends every update
+	ProgressInterval time.Duration
+	// DisableBufferPool allocates a new buffer for every chunk instead of
+	// reusing pooled ones
+	DisableBufferPool bool
+	// ChunkWorkers is the amount of chunks of a file getting compressed &
+	// encrypted in parallel. Zero uses one per CPU core
+	ChunkWorkers int
+	// Limiter bounds the chunk operations in flight on the storage backends.
+	// Snapshots stored concurrently can share one to limit their combined
+	// load. Nil doesn't limit them
+	Limiter *Limiter
+	// NoDedup keys the snapshot's chunks with a per-snapshot salt, so they
+	// never get shared with other snapshots. This hides which data already
+	// exists in the repository, but uses more space. Parent chunks are not
+	// reused either
+	NoDedup bool
+	// PreserveWindowsAttrs records the readonly, hidden, system, archive and
+	// not-content-indexed attributes of files on Windows
+	PreserveWindowsAttrs bool
+	// PreserveCapabilities records the capabilities of files on Linux, e.g.
+	// cap_net_bind_service
+	PreserveCapabilities bool
+	// PreserveACLs records the POSIX access ACLs of files & directories on
+	// Linux, as well as the default ACLs directories pass on to new files
+	PreserveACLs bool
+	// CompressionDict is the ID of a Zstd dictionary, added to the repository
+	// with AddCompressionDict. It compresses chunks smaller than 128 KiB,
+	// which improves the ratio for many small, similar files. Zero disables
+	// it, as do compression methods other than Zstd
+	CompressionDict uint32
+	// CompressMinChunkSize stores chunks smaller than this amount of bytes
+	// uncompressed, regardless of Compress, as compressing them costs more
+	// than it saves. Zero compresses all chunks
+	CompressMinChunkSize uint
+	// SkipSpaceCheck doesn't warn if local storage backends lack the space
+	// for the files of Paths, saving the extra walk needed to sum them up
+	SkipSpaceCheck bool
+	// NormalizePaths is the unicode normalization form paths get stored in,
+	// so they restore the same way on every platform. Paths that collide
+	// after normalization are reported with ErrPathCollision and skipped
+	NormalizePaths uint16
+	// CaseInsensitivePaths also reports paths as colliding if they only
+	// differ by case, as they can't be restored on case-insensitive file
+	// systems
+	CaseInsensitivePaths bool
+	// AbsolutePaths stores the full paths of all files instead of paths
+	// relative to CWD, so they can be restored to their original locations,
+	// see RestoreOptions.RestoreToOriginal. Adding files to a snapshot with
+	// and without it fails with ErrMixedPaths
+	AbsolutePaths bool
+	// MaxArchivesInMemory limits the amount of archives Add keeps in memory.
+	// Once reached, they get stored as a separate segment of the snapshot, so
+	// memory use stays bounded no matter how many files get stored. Use
+	// Snapshot.EachArchive or Snapshot.LoadArchives to access all archives of
+	// such a snapshot. Zero keeps all archives in memory. SkipUnchanged has
+	// no effect once a segment has been stored
+	MaxArchivesInMemory int
+	// ImmutableFor makes the snapshot immutable for this duration after its
+	// creation: until then, removing it fails with ErrImmutableSnapshot and
+	// its chunks stay referenced. Zero doesn't protect the snapshot
+	ImmutableFor time.Duration
+	// DescriptionTemplate replaces the description of the snapshot, with the
+	// variables {host}, {date}, {time}, {id} and {paths} expanded. Unknown
+	// variables fail with a DescriptionTemplateError. Empty keeps the
+	// description
+	DescriptionTemplate string
+	// DedupWindow only deduplicates the chunks against the hashes of this
+	// many chunks most recently stored by Add, instead of asking the
+	// backends which chunks they already hold. This bounds the memory & the
+	// requests needed for deduplication in very large backups, but chunks
+	// that fell out of the window, or got stored by other snapshots, get
+	// stored again. The chunks of the snapshot only get added to the
+	// chunk-index once it gets saved. Zero deduplicates against all stored
+	// chunks
+	DedupWindow int
+
+	salt      string
+	dict      []byte
+	encrypter Encrypter
+	window    *dedupWindow
+	// scanned replaces the FileInfo of every path found by the walk, if set
+	scanned func(path string, fi os.FileInfo) os.FileInfo
+	// beforeRead gets called before the content of a file gets read, if set
+	beforeRead func(path string)
 }
 
 // NewSnapshot creates a new snapshot.
 func NewSnapshot(description string) (*Snapshot, error) {
+	return newSnapshot(description, defaultSnapshotIDLength, time.Now())
+}
+
+// newSnapshot creates a new snapshot taken at date, with an ID of idLength
+// hex characters.
+func newSnapshot(description string, idLength int, date time.Time) (*Snapshot, error) {
 	snapshot := Snapshot{
-		Date:        time.Now(),
+		Date:        date,
 		Description: description,
 		Archives:    make(map[string]*Archive),
 	}
@@ -53,12 +376,14 @@ func NewSnapshot(description string) (*Snapshot, error) {
 	if err != nil {
 		return &snapshot, err
 	}
-	snapshot.ID = u.String()[:8]
+	snapshot.ID = hex.EncodeToString(u[:])[:idLength]
 
 	return &snapshot, nil
 }
 
-func (snapshot *Snapshot) gatherTargetInformation(cwd string, paths []string, excludes []string) chan ArchiveResult {
+// gatherTargetInformation walks paths with the walk settings of opts,
+// reporting the paths found relative to cwd, unless it's empty.
+func (snapshot *Snapshot) gatherTargetInformation(cwd string, paths []string, opts StoreOptions) chan ArchiveResult {
 	ch := make(chan ArchiveResult)
 	var wg sync.WaitGroup
 
@@ -75,13 +400,16 @@ func (snapshot *Snapshot) gatherTargetInformation(cwd string, paths []string, ex
 		var archives []ArchiveResult
 
 		for _, path := range paths {
-			ff := findFiles(path, excludes)
+			ff := findFiles(path, opts)
 
 			for result := range ff {
+				snapshot.countInaccessible(result.Error)
 				if result.Error == nil {
-					rel, err := filepath.Rel(cwd, result.Archive.Path)
-					if err == nil && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
-						result.Archive.Path = rel
+					if cwd != "" {
+						rel, err := filepath.Rel(cwd, result.Archive.Path)
+						if err == nil && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+							result.Archive.Path = rel
+						}
 					}
 					if isSpecialPath(result.Archive.Path) {
 						continue
@@ -120,130 +448,871 @@ func (snapshot *Snapshot) gatherTargetInformation(cwd string, paths []string, ex
 	return ch
 }
 
+// EstimateSnapshotSize walks the paths of opts, applying the same filters as
+// Add, and returns the amount of files and their total size without storing
+// anything. Errors don't stop the walk, the first one gets returned.
+func EstimateSnapshotSize(opts StoreOptions) (files, bytes int64, err error) {
+	snapshot := Snapshot{}
+	paths, _ := collapsePaths(opts.Paths)
+	for result := range snapshot.gatherTargetInformation(opts.CWD, paths, opts) {
+		if result.Error != nil {
+			if err == nil && !errors.Is(result.Error, ErrUnsupportedFile) {
+				err = result.Error
+			}
+			continue
+		}
+		if result.Archive.Type == File {
+			_ = snapshot.excludeFile(result.Archive, opts)
+		}
+	}
+
+	return int64(snapshot.Stats.Files), int64(snapshot.Stats.Size), err
+}
+
 // Add adds a path to a Snapshot.
 func (snapshot *Snapshot) Add(repository Repository, chunkIndex *ChunkIndex, opts StoreOptions) chan Progress {
 	progress := make(chan Progress)
+	log := repository.log()
 
-	ch := snapshot.gatherTargetInformation(opts.CWD, opts.Paths, opts.Excludes)
+	if repository.backend.readOnly {
+		go func() {
+			progress <- newProgressError(ErrReadOnlyRepository)
+			close(progress)
+		}()
+		return progress
+	}
+	opts = opts.withDefaults(repository.Config).withEncrypter(repository.encrypter)
+	if opts.NoDedup {
+		opts.salt = snapshot.dedupSalt()
+	}
+	if opts.DedupWindow > 0 {
+		opts.window = newDedupWindow(opts.DedupWindow)
+		chunkIndex.deferSnapshot(snapshot)
+	}
+	if opts.CompressionDict != 0 && opts.Compress == CompressionZstd {
+		var err error
+		opts.dict, err = repository.compressionDict(opts.CompressionDict)
+		if err != nil {
+			go func() {
+				progress <- newProgressError(err)
+				close(progress)
+			}()
+			return progress
+		}
+	}
+	if !opts.SkipSpaceCheck {
+		checkLocalSpace(repository, opts)
+	}
+	snapshot.mut.Lock()
+	mixed := len(snapshot.Archives) > 0 && snapshot.AbsolutePaths != opts.AbsolutePaths
+	if !mixed {
+		snapshot.AbsolutePaths = opts.AbsolutePaths
+	}
+	snapshot.mut.Unlock()
+	if mixed {
+		go func() {
+			progress <- newProgressError(ErrMixedPaths)
+			close(progress)
+		}()
+		return progress
+	}
+	paths, overlaps := collapsePaths(opts.Paths)
+	if len(overlaps) > 0 && opts.OverlappingPaths == OverlappingPathsError {
+		go func() {
+			progress <- newProgressError(overlaps[0])
+			close(progress)
+		}()
+		return progress
+	}
+	if opts.ParityGroupSize > 0 && opts.ParityGroupSize+opts.ParityParts > maxParityShards {
+		go func() {
+			progress <- newProgressError(ErrParityGroupTooLarge)
+			close(progress)
+		}()
+		return progress
+	}
+	if opts.DescriptionTemplate != "" {
+		description, err := expandDescription(opts.DescriptionTemplate, snapshot, opts.Paths)
+		if err != nil {
+			go func() {
+				progress <- newProgressError(err)
+				close(progress)
+			}()
+			return progress
+		}
+		snapshot.Description = description
+	}
+	moved := opts.parentContentHashes()
+	collisions := newPathCollisions(opts.CaseInsensitivePaths)
+	cwd := opts.CWD
+	if opts.AbsolutePaths {
+		cwd = ""
+	}
+	ch := snapshot.gatherTargetInformation(cwd, paths, opts)
+
+	snapshot.repository = &repository
+	repository.backend.limiter = opts.Limiter
+	// stores the archives held in memory once there are too many of them
+	flush := func() bool {
+		if opts.MaxArchivesInMemory <= 0 || len(snapshot.Archives) < opts.MaxArchivesInMemory {
+			return true
+		}
+		if err := snapshot.flushArchives(&repository); err != nil {
+			log.Error("Storing archives of snapshot ", snapshot.ID, " failed: ", err)
+			progress <- newProgressError(err)
+			return false
+		}
+		return true
+	}
+	// reports a file deleted since the walk found it, returns false if the
+	// snapshot should be aborted
+	vanished := func(archive *Archive) bool {
+		err := &os.PathError{Op: "read", Path: archive.Path, Err: ErrFileVanished}
+		snapshot.mut.Lock()
+		snapshot.Stats.Files--
+		snapshot.Stats.Size -= archive.Size
+		p := Progress{Path: archive.Path, TotalStatistics: snapshot.Stats}
+		snapshot.mut.Unlock()
+
+		log.Warn(err)
+		if opts.Pedantic {
+			p.Error = err
+			progress <- p
+			return false
+		}
+		p.Warning = err
+		progress <- p
+		return true
+	}
 
 	go func() {
+		log.Info("Adding to snapshot ", snapshot.ID)
+		for _, overlap := range overlaps {
+			log.Warn(overlap)
+			progress <- Progress{Path: overlap.Path, Warning: overlap}
+		}
 		for result := range ch {
+			// paths denied by InaccessibleWarn got counted while walking
+			if result.Error != nil && !opts.Pedantic && result.Archive != nil && os.IsPermission(result.Error) {
+				snapshot.mut.Lock()
+				p := Progress{Path: result.Archive.Path, Warning: result.Error, TotalStatistics: snapshot.Stats}
+				snapshot.mut.Unlock()
+				log.Warn(result.Error)
+				progress <- p
+				continue
+			}
+			if result.Error != nil && !opts.Pedantic && errors.Is(result.Error, ErrUnsupportedFile) {
+				snapshot.mut.Lock()
+				snapshot.Stats.Unsupported++
+				p := Progress{Path: result.Archive.Path, Warning: result.Error, TotalStatistics: snapshot.Stats}
+				snapshot.mut.Unlock()
+				log.Warn(result.Error)
+				progress <- p
+				continue
+			}
 			if result.Error != nil {
 				p := newProgressError(result.Error)
-				p.Path = result.Archive.Path
+				if result.Archive != nil {
+					p.Path = result.Archive.Path
+				}
+				log.Warn(p.Path, ": ", p.Error)
 				progress <- p
 				if opts.Pedantic {
 					break
 				}
 				continue
 			}
+			if result.Warning != nil {
+				log.Warn(result.Warning)
+				progress <- Progress{Path: result.Archive.Path, Warning: result.Warning}
+			}
 
 			archive := result.Archive
-			rel, err := filepath.Rel(opts.CWD, archive.Path)
-			if err == nil && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			if opts.AbsolutePaths {
+				// relative Paths lead to relative archive paths
+				if abs, err := filepath.Abs(archive.Path); err == nil {
+					archive.Path = abs
+				}
+			} else if rel, err := filepath.Rel(opts.CWD, archive.Path); err == nil && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
 				archive.Path = rel
 			}
+			var err error
 			if isSpecialPath(archive.Path) {
 				continue
 			}
+			if archive.Type == File {
+				if serr := snapshot.excludeFile(archive, opts); serr != nil {
+					snapshot.mut.Lock()
+					p := Progress{Path: archive.Path, Warning: serr, TotalStatistics: snapshot.Stats}
+					snapshot.mut.Unlock()
+					log.Warn(serr)
+					progress <- p
+					continue
+				}
+			}
 
-			p := newProgress(archive)
-			snapshot.mut.Lock()
-			p.TotalStatistics = snapshot.Stats
-			snapshot.mut.Unlock()
-			progress <- p
+			// the path the file can be read from
+			source := archive.Path
+			archive.Path = normalizePath(archive.Path, opts.NormalizePaths)
+			if err := collisions.add(source, archive.Path); err != nil {
+				p := newProgressError(err)
+				p.Path = source
+				log.Warn(p.Path, ": ", p.Error)
+				progress <- p
+				if opts.Pedantic {
+					break
+				}
+				continue
+			}
 
-			if archive.Type == File {
-				opts.DataParts = uint(math.Max(1, float64(opts.DataParts)))
-				chunkchan, err := chunkFile(archive.Path, repository.Key, opts)
+			if opts.PreserveWindowsAttrs {
+				archive.Attributes, err = fileAttributes(source)
 				if err != nil {
-					if os.IsNotExist(err) {
-						// if this file has already been deleted before we could backup it, we can gracefully ignore it and continue
-						continue
+					p := newProgressError(err)
+					p.Path = archive.Path
+					log.Warn(p.Path, ": ", p.Error)
+					progress <- p
+					if opts.Pedantic {
+						break
 					}
-					p = newProgressError(err)
+				}
+			}
+			if opts.PreserveCapabilities && archive.Type == File {
+				archive.Capability, err = fileCapability(source)
+				if err != nil {
+					p := newProgressError(err)
 					p.Path = archive.Path
+					log.Warn(p.Path, ": ", p.Error)
 					progress <- p
 					if opts.Pedantic {
 						break
 					}
-					continue
 				}
-				archive.Encrypted = opts.Encrypt
-				archive.Compressed = opts.Compress
-
-				for cd := range chunkchan {
-					if cd.Error != nil {
-						p = newProgressError(err)
-						p.Path = archive.Path
-						progress <- p
-						if opts.Pedantic {
-							close(progress)
-							return
-						}
-						continue
+			}
+			if opts.PreserveACLs && archive.Type != SymLink {
+				archive.ACL, archive.DefaultACL, err = fileACLs(source, archive.Type == Directory)
+				if err != nil {
+					p := newProgressError(err)
+					p.Path = archive.Path
+					log.Warn(p.Path, ": ", p.Error)
+					progress <- p
+					if opts.Pedantic {
+						break
 					}
-					chunk := cd.Chunk
-					// fmt.Printf("\tSplit %s (#%d, %d bytes), compression: %s, encryption: %s, hash: %s\n", id.Path, cd.Num, cd.Size, CompressionText(cd.Compressed), EncryptionText(cd.Encrypted), cd.Hash)
+				}
+			}
 
-					// store this chunk
-					n, err := repository.backend.StoreChunk(chunk)
+			p := newProgress(archive)
+			snapshot.mut.Lock()
+			p.TotalStatistics = snapshot.Stats
+			snapshot.mut.Unlock()
+			progress <- p
+
+			if archive.Type == File {
+				if opts.beforeRead != nil {
+					opts.beforeRead(source)
+				}
+				if opts.RecordContentHash {
+					archive.ContentHash, err = contentHashFile(source)
 					if err != nil {
+						if os.IsNotExist(err) {
+							if !vanished(archive) {
+								break
+							}
+							continue
+						}
+						snapshot.countInaccessible(err)
 						p = newProgressError(err)
 						p.Path = archive.Path
+						log.Warn(p.Path, ": ", p.Error)
 						progress <- p
 						if opts.Pedantic {
-							close(progress)
-							return
+							break
 						}
 						continue
 					}
+				}
 
-					// release the memory, we don't need the data anymore
-					chunk.Data = &[][]byte{}
-
-					archive.Chunks = append(archive.Chunks, chunk)
-					archive.StorageSize += n
+				parent, ok := opts.unchangedParentArchive(archive)
+				if !ok && archive.ContentHash != "" {
+					// the file may have been moved or renamed since the parent snapshot
+					parent, ok = moved[archive.ContentHash]
+				}
+				if ok {
+					// this file didn't change since the parent snapshot, reuse its chunks
+					log.Debug("Reusing chunks of unchanged file ", archive.Path)
+					archive.Chunks = parent.Chunks
+					archive.StorageSize = parent.StorageSize
+					archive.Encrypted = parent.Encrypted
+					archive.Compressed = parent.Compressed
+					archive.HMAC = parent.HMAC
 
 					p.CurrentItemStats.StorageSize = archive.StorageSize
-					p.CurrentItemStats.Transferred += uint64(chunk.OriginalSize)
-					snapshot.Stats.Transferred += uint64(chunk.OriginalSize)
-					snapshot.Stats.StorageSize += n
-
+					p.CurrentItemStats.Transferred = archive.Size
 					snapshot.mut.Lock()
+					snapshot.Stats.Transferred += archive.Size
 					p.TotalStatistics = snapshot.Stats
 					snapshot.mut.Unlock()
 					progress <- p
+
+					snapshot.AddArchive(archive)
+					chunkIndex.AddArchive(archive, snapshot.ID)
+					if !flush() {
+						close(progress)
+						return
+					}
+					continue
+				}
+
+				log.Debug("Storing file ", archive.Path)
+				opts.DataParts = uint(math.Max(1, float64(opts.DataParts)))
+				mac := newArchiveHMAC(repository.Key)
+				chunkchan, err := chunkFile(source, opts.chunkKey(repository.currentDataKey()), repository.backend.maxChunkSize(opts), mac, opts)
+				if err != nil {
+					if os.IsNotExist(err) {
+						// this file has been deleted before we could back it up
+						if !vanished(archive) {
+							break
+						}
+						continue
+					}
+					// the file became unreadable since it got scanned, which
+					// fails its archive like any other read error
+					snapshot.countInaccessible(err)
+					chunkchan = make(chan ChunkResult, 1)
+					chunkchan <- ChunkResult{Error: err}
+					close(chunkchan)
+				}
+				stored := snapshot.effectiveness.storedOriginal
+				if !snapshot.storeChunks(repository, chunkIndex, archive, chunkchan, p, progress, opts) {
+					close(progress)
+					return
 				}
+				if opts.Parent != nil && !opts.NoDedup && opts.Parent.Archives[archive.Path] != nil {
+					// an earlier version of the file got stored
+					snapshot.effectiveness.changedSize += archive.Size
+					snapshot.effectiveness.changedStored += snapshot.effectiveness.storedOriginal - stored
+				}
+				archive.HMAC = hex.EncodeToString(mac.Sum(nil))
 			}
 
 			snapshot.AddArchive(archive)
 			chunkIndex.AddArchive(archive, snapshot.ID)
+			if !flush() {
+				close(progress)
+				return
+			}
+		}
+
+		if err := snapshot.flushParityGroup(repository, chunkIndex, opts); err != nil {
+			log.Error("Storing parity of snapshot ", snapshot.ID, " failed: ", err)
+			progress <- newProgressError(err)
+		}
+		if err := snapshot.flushPack(repository); err != nil {
+			log.Error("Storing pack object of snapshot ", snapshot.ID, " failed: ", err)
+			snapshot.mut.Lock()
+			snapshot.Partial = true
+			snapshot.mut.Unlock()
+			progress <- newProgressError(err)
+		}
+		if opts.SkipUnchanged && opts.Parent != nil && snapshot.ArchiveSegments == 0 && snapshot.sameArchives(opts.Parent) {
+			// nothing changed since the parent snapshot, don't keep a redundant one
+			_ = chunkIndex.ReleaseSnapshot(snapshot)
+			snapshot.unchanged = true
+			log.Info("Snapshot ", snapshot.ID, " is identical to its parent")
+		} else {
+			if opts.ImmutableFor > 0 {
+				snapshot.ImmutableUntil = snapshot.Date.Add(opts.ImmutableFor)
+			}
+			for _, w := range snapshot.effectiveness.warnings(opts) {
+				log.Warn(w)
+				snapshot.mut.Lock()
+				p := Progress{Warning: w, TotalStatistics: snapshot.Stats}
+				snapshot.mut.Unlock()
+				progress <- p
+			}
+			log.Info("Added to snapshot ", snapshot.ID, ": ", snapshot.Stats.String())
 		}
 
 		close(progress)
 	}()
 
+	if opts.ProgressInterval > 0 {
+		return coalesceProgress(progress, opts.ProgressInterval)
+	}
 	return progress
 }
 
+// storeChunks stores the chunks received from chunks in the repository and
+// adds them to archive, sending progress updates based on p. If a chunk
+// can't be read or stored, the archive gets marked as failed and the
+// snapshot as partial. It returns false if a pedantic run has to be aborted.
+func (snapshot *Snapshot) storeChunks(repository Repository, chunkIndex *ChunkIndex, archive *Archive, chunks chan ChunkResult, p Progress, progress chan Progress, opts StoreOptions) bool {
+	log := repository.log()
+
+	archive.Encrypted = opts.Encrypt
+	archive.Compressed = opts.Compress
+
+	repository.backend.slowHandler = func(w *SlowOperationWarning) {
+		log.Warn(archive.Path, ": ", w)
+		wp := p
+		wp.Error = nil
+		wp.Warning = w
+		progress <- wp
+	}
+
+	defer func() {
+		if archive.Failed {
+			snapshot.mut.Lock()
+			snapshot.Partial = true
+			snapshot.mut.Unlock()
+		}
+	}()
+
+	// chunks already stored on the backends get looked up in batches, if
+	// the backends support it
+	batchSize := 1
+	if repository.backend.checksExistence() {
+		batchSize = existenceBatchSize
+	}
+	batch := make([]ChunkResult, 0, batchSize)
+	for cd := range chunks {
+		batch = append(batch, cd)
+		if len(batch) < batchSize {
+			continue
+		}
+		if !snapshot.storeChunkBatch(repository, chunkIndex, archive, batch, &p, progress, opts) {
+			return false
+		}
+		batch = batch[:0]
+	}
+
+	return snapshot.storeChunkBatch(repository, chunkIndex, archive, batch, &p, progress, opts)
+}
+
+// storeChunkBatch stores the chunks of batch that aren't stored on the
+// backends yet and adds all of them to archive. Small chunks get added to
+// the snapshot's parity group or pack object.
+func (snapshot *Snapshot) storeChunkBatch(repository Repository, chunkIndex *ChunkIndex, archive *Archive, batch []ChunkResult, pp *Progress, progress chan Progress, opts StoreOptions) bool {
+	log := repository.log()
+	p := *pp
+	defer func() {
+		*pp = p
+	}()
+
+	var exists []bool
+	if opts.window == nil {
+		exists = snapshot.existingChunks(repository, batch)
+	} else {
+		exists = make([]bool, len(batch))
+	}
+	for i, cd := range batch {
+		if cd.Error != nil {
+			archive.Failed = true
+			p = newProgressError(cd.Error)
+			p.Path = archive.Path
+			log.Warn(p.Path, ": ", p.Error)
+			progress <- p
+			if opts.Pedantic {
+				return false
+			}
+			continue
+		}
+		chunk := cd.Chunk
+		chunk.Epoch = repository.DataEpoch()
+		chunk.Salt = opts.salt
+		// fmt.Printf("\tSplit %s (#%d, %d bytes), compression: %s, encryption: %s, hash: %s\n", id.Path, cd.Num, cd.Size, CompressionText(cd.Compressed), EncryptionText(cd.Encrypted), cd.Hash)
+
+		// store this chunk, unless it's stored already
+		var n uint64
+		var err error
+		if opts.window != nil {
+			exists[i] = opts.window.contains(chunk.Hash)
+		}
+		if opts.packs(chunk) && (!exists[i] || opts.window != nil) {
+			// the window doesn't know where packed chunks got stored
+			n, err = snapshot.addToPack(repository, chunkIndex, &chunk, opts)
+		} else if !exists[i] {
+			n, err = repository.backend.StoreChunk(chunk)
+		}
+		if err == nil && opts.window != nil {
+			opts.window.add(chunk.Hash)
+		}
+		if err == nil && n > 0 {
+			snapshot.effectiveness.storedOriginal += uint64(chunk.OriginalSize)
+			snapshot.effectiveness.storedEncoded += uint64(chunk.Size)
+		}
+		if err != nil {
+			archive.Failed = true
+			p = newProgressError(err)
+			p.Path = archive.Path
+			log.Warn(p.Path, ": ", p.Error)
+			progress <- p
+			if opts.Pedantic {
+				return false
+			}
+			continue
+		}
+
+		if opts.groupsParity(chunk.Size) {
+			if err := snapshot.addToParityGroup(repository, chunkIndex, chunk, (*chunk.Data)[0], opts); err != nil {
+				p = newProgressError(err)
+				p.Path = archive.Path
+				log.Warn(p.Path, ": ", p.Error)
+				progress <- p
+				if opts.Pedantic {
+					return false
+				}
+			}
+		}
+
+		// release the memory, we don't need the data anymore
+		chunk.Data = &[][]byte{}
+
+		archive.Chunks = append(archive.Chunks, chunk)
+		archive.StorageSize += n
+
+		p.CurrentItemStats.StorageSize = archive.StorageSize
+		p.CurrentItemStats.Transferred += uint64(chunk.OriginalSize)
+		snapshot.Stats.Transferred += uint64(chunk.OriginalSize)
+		snapshot.Stats.StorageSize += n
+
+		snapshot.mut.Lock()
+		p.TotalStatistics = snapshot.Stats
+		snapshot.mut.Unlock()
+		progress <- p
+	}
+
+	return true
+}
+
+// existingChunks returns for every chunk of batch whether all its parts are
+// stored on the backends already. If that can't be determined, all chunks
+// get reported as missing and are checked one by one while storing them.
+func (snapshot *Snapshot) existingChunks(repository Repository, batch []ChunkResult) []bool {
+	exists := make([]bool, len(batch))
+	var parts []ChunkPart
+	for _, cd := range batch {
+		if cd.Error != nil {
+			continue
+		}
+		for i := range *cd.Chunk.Data {
+			parts = append(parts, ChunkPart{cd.Chunk.Hash, uint(i), cd.Chunk.DataParts})
+		}
+	}
+
+	if len(parts) == 0 {
+		return exists
+	}
+
+	found, err := repository.backend.ChunksExist(parts)
+	if err != nil {
+		repository.log().Debug("Checking for existing chunks failed: ", err)
+		return exists
+	}
+	for i, cd := range batch {
+		if cd.Error != nil {
+			continue
+		}
+		exists[i] = true
+		for range *cd.Chunk.Data {
+			exists[i] = exists[i] && found[0]
+			found = found[1:]
+		}
+	}
+	return exists
+}
+
+// dedupSalt returns the salt keying the chunks of a NoDedup snapshot,
+// generating it on first use.
+func (snapshot *Snapshot) dedupSalt() string {
+	snapshot.mut.Lock()
+	defer snapshot.mut.Unlock()
+
+	if snapshot.salt == "" {
+		b := make([]byte, 16)
+		_, _ = rand.Read(b)
+		snapshot.salt = hex.EncodeToString(b)
+	}
+
+	return snapshot.salt
+}
+
+// chunkKey returns the key chunks get encrypted with. Salted chunks use a
+// key derived from the salt, so their encrypted data differs, too.
+func (opts StoreOptions) chunkKey(key string) string {
+	return saltedKey(key, opts.salt)
+}
+
+// saltedKey derives the encryption key of chunks with salt from key.
+func saltedKey(key, salt string) string {
+	if salt == "" {
+		return key
+	}
+
+	return key + salt
+}
+
+// countInaccessible counts err in the snapshot's statistics if it was caused
+// by missing permissions.
+func (snapshot *Snapshot) countInaccessible(err error) {
+	if os.IsPermission(err) {
+		snapshot.mut.Lock()
+		snapshot.Stats.Inaccessible++
+		snapshot.mut.Unlock()
+	}
+}
+
+// excludeFile returns a FileSizeError or FileAgeError if the file archive
+// is excluded by the limits of opts, and removes it from the snapshot's
+// statistics in that case.
+func (snapshot *Snapshot) excludeFile(archive *Archive, opts StoreOptions) error {
+	err := opts.checkFileSize(archive)
+	if err == nil {
+		err = opts.checkFileAge(archive)
+	}
+	if err != nil {
+		snapshot.mut.Lock()
+		snapshot.Stats.Files--
+		snapshot.Stats.Size -= archive.Size
+		snapshot.mut.Unlock()
+	}
+	return err
+}
+
+// checkFileSize returns a FileSizeError if the size of the file archive is
+// outside of the configured limits.
+func (opts StoreOptions) checkFileSize(archive *Archive) error {
+	if opts.MaxFileSize > 0 && archive.Size > opts.MaxFileSize {
+		return &FileSizeError{archive.Path, archive.Size, opts.MaxFileSize}
+	}
+	if opts.MinFileSize > 0 && archive.Size < opts.MinFileSize {
+		return &FileSizeError{archive.Path, archive.Size, opts.MinFileSize}
+	}
+	return nil
+}
+
+// checkFileAge returns a FileAgeError if the file archive was last modified
+// outside of the configured cutoffs.
+func (opts StoreOptions) checkFileAge(archive *Archive) error {
+	mtime := time.Unix(archive.ModTime, 0)
+	if !opts.ExcludeOlderThan.IsZero() && mtime.Before(opts.ExcludeOlderThan) {
+		return &FileAgeError{archive.Path, mtime, opts.ExcludeOlderThan}
+	}
+	if !opts.ExcludeNewerThan.IsZero() && mtime.After(opts.ExcludeNewerThan) {
+		return &FileAgeError{archive.Path, mtime, opts.ExcludeNewerThan}
+	}
+	return nil
+}
+
+// inaccessiblePolicy returns the policy for inaccessible paths, which is
+// always InaccessibleAbort for pedantic runs.
+func (opts StoreOptions) inaccessiblePolicy() uint16 {
+	if opts.Pedantic {
+		return InaccessibleAbort
+	}
+
+	return opts.Inaccessible
+}
+
+// withDefaults returns opts with all unset settings taken from cfg. Settings
+// marked in opts.Explicit are kept, even if they're zero.
+func (opts StoreOptions) withDefaults(cfg RepositoryConfig) StoreOptions {
+	unset := func(explicit uint16, zero bool) bool {
+		return zero && opts.Explicit&explicit == 0
+	}
+	if unset(ExplicitCompress, opts.Compress == CompressionNone) {
+		opts.Compress = cfg.Compress
+	}
+	if unset(ExplicitEncrypt, opts.Encrypt == EncryptionNone) {
+		opts.Encrypt = cfg.Encrypt
+	}
+	if unset(ExplicitDataParts, opts.DataParts == 0) {
+		opts.DataParts = cfg.DataParts
+	}
+	if unset(ExplicitParityParts, opts.ParityParts == 0) {
+		opts.ParityParts = cfg.ParityParts
+	}
+	if unset(ExplicitChunkSize, opts.ChunkSize == 0) {
+		opts.ChunkSize = cfg.ChunkSize
+	}
+
+	return opts
+}
+
+// unchangedParentArchive returns the parent snapshot's archive for the same
+// path, if the file did not change since the parent snapshot was created.
+func (opts StoreOptions) unchangedParentArchive(archive *Archive) (*Archive, bool) {
+	if opts.Parent == nil || opts.NoDedup {
+		return nil, false
+	}
+
+	parent, ok := opts.Parent.Archives[archive.Path]
+	if !ok || parent.Type != File || parent.Size != archive.Size {
+		return nil, false
+	}
+	if opts.RecordContentHash {
+		return parent, parent.ContentHash != "" && parent.ContentHash == archive.ContentHash
+	}
+
+	return parent, parent.ModTime == archive.ModTime
+}
+
+// commonDir returns the deepest directory containing all archives of
+// snapshot.
+func (snapshot *Snapshot) commonDir() (string, error) {
+	var common string
+	err := snapshot.EachArchive(func(arc *Archive) error {
+		dir := filepath.Dir(arc.Path)
+		if common == "" {
+			common = dir
+			return nil
+		}
+		for !isWithinPath(common, dir) {
+			parent := filepath.Dir(common)
+			if parent == common {
+				break
+			}
+			common = parent
+		}
+		return nil
+	})
+
+	return common, err
+}
+
+// Unchanged returns true if Add found the snapshot to be identical to its
+// parent and StoreOptions.SkipUnchanged was set. Such a snapshot can't be
+// saved.
+func (snapshot *Snapshot) Unchanged() bool {
+	return snapshot.unchanged
+}
+
+// sameArchives returns true if snapshot contains exactly the same archives
+// as other.
+func (snapshot *Snapshot) sameArchives(other *Snapshot) bool {
+	if len(snapshot.Archives) != len(other.Archives) {
+		return false
+	}
+
+	for path, a := range snapshot.Archives {
+		b, ok := other.Archives[path]
+		if !ok ||
+			a.Type != b.Type ||
+			a.PointsTo != b.PointsTo ||
+			a.Mode != b.Mode ||
+			a.ModTime != b.ModTime ||
+			a.Size != b.Size ||
+			a.UID != b.UID ||
+			a.GID != b.GID ||
+			len(a.Chunks) != len(b.Chunks) {
+			return false
+		}
+		for i := range a.Chunks {
+			if a.Chunks[i].Hash != b.Chunks[i].Hash {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// parentContentHashes maps the content hashes of all files in the parent
+// snapshot to their archives.
+func (opts StoreOptions) parentContentHashes() map[string]*Archive {
+	hashes := make(map[string]*Archive)
+	if opts.Parent == nil || !opts.RecordContentHash || opts.NoDedup {
+		return hashes
+	}
+
+	for _, arc := range opts.Parent.Archives {
+		if arc.Type == File && arc.ContentHash != "" {
+			hashes[arc.ContentHash] = arc
+		}
+	}
+
+	return hashes
+}
+
+func contentHashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return ContentHash(f)
+}
+
 // Clone clones a snapshot.
 func (snapshot *Snapshot) Clone() (*Snapshot, error) {
-	s, err := NewSnapshot(snapshot.Description)
+	idLength := len(snapshot.ID)
+	if idLength < minSnapshotIDLength || idLength > maxSnapshotIDLength {
+		idLength = defaultSnapshotIDLength
+	}
+	s, err := newSnapshot(snapshot.Description, idLength, snapshot.now())
 	if err != nil {
 		return s, err
 	}
 
+	if err := snapshot.LoadArchives(); err != nil {
+		return s, err
+	}
 	s.Stats = snapshot.Stats
 	s.Archives = snapshot.Archives
+	s.repository = snapshot.repository
 
 	return s, nil
 }
 
+// CloneSnapshotToVolume adds a clone of the snapshot with snapshotID to the
+// volume with volumeID. The clone references the chunks of the original
+// snapshot, so no data gets read or stored. It keeps the date, tags, pinning
+// and immutability of the original snapshot. It gets saved, but the
+// chunk-index and the repository need to be saved afterwards.
+func CloneSnapshotToVolume(repository *Repository, index *ChunkIndex, snapshotID, volumeID string) (*Snapshot, error) {
+	_, snapshot, err := repository.FindSnapshot(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := repository.FindVolume(volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	clone, err := snapshot.Clone()
+	if err != nil {
+		return nil, err
+	}
+	clone.Date = snapshot.Date
+	clone.Partial = snapshot.Partial
+	clone.AbsolutePaths = snapshot.AbsolutePaths
+	clone.ParityGroups = snapshot.ParityGroups
+	clone.Pinned = snapshot.Pinned
+	clone.ImmutableUntil = snapshot.ImmutableUntil
+	for key, value := range snapshot.Tags {
+		clone.SetTag(key, value)
+	}
+
+	for _, arc := range clone.Archives {
+		index.AddArchive(arc, clone.ID)
+	}
+	for _, group := range clone.ParityGroups {
+		index.AddParityGroup(group, clone.ID)
+	}
+
+	if err := clone.Save(repository); err != nil {
+		return nil, err
+	}
+	return clone, volume.AddSnapshot(clone.ID)
+}
+
 // openSnapshot opens an existing snapshot.
 func openSnapshot(id string, repository *Repository) (*Snapshot, error) {
 	snapshot := Snapshot{
-		Archives: make(map[string]*Archive),
+		Archives:   make(map[string]*Archive),
+		repository: repository,
 	}
 	b, err := repository.backend.LoadSnapshot(id)
 	if err != nil {
@@ -254,22 +1323,108 @@ func openSnapshot(id string, repository *Repository) (*Snapshot, error) {
 		return &snapshot, err
 	}
 	err = pipe.Decode(b, &snapshot)
-	return &snapshot, err
+	if err != nil {
+		return &snapshot, err
+	}
+	return &snapshot, snapshot.verify(id, repository.Key)
+}
+
+// digest returns the digest of the snapshot's metadata.
+func (snapshot *Snapshot) digest(key string) (string, error) {
+	digest := snapshot.Digest
+	snapshot.Digest = ""
+	defer func() {
+		snapshot.Digest = digest
+	}()
+
+	return metadataDigest(key, snapshot.ID, snapshot, &Snapshot{})
+}
+
+// verify returns ErrSnapshotTampered if the snapshot's metadata doesn't
+// match its digest, or if it isn't the snapshot with id.
+func (snapshot *Snapshot) verify(id, key string) error {
+	if snapshot.ID != id {
+		return ErrSnapshotTampered
+	}
+	if snapshot.Digest == "" {
+		// saved by an older version
+		return nil
+	}
+
+	digest, err := snapshot.digest(key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(digest), []byte(snapshot.Digest)) {
+		return ErrSnapshotTampered
+	}
+	return nil
 }
 
 // Save writes a snapshot's metadata.
 func (snapshot *Snapshot) Save(repository *Repository) error {
+	if snapshot.unchanged {
+		return ErrSnapshotUnchanged
+	}
+
+	snapshot.normalizeChunks()
 	pipe, err := NewEncodingPipeline(CompressionLZMA, EncryptionAES, repository.Key)
 	if err != nil {
 		return err
 	}
+	snapshot.Digest, err = snapshot.digest(repository.Key)
+	if err != nil {
+		return err
+	}
 	b, err := pipe.Encode(snapshot)
 	if err != nil {
 		return err
 	}
+	repository.log().Debug("Saving snapshot ", snapshot.ID)
 	return repository.backend.SaveSnapshot(snapshot.ID, b)
 }
 
+// SetPinned pins or unpins a snapshot. Pinned snapshots are never removed
+// by a RetentionPolicy, removing them fails with ErrPinnedSnapshot.
+func (snapshot *Snapshot) SetPinned(pinned bool) {
+	snapshot.Pinned = pinned
+}
+
+// SetTag sets the tag key of a snapshot to value. Tags can group snapshots
+// from different sources, see RetentionPolicy.GroupByTag.
+func (snapshot *Snapshot) SetTag(key, value string) {
+	if snapshot.Tags == nil {
+		snapshot.Tags = make(map[string]string)
+	}
+	snapshot.Tags[key] = value
+}
+
+// checkRemovable returns ErrPinnedSnapshot or ErrImmutableSnapshot if the
+// snapshot can't be removed.
+func (snapshot *Snapshot) checkRemovable() error {
+	if snapshot.Pinned {
+		return ErrPinnedSnapshot
+	}
+	if snapshot.Immutable() {
+		return ErrImmutableSnapshot
+	}
+	return nil
+}
+
+// Immutable returns true if the snapshot can't be removed yet, see
+// StoreOptions.ImmutableFor.
+func (snapshot *Snapshot) Immutable() bool {
+	return snapshot.now().Before(snapshot.ImmutableUntil)
+}
+
+// now returns the current time according to the snapshot's repository.
+func (snapshot *Snapshot) now() time.Time {
+	if snapshot.repository == nil {
+		return time.Now()
+	}
+	return snapshot.repository.now()
+}
+
 // AddArchive adds an archive to a snapshot.
 func (snapshot *Snapshot) AddArchive(archive *Archive) {
 	snapshot.Archives[archive.Path] = archive
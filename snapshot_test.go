@@ -9,11 +9,20 @@
 package knoxite
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/minio/highwayhash"
 	"github.com/muesli/combinator"
@@ -200,7 +209,7 @@ func TestSnapshotCreate(t *testing.T) {
 			}
 			defer os.RemoveAll(targetdir)
 
-			progress, err := DecodeSnapshot(r, snapshot, targetdir, tt.ExcludesRestore, false)
+			progress, err := DecodeSnapshot(r, snapshot, targetdir, RestoreOptions{Excludes: tt.ExcludesRestore})
 			if err != nil {
 				t.Errorf("Failed restoring snapshot: %s", err)
 				return
@@ -306,3 +315,1745 @@ func TestSnapshotFind(t *testing.T) {
 		t.Errorf("Failed finding latest snapshot: %s %s", err, snapshot.ID)
 	}
 }
+
+// storeSnapshot stores opts.Paths in a new snapshot and returns it.
+func storeSnapshot(t *testing.T, r *Repository, index *ChunkIndex, opts StoreOptions) *Snapshot {
+	snapshot, err := NewSnapshot("test_snapshot")
+	if err != nil {
+		t.Fatalf("Failed creating snapshot: %s", err)
+	}
+
+	for p := range snapshot.Add(*r, index, opts) {
+		if p.Error != nil {
+			t.Errorf("Failed adding to snapshot: %s", p.Error)
+		}
+	}
+
+	return snapshot
+}
+
+func TestSnapshotParentContentHash(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(filepath.Join(dir, "repo"), testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	file := filepath.Join(dir, "data")
+	mtime := time.Unix(1500000000, 0)
+	if err := ioutil.WriteFile(file, []byte("original content"), 0600); err != nil {
+		t.Fatalf("Failed writing test file: %s", err)
+	}
+	_ = os.Chtimes(file, mtime, mtime)
+
+	for _, contentHash := range []bool{false, true} {
+		opts := StoreOptions{
+			CWD:               wd,
+			Paths:             []string{file},
+			Encrypt:           EncryptionAES,
+			DataParts:         1,
+			RecordContentHash: contentHash,
+		}
+		parent := storeSnapshot(t, &r, &index, opts)
+
+		// change the content, but keep size & mtime
+		if err := ioutil.WriteFile(file, []byte("modified content"), 0600); err != nil {
+			t.Fatalf("Failed writing test file: %s", err)
+		}
+		_ = os.Chtimes(file, mtime, mtime)
+
+		opts.Parent = parent
+		snapshot := storeSnapshot(t, &r, &index, opts)
+
+		changed := snapshot.Archives[file].Chunks[0].Hash != parent.Archives[file].Chunks[0].Hash
+		if changed != contentHash {
+			t.Errorf("Content hash mode %v: expected change detected to be %v, got %v", contentHash, contentHash, changed)
+		}
+
+		// restore the original content for the next run
+		_ = ioutil.WriteFile(file, []byte("original content"), 0600)
+		_ = os.Chtimes(file, mtime, mtime)
+	}
+}
+
+func TestSnapshotSkipUnchanged(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(filepath.Join(dir, "repo"), testPassword)
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test_name", "test_description")
+	_ = r.AddVolume(vol)
+	wd, _ := os.Getwd()
+
+	tree := filepath.Join(dir, "tree")
+	_ = os.Mkdir(tree, 0700)
+	if err := ioutil.WriteFile(filepath.Join(tree, "data"), []byte("some content"), 0600); err != nil {
+		t.Fatalf("Failed writing test file: %s", err)
+	}
+
+	opts := StoreOptions{
+		CWD:           wd,
+		Paths:         []string{tree},
+		Encrypt:       EncryptionAES,
+		DataParts:     1,
+		SkipUnchanged: true,
+	}
+
+	var parent *Snapshot
+	for i := 0; i < 2; i++ {
+		opts.Parent = parent
+		snapshot := storeSnapshot(t, &r, &index, opts)
+
+		if i == 0 {
+			if snapshot.Unchanged() {
+				t.Fatal("Expected first snapshot to be stored")
+			}
+			if err := snapshot.Save(&r); err != nil {
+				t.Fatalf("Failed saving snapshot: %s", err)
+			}
+			_ = vol.AddSnapshot(snapshot.ID)
+			parent = snapshot
+			continue
+		}
+
+		if !snapshot.Unchanged() {
+			t.Error("Expected second snapshot to be detected as unchanged")
+		}
+		if err := snapshot.Save(&r); err != ErrSnapshotUnchanged {
+			t.Errorf("Expected ErrSnapshotUnchanged, got %v", err)
+		}
+		for _, chunk := range index.Chunks {
+			for _, id := range chunk.Snapshots {
+				if id == snapshot.ID {
+					t.Error("Unchanged snapshot still referenced in chunk-index")
+				}
+			}
+		}
+	}
+
+	if len(vol.Snapshots) != 1 {
+		t.Errorf("Expected 1 snapshot in volume, got %d", len(vol.Snapshots))
+	}
+}
+
+func TestSnapshotRepositoryDefaults(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository("mem://snapshot-defaults", testPassword)
+	r.SetDefaults(RepositoryConfig{
+		Compress:  CompressionZstd,
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+		ChunkSize: 64 * 1024,
+	})
+	if err := r.Save(); err != nil {
+		t.Fatalf("Failed saving repository: %s", err)
+	}
+	r, err = OpenRepository("mem://snapshot-defaults", testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	file := filepath.Join(dir, "data")
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i * i)
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("Failed writing test file: %s", err)
+	}
+
+	// compression is set per call, everything else is inherited
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:      wd,
+		Paths:    []string{file},
+		Compress: CompressionGZip,
+	})
+
+	arc := snapshot.Archives[file]
+	if arc.Compressed != CompressionGZip {
+		t.Errorf("Expected per-call compression %d, got %d", CompressionGZip, arc.Compressed)
+	}
+	if arc.Encrypted != EncryptionAES {
+		t.Errorf("Expected default encryption %d, got %d", EncryptionAES, arc.Encrypted)
+	}
+	if len(arc.Chunks) < 4 {
+		t.Errorf("Expected default chunk size to split the file into at least 4 chunks, got %d", len(arc.Chunks))
+	}
+	for _, chunk := range arc.Chunks {
+		if chunk.OriginalSize > 64*1024 {
+			t.Errorf("Expected chunks of at most %d bytes, got %d", 64*1024, chunk.OriginalSize)
+		}
+	}
+
+	// explicitly set zero values turn the defaults off
+	snapshot = storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:      wd,
+		Paths:    []string{file},
+		Encrypt:  EncryptionNone,
+		Explicit: ExplicitCompress | ExplicitEncrypt | ExplicitChunkSize,
+	})
+
+	arc = snapshot.Archives[file]
+	if arc.Compressed != CompressionNone {
+		t.Errorf("Expected explicitly disabled compression, got %d", arc.Compressed)
+	}
+	if arc.Encrypted != EncryptionNone {
+		t.Errorf("Expected explicitly disabled encryption, got %d", arc.Encrypted)
+	}
+	if len(arc.Chunks) != 1 {
+		t.Errorf("Expected the default chunk size to store the file in 1 chunk, got %d", len(arc.Chunks))
+	}
+}
+
+// countingBackend counts the chunks stored on a backend.
+type countingBackend struct {
+	Backend
+	stored *int32
+}
+
+func (b countingBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	atomic.AddInt32(b.stored, 1)
+	return b.Backend.StoreChunk(shasum, part, totalParts, data)
+}
+
+func TestSnapshotParentRename(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository("mem://snapshot-parent-rename", testPassword)
+	var stored int32
+	var be Backend = countingBackend{*r.backend.Backends[0], &stored}
+	r.backend.Backends[0] = &be
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0700)
+	data := make([]byte, 4*1024*1024)
+	_, _ = rand.Read(data)
+	if err := ioutil.WriteFile(filepath.Join(src, "big"), data, 0600); err != nil {
+		t.Fatalf("Failed writing test file: %s", err)
+	}
+
+	opts := StoreOptions{
+		CWD:               wd,
+		Paths:             []string{src},
+		Encrypt:           EncryptionAES,
+		DataParts:         1,
+		RecordContentHash: true,
+	}
+	parent := storeSnapshot(t, &r, &index, opts)
+	if stored == 0 {
+		t.Fatal("Expected chunks to be stored for the first snapshot")
+	}
+
+	if err := os.Rename(filepath.Join(src, "big"), filepath.Join(src, "moved")); err != nil {
+		t.Fatalf("Failed moving test file: %s", err)
+	}
+
+	stored = 0
+	opts.Parent = parent
+	snapshot := storeSnapshot(t, &r, &index, opts)
+	if stored != 0 {
+		t.Errorf("Expected no chunks to be stored for a moved file, got %d", stored)
+	}
+
+	moved := snapshot.Archives[filepath.Join(src, "moved")]
+	original := parent.Archives[filepath.Join(src, "big")]
+	if moved == nil || len(moved.Chunks) != len(original.Chunks) || moved.Chunks[0].Hash != original.Chunks[0].Hash {
+		t.Error("Expected moved file to reuse the parent's chunks")
+	}
+}
+
+func TestEstimateSnapshotSize(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.MkdirAll(filepath.Join(src, "sub"), 0700)
+	_ = os.MkdirAll(filepath.Join(src, "cache"), 0700)
+	for i, name := range []string{"a", "sub/b", "sub/c.tmp", "cache/d"} {
+		data := make([]byte, 1000*(i+1))
+		_ = ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(name)), data, 0600)
+	}
+
+	r, _ := NewRepository("mem://snapshot-estimate-size", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	opts := StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Excludes:  []string{"*.tmp", "cache"},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}
+
+	files, size, err := EstimateSnapshotSize(opts)
+	if err != nil {
+		t.Fatalf("Failed estimating snapshot size: %s", err)
+	}
+
+	snapshot := storeSnapshot(t, &r, &index, opts)
+	var storedFiles, storedSize int64
+	for _, arc := range snapshot.Archives {
+		if arc.Type == File {
+			storedFiles++
+			storedSize += int64(arc.Size)
+		}
+	}
+
+	if files != storedFiles || size != storedSize {
+		t.Errorf("Expected estimate of %d files and %d bytes, got %d files and %d bytes",
+			storedFiles, storedSize, files, size)
+	}
+	if files != 2 || size != 3000 {
+		t.Errorf("Expected excludes to be applied, got %d files and %d bytes", files, size)
+	}
+}
+
+func TestEstimateSnapshotSizeLimits(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0700)
+	old := time.Now().Add(-48 * time.Hour)
+	for i, name := range []string{"a", "b", "c", "old", "huge"} {
+		data := make([]byte, 1000*(i+1))
+		path := filepath.Join(src, name)
+		_ = ioutil.WriteFile(path, data, 0600)
+		if name == "old" {
+			_ = os.Chtimes(path, old, old)
+		}
+	}
+
+	r, _ := NewRepository("mem://snapshot-estimate-size-limits", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	opts := StoreOptions{
+		CWD:              wd,
+		Paths:            []string{src},
+		MaxFileSize:      4500,
+		MinFileSize:      1500,
+		ExcludeOlderThan: time.Now().Add(-24 * time.Hour),
+		Encrypt:          EncryptionAES,
+		DataParts:        1,
+	}
+
+	files, size, err := EstimateSnapshotSize(opts)
+	if err != nil {
+		t.Fatalf("Failed estimating snapshot size: %s", err)
+	}
+
+	snapshot := storeSnapshot(t, &r, &index, opts)
+	var storedFiles, storedSize int64
+	for _, arc := range snapshot.Archives {
+		if arc.Type == File {
+			storedFiles++
+			storedSize += int64(arc.Size)
+		}
+	}
+
+	if files != storedFiles || size != storedSize {
+		t.Errorf("Expected estimate of %d files and %d bytes, got %d files and %d bytes",
+			storedFiles, storedSize, files, size)
+	}
+	// only b and c are within the size limits and recent enough
+	if files != 2 || size != 5000 {
+		t.Errorf("Expected size and age limits to be applied, got %d files and %d bytes", files, size)
+	}
+}
+
+func TestSnapshotNoDedup(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "data")
+	data := []byte("some content that exists in many snapshots")
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("Failed writing test file: %s", err)
+	}
+	wd, _ := os.Getwd()
+
+	for _, encrypt := range []uint16{EncryptionAES, EncryptionNone} {
+		r, _ := NewRepository(fmt.Sprintf("mem://no-dedup-%d", encrypt), testPassword)
+		index, _ := OpenChunkIndex(&r)
+
+		opts := StoreOptions{
+			CWD:       wd,
+			Paths:     []string{file},
+			Encrypt:   encrypt,
+			DataParts: 1,
+			NoDedup:   true,
+		}
+		first := storeSnapshot(t, &r, &index, opts)
+		opts.Parent = first
+		second := storeSnapshot(t, &r, &index, opts)
+
+		a := first.Archives[file].Chunks[0]
+		b := second.Archives[file].Chunks[0]
+		if a.Hash == b.Hash {
+			t.Errorf("Encryption %d: expected identical data to be stored twice, got chunk %s in both snapshots", encrypt, a.Hash)
+		}
+		if len(index.Chunks) != 2 {
+			t.Errorf("Encryption %d: expected 2 chunks in the index, got %d", encrypt, len(index.Chunks))
+		}
+
+		for i, snapshot := range []*Snapshot{first, second} {
+			target := filepath.Join(dir, fmt.Sprintf("target-%d-%d", encrypt, i))
+			if errs := restoreSnapshot(t, r, snapshot, target, RestoreOptions{}); len(errs) > 0 {
+				t.Errorf("Encryption %d: failed restoring snapshot: %v", encrypt, errs)
+				continue
+			}
+
+			restored, err := ioutil.ReadFile(filepath.Join(target, file))
+			if err != nil {
+				t.Errorf("Encryption %d: failed reading restored file: %s", encrypt, err)
+			} else if !bytes.Equal(restored, data) {
+				t.Errorf("Encryption %d: restored content differs", encrypt)
+			}
+		}
+	}
+}
+
+// failingBackend fails to store chunks containing "unreadable".
+type failingBackend struct {
+	Backend
+}
+
+func (b failingBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	if bytes.Contains(data, []byte("unreadable")) {
+		return 0, errors.New("storing chunk failed")
+	}
+	return b.Backend.StoreChunk(shasum, part, totalParts, data)
+}
+
+func TestSnapshotPartial(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository("mem://snapshot-partial", testPassword)
+	var be Backend = failingBackend{*r.backend.Backends[0]}
+	r.backend.Backends[0] = &be
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	files := map[string]string{
+		"a":   "some content",
+		"b":   "unreadable content",
+		"c":   "more content",
+		"d/e": "nested content",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, name)
+		_ = os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed writing test file: %s", err)
+		}
+	}
+
+	snapshot, _ := NewSnapshot("test_snapshot")
+	var errs int
+	for p := range snapshot.Add(r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		DataParts: 1,
+	}) {
+		if p.Error != nil {
+			errs++
+		}
+	}
+	if errs != 1 {
+		t.Errorf("Expected 1 error, got %d", errs)
+	}
+	if err := snapshot.Save(&r); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err = openSnapshot(snapshot.ID, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snapshot.Partial {
+		t.Error("Expected snapshot to be partial")
+	}
+	for _, arc := range snapshot.Archives {
+		if failed := arc.Path == filepath.Join(src, "b"); arc.Failed != failed {
+			t.Errorf("Expected failed status of %s to be %v, got %v", arc.Path, failed, arc.Failed)
+		}
+	}
+	if issues := snapshot.Validate(&index); len(issues) > 0 {
+		t.Errorf("Expected partial snapshot to be valid, got %v", issues)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring partial snapshot: %v", errs)
+	}
+	for name, content := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dst, src, name))
+		if name == "b" {
+			if !os.IsNotExist(err) {
+				t.Errorf("Expected failed file not to be restored, got %v", err)
+			}
+			continue
+		}
+		if err != nil || string(b) != content {
+			t.Errorf("Expected %s to be restored with content %q, got %q (%v)", name, content, b, err)
+		}
+	}
+}
+
+func TestSnapshotPartialUnreadableFile(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	for _, name := range []string{"a", "b", "c"} {
+		_ = ioutil.WriteFile(filepath.Join(src, name), []byte("content of "+name), 0644)
+	}
+
+	// b turns into a symlink loop after it got scanned, so opening it fails
+	unreadable := filepath.Join(src, "b")
+	beforeRead := func(path string) {
+		if path == unreadable {
+			_ = os.Remove(path)
+			_ = os.Symlink(path, path)
+		}
+	}
+
+	r, _ := NewRepository("mem://snapshot-partial-unreadable", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	snapshot, _ := NewSnapshot("test_snapshot")
+	var errs int
+	for p := range snapshot.Add(r, &index, StoreOptions{
+		CWD:        wd,
+		Paths:      []string{src},
+		DataParts:  1,
+		beforeRead: beforeRead,
+	}) {
+		if p.Error != nil {
+			errs++
+		}
+	}
+	if errs != 1 {
+		t.Errorf("Expected 1 error, got %d", errs)
+	}
+	if err := snapshot.Save(&r); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err = openSnapshot(snapshot.ID, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snapshot.Partial {
+		t.Error("Expected snapshot to be partial")
+	}
+	arc, ok := snapshot.Archives[unreadable]
+	if !ok || !arc.Failed {
+		t.Errorf("Expected archive of the unreadable file to be marked as failed, got %+v", arc)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	progress, err := DecodeSnapshot(r, snapshot, dst, RestoreOptions{})
+	if err != nil {
+		t.Fatalf("Failed restoring partial snapshot: %s", err)
+	}
+	var skipped []string
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed restoring partial snapshot: %s", p.Error)
+		}
+		if p.Warning == ErrArchiveFailed {
+			skipped = append(skipped, p.Path)
+		}
+	}
+	if len(skipped) != 1 || skipped[0] != unreadable {
+		t.Errorf("Expected a warning about skipping %s, got %v", unreadable, skipped)
+	}
+	for _, name := range []string{"a", "c"} {
+		b, err := ioutil.ReadFile(filepath.Join(dst, src, name))
+		if err != nil || string(b) != "content of "+name {
+			t.Errorf("Expected %s to be restored, got %q (%v)", name, b, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dst, unreadable)); !os.IsNotExist(err) {
+		t.Errorf("Expected failed file not to be restored, got %v", err)
+	}
+}
+
+func TestSnapshotArchiveSegments(t *testing.T) {
+	testPassword := "this_is_a_password"
+	const files = 10000
+	const limit = 500
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	for i := 0; i < files; i++ {
+		sub := filepath.Join(src, strconv.Itoa(i%100))
+		if i < 100 {
+			_ = os.MkdirAll(sub, 0755)
+		}
+		_ = ioutil.WriteFile(filepath.Join(sub, strconv.Itoa(i)), []byte(strconv.Itoa(i)), 0644)
+	}
+
+	// returns the snapshot and the amount of heap memory it occupies
+	store := func(name string, maxArchives int) (*Snapshot, Repository, int64) {
+		r, err := NewRepository("mem://"+name, testPassword)
+		if err != nil {
+			t.Fatalf("Failed creating repository: %s", err)
+		}
+		index, _ := OpenChunkIndex(&r)
+		wd, _ := os.Getwd()
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:                 wd,
+			Paths:               []string{src},
+			Encrypt:             EncryptionAES,
+			DataParts:           1,
+			MaxArchivesInMemory: maxArchives,
+		})
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+
+		if err := snapshot.Save(&r); err != nil {
+			t.Fatalf("Failed saving snapshot: %s", err)
+		}
+		// the heap may shrink below the baseline, which must not wrap around
+		return snapshot, r, int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	}
+
+	_, _, inMemory := store("archivesinmemory", 0)
+	snapshot, r, segmented := store("archivesegments", limit)
+	t.Logf("Heap after storing %d files: %d bytes in memory, %d bytes segmented", files, inMemory, segmented)
+	if inMemory <= 0 {
+		t.Fatalf("Expected snapshot with all archives in memory to occupy heap memory, got %d bytes", inMemory)
+	}
+
+	if len(snapshot.Archives) >= limit {
+		t.Errorf("Expected less than %d archives in memory, got %d", limit, len(snapshot.Archives))
+	}
+	if snapshot.ArchiveSegments == 0 {
+		t.Fatal("Expected archives to be stored in segments")
+	}
+	if segmented >= inMemory {
+		t.Errorf("Expected segmented snapshot to use less memory than %d bytes, got %d", inMemory, segmented)
+	}
+
+	// reading the snapshot back only loads the last segment's archives
+	snapshot, err = openSnapshot(snapshot.ID, &r)
+	if err != nil {
+		t.Fatalf("Failed opening snapshot: %s", err)
+	}
+	count := 0
+	err = snapshot.EachArchive(func(arc *Archive) error {
+		if arc.Type == File {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed reading archives: %s", err)
+	}
+	if count != files {
+		t.Errorf("Expected %d files in snapshot, got %d", files, count)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if errs := restoreSnapshot(t, r, snapshot, dst, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring snapshot: %v", errs)
+	}
+	file := filepath.Join(strconv.Itoa(files%100), strconv.Itoa(files-100))
+	b, err := ioutil.ReadFile(filepath.Join(dst, src, file))
+	if err != nil || string(b) != strconv.Itoa(files-100) {
+		t.Errorf("Restored file %s differs: %q (%v)", file, b, err)
+	}
+
+	if err := snapshot.LoadArchives(); err != nil {
+		t.Fatalf("Failed loading archives: %s", err)
+	}
+	if snapshot.ArchiveSegments != 0 || len(snapshot.Archives) < files {
+		t.Errorf("Expected all %d archives in memory, got %d", files, len(snapshot.Archives))
+	}
+}
+
+func TestSnapshotDeterministicOrder(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	for i := 0; i < 50; i++ {
+		sub := filepath.Join(src, strconv.Itoa(i%7))
+		_ = os.MkdirAll(sub, 0755)
+		data := make([]byte, 1024*(i+1))
+		_, _ = rand.Read(data)
+		_ = ioutil.WriteFile(filepath.Join(sub, strconv.Itoa(i)), data, 0644)
+	}
+
+	// returns the paths of the snapshot's archives in the order they got
+	// stored in
+	store := func(name string) []string {
+		r, err := NewRepository("mem://"+name, testPassword)
+		if err != nil {
+			t.Fatalf("Failed creating repository: %s", err)
+		}
+		index, _ := OpenChunkIndex(&r)
+		wd, _ := os.Getwd()
+
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:                 wd,
+			Paths:               []string{src},
+			ChunkSize:           4096,
+			ChunkWorkers:        4,
+			Encrypt:             EncryptionAES,
+			DataParts:           1,
+			MaxArchivesInMemory: 8,
+		})
+		if err := snapshot.Save(&r); err != nil {
+			t.Fatalf("Failed saving snapshot: %s", err)
+		}
+
+		snapshot, err = openSnapshot(snapshot.ID, &r)
+		if err != nil {
+			t.Fatalf("Failed opening snapshot: %s", err)
+		}
+		var paths []string
+		err = snapshot.EachArchive(func(arc *Archive) error {
+			paths = append(paths, arc.Path)
+			for i, chunk := range arc.Chunks {
+				if chunk.Num != uint(i) {
+					t.Errorf("Expected chunk %d of %s, got chunk %d", i, arc.Path, chunk.Num)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed reading archives: %s", err)
+		}
+		return paths
+	}
+
+	first := store("deterministicorder1")
+	second := store("deterministicorder2")
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Expected both snapshots to store archives in the same order:\n%v\n%v", first, second)
+	}
+}
+
+// existenceBackend counts the requests needed to store chunks on a backend
+// that can check for existing chunks in batches.
+type existenceBackend struct {
+	Backend
+	requests *int32
+}
+
+func (b existenceBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	atomic.AddInt32(b.requests, 1)
+	return b.Backend.StoreChunk(shasum, part, totalParts, data)
+}
+
+func (b existenceBackend) ChunksExist(parts []ChunkPart) ([]bool, error) {
+	atomic.AddInt32(b.requests, 1)
+	exists := make([]bool, len(parts))
+	for i, p := range parts {
+		_, err := b.Backend.LoadChunk(p.Hash, p.Part, p.TotalParts)
+		exists[i] = err == nil
+	}
+	return exists, nil
+}
+
+func TestSnapshotBatchedExistenceChecks(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "data")
+	data := make([]byte, 4*1024*1024)
+	_, _ = rand.Read(data)
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("Failed writing test file: %s", err)
+	}
+
+	// stores the file twice and returns the requests needed the second time
+	storeTwice := func(name string, batched bool) (int32, *Snapshot) {
+		r, _ := NewRepository("mem://"+name, testPassword)
+		var requests int32
+		var be Backend = countingBackend{*r.backend.Backends[0], &requests}
+		if batched {
+			be = existenceBackend{*r.backend.Backends[0], &requests}
+		}
+		r.backend.Backends[0] = &be
+		index, _ := OpenChunkIndex(&r)
+		wd, _ := os.Getwd()
+
+		opts := StoreOptions{
+			CWD:       wd,
+			Paths:     []string{file},
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+			ChunkSize: 64 * 1024,
+		}
+		storeSnapshot(t, &r, &index, opts)
+		requests = 0
+		snapshot := storeSnapshot(t, &r, &index, opts)
+
+		b, _, err := DecodeArchiveData(r, *snapshot.Archives[file])
+		if err != nil || !bytes.Equal(b, data) {
+			t.Errorf("Failed restoring file (batched: %v): %v", batched, err)
+		}
+		return requests, snapshot
+	}
+
+	single, snapshot := storeTwice("existence-single", false)
+	batched, _ := storeTwice("existence-batched", true)
+	chunks := int32(len(snapshot.Archives[file].Chunks))
+	if single != chunks {
+		t.Errorf("Expected %d requests without batched existence checks, got %d", chunks, single)
+	}
+	expected := (chunks + existenceBatchSize - 1) / existenceBatchSize
+	if batched != expected {
+		t.Errorf("Expected %d requests with batched existence checks, got %d", expected, batched)
+	}
+}
+
+func TestSnapshotExcludeCaches(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	for _, d := range []string{"cache", "invalid", "data"} {
+		_ = os.MkdirAll(filepath.Join(src, d), 0755)
+		_ = ioutil.WriteFile(filepath.Join(src, d, "file"), []byte(d), 0644)
+	}
+	_ = ioutil.WriteFile(filepath.Join(src, "cache", "CACHEDIR.TAG"),
+		[]byte("Signature: 8a477f597d28d172789f06886806bc55\n# This file is a cache directory tag.\n"), 0644)
+	// tags without the signature don't count
+	_ = ioutil.WriteFile(filepath.Join(src, "invalid", "CACHEDIR.TAG"), []byte("not a cache\n"), 0644)
+
+	for i, excludeCaches := range []bool{false, true} {
+		r, _ := NewRepository("mem://exclude-caches"+strconv.Itoa(i), testPassword)
+		index, _ := OpenChunkIndex(&r)
+		wd, _ := os.Getwd()
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:           wd,
+			Paths:         []string{src},
+			Encrypt:       EncryptionAES,
+			DataParts:     1,
+			ExcludeCaches: excludeCaches,
+		})
+
+		for path, expected := range map[string]bool{
+			filepath.Join(src, "cache"):           !excludeCaches,
+			filepath.Join(src, "cache", "file"):   !excludeCaches,
+			filepath.Join(src, "invalid", "file"): true,
+			filepath.Join(src, "data", "file"):    true,
+		} {
+			if _, ok := snapshot.Archives[path]; ok != expected {
+				t.Errorf("Exclude caches %v: expected %s to be stored: %v, got %v", excludeCaches, path, expected, ok)
+			}
+		}
+	}
+}
+
+func TestSnapshotFileSizeLimits(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sizes := map[string]int{"tiny": 10, "small": 1024, "medium": 16 * 1024, "huge": 256 * 1024}
+	for name, size := range sizes {
+		_ = ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644)
+	}
+
+	r, _ := NewRepository("mem://file-size-limits", testPassword)
+	var stored int32
+	var be Backend = countingBackend{*r.backend.Backends[0], &stored}
+	r.backend.Backends[0] = &be
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot, _ := NewSnapshot("test_snapshot")
+	skipped := make(map[string]bool)
+	for p := range snapshot.Add(r, &index, StoreOptions{
+		CWD:         wd,
+		Paths:       []string{dir},
+		Encrypt:     EncryptionAES,
+		DataParts:   1,
+		MinFileSize: 100,
+		MaxFileSize: 64 * 1024,
+	}) {
+		if p.Error != nil {
+			t.Errorf("Failed adding to snapshot: %s", p.Error)
+		}
+		if p.Warning != nil {
+			if !errors.Is(p.Warning, ErrFileSizeExcluded) {
+				t.Errorf("Expected a FileSizeError, got %v", p.Warning)
+			}
+			skipped[filepath.Base(p.Path)] = true
+		}
+	}
+
+	for name := range sizes {
+		excluded := name == "tiny" || name == "huge"
+		if skipped[name] != excluded {
+			t.Errorf("Expected %s to be reported as skipped: %v", name, excluded)
+		}
+		if _, ok := snapshot.Archives[filepath.Join(dir, name)]; ok == excluded {
+			t.Errorf("Expected %s to be stored: %v", name, !excluded)
+		}
+	}
+	if snapshot.Stats.Files != 2 || snapshot.Stats.Size != 17*1024 {
+		t.Errorf("Expected stats of 2 files with 17 KiB, got %+v", snapshot.Stats)
+	}
+	if stored != 2 {
+		t.Errorf("Expected 2 chunks to be stored, got %d", stored)
+	}
+}
+
+func TestSnapshotFileAgeCutoffs(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtimes := map[string]time.Time{
+		"ancient": time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC),
+		"old":     time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+		"recent":  time.Date(2020, 6, 20, 0, 0, 0, 0, time.UTC),
+		"future":  time.Date(2020, 7, 10, 0, 0, 0, 0, time.UTC),
+	}
+	for name, mtime := range mtimes {
+		path := filepath.Join(dir, name)
+		_ = ioutil.WriteFile(path, []byte(name), 0644)
+		_ = os.Chtimes(path, mtime, mtime)
+	}
+
+	r, _ := NewRepository("mem://file-age-cutoffs", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot, _ := NewSnapshot("test_snapshot")
+	skipped := make(map[string]bool)
+	for p := range snapshot.Add(r, &index, StoreOptions{
+		CWD:              wd,
+		Paths:            []string{dir},
+		Encrypt:          EncryptionAES,
+		DataParts:        1,
+		ExcludeOlderThan: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		ExcludeNewerThan: time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC),
+	}) {
+		if p.Error != nil {
+			t.Errorf("Failed adding to snapshot: %s", p.Error)
+		}
+		if p.Warning != nil {
+			if !errors.Is(p.Warning, ErrFileAgeExcluded) {
+				t.Errorf("Expected a FileAgeError, got %v", p.Warning)
+			}
+			skipped[filepath.Base(p.Path)] = true
+		}
+	}
+
+	for name := range mtimes {
+		excluded := name == "ancient" || name == "future"
+		if skipped[name] != excluded {
+			t.Errorf("Expected %s to be reported as skipped: %v", name, excluded)
+		}
+		if _, ok := snapshot.Archives[filepath.Join(dir, name)]; ok == excluded {
+			t.Errorf("Expected %s to be stored: %v", name, !excluded)
+		}
+	}
+	if len(skipped) != 2 || snapshot.Stats.Files != 2 {
+		t.Errorf("Expected 2 files to be stored and 2 skipped, got %d stored and %d skipped", snapshot.Stats.Files, len(skipped))
+	}
+}
+
+func TestSnapshotVanishedFile(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	vanishing := filepath.Join(dir, "vanishing")
+	beforeRead := func(path string) {
+		if path == vanishing {
+			_ = os.Remove(path)
+		}
+	}
+
+	for i, pedantic := range []bool{false, true} {
+		for _, name := range []string{"a", "vanishing", "z"} {
+			_ = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		}
+
+		r, _ := NewRepository("mem://vanished-file"+strconv.Itoa(i), testPassword)
+		index, _ := OpenChunkIndex(&r)
+		wd, _ := os.Getwd()
+
+		snapshot, _ := NewSnapshot("test_snapshot")
+		var warnings, errs []error
+		for p := range snapshot.Add(r, &index, StoreOptions{
+			CWD:        wd,
+			Paths:      []string{dir},
+			Encrypt:    EncryptionAES,
+			DataParts:  1,
+			Pedantic:   pedantic,
+			beforeRead: beforeRead,
+		}) {
+			if p.Error != nil {
+				errs = append(errs, p.Error)
+			}
+			if p.Warning != nil {
+				warnings = append(warnings, p.Warning)
+			}
+		}
+
+		if pedantic {
+			if len(errs) != 1 || !errors.Is(errs[0], ErrFileVanished) {
+				t.Errorf("Expected ErrFileVanished in pedantic mode, got %v", errs)
+			}
+			if _, ok := snapshot.Archives[filepath.Join(dir, "z")]; ok {
+				t.Error("Expected pedantic mode to abort the snapshot")
+			}
+			continue
+		}
+
+		if len(errs) != 0 {
+			t.Errorf("Expected no errors, got %v", errs)
+		}
+		if len(warnings) != 1 || !errors.Is(warnings[0], ErrFileVanished) || os.IsPermission(warnings[0]) {
+			t.Errorf("Expected a single ErrFileVanished warning, got %v", warnings)
+		}
+		if _, ok := snapshot.Archives[vanishing]; ok {
+			t.Error("Didn't expect the vanished file to be stored")
+		}
+		for _, name := range []string{"a", "z"} {
+			if _, ok := snapshot.Archives[filepath.Join(dir, name)]; !ok {
+				t.Errorf("Expected %s to be stored", name)
+			}
+		}
+		if snapshot.Stats.Files != 2 || snapshot.Stats.Inaccessible != 0 {
+			t.Errorf("Expected stats of 2 files and no inaccessible ones, got %+v", snapshot.Stats)
+		}
+	}
+}
+
+// irregularFileInfo reports a file of a type the platform doesn't know.
+type irregularFileInfo struct {
+	os.FileInfo
+}
+
+func (fi irregularFileInfo) Mode() os.FileMode {
+	return fi.FileInfo.Mode() | os.ModeIrregular
+}
+
+func TestSnapshotUnsupportedFile(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "irregular", "z"} {
+		_ = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+	irregular := filepath.Join(dir, "irregular")
+	scanned := func(path string, fi os.FileInfo) os.FileInfo {
+		if path == irregular {
+			return irregularFileInfo{fi}
+		}
+		return fi
+	}
+
+	for i, pedantic := range []bool{false, true} {
+		r, _ := NewRepository("mem://unsupported-file"+strconv.Itoa(i), testPassword)
+		index, _ := OpenChunkIndex(&r)
+		wd, _ := os.Getwd()
+
+		snapshot, _ := NewSnapshot("test_snapshot")
+		var warnings, errs []error
+		for p := range snapshot.Add(r, &index, StoreOptions{
+			CWD:       wd,
+			Paths:     []string{dir},
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+			Pedantic:  pedantic,
+			scanned:   scanned,
+		}) {
+			if p.Error != nil {
+				errs = append(errs, p.Error)
+			}
+			if p.Warning != nil {
+				warnings = append(warnings, p.Warning)
+			}
+		}
+
+		if pedantic {
+			if len(errs) != 1 || !errors.Is(errs[0], ErrUnsupportedFile) {
+				t.Errorf("Expected ErrUnsupportedFile in pedantic mode, got %v", errs)
+			}
+			if _, ok := snapshot.Archives[filepath.Join(dir, "z")]; ok {
+				t.Error("Expected pedantic mode to abort the snapshot")
+			}
+			continue
+		}
+
+		if len(errs) != 0 {
+			t.Errorf("Expected no errors, got %v", errs)
+		}
+		var ue *UnsupportedFileError
+		if len(warnings) != 1 || !errors.As(warnings[0], &ue) || ue.Path != irregular {
+			t.Errorf("Expected a single UnsupportedFileError warning for %s, got %v", irregular, warnings)
+		}
+		if _, ok := snapshot.Archives[irregular]; ok {
+			t.Error("Didn't expect the irregular file to be stored")
+		}
+		for _, name := range []string{"a", "z"} {
+			if _, ok := snapshot.Archives[filepath.Join(dir, name)]; !ok {
+				t.Errorf("Expected %s to be stored", name)
+			}
+		}
+		if snapshot.Stats.Files != 2 || snapshot.Stats.Unsupported != 1 || snapshot.Stats.Errors != 0 {
+			t.Errorf("Expected stats of 2 files and a single unsupported one, got %+v", snapshot.Stats)
+		}
+	}
+}
+
+// inFlightBackend records the most chunks being stored at once on any of the
+// backends sharing its counters.
+type inFlightBackend struct {
+	Backend
+	inFlight, max *int32
+}
+
+func (b inFlightBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	n := atomic.AddInt32(b.inFlight, 1)
+	defer atomic.AddInt32(b.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(b.max)
+		if n <= max || atomic.CompareAndSwapInt32(b.max, max, n) {
+			break
+		}
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	return b.Backend.StoreChunk(shasum, part, totalParts, data)
+}
+
+func TestSnapshotSharedLimiter(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 8; i++ {
+		data := make([]byte, 10*1024)
+		_, _ = rand.Read(data)
+		_ = ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(i)), data, 0644)
+	}
+
+	const limit = 2
+	limiter := NewLimiter(limit)
+	var inFlight, max int32
+	done := make(chan *Snapshot)
+	for i := 0; i < 2*limit; i++ {
+		r, _ := NewRepository("mem://shared-limiter"+strconv.Itoa(i), testPassword)
+		var be Backend = inFlightBackend{*r.backend.Backends[0], &inFlight, &max}
+		r.backend.Backends[0] = &be
+		index, _ := OpenChunkIndex(&r)
+		wd, _ := os.Getwd()
+
+		go func() {
+			snapshot, _ := NewSnapshot("test_snapshot")
+			for p := range snapshot.Add(r, &index, StoreOptions{
+				CWD:       wd,
+				Paths:     []string{dir},
+				Encrypt:   EncryptionAES,
+				DataParts: 1,
+				Limiter:   limiter,
+			}) {
+				if p.Error != nil {
+					t.Errorf("Failed adding to snapshot: %s", p.Error)
+				}
+			}
+			done <- snapshot
+		}()
+	}
+
+	for i := 0; i < 2*limit; i++ {
+		if snapshot := <-done; snapshot.Stats.Files != 8 {
+			t.Errorf("Expected 8 files to be stored, got %d", snapshot.Stats.Files)
+		}
+	}
+	if max > limit {
+		t.Errorf("Expected at most %d chunks being stored at once, got %d", limit, max)
+	}
+}
+
+func TestCloneSnapshotToVolume(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	data := make([]byte, 256*1024)
+	_, _ = rand.Read(data)
+	_ = ioutil.WriteFile(filepath.Join(src, "data"), data, 0644)
+
+	r, _ := NewRepository("mem://clone-to-volume", testPassword)
+	var stored int32
+	var be Backend = countingBackend{*r.backend.Backends[0], &stored}
+	r.backend.Backends[0] = &be
+	from, _ := NewVolume("from", "")
+	to, _ := NewVolume("to", "")
+	_ = r.AddVolume(from)
+	_ = r.AddVolume(to)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+		ChunkSize: 64 * 1024,
+	})
+	snapshot.SetTag("host", "backup01")
+	snapshot.SetPinned(true)
+	snapshot.ImmutableUntil = time.Now().Add(-time.Hour).UTC()
+	_ = snapshot.Save(&r)
+	_ = from.AddSnapshot(snapshot.ID)
+	chunks := stored
+
+	clone, err := CloneSnapshotToVolume(&r, &index, snapshot.ID, to.ID)
+	if err != nil {
+		t.Fatalf("Failed cloning snapshot: %s", err)
+	}
+	if stored != chunks {
+		t.Errorf("Expected no chunks to be stored by cloning, got %d", stored-chunks)
+	}
+	if clone.ID == snapshot.ID || !clone.Date.Equal(snapshot.Date) || clone.Stats != snapshot.Stats {
+		t.Errorf("Expected a new snapshot with the same date & stats, got %s at %s: %+v", clone.ID, clone.Date, clone.Stats)
+	}
+	loaded, err := to.LoadSnapshot(clone.ID, &r)
+	if err != nil {
+		t.Fatalf("Expected the clone to be part of the destination volume: %s", err)
+	}
+	if !reflect.DeepEqual(loaded.Tags, snapshot.Tags) || !loaded.Pinned || !loaded.ImmutableUntil.Equal(snapshot.ImmutableUntil) {
+		t.Errorf("Expected the clone to keep tags %v, pinning & immutability until %s, got %v, %t, %s",
+			snapshot.Tags, snapshot.ImmutableUntil, loaded.Tags, loaded.Pinned, loaded.ImmutableUntil)
+	}
+
+	// the clone keeps the chunks referenced once the original is gone
+	snapshot.SetPinned(false)
+	_ = snapshot.Save(&r)
+	_ = from.RemoveSnapshot(snapshot.ID)
+	_ = index.ReleaseSnapshot(snapshot)
+	if unreferenced := index.Unreferenced(); len(unreferenced) != 0 {
+		t.Errorf("Expected all chunks to be referenced by the clone, got %d unreferenced", len(unreferenced))
+	}
+
+	clone, err = openSnapshot(clone.ID, &r)
+	if err != nil {
+		t.Fatalf("Failed opening cloned snapshot: %s", err)
+	}
+	dst := filepath.Join(dir, "dst")
+	if errs := restoreSnapshot(t, r, clone, dst, RestoreOptions{}); len(errs) > 0 {
+		t.Fatalf("Failed restoring cloned snapshot: %v", errs)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dst, src, "data"))
+	if !bytes.Equal(b, data) {
+		t.Error("Restored data differs from the original file")
+	}
+}
+
+func TestSnapshotLZMAOptions(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// repetitions only a large dictionary can make use of
+	block := make([]byte, 300*1024)
+	_, _ = rand.Read(block)
+	data := bytes.Repeat(block, 3)
+	src := filepath.Join(dir, "data")
+	_ = ioutil.WriteFile(src, data, 0644)
+
+	sizes := make(map[string]uint64)
+	for name, lzma := range map[string]LZMAOptions{
+		"default": {},
+		"preset1": {Preset: 1},
+		"preset9": {Preset: 9},
+		"dict":    {Preset: 9, DictSize: 64 * 1024},
+	} {
+		r, _ := NewRepository("mem://lzma-options-"+name, testPassword)
+		index, _ := OpenChunkIndex(&r)
+		wd, _ := os.Getwd()
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:       wd,
+			Paths:     []string{src},
+			Compress:  CompressionLZMA,
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+			LZMA:      lzma,
+		})
+
+		arc := snapshot.Archives[src]
+		b, _, err := DecodeArchiveData(r, *arc)
+		if err != nil {
+			t.Fatalf("Failed restoring file compressed with %s: %s", name, err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("Restored data differs from the original file with %s", name)
+		}
+		sizes[name] = arc.StorageSize
+	}
+
+	if sizes["preset1"] <= sizes["preset9"] || sizes["dict"] <= sizes["preset9"] {
+		t.Errorf("Expected small dictionaries to compress worse than preset 9, got %+v", sizes)
+	}
+
+	if _, err := (Compressor{Method: CompressionLZMA, LZMA: LZMAOptions{Preset: 10}}).Process(data); err != ErrInvalidLZMAPreset {
+		t.Errorf("Expected %v, got %v", ErrInvalidLZMAPreset, err)
+	}
+}
+
+func TestSnapshotTampered(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	_ = ioutil.WriteFile(filepath.Join(src, "data"), []byte("knoxite"), 0644)
+
+	r, _ := NewRepository("mem://snapshot-tampered", testPassword)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:       wd,
+			Paths:     []string{src},
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+		})
+		_ = snapshot.Save(&r)
+		_ = vol.AddSnapshot(snapshot.ID)
+		ids = append(ids, snapshot.ID)
+	}
+
+	snapshot, err := openSnapshot(ids[0], &r)
+	if err != nil {
+		t.Fatalf("Failed opening untouched snapshot: %s", err)
+	}
+	if snapshot.Digest == "" {
+		t.Fatal("Expected snapshot to carry a digest")
+	}
+
+	// alter an archive without updating the digest
+	for _, arc := range snapshot.Archives {
+		arc.Size++
+	}
+	pipe, _ := NewEncodingPipeline(CompressionLZMA, EncryptionAES, r.Key)
+	b, _ := pipe.Encode(snapshot)
+	_ = r.backend.SaveSnapshot(snapshot.ID, b)
+
+	if _, _, err := r.FindSnapshot(ids[0]); err != ErrSnapshotTampered {
+		t.Errorf("Expected %v for altered archives, got %v", ErrSnapshotTampered, err)
+	}
+	if _, _, err := r.FindSnapshot("latest"); err != ErrSnapshotTampered {
+		t.Errorf("Expected %v finding the latest snapshot, got %v", ErrSnapshotTampered, err)
+	}
+
+	// a genuine snapshot stored under another ID
+	b, _ = r.backend.LoadSnapshot(ids[1])
+	_ = r.backend.SaveSnapshot(ids[0], b)
+	if _, err := vol.LoadSnapshot(ids[0], &r); err != ErrSnapshotTampered {
+		t.Errorf("Expected %v for a swapped snapshot, got %v", ErrSnapshotTampered, err)
+	}
+
+	if _, _, err := r.FindSnapshot(ids[1]); err != nil {
+		t.Errorf("Expected untouched snapshot to open, got %v", err)
+	}
+}
+
+func TestSnapshotCompressionDistribution(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	_ = ioutil.WriteFile(filepath.Join(src, "old"), bytes.Repeat([]byte("knoxite"), 600), 0644)
+
+	r, _ := NewRepository("mem://compression-distribution", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	opts := StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		Compress:  CompressionGZip,
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}
+	parent := storeSnapshot(t, &r, &index, opts)
+
+	// the unchanged file keeps its compression when reused from the parent,
+	// the tiny file gets stored uncompressed
+	_ = ioutil.WriteFile(filepath.Join(src, "new"), bytes.Repeat([]byte("knoxite"), 300), 0644)
+	_ = ioutil.WriteFile(filepath.Join(src, "tiny"), bytes.Repeat([]byte("knoxite"), 100), 0644)
+	opts.Compress = CompressionZstd
+	opts.CompressMinChunkSize = 1000
+	opts.Parent = parent
+	snapshot := storeSnapshot(t, &r, &index, opts)
+
+	distribution, err := snapshot.CompressionDistribution()
+	if err != nil {
+		t.Fatalf("Failed getting compression distribution: %s", err)
+	}
+	expected := []CompressionShare{
+		{Method: CompressionGZip, Files: 1, Size: 4200, Share: 0.6},
+		{Method: CompressionZstd, Files: 1, Size: 2100, Share: 0.3},
+		{Method: CompressionNone, Files: 1, Size: 700, Share: 0.1},
+	}
+	if len(distribution) != len(expected) {
+		t.Fatalf("Expected %d compression algos, got %+v", len(expected), distribution)
+	}
+	for i, e := range expected {
+		d := distribution[i]
+		if d.Method != e.Method || d.Files != e.Files || d.Size != e.Size || d.Share != e.Share || d.StorageSize == 0 {
+			t.Errorf("Expected %+v, got %+v", e, d)
+		}
+	}
+}
+
+func TestSnapshotOverlappingPaths(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	_ = ioutil.WriteFile(filepath.Join(src, "a"), []byte("a"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(src, "sub", "b"), []byte("b"), 0644)
+
+	r, _ := NewRepository("mem://overlapping-paths", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	opts := StoreOptions{
+		CWD: wd,
+		Paths: []string{
+			filepath.Join(src, "sub", "b"),
+			src,
+			filepath.Join(src, "sub"),
+			src + string(filepath.Separator),
+		},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	}
+
+	snapshot, _ := NewSnapshot("test_snapshot")
+	var warnings int
+	for p := range snapshot.Add(r, &index, opts) {
+		if p.Error != nil {
+			t.Errorf("Failed adding to snapshot: %s", p.Error)
+		}
+		if errors.Is(p.Warning, ErrOverlappingPaths) {
+			warnings++
+		}
+	}
+	if warnings != 3 {
+		t.Errorf("Expected 3 overlapping paths to be reported, got %d", warnings)
+	}
+	if snapshot.Stats.Files != 2 || snapshot.Stats.Dirs != 2 || len(snapshot.Archives) != 4 {
+		t.Errorf("Expected every file to be stored once, got %d archives: %s", len(snapshot.Archives), snapshot.Stats)
+	}
+
+	opts.OverlappingPaths = OverlappingPathsError
+	snapshot, _ = NewSnapshot("test_snapshot")
+	var failed bool
+	for p := range snapshot.Add(r, &index, opts) {
+		if errors.Is(p.Error, ErrOverlappingPaths) {
+			failed = true
+		}
+	}
+	if !failed || len(snapshot.Archives) != 0 {
+		t.Errorf("Expected overlapping paths to abort the snapshot")
+	}
+}
+
+func TestSnapshotIneffectiveCompression(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	random := make([]byte, 2*minEffectivenessSize)
+	_, _ = rand.Read(random)
+	_ = ioutil.WriteFile(filepath.Join(dir, "random"), random, 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, "text"), bytes.Repeat([]byte("knoxite "), minEffectivenessSize/4), 0644)
+
+	r, _ := NewRepository("mem://ineffective-compression", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	for name, expected := range map[string]bool{"random": true, "text": false} {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		var warned bool
+		for p := range snapshot.Add(r, &index, StoreOptions{
+			CWD:       wd,
+			Paths:     []string{filepath.Join(dir, name)},
+			Compress:  CompressionGZip,
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+		}) {
+			if p.Error != nil {
+				t.Errorf("Failed adding to snapshot: %s", p.Error)
+			}
+			if errors.Is(p.Warning, ErrCompressionIneffective) {
+				warned = true
+			}
+		}
+		if warned != expected {
+			t.Errorf("Expected compression of %s to be reported as ineffective: %v, got %v", name, expected, warned)
+		}
+	}
+}
+
+func TestSnapshotDedupWindow(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	blocks := make([][]byte, 7)
+	for i := range blocks {
+		blocks[i] = make([]byte, 4096)
+		_, _ = rand.Read(blocks[i])
+	}
+	// block 0 & 1 repeat within a window of 4 chunks, the last block 0
+	// only after it has been evicted
+	var data []byte
+	for _, i := range []int{0, 1, 0, 1, 2, 3, 4, 5, 6, 0} {
+		data = append(data, blocks[i]...)
+	}
+	file := filepath.Join(dir, "data")
+	_ = ioutil.WriteFile(file, data, 0644)
+
+	tt := []struct {
+		window int
+		stored int32
+	}{
+		{4, 8},
+		{16, 7},
+	}
+	for _, test := range tt {
+		r, _ := NewRepository("mem://dedup-window-"+strconv.Itoa(test.window), testPassword)
+		var stored int32
+		var be Backend = countingBackend{*r.backend.Backends[0], &stored}
+		r.backend.Backends[0] = &be
+		index, _ := OpenChunkIndex(&r)
+		wd, _ := os.Getwd()
+
+		snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+			CWD:         wd,
+			Paths:       []string{file},
+			Chunker:     fixedChunker{size: 4096},
+			Encrypt:     EncryptionAES,
+			DataParts:   1,
+			DedupWindow: test.window,
+		})
+		if stored != test.stored {
+			t.Errorf("Expected %d chunks to be stored with a window of %d, got %d", test.stored, test.window, stored)
+		}
+
+		b, _, err := DecodeArchiveData(r, *snapshot.Archives[file])
+		if err != nil || !bytes.Equal(b, data) {
+			t.Errorf("Failed restoring data stored with a window of %d: %v", test.window, err)
+		}
+	}
+
+	// the chunk-index doesn't grow while the snapshot gets added, only once
+	// it gets saved
+	r, _ := NewRepository("mem://dedup-window-index", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	snapshot, _ := NewSnapshot("test_snapshot")
+	var peak int
+	for p := range snapshot.Add(r, &index, StoreOptions{
+		CWD:         wd,
+		Paths:       []string{file},
+		Chunker:     fixedChunker{size: 4096},
+		Encrypt:     EncryptionAES,
+		DataParts:   1,
+		DedupWindow: 4,
+	}) {
+		if p.Error != nil {
+			t.Fatalf("Failed adding to snapshot: %s", p.Error)
+		}
+		index.mut.Lock()
+		if len(index.Chunks) > peak {
+			peak = len(index.Chunks)
+		}
+		index.mut.Unlock()
+	}
+	if peak > 4 {
+		t.Errorf("Expected the chunk-index to hold at most 4 chunks while adding, got %d", peak)
+	}
+	if err := snapshot.Save(&r); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Save(&r); err != nil {
+		t.Fatalf("Failed saving chunk-index: %s", err)
+	}
+	index, _ = OpenChunkIndex(&r)
+	if len(index.Chunks) != len(blocks) {
+		t.Errorf("Expected the saved chunk-index to hold %d chunks, got %d", len(blocks), len(index.Chunks))
+	}
+	if c := index.Chunks[snapshot.Archives[file].Chunks[0].Hash]; c == nil || c.Snapshots[0] != snapshot.ID {
+		t.Errorf("Expected the first chunk to be referenced by the snapshot, got %+v", c)
+	}
+
+	w := newDedupWindow(4)
+	for i := 0; i < 1000; i++ {
+		w.add(strconv.Itoa(i))
+	}
+	if w.len() != 4 || len(w.hashes) != 4 {
+		t.Errorf("Expected the window to hold 4 hashes, got %d", w.len())
+	}
+	if w.contains("0") || !w.contains("999") {
+		t.Error("Expected the window to only hold the most recent hashes")
+	}
+}
@@ -0,0 +1,187 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"crypto/hmac"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// Error declarations.
+var (
+	ErrNoRepository = errors.New("Snapshot has not been stored in or opened from a repository")
+)
+
+// archiveSegmentID returns the ID the n-th archive segment of snapshot gets
+// stored under.
+func (snapshot *Snapshot) archiveSegmentID(n uint) string {
+	return snapshot.ID + "-archives-" + strconv.FormatUint(uint64(n), 10)
+}
+
+// flushArchives stores the archives held in memory as a new segment and
+// removes them from snapshot.Archives.
+func (snapshot *Snapshot) flushArchives(repository *Repository) error {
+	snapshot.normalizeChunks()
+	archives := snapshot.sortedArchives()
+
+	pipe, err := NewEncodingPipeline(CompressionLZMA, EncryptionAES, repository.Key)
+	if err != nil {
+		return err
+	}
+	b, err := pipe.Encode(archives)
+	if err != nil {
+		return err
+	}
+	id := snapshot.archiveSegmentID(snapshot.ArchiveSegments)
+	digest, err := segmentDigest(repository.Key, id, archives)
+	if err != nil {
+		return err
+	}
+	repository.log().Debug("Saving archive segment ", id)
+	if err := repository.backend.SaveSnapshot(id, b); err != nil {
+		return err
+	}
+
+	snapshot.ArchiveSegments++
+	snapshot.SegmentDigests = append(snapshot.SegmentDigests, digest)
+	snapshot.Archives = make(map[string]*Archive)
+	return nil
+}
+
+// segmentDigest returns the digest of the archives stored as the segment id.
+func segmentDigest(key, id string, archives []*Archive) (string, error) {
+	var decoded []*Archive
+	return metadataDigest(key, id, archives, &decoded)
+}
+
+// loadArchiveSegment returns the archives of the n-th segment of snapshot.
+func (snapshot *Snapshot) loadArchiveSegment(n uint) ([]*Archive, error) {
+	if snapshot.repository == nil {
+		return nil, ErrNoRepository
+	}
+
+	id := snapshot.archiveSegmentID(n)
+	b, err := snapshot.repository.backend.LoadSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	pipe, err := NewDecodingPipeline(CompressionLZMA, EncryptionAES, snapshot.repository.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []*Archive
+	err = pipe.Decode(b, &archives)
+	if err != nil || snapshot.Digest == "" {
+		// snapshots saved by older versions have no digests
+		return archives, err
+	}
+
+	if n >= uint(len(snapshot.SegmentDigests)) {
+		return nil, ErrSnapshotTampered
+	}
+	digest, err := segmentDigest(snapshot.repository.Key, id, archives)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(digest), []byte(snapshot.SegmentDigests[n])) {
+		return nil, ErrSnapshotTampered
+	}
+	return archives, nil
+}
+
+// EachArchive calls fn for every archive of snapshot, including the ones
+// stored in separate segments (see StoreOptions.MaxArchivesInMemory), which
+// get loaded one segment at a time. Within every segment, archives are
+// sorted by path. It stops at the first error returned by fn and returns it.
+func (snapshot *Snapshot) EachArchive(fn func(arc *Archive) error) error {
+	for n := uint(0); n < snapshot.ArchiveSegments; n++ {
+		archives, err := snapshot.loadArchiveSegment(n)
+		if err != nil {
+			return err
+		}
+		for _, arc := range archives {
+			if err := fn(arc); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, arc := range snapshot.sortedArchives() {
+		if err := fn(arc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedArchives returns the archives held in memory sorted by path, so
+// snapshots of the same tree list & store them in the same order.
+func (snapshot *Snapshot) sortedArchives() []*Archive {
+	archives := make([]*Archive, 0, len(snapshot.Archives))
+	for _, arc := range snapshot.Archives {
+		archives = append(archives, arc)
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].Path < archives[j].Path
+	})
+
+	return archives
+}
+
+// normalizeChunks sorts the chunks of the archives held in memory by their
+// number, no matter in which order they got added.
+func (snapshot *Snapshot) normalizeChunks() {
+	for _, arc := range snapshot.Archives {
+		chunks := arc.Chunks
+		sort.SliceStable(chunks, func(i, j int) bool {
+			return chunks[i].Num < chunks[j].Num
+		})
+	}
+}
+
+// eachArchiveDirsFirst calls fn like EachArchive, but for all directories
+// before any other archive.
+func (snapshot *Snapshot) eachArchiveDirsFirst(fn func(arc *Archive) error) error {
+	err := snapshot.EachArchive(func(arc *Archive) error {
+		if arc.Type != Directory {
+			return nil
+		}
+		return fn(arc)
+	})
+	if err != nil {
+		return err
+	}
+
+	return snapshot.EachArchive(func(arc *Archive) error {
+		if arc.Type == Directory {
+			return nil
+		}
+		return fn(arc)
+	})
+}
+
+// LoadArchives loads the archives stored in separate segments into
+// snapshot.Archives, so all of them can be accessed by path. Saving the
+// snapshot afterwards stores all archives in its metadata again.
+func (snapshot *Snapshot) LoadArchives() error {
+	for n := uint(0); n < snapshot.ArchiveSegments; n++ {
+		archives, err := snapshot.loadArchiveSegment(n)
+		if err != nil {
+			return err
+		}
+		for _, arc := range archives {
+			snapshot.Archives[arc.Path] = arc
+		}
+	}
+
+	snapshot.ArchiveSegments = 0
+	return nil
+}
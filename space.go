@@ -0,0 +1,126 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Error declarations.
+var (
+	ErrInsufficientSpace = errors.New("Not enough free space")
+)
+
+// InsufficientSpaceError records the space needed on a file system that
+// doesn't have enough of it available.
+type InsufficientSpaceError struct {
+	Path      string
+	Required  uint64
+	Available uint64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("Not enough free space at %s: %s required, %s available",
+		e.Path, SizeToString(e.Required), SizeToString(e.Available))
+}
+
+// Is lets errors.Is match an InsufficientSpaceError with ErrInsufficientSpace.
+func (e *InsufficientSpaceError) Is(target error) bool {
+	return target == ErrInsufficientSpace
+}
+
+// availableSpace reports the free space of the file system containing a
+// path. It can be replaced in tests.
+var availableSpace = freeSpace
+
+// checkSpace returns an InsufficientSpaceError if less than required bytes
+// are available at path, which doesn't have to exist yet. Nothing gets
+// reported if the free space can't be determined.
+func checkSpace(path string, required uint64) error {
+	dir := path
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+
+	available, err := availableSpace(dir)
+	if err != nil {
+		return nil
+	}
+	if available < required {
+		return &InsufficientSpaceError{path, required, available}
+	}
+
+	return nil
+}
+
+// restoreStats returns the amount & size of the items a restore of snapshot
+// with opts writes.
+func restoreStats(snapshot *Snapshot, opts RestoreOptions) (Stats, error) {
+	var stats Stats
+	err := snapshot.EachArchive(func(arc *Archive) error {
+		if arc.Failed {
+			return nil
+		}
+
+		for _, exclude := range opts.Excludes {
+			if match, _ := filepath.Match(strings.ToLower(exclude), strings.ToLower(arc.Path)); match {
+				return nil
+			}
+		}
+
+		switch arc.Type {
+		case File:
+			stats.Files++
+			stats.Size += arc.Size
+			stats.StorageSize += arc.StorageSize
+		case Directory:
+			stats.Dirs++
+		case SymLink:
+			stats.SymLinks++
+		}
+		return nil
+	})
+
+	return stats, err
+}
+
+// checkLocalSpace warns if the local storage backends of repository don't
+// have enough free space for the files of opts. Compression and
+// deduplication usually need less, so this doesn't stop a store.
+func checkLocalSpace(repository Repository, opts StoreOptions) {
+	var size int64 = -1
+	for _, be := range repository.backend.Backends {
+		local, ok := (*be).(*StorageLocal)
+		if !ok {
+			continue
+		}
+		if size < 0 {
+			_, size, _ = EstimateSnapshotSize(opts)
+		}
+
+		// every backend stores one of the data or parity parts of a chunk
+		required := uint64(size)
+		if opts.DataParts > 1 {
+			required /= uint64(opts.DataParts)
+		}
+		if err := checkSpace(local.Path, required); err != nil {
+			repository.log().Warn(err)
+		}
+	}
+}
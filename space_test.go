@@ -0,0 +1,95 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpaceCheck(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var free uint64
+	var checked []string
+	availableSpace = func(path string) (uint64, error) {
+		checked = append(checked, path)
+		return free, nil
+	}
+	defer func() {
+		availableSpace = freeSpace
+	}()
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	content := make([]byte, 64*1024)
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logger := &capturingLogger{}
+	r, err := NewRepositoryWithOptions(filepath.Join(dir, "repo"), testPassword, RepositoryOptions{Logger: logger})
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	free = 100 * 1024
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{src},
+		DataParts: 1,
+	})
+	if !logger.contains("Warn: " + (&InsufficientSpaceError{filepath.Join(dir, "repo"), 128 * 1024, free}).Error()) {
+		t.Errorf("Expected a warning about insufficient space, got %v", logger.messages)
+	}
+
+	// the target doesn't exist yet, its parent gets checked instead
+	dst := filepath.Join(dir, "dst", "nested")
+	checked = nil
+	_, err = DecodeSnapshot(r, snapshot, dst, RestoreOptions{})
+	if !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("Expected %v, got %v", ErrInsufficientSpace, err)
+	}
+	if len(checked) != 1 || checked[0] != dir {
+		t.Errorf("Expected free space of %s to be checked, got %v", dir, checked)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dst")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be restored, got %v", err)
+	}
+
+	// excluded files don't count
+	progress, err := DecodeSnapshot(r, snapshot, dst, RestoreOptions{Excludes: []string{filepath.Join(src, "a")}})
+	if err != nil {
+		t.Fatalf("Expected restore excluding files to fit, got %v", err)
+	}
+	for range progress {
+	}
+
+	if errs := restoreSnapshot(t, r, snapshot, filepath.Join(dir, "skip"), RestoreOptions{SkipSpaceCheck: true}); len(errs) > 0 {
+		t.Errorf("Failed restoring snapshot: %v", errs)
+	}
+
+	free = 1 << 20
+	if errs := restoreSnapshot(t, r, snapshot, filepath.Join(dir, "fits"), RestoreOptions{}); len(errs) > 0 {
+		t.Errorf("Failed restoring snapshot: %v", errs)
+	}
+}
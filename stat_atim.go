@@ -0,0 +1,12 @@
+// +build dragonfly linux openbsd solaris
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+func (s statUnix) atime() int64 { return int64(s.Atim.Sec) }
@@ -15,4 +15,5 @@ type statT interface {
 	gid() uint32
 	rdev() uint64
 	size() int64
+	atime() int64
 }
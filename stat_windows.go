@@ -9,7 +9,10 @@
 
 package knoxite
 
-import "syscall"
+import (
+	"syscall"
+	"time"
+)
 
 type statWin syscall.Win32FileAttributeData
 
@@ -31,6 +34,10 @@ func (s statWin) uid() uint32   { return 0 }
 func (s statWin) gid() uint32   { return 0 }
 func (s statWin) rdev() uint64  { return 0 }
 
+func (s statWin) atime() int64 {
+	return s.LastAccessTime.Nanoseconds() / int64(time.Second)
+}
+
 func (s statWin) size() int64 {
 	return int64(s.FileSizeLow) | (int64(s.FileSizeHigh) << 32)
 }
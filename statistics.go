@@ -8,18 +8,78 @@
 package knoxite
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 )
 
+// Const declarations.
+const (
+	// snapshots storing less data than this don't get analyzed for
+	// ineffective compression or deduplication
+	minEffectivenessSize = 1 << 20
+	// changed files storing more than this fraction of their size again are
+	// considered not to deduplicate
+	maxChangedStoredRatio = 0.99
+)
+
+// Error declarations.
+var (
+	ErrCompressionIneffective = errors.New("Compression made the stored data larger")
+	ErrDedupIneffective       = errors.New("Changed files barely deduplicated against their earlier versions")
+)
+
+// IneffectiveStorageWarning reports a snapshot whose compression or
+// deduplication didn't pay off, which often hints at a misconfiguration,
+// e.g. compressing already encrypted or compressed data.
+type IneffectiveStorageWarning struct {
+	Err    error  // ErrCompressionIneffective or ErrDedupIneffective
+	Size   uint64 // original size of the analyzed data
+	Stored uint64 // size of the data in storage
+}
+
+func (e *IneffectiveStorageWarning) Error() string {
+	return fmt.Sprintf("%s: %s stored as %s", e.Err, SizeToString(e.Size), SizeToString(e.Stored))
+}
+
+// Unwrap returns the sentinel error describing the problem.
+func (e *IneffectiveStorageWarning) Unwrap() error {
+	return e.Err
+}
+
+// storageEffectiveness gathers how well the data of a snapshot compressed
+// and deduplicated.
+type storageEffectiveness struct {
+	storedOriginal uint64 // original size of newly stored chunks
+	storedEncoded  uint64 // compressed & encrypted size of newly stored chunks
+	changedSize    uint64 // size of files whose earlier version is in the parent
+	changedStored  uint64 // original size of their newly stored chunks
+}
+
+// warnings returns an IneffectiveStorageWarning for every problem found.
+func (e storageEffectiveness) warnings(opts StoreOptions) []error {
+	var warnings []error
+	if opts.Compress != CompressionNone && e.storedOriginal >= minEffectivenessSize && e.storedEncoded > e.storedOriginal {
+		warnings = append(warnings, &IneffectiveStorageWarning{ErrCompressionIneffective, e.storedOriginal, e.storedEncoded})
+	}
+	if e.changedSize >= minEffectivenessSize && float64(e.changedStored) > float64(e.changedSize)*maxChangedStoredRatio {
+		warnings = append(warnings, &IneffectiveStorageWarning{ErrDedupIneffective, e.changedSize, e.changedStored})
+	}
+
+	return warnings
+}
+
 // Stats contains a bunch of Stats counters.
 type Stats struct {
-	Files       uint64 `json:"files"`
-	Dirs        uint64 `json:"dirs"`
-	SymLinks    uint64 `json:"symlinks"`
-	Size        uint64 `json:"size"`
-	StorageSize uint64 `json:"stored_size"`
-	Transferred uint64 `json:"transferred"`
-	Errors      uint64 `json:"errors"`
+	Files        uint64 `json:"files"`
+	Dirs         uint64 `json:"dirs"`
+	SymLinks     uint64 `json:"symlinks"`
+	Size         uint64 `json:"size"`
+	StorageSize  uint64 `json:"stored_size"`
+	Transferred  uint64 `json:"transferred"`
+	Errors       uint64 `json:"errors"`
+	Inaccessible uint64 `json:"inaccessible"` // paths that couldn't be read due to missing permissions
+	Unsupported  uint64 `json:"unsupported"`  // paths skipped as the platform can't store them
 }
 
 // Add accumulates other into s.
@@ -31,6 +91,8 @@ func (s *Stats) Add(other Stats) {
 	s.StorageSize += other.StorageSize
 	s.Transferred += other.Transferred
 	s.Errors += other.Errors
+	s.Inaccessible += other.Inaccessible
+	s.Unsupported += other.Unsupported
 }
 
 // SizeToString prettifies sizes.
@@ -59,6 +121,94 @@ func SizeToString(size uint64) (str string) {
 
 // String returns human-readable Stats.
 func (s Stats) String() string {
-	return fmt.Sprintf("%d files, %d dirs, %d symlinks, %d errors, %v Original Size, %v Storage Size",
+	str := fmt.Sprintf("%d files, %d dirs, %d symlinks, %d errors, %v Original Size, %v Storage Size",
 		s.Files, s.Dirs, s.SymLinks, s.Errors, SizeToString(s.Size), SizeToString(s.StorageSize))
+	if s.Inaccessible > 0 {
+		str += fmt.Sprintf(", %d inaccessible", s.Inaccessible)
+	}
+	if s.Unsupported > 0 {
+		str += fmt.Sprintf(", %d unsupported", s.Unsupported)
+	}
+	return str
+}
+
+// CompressionShare holds the data of a snapshot stored with one compression
+// algo. Files counts every file with at least one chunk stored with the algo.
+type CompressionShare struct {
+	Method      uint16
+	Files       uint64
+	Size        uint64
+	StorageSize uint64
+	Share       float64 // fraction of the snapshot's original size
+}
+
+// CompressionDistribution returns how much of a snapshot got stored with
+// each compression algo, largest share first. Snapshots can mix algos, e.g.
+// when files got reused from a parent snapshot stored with another one, or
+// when chunks got stored uncompressed. The storage size of a file gets split
+// among its chunks by their encoded size.
+func (snapshot *Snapshot) CompressionDistribution() ([]CompressionShare, error) {
+	shares := make(map[uint16]*CompressionShare)
+	var total uint64
+	err := snapshot.EachArchive(func(arc *Archive) error {
+		if arc.Type != File {
+			return nil
+		}
+
+		share := func(method uint16) *CompressionShare {
+			share, ok := shares[method]
+			if !ok {
+				share = &CompressionShare{Method: method}
+				shares[method] = share
+			}
+			return share
+		}
+		if len(arc.Chunks) == 0 {
+			share(arc.Compressed).Files++
+		}
+
+		var encoded uint64
+		for _, chunk := range arc.Chunks {
+			encoded += uint64(chunk.Size)
+		}
+		counted := make(map[uint16]bool)
+		remaining := arc.StorageSize
+		for i, chunk := range arc.Chunks {
+			method := chunk.compression(arc)
+			s := share(method)
+			if !counted[method] {
+				s.Files++
+				counted[method] = true
+			}
+			s.Size += uint64(chunk.OriginalSize)
+
+			// the last chunk gets the remainder left by rounding
+			storageSize := remaining
+			if i < len(arc.Chunks)-1 && encoded > 0 {
+				storageSize = arc.StorageSize * uint64(chunk.Size) / encoded
+			}
+			s.StorageSize += storageSize
+			remaining -= storageSize
+		}
+		total += arc.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var distribution []CompressionShare
+	for _, share := range shares {
+		if total > 0 {
+			share.Share = float64(share.Size) / float64(total)
+		}
+		distribution = append(distribution, *share)
+	}
+	sort.Slice(distribution, func(i, j int) bool {
+		if distribution[i].Size != distribution[j].Size {
+			return distribution[i].Size > distribution[j].Size
+		}
+		return distribution[i].Method < distribution[j].Method
+	})
+	return distribution, nil
 }
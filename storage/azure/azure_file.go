@@ -78,6 +78,25 @@ func (*AzureFileStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
 	return &backend, nil
 }
 
+// CredentialsEnv returns the environment variables Azure tools use for
+// storage account credentials.
+func (*AzureFileStorage) CredentialsEnv() (string, string) {
+	return "AZURE_STORAGE_ACCOUNT", "AZURE_STORAGE_KEY"
+}
+
+// NewBackendWithCredentials returns an AzureFileStorage backend connecting with the
+// credentials user, which don't become part of its Location.
+func (backend *AzureFileStorage) NewBackendWithCredentials(u url.URL, user *url.Userinfo) (knoxite.Backend, error) {
+	location := u.User
+	u.User = user
+	b, err := backend.NewBackend(u)
+	if err != nil {
+		return b, err
+	}
+	b.(*AzureFileStorage).url.User = location
+	return b, nil
+}
+
 // Location returns the type and location of the repository.
 func (backend *AzureFileStorage) Location() string {
 	return backend.url.String()
@@ -80,6 +80,25 @@ func (*BackblazeStorage) NewBackend(URL url.URL) (knoxite.Backend, error) {
 	}, nil
 }
 
+// CredentialsEnv returns the environment variables B2 tools use for
+// application keys.
+func (*BackblazeStorage) CredentialsEnv() (string, string) {
+	return "B2_APPLICATION_KEY_ID", "B2_APPLICATION_KEY"
+}
+
+// NewBackendWithCredentials returns a BackblazeStorage backend connecting with the
+// credentials user, which don't become part of its Location.
+func (backend *BackblazeStorage) NewBackendWithCredentials(u url.URL, user *url.Userinfo) (knoxite.Backend, error) {
+	location := u.User
+	u.User = user
+	b, err := backend.NewBackend(u)
+	if err != nil {
+		return b, err
+	}
+	b.(*BackblazeStorage).url.User = location
+	return b, nil
+}
+
 // Location returns the type and location of the repository.
 func (backend *BackblazeStorage) Location() string {
 	return backend.url.String()
@@ -118,6 +137,22 @@ func (backend *BackblazeStorage) LoadChunk(shasum string, part, totalParts uint)
 	return ioutil.ReadAll(obj)
 }
 
+// StatChunk returns the size of a single stored Chunk, without downloading
+// it.
+func (backend *BackblazeStorage) StatChunk(shasum string, part, totalParts uint) (uint64, error) {
+	fileName := shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+
+	files, err := backend.findLatestFileVersion(fileName)
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		return 0, knoxite.ErrLoadChunkFailed
+	}
+
+	return uint64(files[0].Size), nil
+}
+
 // StoreChunk stores a single Chunk on backblaze.
 func (backend *BackblazeStorage) StoreChunk(shasum string, part, totalParts uint, data []byte) (size uint64, err error) {
 	fileName := shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
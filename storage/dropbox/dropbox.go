@@ -51,6 +51,19 @@ func (*DropboxStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
 	return &backend, nil
 }
 
+// NewBackendWithCredentials returns a DropboxStorage backend connecting with the
+// credentials user, which don't become part of its Location.
+func (backend *DropboxStorage) NewBackendWithCredentials(u url.URL, user *url.Userinfo) (knoxite.Backend, error) {
+	location := u.User
+	u.User = user
+	b, err := backend.NewBackend(u)
+	if err != nil {
+		return b, err
+	}
+	b.(*DropboxStorage).url.User = location
+	return b, nil
+}
+
 // Location returns the type and location of the repository.
 func (backend *DropboxStorage) Location() string {
 	return backend.url.String()
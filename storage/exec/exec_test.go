@@ -0,0 +1,96 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package exec
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/knoxite/knoxite"
+)
+
+func TestExecStorageRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a local stand-in for e.g. ssh host 'cat > path'
+	q := url.Values{}
+	q.Set("put", `cat > "$KNOXITE_PATH"`)
+	q.Set("get", `cat "$KNOXITE_PATH"`)
+	q.Set("delete", `rm "$KNOXITE_PATH"`)
+	q.Set("stat", `wc -c < "$KNOXITE_PATH"`)
+	q.Set("mkdir", `mkdir -p "$KNOXITE_PATH"`)
+	u := url.URL{Scheme: "exec", User: url.UserPassword("knoxite", "secret"), Host: "localhost", Path: dir, RawQuery: q.Encode()}
+
+	backend, err := knoxite.BackendFromURL(u.String())
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+	if err := backend.InitRepository(); err != nil {
+		t.Fatalf("Failed initializing repository: %s", err)
+	}
+
+	data := []byte("knoxite")
+	hash := "0123456789abcdef"
+	if _, err := backend.StoreChunk(hash, 1, 1, data); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "chunks", knoxite.SubDirForChunk(hash), hash+".1_1")); err != nil {
+		t.Errorf("Expected chunk to be stored by the put command: %s", err)
+	}
+	b, err := backend.LoadChunk(hash, 1, 1)
+	if err != nil {
+		t.Fatalf("Failed loading chunk: %s", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("Expected %q, got %q", data, b)
+	}
+
+	if err := backend.DeleteChunk(hash, 1, 1); err != nil {
+		t.Fatalf("Failed deleting chunk: %s", err)
+	}
+	if _, err := backend.LoadChunk(hash, 1, 1); err == nil {
+		t.Error("Expected loading a deleted chunk to fail")
+	}
+}
+
+func TestExecStorageSecrets(t *testing.T) {
+	q := url.Values{}
+	q.Set("put", `cat > /dev/null`)
+	q.Set("get", `printf %s "$KNOXITE_USER:$KNOXITE_PASSWORD@$KNOXITE_HOST"`)
+	q.Set("delete", `true`)
+	u := url.URL{Scheme: "exec", User: url.UserPassword("knoxite", "secret"), Host: "remote", Path: "/repo", RawQuery: q.Encode()}
+
+	backend, err := knoxite.BackendFromURL(u.String())
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+
+	// the password is only passed in the environment
+	b, err := backend.LoadRepository()
+	if err != nil {
+		t.Fatalf("Failed running get command: %s", err)
+	}
+	if string(b) != "knoxite:secret@remote" {
+		t.Errorf("Expected credentials in the environment, got %q", b)
+	}
+
+	q.Del("delete")
+	u.RawQuery = q.Encode()
+	if _, err := knoxite.BackendFromURL(u.String()); !errors.Is(err, ErrMissingCommand) {
+		t.Errorf("Expected %v, got %v", ErrMissingCommand, err)
+	}
+}
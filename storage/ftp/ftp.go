@@ -12,8 +12,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/textproto"
 	"net/url"
 	"path/filepath"
 	"strings"
@@ -26,12 +28,28 @@ import (
 
 // FTPStorage stores data on a remote FTP.
 type FTPStorage struct {
-	url   url.URL
-	ftp   *ftp.ServerConn
-	login bool
+	url  url.URL
+	pool *knoxite.ConnectionPool
 	knoxite.StorageFilesystem
 }
 
+// ftpConnection is a single pooled FTP connection.
+type ftpConnection struct {
+	*ftp.ServerConn
+	login bool
+}
+
+// Close logs out and terminates the connection.
+func (c *ftpConnection) Close() error {
+	if c.login {
+		if err := c.Logout(); err != nil {
+			_ = c.Quit()
+			return err
+		}
+	}
+	return c.Quit()
+}
+
 // Error declarations.
 var (
 	ErrInvalidAuthentication = errors.New("Wrong Username or Password")
@@ -49,29 +67,41 @@ func (*FTPStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
 		u.Host = net.JoinHostPort(u.Host, port)
 	}
 
-	// Starting a connection
-	con, err := ftp.DialTimeout(u.Host, 30*time.Second)
-	if err != nil {
-		return &FTPStorage{}, err
-	}
-
-	// Authenticate the client if desired
-	loggedIn := false
-	if u.User != nil && len(u.User.Username()) > 0 {
-		// Doesn't matter if pw exists
-		pw, _ := u.User.Password()
-		err = con.Login(u.User.Username(), pw)
+	dial := func() (io.Closer, error) {
+		// Starting a connection
+		con, err := ftp.DialTimeout(u.Host, 30*time.Second)
 		if err != nil {
-			return &FTPStorage{}, ErrInvalidAuthentication
+			return nil, err
+		}
+
+		// Authenticate the client if desired
+		loggedIn := false
+		if u.User != nil && len(u.User.Username()) > 0 {
+			// Doesn't matter if pw exists
+			pw, _ := u.User.Password()
+			err = con.Login(u.User.Username(), pw)
+			if err != nil {
+				_ = con.Quit()
+				return nil, ErrInvalidAuthentication
+			}
+			loggedIn = true
 		}
-		loggedIn = true
+
+		return &ftpConnection{ServerConn: con, login: loggedIn}, nil
 	}
 
 	backend := FTPStorage{
-		url:   u,
-		ftp:   con,
-		login: loggedIn,
+		url:  u,
+		pool: knoxite.NewConnectionPool(dial),
+	}
+	backend.pool.DiscardOn(brokenConnection)
+
+	// establish the first connection right away, so we can report errors early
+	c, err := backend.pool.Get()
+	if err != nil {
+		return &FTPStorage{}, err
 	}
+	backend.pool.Put(c)
 
 	fs, err := knoxite.NewStorageFilesystem(u.Path, &backend)
 	if err != nil {
@@ -82,6 +112,42 @@ func (*FTPStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
 	return &backend, nil
 }
 
+// brokenConnection returns whether err means that an FTP connection may be
+// broken. Replies of the server, like 550 for a missing file, leave the
+// connection usable, unless it's about to close it.
+func brokenConnection(err error) bool {
+	var reply *textproto.Error
+	return !errors.As(err, &reply) || reply.Code == ftp.StatusNotAvailable
+}
+
+// conn returns a pooled connection, which needs to be handed back with
+// backend.pool.Release.
+func (backend *FTPStorage) conn() (*ftpConnection, error) {
+	c, err := backend.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	return c.(*ftpConnection), nil
+}
+
+// SetOptions applies the connection settings to the connection pool.
+func (backend *FTPStorage) SetOptions(opts knoxite.BackendOptions) {
+	backend.pool.SetOptions(opts)
+}
+
+// NewBackendWithCredentials returns a FTPStorage backend connecting with the
+// credentials user, which don't become part of its Location.
+func (backend *FTPStorage) NewBackendWithCredentials(u url.URL, user *url.Userinfo) (knoxite.Backend, error) {
+	location := u.User
+	u.User = user
+	b, err := backend.NewBackend(u)
+	if err != nil {
+		return b, err
+	}
+	b.(*FTPStorage).url.User = location
+	return b, nil
+}
+
 // Location returns the type and location of the repository.
 func (backend *FTPStorage) Location() string {
 	return backend.url.String()
@@ -89,12 +155,7 @@ func (backend *FTPStorage) Location() string {
 
 // Close the backend.
 func (backend *FTPStorage) Close() error {
-	if backend.login {
-		if err := backend.ftp.Logout(); err != nil {
-			return err
-		}
-	}
-	return backend.ftp.Quit()
+	return backend.pool.Close()
 }
 
 // Protocols returns the Protocol Schemes supported by this backend.
@@ -113,28 +174,46 @@ func (backend *FTPStorage) AvailableSpace() (uint64, error) {
 }
 
 // CreatePath creates a dir including all its parent dirs, when required.
-func (backend *FTPStorage) CreatePath(path string) error {
+func (backend *FTPStorage) CreatePath(path string) (err error) {
+	c, err := backend.conn()
+	if err != nil {
+		return err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
 	slicedPath := strings.Split(path, "/")
 	for i := range slicedPath {
 		if i == 0 {
 			// don't try to create root-dir
 			continue
 		}
-		_ = backend.ftp.MakeDir(filepath.Join(slicedPath[:i+1]...))
+		_ = c.MakeDir(filepath.Join(slicedPath[:i+1]...))
 	}
 
 	return nil
 }
 
 // Stat returns the size of a file on ftp.
-func (backend *FTPStorage) Stat(path string) (uint64, error) {
-	size, err := backend.ftp.FileSize(path)
-	return uint64(size), err
+func (backend *FTPStorage) Stat(path string) (size uint64, err error) {
+	c, err := backend.conn()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
+	n, err := c.FileSize(path)
+	return uint64(n), err
 }
 
 // ReadFile reads a file from ftp.
-func (backend *FTPStorage) ReadFile(path string) ([]byte, error) {
-	file, err := backend.ftp.Retr(path)
+func (backend *FTPStorage) ReadFile(path string) (data []byte, err error) {
+	c, err := backend.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
+	file, err := c.Retr(path)
 	if err != nil {
 		return nil, err
 	}
@@ -145,19 +224,53 @@ func (backend *FTPStorage) ReadFile(path string) ([]byte, error) {
 
 // WriteFile writes file to ftp.
 func (backend *FTPStorage) WriteFile(path string, data []byte) (size uint64, err error) {
-	err = backend.ftp.Stor(path, bytes.NewReader(data))
+	c, err := backend.conn()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
+	err = c.Stor(path, bytes.NewReader(data))
 	return uint64(len(data)), err
 }
 
+// RenameFile renames a file on ftp.
+func (backend *FTPStorage) RenameFile(from, to string) (err error) {
+	c, err := backend.conn()
+	if err != nil {
+		return err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
+	return c.Rename(from, to)
+}
+
 // DeleteFile deletes a file from ftp.
-func (backend *FTPStorage) DeleteFile(path string) error {
-	return backend.ftp.Delete(path)
+func (backend *FTPStorage) DeleteFile(path string) (err error) {
+	c, err := backend.conn()
+	if err != nil {
+		return err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
+	return c.Delete(path)
 }
 
 // DeletePath deletes a directory including all its content from ftp.
 func (backend *FTPStorage) DeletePath(path string) error {
+	c, err := backend.conn()
+	if err != nil {
+		return err
+	}
+	// deletePath changes the working directory, so don't reuse this connection
+	defer backend.pool.Discard(c)
+
+	return deletePath(c, path)
+}
+
+func deletePath(c *ftpConnection, path string) error {
 	fmt.Println("Deleting path", path)
-	list, err := backend.ftp.List("")
+	list, err := c.List("")
 	if err != nil {
 		return err
 	}
@@ -171,26 +284,26 @@ func (backend *FTPStorage) DeletePath(path string) error {
 				continue
 			}
 
-			err = backend.ftp.ChangeDir(l.Name)
+			err = c.ChangeDir(l.Name)
 			if err != nil {
 				return err
 			}
-			err = backend.DeletePath(fpath)
+			err = deletePath(c, fpath)
 			if err != nil {
 				return err
 			}
-			err = backend.ftp.ChangeDirToParent()
+			err = c.ChangeDirToParent()
 			if err != nil {
 				return err
 			}
-			err = backend.ftp.RemoveDir(fpath)
+			err = c.RemoveDir(fpath)
 			if err != nil {
 				return err
 			}
 		}
 
 		if l.Type == ftp.EntryTypeFile {
-			err = backend.ftp.Delete(fpath)
+			err = c.Delete(fpath)
 			if err != nil {
 				return err
 			}
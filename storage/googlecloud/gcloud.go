@@ -100,6 +100,19 @@ func (*GoogleCloudStorage) NewBackend(URL url.URL) (knoxite.Backend, error) {
 	return &backend, nil
 }
 
+// NewBackendWithCredentials returns a GoogleCloudStorage backend connecting with the
+// credentials user, which don't become part of its Location.
+func (backend *GoogleCloudStorage) NewBackendWithCredentials(u url.URL, user *url.Userinfo) (knoxite.Backend, error) {
+	location := u.User
+	u.User = user
+	b, err := backend.NewBackend(u)
+	if err != nil {
+		return b, err
+	}
+	b.(*GoogleCloudStorage).url.User = location
+	return b, nil
+}
+
 // Location returns the type and location of the repository.
 func (backend *GoogleCloudStorage) Location() string {
 	return backend.url.String()
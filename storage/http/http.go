@@ -77,6 +77,22 @@ func (backend *HTTPStorage) LoadChunk(shasum string, part, totalParts uint) ([]b
 	return ioutil.ReadAll(res.Body)
 }
 
+// StatChunk returns the size of a single stored Chunk, without downloading
+// it.
+func (backend *HTTPStorage) StatChunk(shasum string, part, totalParts uint) (uint64, error) {
+	res, err := http.Head(backend.URL.String() + "/download/" + shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.ContentLength < 0 {
+		return 0, knoxite.ErrLoadChunkFailed
+	}
+
+	return uint64(res.ContentLength), nil
+}
+
 // StoreChunk stores a single Chunk on network.
 func (backend *HTTPStorage) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
 	bodyBuf := &bytes.Buffer{}
@@ -62,6 +62,19 @@ func (*MegaStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
 	return &backend, nil
 }
 
+// NewBackendWithCredentials returns a MegaStorage backend connecting with the
+// credentials user, which don't become part of its Location.
+func (backend *MegaStorage) NewBackendWithCredentials(u url.URL, user *url.Userinfo) (knoxite.Backend, error) {
+	location := u.User
+	u.User = user
+	b, err := backend.NewBackend(u)
+	if err != nil {
+		return b, err
+	}
+	b.(*MegaStorage).url.User = location
+	return b, nil
+}
+
 // Location returns the type and location of the repository.
 func (backend *MegaStorage) Location() string {
 	return backend.url.String()
@@ -0,0 +1,54 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package s3
+
+import (
+	"os"
+	"testing"
+
+	"github.com/knoxite/knoxite"
+)
+
+func TestS3Credentials(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "aws-key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "aws-secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	tests := []struct {
+		url       string
+		accessKey string
+		secretKey string
+	}{
+		{"s3://url-key:url-secret@localhost:9000/us-east-1/bucket", "url-key", "url-secret"},
+		{"s3://url-key@localhost:9000/us-east-1/bucket", "url-key", "aws-secret"},
+		{"s3://localhost:9000/us-east-1/bucket", "aws-key", "aws-secret"},
+	}
+
+	for _, tt := range tests {
+		b, err := knoxite.BackendFromURL(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend := b.(*S3Storage)
+		if backend.accessKey != tt.accessKey || backend.secretKey != tt.secretKey {
+			t.Errorf("%s: expected credentials %s:%s, got %s:%s",
+				tt.url, tt.accessKey, tt.secretKey, backend.accessKey, backend.secretKey)
+		}
+	}
+
+	os.Setenv("KNOXITE_S3_USERNAME", "knoxite-key")
+	defer os.Unsetenv("KNOXITE_S3_USERNAME")
+	b, err := knoxite.BackendFromURL("s3://localhost:9000/us-east-1/bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend := b.(*S3Storage); backend.accessKey != "knoxite-key" || backend.secretKey != "aws-secret" {
+		t.Errorf("Expected credentials knoxite-key:aws-secret, got %s:%s", backend.accessKey, backend.secretKey)
+	}
+}
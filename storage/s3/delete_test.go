@@ -0,0 +1,89 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/knoxite/knoxite"
+)
+
+func TestStorageBatchDelete(t *testing.T) {
+	mock := &mockS3{puts: make(map[string]http.Header)}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	backendURL, _ := url.Parse("s3://key:secret@" + u.Host + "/us-east-1/test")
+	backend, err := (&S3Storage{}).NewBackend(*backendURL)
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+
+	var parts []knoxite.ChunkPart
+	for i := 0; i < 1500; i++ {
+		hash := fmt.Sprintf("%016x", i)
+		if i == 42 {
+			hash = "denied"
+		}
+		if _, err := backend.StoreChunk(hash, 0, 1, []byte("data")); err != nil {
+			t.Fatalf("Failed storing chunk: %s", err)
+		}
+		parts = append(parts, knoxite.ChunkPart{Hash: hash, Part: 0, TotalParts: 1})
+	}
+
+	failed, err := backend.(knoxite.BatchDeleter).BatchDelete(parts)
+	if err == nil || len(failed) != 1 || failed[0].Hash != "denied" {
+		t.Errorf("Expected only the denied chunk to fail, got %v: %v", failed, err)
+	}
+
+	if len(mock.deletes) != 2 || len(mock.deletes[0]) != 1000 || len(mock.deletes[1]) != 500 {
+		t.Errorf("Expected 2 batched delete requests, got %d", len(mock.deletes))
+	}
+	if len(mock.puts) != 1 {
+		t.Errorf("Expected only the denied chunk to remain, got %d objects", len(mock.puts))
+	}
+	if _, ok := mock.puts["/test-chunks/denied.0_1"]; !ok {
+		t.Error("Expected the denied chunk to remain")
+	}
+}
+
+func TestStorageBatchDeletePrefix(t *testing.T) {
+	mock := &mockS3{puts: make(map[string]http.Header)}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	backends := make(map[string]knoxite.Backend)
+	for _, prefix := range []string{"first", "second"} {
+		backend, err := knoxite.BackendFromURLWithOptions("s3://key:secret@"+u.Host+"/us-east-1/test", knoxite.BackendOptions{Prefix: prefix})
+		if err != nil {
+			t.Fatalf("Failed creating backend: %s", err)
+		}
+		if _, err := backend.StoreChunk("0123456789abcdef", 0, 1, []byte("data")); err != nil {
+			t.Fatalf("Failed storing chunk: %s", err)
+		}
+		backends[prefix] = backend
+	}
+
+	parts := []knoxite.ChunkPart{{Hash: "0123456789abcdef", Part: 0, TotalParts: 1}}
+	if failed, err := backends["first"].(knoxite.BatchDeleter).BatchDelete(parts); err != nil || len(failed) > 0 {
+		t.Fatalf("Failed deleting chunk: %v", err)
+	}
+
+	if _, ok := mock.puts["/test-chunks/first/0123456789abcdef.0_1"]; ok {
+		t.Error("Expected the chunk below the first prefix to be deleted")
+	}
+	if _, ok := mock.puts["/test-chunks/second/0123456789abcdef.0_1"]; !ok {
+		t.Errorf("Expected the chunk below the second prefix to remain, got %v", mock.puts)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package s3
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knoxite/knoxite"
+)
+
+// mockS3 records the headers and sizes of all objects put into it and of
+// the multipart uploads started, as well as the batches of multi-object
+// delete requests. Objects with "denied" in their name can't be deleted.
+type mockS3 struct {
+	sync.Mutex
+	puts    map[string]http.Header
+	sizes   map[string]int64
+	uploads map[string]http.Header
+	deletes [][]string
+}
+
+// mockDelete is the body of a multi-object delete request.
+type mockDelete struct {
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+func (m *mockS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Query().Get("location") != "" || r.URL.RawQuery == "location=":
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><LocationConstraint>us-east-1</LocationConstraint>`))
+	case r.Method == http.MethodHead:
+		m.Lock()
+		size, ok := m.sizes[r.URL.Path]
+		m.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	case r.Method == http.MethodPost && strings.Contains(r.URL.RawQuery, "delete"):
+		var req mockDelete
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		m.Lock()
+		var batch []string
+		res := `<?xml version="1.0" encoding="UTF-8"?><DeleteResult>`
+		for _, o := range req.Objects {
+			batch = append(batch, o.Key)
+			if strings.Contains(o.Key, "denied") {
+				res += "<Error><Key>" + o.Key + "</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>"
+				continue
+			}
+			delete(m.puts, r.URL.Path+o.Key)
+			delete(m.sizes, r.URL.Path+o.Key)
+		}
+		m.deletes = append(m.deletes, batch)
+		m.Unlock()
+
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(res + "</DeleteResult>"))
+	case r.Method == http.MethodPost && strings.Contains(r.URL.RawQuery, "uploads"):
+		m.Lock()
+		m.uploads[r.URL.Path] = r.Header
+		m.Unlock()
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`))
+	case r.Method == http.MethodPut:
+		m.Lock()
+		m.puts[r.URL.Path] = r.Header
+		if m.sizes == nil {
+			m.sizes = make(map[string]int64)
+		}
+		m.sizes[r.URL.Path] = r.ContentLength
+		if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+			// streaming uploads carry chunk signatures in their body
+			m.sizes[r.URL.Path], _ = strconv.ParseInt(decoded, 10, 64)
+		}
+		m.Unlock()
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestStorageObjectOptions(t *testing.T) {
+	mock := &mockS3{puts: make(map[string]http.Header)}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	backendURL, _ := url.Parse("s3://key:secret@" + u.Host + "/us-east-1/test")
+	backend, err := (&S3Storage{}).NewBackend(*backendURL)
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+
+	backend.(knoxite.ConfigurableBackend).SetOptions(knoxite.BackendOptions{
+		ObjectTags:      map[string]string{"tier": "cold", "app": "knoxite"},
+		ObjectRetention: 24 * time.Hour,
+	})
+	if _, err := backend.StoreChunk("0123456789abcdef", 0, 1, []byte("data")); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+
+	header, ok := mock.puts["/test-chunks/0123456789abcdef.0_1"]
+	if !ok {
+		t.Fatalf("Expected chunk to be put, got %v", mock.puts)
+	}
+	if tags := header.Get("X-Amz-Tagging"); tags != "app=knoxite&tier=cold" {
+		t.Errorf("Expected tagging header, got %q", tags)
+	}
+	if mode := header.Get("X-Amz-Object-Lock-Mode"); mode != "GOVERNANCE" {
+		t.Errorf("Expected object lock mode header, got %q", mode)
+	}
+	if auth := header.Get("Authorization"); !strings.Contains(auth, "x-amz-object-lock-mode") || !strings.Contains(auth, "x-amz-tagging") {
+		t.Errorf("Expected object headers to be signed, got %q", auth)
+	}
+	until, err := time.Parse(time.RFC3339, header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	if err != nil || until.Before(time.Now().Add(23*time.Hour)) {
+		t.Errorf("Expected retention of 24h, got %q", header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	}
+}
+
+func TestStorageMultipartObjectOptions(t *testing.T) {
+	mock := &mockS3{puts: make(map[string]http.Header), uploads: make(map[string]http.Header)}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	backendURL, _ := url.Parse("s3://key:secret@" + u.Host + "/us-east-1/test")
+	backend, err := (&S3Storage{}).NewBackend(*backendURL)
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+
+	backend.(knoxite.ConfigurableBackend).SetOptions(knoxite.BackendOptions{
+		ObjectTags:      map[string]string{"tier": "cold"},
+		ObjectRetention: 24 * time.Hour,
+	})
+	upload := &knoxite.MultipartUpload{Hash: "0123456789abcdef", Part: 0, TotalParts: 1}
+	if err := backend.(knoxite.MultipartUploader).BeginUpload(upload); err != nil {
+		t.Fatalf("Failed beginning upload: %s", err)
+	}
+	if upload.ID != "upload-1" {
+		t.Errorf("Expected upload ID upload-1, got %q", upload.ID)
+	}
+
+	header, ok := mock.uploads["/test-chunks/0123456789abcdef.0_1"]
+	if !ok {
+		t.Fatalf("Expected multipart upload to be started, got %v", mock.uploads)
+	}
+	if tags := header.Get("X-Amz-Tagging"); tags != "tier=cold" {
+		t.Errorf("Expected tagging header, got %q", tags)
+	}
+	if mode := header.Get("X-Amz-Object-Lock-Mode"); mode != "GOVERNANCE" {
+		t.Errorf("Expected object lock mode header, got %q", mode)
+	}
+	if header.Get("X-Amz-Object-Lock-Retain-Until-Date") == "" {
+		t.Error("Expected object lock retention header")
+	}
+	for k := range header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			t.Errorf("Expected object headers not to be sent as user metadata, got %s", k)
+		}
+	}
+}
+
+func TestStorageStatChunk(t *testing.T) {
+	mock := &mockS3{puts: make(map[string]http.Header)}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	backendURL, _ := url.Parse("s3://key:secret@" + u.Host + "/us-east-1/test")
+	backend, err := (&S3Storage{}).NewBackend(*backendURL)
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+
+	if _, err := backend.StoreChunk("0123456789abcdef", 0, 1, []byte("data")); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+
+	cs := backend.(knoxite.ChunkStater)
+	n, err := cs.StatChunk("0123456789abcdef", 0, 1)
+	if err != nil {
+		t.Fatalf("Failed stating chunk: %s", err)
+	}
+	if n != 4 {
+		t.Errorf("Expected chunk size of 4 bytes, got %d", n)
+	}
+	if _, err := cs.StatChunk("fedcba9876543210", 0, 1); err == nil {
+		t.Error("Expected stating a missing chunk to fail")
+	}
+}
@@ -10,14 +10,21 @@ package s3
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
 	"errors"
 	"io/ioutil"
+	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/s3signer"
 
 	"github.com/knoxite/knoxite"
 )
@@ -30,13 +37,28 @@ type S3Storage struct {
 	repositoryBucket string
 	region           string
 	client           *minio.Client
+	ssl              bool
+	accessKey        string
+	secretKey        string
+	prefix           string
+
+	tags      map[string]string
+	retention time.Duration
 }
 
+const (
+	// multipartPieceSize is the size of the pieces of multipart uploads
+	multipartPieceSize = 5 << 20
+	// previousSuffix gets appended to the name of the previous generation
+	// of the chunk-index
+	previousSuffix = ".previous"
+)
+
 func init() {
 	knoxite.RegisterStorageBackend(&S3Storage{})
 }
 
-// NewBackend returns a S3Storage backend.
+// NewBackend returns an S3Storage backend.
 func (*S3Storage) NewBackend(URL url.URL) (knoxite.Backend, error) {
 	var ssl bool
 	switch URL.Scheme {
@@ -54,16 +76,10 @@ func (*S3Storage) NewBackend(URL url.URL) (knoxite.Backend, error) {
 		pw, _ = URL.User.Password()
 	}
 	if len(username) == 0 {
-		username = os.Getenv("AWS_ACCESS_KEY_ID")
-		if len(username) == 0 {
-			return &S3Storage{}, knoxite.ErrInvalidUsername
-		}
+		return &S3Storage{}, knoxite.ErrInvalidUsername
 	}
 	if len(pw) == 0 {
-		pw = os.Getenv("AWS_SECRET_ACCESS_KEY")
-		if len(pw) == 0 {
-			return &S3Storage{}, knoxite.ErrInvalidPassword
-		}
+		return &S3Storage{}, knoxite.ErrInvalidPassword
 	}
 
 	regionAndBucketPrefix := strings.Split(URL.Path, "/")
@@ -78,6 +94,9 @@ func (*S3Storage) NewBackend(URL url.URL) (knoxite.Backend, error) {
 
 	return &S3Storage{url: URL,
 		client:           cl,
+		ssl:              ssl,
+		accessKey:        username,
+		secretKey:        pw,
 		region:           regionAndBucketPrefix[1],
 		chunkBucket:      regionAndBucketPrefix[2] + "-chunks",
 		snapshotBucket:   regionAndBucketPrefix[2] + "-snapshots",
@@ -85,11 +104,139 @@ func (*S3Storage) NewBackend(URL url.URL) (knoxite.Backend, error) {
 	}, nil
 }
 
+// CredentialsEnv returns the environment variables AWS tools use for
+// credentials.
+func (*S3Storage) CredentialsEnv() (string, string) {
+	return "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"
+}
+
+// NewBackendWithCredentials returns an S3Storage backend connecting with the
+// credentials user, which don't become part of its Location.
+func (backend *S3Storage) NewBackendWithCredentials(u url.URL, user *url.Userinfo) (knoxite.Backend, error) {
+	location := u.User
+	u.User = user
+	b, err := backend.NewBackend(u)
+	if err != nil {
+		return b, err
+	}
+	b.(*S3Storage).url.User = location
+	return b, nil
+}
+
 // Location returns the type and location of the repository.
 func (backend *S3Storage) Location() string {
 	return backend.url.String()
 }
 
+// SetOptions applies the object tags & retention period used for chunks.
+func (backend *S3Storage) SetOptions(opts knoxite.BackendOptions) {
+	backend.tags = opts.ObjectTags
+	backend.retention = opts.ObjectRetention
+}
+
+// SetPrefix stores all objects below prefix, so the buckets can be shared
+// with other repositories.
+func (backend *S3Storage) SetPrefix(prefix string) {
+	backend.prefix = strings.Trim(prefix, "/")
+	if backend.prefix != "" {
+		backend.prefix += "/"
+	}
+}
+
+// objectName returns the name of the object stored as name.
+func (backend *S3Storage) objectName(name string) string {
+	return backend.prefix + name
+}
+
+// objectHeaders returns the headers carrying the configured object tags &
+// retention period.
+func (backend *S3Storage) objectHeaders() map[string]string {
+	headers := make(map[string]string)
+	if len(backend.tags) > 0 {
+		tags := url.Values{}
+		for k, v := range backend.tags {
+			tags.Set(k, v)
+		}
+		headers["X-Amz-Tagging"] = tags.Encode()
+	}
+	if backend.retention > 0 {
+		headers["X-Amz-Object-Lock-Mode"] = "GOVERNANCE"
+		headers["X-Amz-Object-Lock-Retain-Until-Date"] = time.Now().Add(backend.retention).UTC().Format(time.RFC3339)
+	}
+
+	return headers
+}
+
+// putObjectWithHeaders stores data with a plain signed PUT request carrying
+// the object headers, which the minio client can't send.
+func (backend *S3Storage) putObjectWithHeaders(bucket, name string, data []byte) error {
+	resp, err := backend.requestWithHeaders(http.MethodPut, bucket, name, "", data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// newMultipartUploadWithHeaders starts a multipart upload with a plain signed
+// POST request carrying the object headers, which the minio client would
+// send as user metadata instead.
+func (backend *S3Storage) newMultipartUploadWithHeaders(bucket, name string) (string, error) {
+	resp, err := backend.requestWithHeaders(http.MethodPost, bucket, name, "uploads", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// requestWithHeaders sends a signed request for the object name, carrying
+// the object headers and data. It returns the response if it succeeded.
+func (backend *S3Storage) requestWithHeaders(method, bucket, name, query string, data []byte) (*http.Response, error) {
+	scheme := "http"
+	if backend.ssl {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: backend.url.Host, Path: "/" + bucket + "/" + name, RawQuery: query}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	md5sum := md5.Sum(data)
+	shasum := sha256.Sum256(data)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if data != nil {
+		req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(md5sum[:]))
+	}
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(shasum[:]))
+	for k, v := range backend.objectHeaders() {
+		req.Header.Set(k, v)
+	}
+	req = s3signer.SignV4(*req, backend.accessKey, backend.secretKey, "", backend.region)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		errResp := minio.ErrorResponse{}
+		if err := xml.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Code == "" {
+			return nil, errors.New(resp.Status)
+		}
+		return nil, errResp
+	}
+	return resp, nil
+}
+
 // Close the backend.
 func (backend *S3Storage) Close() error {
 	return nil
@@ -112,7 +259,7 @@ func (backend *S3Storage) AvailableSpace() (uint64, error) {
 
 // LoadChunk loads a Chunk from network.
 func (backend *S3Storage) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
-	fileName := shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+	fileName := backend.objectName(shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10))
 	obj, err := backend.client.GetObject(backend.chunkBucket, fileName, minio.GetObjectOptions{})
 	if err != nil {
 		return nil, err
@@ -122,9 +269,41 @@ func (backend *S3Storage) LoadChunk(shasum string, part, totalParts uint) ([]byt
 	return ioutil.ReadAll(obj)
 }
 
+// LoadChunkRange loads length bytes at offset of a Chunk from network.
+func (backend *S3Storage) LoadChunkRange(shasum string, part, totalParts uint, offset, length uint64) ([]byte, error) {
+	if length == 0 {
+		return []byte{}, nil
+	}
+
+	fileName := backend.objectName(shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10))
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(int64(offset), int64(offset+length-1)); err != nil {
+		return nil, err
+	}
+	obj, err := backend.client.GetObject(backend.chunkBucket, fileName, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	return ioutil.ReadAll(obj)
+}
+
+// StatChunk returns the size of a single stored Chunk, without downloading
+// it.
+func (backend *S3Storage) StatChunk(shasum string, part, totalParts uint) (uint64, error) {
+	fileName := backend.objectName(shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10))
+	info, err := backend.client.StatObject(backend.chunkBucket, fileName, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(info.Size), nil
+}
+
 // StoreChunk stores a single Chunk on network.
 func (backend *S3Storage) StoreChunk(shasum string, part, totalParts uint, data []byte) (size uint64, err error) {
-	fileName := shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+	fileName := backend.objectName(shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10))
 
 	if _, err = backend.client.StatObject(backend.chunkBucket, fileName, minio.StatObjectOptions{}); err == nil {
 		// Chunk is already stored
@@ -132,13 +311,83 @@ func (backend *S3Storage) StoreChunk(shasum string, part, totalParts uint, data
 	}
 
 	buf := bytes.NewBuffer(data)
+	if len(backend.tags) > 0 || backend.retention > 0 {
+		err = backend.putObjectWithHeaders(backend.chunkBucket, fileName, data)
+		return uint64(len(data)), err
+	}
+
 	i, err := backend.client.PutObject(backend.chunkBucket, fileName, buf, int64(buf.Len()), minio.PutObjectOptions{ContentType: "application/octet-stream"})
 	return uint64(i), err
 }
 
+// MultipartPieceSize returns the size of the pieces chunks larger than it
+// get uploaded in, the minimum S3 allows.
+func (backend *S3Storage) MultipartPieceSize() int {
+	return multipartPieceSize
+}
+
+// BeginUpload starts a multipart upload of a chunk, unless it's already
+// stored.
+func (backend *S3Storage) BeginUpload(upload *knoxite.MultipartUpload) error {
+	fileName := backend.objectName(upload.Hash + "." + strconv.FormatUint(uint64(upload.Part), 10) + "_" + strconv.FormatUint(uint64(upload.TotalParts), 10))
+
+	if _, err := backend.client.StatObject(backend.chunkBucket, fileName, minio.StatObjectOptions{}); err == nil {
+		// Chunk is already stored
+		upload.Exists = true
+		return nil
+	}
+
+	var id string
+	var err error
+	if len(backend.tags) > 0 || backend.retention > 0 {
+		id, err = backend.newMultipartUploadWithHeaders(backend.chunkBucket, fileName)
+	} else {
+		core := minio.Core{Client: backend.client}
+		id, err = core.NewMultipartUpload(backend.chunkBucket, fileName, minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	}
+	upload.ID = id
+	return err
+}
+
+// UploadPiece uploads a piece of a chunk.
+func (backend *S3Storage) UploadPiece(upload *knoxite.MultipartUpload, number int, data []byte) (knoxite.UploadedPiece, error) {
+	fileName := backend.objectName(upload.Hash + "." + strconv.FormatUint(uint64(upload.Part), 10) + "_" + strconv.FormatUint(uint64(upload.TotalParts), 10))
+
+	md5sum := md5.Sum(data)
+	shasum := sha256.Sum256(data)
+	core := minio.Core{Client: backend.client}
+	part, err := core.PutObjectPart(backend.chunkBucket, fileName, upload.ID, number, bytes.NewReader(data), int64(len(data)),
+		base64.StdEncoding.EncodeToString(md5sum[:]), hex.EncodeToString(shasum[:]), nil)
+	if err != nil {
+		return knoxite.UploadedPiece{}, err
+	}
+	return knoxite.UploadedPiece{Number: part.PartNumber, ETag: part.ETag}, nil
+}
+
+// CompleteUpload assembles the uploaded pieces of a chunk.
+func (backend *S3Storage) CompleteUpload(upload *knoxite.MultipartUpload) error {
+	fileName := backend.objectName(upload.Hash + "." + strconv.FormatUint(uint64(upload.Part), 10) + "_" + strconv.FormatUint(uint64(upload.TotalParts), 10))
+
+	var parts []minio.CompletePart
+	for _, piece := range upload.Pieces {
+		parts = append(parts, minio.CompletePart{PartNumber: piece.Number, ETag: piece.ETag})
+	}
+	core := minio.Core{Client: backend.client}
+	_, err := core.CompleteMultipartUpload(backend.chunkBucket, fileName, upload.ID, parts)
+	return err
+}
+
+// AbortUpload discards the uploaded pieces of a chunk.
+func (backend *S3Storage) AbortUpload(upload *knoxite.MultipartUpload) error {
+	fileName := backend.objectName(upload.Hash + "." + strconv.FormatUint(uint64(upload.Part), 10) + "_" + strconv.FormatUint(uint64(upload.TotalParts), 10))
+
+	core := minio.Core{Client: backend.client}
+	return core.AbortMultipartUpload(backend.chunkBucket, fileName, upload.ID)
+}
+
 // DeleteChunk deletes a single Chunk.
 func (backend *S3Storage) DeleteChunk(shasum string, part, totalParts uint) error {
-	fileName := shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+	fileName := backend.objectName(shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10))
 
 	err := backend.client.RemoveObject(backend.chunkBucket, fileName)
 	if err != nil {
@@ -148,9 +397,42 @@ func (backend *S3Storage) DeleteChunk(shasum string, part, totalParts uint) erro
 	return nil
 }
 
+// BatchDelete deletes many chunks using multi-object delete requests of up
+// to 1000 objects each.
+func (backend *S3Storage) BatchDelete(parts []knoxite.ChunkPart) ([]knoxite.ChunkPart, error) {
+	names := make(map[string]knoxite.ChunkPart)
+	objects := make(chan string, len(parts))
+	for _, p := range parts {
+		fileName := backend.objectName(p.Hash + "." + strconv.FormatUint(uint64(p.Part), 10) + "_" + strconv.FormatUint(uint64(p.TotalParts), 10))
+		names[fileName] = p
+		objects <- fileName
+	}
+	close(objects)
+
+	var failed []knoxite.ChunkPart
+	var err error
+	requestFailed := false
+	for rerr := range backend.client.RemoveObjects(backend.chunkBucket, objects) {
+		if err == nil {
+			err = rerr.Err
+		}
+		if p, ok := names[rerr.ObjectName]; ok {
+			failed = append(failed, p)
+		} else {
+			// an entire request failed, without naming its objects
+			requestFailed = true
+		}
+	}
+
+	if requestFailed {
+		return parts, err
+	}
+	return failed, err
+}
+
 // LoadSnapshot loads a snapshot.
 func (backend *S3Storage) LoadSnapshot(id string) ([]byte, error) {
-	obj, err := backend.client.GetObject(backend.snapshotBucket, id, minio.GetObjectOptions{})
+	obj, err := backend.client.GetObject(backend.snapshotBucket, backend.objectName(id), minio.GetObjectOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -162,13 +444,13 @@ func (backend *S3Storage) LoadSnapshot(id string) ([]byte, error) {
 // SaveSnapshot stores a snapshot.
 func (backend *S3Storage) SaveSnapshot(id string, data []byte) error {
 	buf := bytes.NewBuffer(data)
-	_, err := backend.client.PutObject(backend.snapshotBucket, id, buf, int64(buf.Len()), minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	_, err := backend.client.PutObject(backend.snapshotBucket, backend.objectName(id), buf, int64(buf.Len()), minio.PutObjectOptions{ContentType: "application/octet-stream"})
 	return err
 }
 
 // LoadChunkIndex reads the chunk-index.
 func (backend *S3Storage) LoadChunkIndex() ([]byte, error) {
-	obj, err := backend.client.GetObject(backend.chunkBucket, knoxite.ChunkIndexFilename, minio.GetObjectOptions{})
+	obj, err := backend.client.GetObject(backend.chunkBucket, backend.objectName(knoxite.ChunkIndexFilename), minio.GetObjectOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -180,57 +462,65 @@ func (backend *S3Storage) LoadChunkIndex() ([]byte, error) {
 // SaveChunkIndex stores the chunk-index.
 func (backend *S3Storage) SaveChunkIndex(data []byte) error {
 	buf := bytes.NewBuffer(data)
-	_, err := backend.client.PutObject(backend.chunkBucket, knoxite.ChunkIndexFilename, buf, int64(buf.Len()), minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	_, err := backend.client.PutObject(backend.chunkBucket, backend.objectName(knoxite.ChunkIndexFilename), buf, int64(buf.Len()), minio.PutObjectOptions{ContentType: "application/octet-stream"})
 	return err
 }
 
-// InitRepository creates a new repository.
-func (backend *S3Storage) InitRepository() error {
-	chunkBucketExist, err := backend.client.BucketExists(backend.chunkBucket)
+// RotateChunkIndex keeps a copy of the chunk-index as its previous
+// generation, copied on the server.
+func (backend *S3Storage) RotateChunkIndex() error {
+	name := backend.objectName(knoxite.ChunkIndexFilename)
+	src := minio.NewSourceInfo(backend.chunkBucket, name, nil)
+	dst, err := minio.NewDestinationInfo(backend.chunkBucket, name+previousSuffix, nil, nil)
 	if err != nil {
 		return err
 	}
-	if !chunkBucketExist {
-		err = backend.client.MakeBucket(backend.chunkBucket, backend.region)
-		if err != nil {
-			return err
-		}
-	} else {
-		return knoxite.ErrRepositoryExists
-	}
+	return backend.client.CopyObject(dst, src)
+}
 
-	snapshotBucketExist, err := backend.client.BucketExists(backend.snapshotBucket)
+// LoadPreviousChunkIndex reads the previous generation of the chunk-index.
+func (backend *S3Storage) LoadPreviousChunkIndex() ([]byte, error) {
+	obj, err := backend.client.GetObject(backend.chunkBucket, backend.objectName(knoxite.ChunkIndexFilename+previousSuffix), minio.GetObjectOptions{})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if !snapshotBucketExist {
-		err = backend.client.MakeBucket(backend.snapshotBucket, backend.region)
+	defer obj.Close()
+
+	return ioutil.ReadAll(obj)
+}
+
+// InitRepository creates a new repository. Repositories stored below a
+// prefix share their buckets, which only get created if they don't exist yet.
+func (backend *S3Storage) InitRepository() error {
+	for _, bucket := range []string{backend.chunkBucket, backend.snapshotBucket, backend.repositoryBucket} {
+		exists, err := backend.client.BucketExists(bucket)
 		if err != nil {
 			return err
 		}
-	} else {
-		return knoxite.ErrRepositoryExists
-	}
+		if exists {
+			if backend.prefix == "" {
+				return knoxite.ErrRepositoryExists
+			}
+			continue
+		}
 
-	repositoryBucketExist, err := backend.client.BucketExists(backend.repositoryBucket)
-	if err != nil {
-		return err
-	}
-	if !repositoryBucketExist {
-		err = backend.client.MakeBucket(backend.repositoryBucket, backend.region)
+		err = backend.client.MakeBucket(bucket, backend.region)
 		if err != nil {
 			return err
 		}
-	} else {
-		return knoxite.ErrRepositoryExists
 	}
 
+	if backend.prefix != "" {
+		if _, err := backend.client.StatObject(backend.repositoryBucket, backend.objectName(knoxite.RepoFilename), minio.StatObjectOptions{}); err == nil {
+			return knoxite.ErrRepositoryExists
+		}
+	}
 	return nil
 }
 
 // LoadRepository reads the metadata for a repository.
 func (backend *S3Storage) LoadRepository() ([]byte, error) {
-	obj, err := backend.client.GetObject(backend.repositoryBucket, knoxite.RepoFilename, minio.GetObjectOptions{})
+	obj, err := backend.client.GetObject(backend.repositoryBucket, backend.objectName(knoxite.RepoFilename), minio.GetObjectOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -242,6 +532,6 @@ func (backend *S3Storage) LoadRepository() ([]byte, error) {
 // SaveRepository stores the metadata for a repository.
 func (backend *S3Storage) SaveRepository(data []byte) error {
 	buf := bytes.NewBuffer(data)
-	_, err := backend.client.PutObject(backend.repositoryBucket, knoxite.RepoFilename, buf, int64(buf.Len()), minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	_, err := backend.client.PutObject(backend.repositoryBucket, backend.objectName(knoxite.RepoFilename), buf, int64(buf.Len()), minio.PutObjectOptions{ContentType: "application/octet-stream"})
 	return err
 }
@@ -0,0 +1,73 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// mockServer serves an in-memory filesystem over SFTP and counts the
+// connections opened to it.
+func mockServer(t *testing.T) (func() (io.Closer, error), *int32) {
+	var opened int32
+	handlers := sftp.InMemHandler()
+
+	dial := func() (io.Closer, error) {
+		atomic.AddInt32(&opened, 1)
+
+		client, server := net.Pipe()
+		go func() {
+			_ = sftp.NewRequestServer(server, handlers).Serve()
+		}()
+
+		c, err := sftp.NewClientPipe(client, client)
+		if err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+		return &sftpConnection{ssh: client, sftp: c}, nil
+	}
+
+	return dial, &opened
+}
+
+func TestStoragePooledConnections(t *testing.T) {
+	dial, opened := mockServer(t)
+	backend, err := newSFTPStorage(url.URL{Scheme: "sftp", Host: "mock", Path: "/repo"}, dial)
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+	defer backend.Close()
+
+	// every new chunk gets stat'ed first, which fails as it doesn't exist yet
+	for i := 0; i < 32; i++ {
+		data := []byte(strconv.Itoa(i))
+		if _, err := backend.StoreChunk("chunk"+strconv.Itoa(i), 0, 1, data); err != nil {
+			t.Fatalf("Failed storing chunk: %s", err)
+		}
+		b, err := backend.LoadChunk("chunk"+strconv.Itoa(i), 0, 1)
+		if err != nil || !bytes.Equal(b, data) {
+			t.Fatalf("Failed loading chunk: %v", err)
+		}
+	}
+	if _, err := backend.LoadChunk("missing", 0, 1); err == nil {
+		t.Error("Expected loading a missing chunk to fail")
+	}
+
+	if n := atomic.LoadInt32(opened); n != 1 {
+		t.Errorf("Expected a single connection to be reused, got %d connections", n)
+	}
+}
@@ -9,6 +9,8 @@
 package sftp
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/url"
@@ -26,11 +28,21 @@ import (
 
 type SFTPStorage struct {
 	url  url.URL
-	ssh  *ssh.Client
-	sftp *sftp.Client
+	pool *knoxite.ConnectionPool
 	knoxite.StorageFilesystem
 }
 
+// sftpConnection is a single pooled SSH/SFTP connection.
+type sftpConnection struct {
+	ssh  io.Closer // the SSH connection carrying the SFTP session
+	sftp *sftp.Client
+}
+
+func (c *sftpConnection) Close() error {
+	_ = c.sftp.Close()
+	return c.ssh.Close()
+}
+
 func init() {
 	knoxite.RegisterStorageBackend(&SFTPStorage{})
 }
@@ -72,21 +84,39 @@ func (*SFTPStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
 		HostKeyCallback: hostKeyCallback,
 	}
 
-	conn, err := ssh.Dial("tcp", u.Hostname()+":"+u.Port(), config)
-	if err != nil {
-		return &SFTPStorage{}, err
-	}
+	dial := func() (io.Closer, error) {
+		conn, err := ssh.Dial("tcp", u.Hostname()+":"+u.Port(), config)
+		if err != nil {
+			return nil, err
+		}
 
-	client, err := sftp.NewClient(conn)
-	if err != nil {
-		return &SFTPStorage{}, err
+		client, err := sftp.NewClient(conn)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+
+		return &sftpConnection{ssh: conn, sftp: client}, nil
 	}
 
+	return newSFTPStorage(u, dial)
+}
+
+// newSFTPStorage returns a SFTPStorage backend, which calls dial to establish
+// new connections.
+func newSFTPStorage(u url.URL, dial func() (io.Closer, error)) (*SFTPStorage, error) {
 	backend := SFTPStorage{
 		url:  u,
-		sftp: client,
-		ssh:  conn,
+		pool: knoxite.NewConnectionPool(dial),
 	}
+	backend.pool.DiscardOn(brokenConnection)
+
+	// establish the first connection right away, so we can report errors early
+	c, err := backend.pool.Get()
+	if err != nil {
+		return &SFTPStorage{}, err
+	}
+	backend.pool.Put(c)
 
 	fs, err := knoxite.NewStorageFilesystem(u.Path, &backend)
 	if err != nil {
@@ -97,56 +127,128 @@ func (*SFTPStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
 	return &backend, nil
 }
 
+// brokenConnection returns whether err means that an SFTP connection may be
+// broken. Status replies of the server, like for a missing file, leave the
+// connection usable.
+func brokenConnection(err error) bool {
+	var status *sftp.StatusError
+	return !errors.Is(err, os.ErrNotExist) && !errors.As(err, &status)
+}
+
+// conn returns a pooled connection, which needs to be handed back with
+// backend.pool.Release.
+func (backend *SFTPStorage) conn() (*sftpConnection, error) {
+	c, err := backend.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	return c.(*sftpConnection), nil
+}
+
+func (backend *SFTPStorage) SetOptions(opts knoxite.BackendOptions) {
+	backend.pool.SetOptions(opts)
+}
+
 func (backend *SFTPStorage) Protocols() []string {
 	return []string{"sftp"}
 }
 
 func (backend *SFTPStorage) AvailableSpace() (uint64, error) {
-	stat, err := backend.sftp.StatVFS(backend.url.Path)
+	c, err := backend.conn()
+	if err != nil {
+		return 0, err
+	}
+
+	stat, err := c.sftp.StatVFS(backend.url.Path)
+	backend.pool.Release(c, err)
 	if err != nil || stat == nil {
 		return 0, knoxite.ErrAvailableSpaceUnknown
 	}
 
-	return stat.FreeSpace(), err
+	return stat.FreeSpace(), nil
 }
 
 func (backend *SFTPStorage) Close() error {
-	return backend.sftp.Close()
+	return backend.pool.Close()
 }
 
 func (backend *SFTPStorage) Description() string {
 	return "SSH/SFTP Storage"
 }
 
+// NewBackendWithCredentials returns a SFTPStorage backend connecting with the
+// credentials user, which don't become part of its Location.
+func (backend *SFTPStorage) NewBackendWithCredentials(u url.URL, user *url.Userinfo) (knoxite.Backend, error) {
+	location := u.User
+	u.User = user
+	b, err := backend.NewBackend(u)
+	if err != nil {
+		return b, err
+	}
+	b.(*SFTPStorage).url.User = location
+	return b, nil
+}
+
 func (backend *SFTPStorage) Location() string {
 	return backend.url.String()
 }
 
-func (backend *SFTPStorage) CreatePath(path string) error {
-	return backend.sftp.MkdirAll(path)
+func (backend *SFTPStorage) CreatePath(path string) (err error) {
+	c, err := backend.conn()
+	if err != nil {
+		return err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
+	return c.sftp.MkdirAll(path)
+}
+
+// RenameFile renames a file, replacing an existing one.
+func (backend *SFTPStorage) RenameFile(from, to string) (err error) {
+	c, err := backend.conn()
+	if err != nil {
+		return err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
+	return c.sftp.PosixRename(from, to)
+}
+
+func (backend *SFTPStorage) DeleteFile(path string) (err error) {
+	c, err := backend.conn()
+	if err != nil {
+		return err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
+	return c.sftp.Remove(path)
 }
 
-func (backend *SFTPStorage) DeleteFile(path string) error {
-	return backend.sftp.Remove(path)
+func (backend *SFTPStorage) DeletePath(path string) (err error) {
+	c, err := backend.conn()
+	if err != nil {
+		return err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
+	return deletePath(c.sftp, path)
 }
 
-func (backend *SFTPStorage) DeletePath(path string) error {
+func deletePath(client *sftp.Client, path string) error {
 	// fmt.Println("Deleting path", path)
-	files, err := backend.sftp.ReadDir(path)
+	files, err := client.ReadDir(path)
 	if err != nil {
 		return err
 	}
 	for _, file := range files {
-		fpath := backend.sftp.Join(path, file.Name())
+		fpath := client.Join(path, file.Name())
 		if file.IsDir() {
-			err = backend.DeletePath(fpath)
+			err = deletePath(client, fpath)
 			if err != nil {
 				return err
 			}
-			err = backend.sftp.Remove(fpath)
-		} else {
-			err = backend.DeleteFile(fpath)
 		}
+		err = client.Remove(fpath)
 		if err != nil {
 			return err
 		}
@@ -155,8 +257,14 @@ func (backend *SFTPStorage) DeletePath(path string) error {
 	return nil
 }
 
-func (backend *SFTPStorage) ReadFile(path string) ([]byte, error) {
-	file, err := backend.sftp.Open(path)
+func (backend *SFTPStorage) ReadFile(path string) (data []byte, err error) {
+	c, err := backend.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
+	file, err := c.sftp.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -166,7 +274,13 @@ func (backend *SFTPStorage) ReadFile(path string) ([]byte, error) {
 }
 
 func (backend *SFTPStorage) WriteFile(path string, data []byte) (size uint64, err error) {
-	file, err := backend.sftp.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	c, err := backend.conn()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
+	file, err := c.sftp.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
 	if err != nil {
 		return 0, err
 	}
@@ -176,8 +290,14 @@ func (backend *SFTPStorage) WriteFile(path string, data []byte) (size uint64, er
 	return uint64(length), err
 }
 
-func (backend *SFTPStorage) Stat(path string) (uint64, error) {
-	stat, err := backend.sftp.Stat(path)
+func (backend *SFTPStorage) Stat(path string) (size uint64, err error) {
+	c, err := backend.conn()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { backend.pool.Release(c, err) }()
+
+	stat, err := c.sftp.Stat(path)
 	if err != nil {
 		return 0, err
 	}
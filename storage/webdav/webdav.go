@@ -61,6 +61,19 @@ func (*WebDAVStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
 	return &backend, nil
 }
 
+// NewBackendWithCredentials returns a WebDAVStorage backend connecting with the
+// credentials user, which don't become part of its Location.
+func (backend *WebDAVStorage) NewBackendWithCredentials(u url.URL, user *url.Userinfo) (knoxite.Backend, error) {
+	location := u.User
+	u.User = user
+	b, err := backend.NewBackend(u)
+	if err != nil {
+		return b, err
+	}
+	b.(*WebDAVStorage).URL.User = location
+	return b, nil
+}
+
 // Location returns the type and location of the repository.
 func (backend *WebDAVStorage) Location() string {
 	return backend.URL.String()
@@ -95,6 +108,11 @@ func (backend *WebDAVStorage) CreatePath(path string) error {
 	return backend.Client.MkdirAll(path, 0755)
 }
 
+// RenameFile renames a remote file, replacing an existing one.
+func (backend *WebDAVStorage) RenameFile(from, to string) error {
+	return backend.Client.Rename(from, to, true)
+}
+
 // DeleteFile deletes a remote file.
 func (backend *WebDAVStorage) DeleteFile(path string) error {
 	return backend.Client.Remove(path)
@@ -8,6 +8,7 @@
 package knoxite
 
 import (
+	"io"
 	"path/filepath"
 	"strconv"
 )
@@ -35,6 +36,29 @@ type BackendFilesystem interface {
 	DeleteFile(path string) error
 }
 
+// FileRenamer is implemented by BackendFilesystems that can rename a file,
+// replacing an existing one. StorageFilesystem then stages the repository
+// metadata and the chunk-index, see StagingBackend.
+type FileRenamer interface {
+	// RenameFile renames the file from to to
+	RenameFile(from, to string) error
+}
+
+// FileRangeReader is implemented by BackendFilesystems that can read a range
+// of a file without reading all of it, see RangeLoader.
+type FileRangeReader interface {
+	// ReadFileRange reads length bytes at offset of a file
+	ReadFileRange(path string, offset, length uint64) ([]byte, error)
+}
+
+const (
+	// stagedSuffix gets appended to the name of staged metadata files
+	stagedSuffix = ".tmp"
+	// previousSuffix gets appended to the name of the previous generation
+	// of the chunk-index
+	previousSuffix = ".previous"
+)
+
 // StorageFilesystem is bridging a BackendFilesystem to a Backend interface.
 type StorageFilesystem struct {
 	Path           string
@@ -59,6 +83,16 @@ func NewStorageFilesystem(path string, storage BackendFilesystem) (StorageFilesy
 	return s, nil
 }
 
+// SetPrefix moves all objects into the sub-directory prefix of the backend's
+// path.
+func (backend *StorageFilesystem) SetPrefix(prefix string) {
+	path := filepath.Join(backend.Path, prefix)
+	backend.chunkPath = filepath.Join(path, chunksDirname)
+	backend.snapshotPath = filepath.Join(path, snapshotsDirname)
+	backend.chunkIndexPath = filepath.Join(path, chunksDirname, ChunkIndexFilename)
+	backend.repositoryPath = filepath.Join(path, RepoFilename)
+}
+
 // LoadChunk loads a Chunk from disk.
 func (backend StorageFilesystem) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
 	path := filepath.Join(backend.chunkPath, SubDirForChunk(shasum))
@@ -67,6 +101,25 @@ func (backend StorageFilesystem) LoadChunk(shasum string, part, totalParts uint)
 	return (*backend.storage).ReadFile(fileName)
 }
 
+// LoadChunkRange loads length bytes at offset of a Chunk from disk.
+func (backend StorageFilesystem) LoadChunkRange(shasum string, part, totalParts uint, offset, length uint64) ([]byte, error) {
+	path := filepath.Join(backend.chunkPath, SubDirForChunk(shasum))
+	fileName := filepath.Join(path, shasum+"."+strconv.FormatUint(uint64(part), 10)+"_"+strconv.FormatUint(uint64(totalParts), 10))
+
+	if rr, ok := (*backend.storage).(FileRangeReader); ok {
+		return rr.ReadFileRange(fileName, offset, length)
+	}
+
+	b, err := (*backend.storage).ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if offset+length > uint64(len(b)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b[offset : offset+length], nil
+}
+
 // StoreChunk stores a single Chunk on disk.
 func (backend StorageFilesystem) StoreChunk(shasum string, part, totalParts uint, data []byte) (size uint64, err error) {
 	path := filepath.Join(backend.chunkPath, SubDirForChunk(shasum))
@@ -85,6 +138,14 @@ func (backend StorageFilesystem) StoreChunk(shasum string, part, totalParts uint
 	return (*backend.storage).WriteFile(fileName, data)
 }
 
+// StatChunk returns the size of a single stored Chunk.
+func (backend StorageFilesystem) StatChunk(shasum string, part, totalParts uint) (uint64, error) {
+	path := filepath.Join(backend.chunkPath, SubDirForChunk(shasum))
+	fileName := filepath.Join(path, shasum+"."+strconv.FormatUint(uint64(part), 10)+"_"+strconv.FormatUint(uint64(totalParts), 10))
+
+	return (*backend.storage).Stat(fileName)
+}
+
 // DeleteChunk deletes a single Chunk.
 func (backend StorageFilesystem) DeleteChunk(shasum string, part, totalParts uint) error {
 	path := filepath.Join(backend.chunkPath, SubDirForChunk(shasum))
@@ -115,6 +176,22 @@ func (backend StorageFilesystem) SaveChunkIndex(b []byte) error {
 	return err
 }
 
+// RotateChunkIndex keeps a copy of the chunk-index as its previous
+// generation.
+func (backend StorageFilesystem) RotateChunkIndex() error {
+	b, err := (*backend.storage).ReadFile(backend.chunkIndexPath)
+	if err != nil {
+		return err
+	}
+	_, err = (*backend.storage).WriteFile(backend.chunkIndexPath+previousSuffix, b)
+	return err
+}
+
+// LoadPreviousChunkIndex reads the previous generation of the chunk-index.
+func (backend StorageFilesystem) LoadPreviousChunkIndex() ([]byte, error) {
+	return (*backend.storage).ReadFile(backend.chunkIndexPath + previousSuffix)
+}
+
 // InitRepository creates a new repository.
 func (backend StorageFilesystem) InitRepository() error {
 	if _, err := (*backend.storage).Stat(backend.repositoryPath); err == nil {
@@ -151,6 +228,41 @@ func (backend StorageFilesystem) SaveRepository(b []byte) error {
 	return err
 }
 
+// metadataPath returns the path of the metadata object name, and of its
+// staged version. They're the same if the storage can't rename files.
+func (backend StorageFilesystem) metadataPath(name string) (string, string) {
+	path := backend.repositoryPath
+	if name == MetadataChunkIndex {
+		path = backend.chunkIndexPath
+	}
+	if _, ok := (*backend.storage).(FileRenamer); ok {
+		return path, path + stagedSuffix
+	}
+	return path, path
+}
+
+// StageMetadata stores the metadata object name under a temporary name.
+func (backend StorageFilesystem) StageMetadata(name string, data []byte) error {
+	_, staged := backend.metadataPath(name)
+	_, err := (*backend.storage).WriteFile(staged, data)
+	return err
+}
+
+// LoadStagedMetadata reads the staged metadata object name.
+func (backend StorageFilesystem) LoadStagedMetadata(name string) ([]byte, error) {
+	_, staged := backend.metadataPath(name)
+	return (*backend.storage).ReadFile(staged)
+}
+
+// CommitMetadata replaces the metadata object name with the staged one.
+func (backend StorageFilesystem) CommitMetadata(name string) error {
+	path, staged := backend.metadataPath(name)
+	if path == staged {
+		return nil
+	}
+	return (*backend.storage).(FileRenamer).RenameFile(staged, path)
+}
+
 // SubDirForChunk files a chunk into a subdir, based on the chunks name.
 func SubDirForChunk(id string) string {
 	return filepath.Join(id[0:2], id[2:4])
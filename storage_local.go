@@ -8,16 +8,47 @@
 package knoxite
 
 import (
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 )
 
+// Durability policies for the local storage backend.
+const (
+	DurabilityDataAndDir = iota // Sync written files and their directory
+	DurabilityDataOnly          // Sync written files only
+	DurabilityNone              // Leave syncing to the operating system
+)
+
 // StorageLocal stores data on the local disk.
 type StorageLocal struct {
 	StorageFilesystem
+
+	durability uint16
+	fs         localFS
+}
+
+// localFS is the file system StorageLocal writes to.
+type localFS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (localFile, error)
+}
+
+// localFile is a file opened by a localFS.
+type localFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// osFS is the localFS of the operating system.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (localFile, error) {
+	return os.OpenFile(name, flag, perm)
 }
 
 func init() {
@@ -42,6 +73,11 @@ func (backend *StorageLocal) Location() string {
 	return backend.Path
 }
 
+// SetOptions applies the durability policy from opts.
+func (backend *StorageLocal) SetOptions(opts BackendOptions) {
+	backend.durability = opts.Durability
+}
+
 // Close the backend.
 func (backend *StorageLocal) Close() error {
 	return nil
@@ -77,12 +113,68 @@ func (backend StorageLocal) ReadFile(path string) ([]byte, error) {
 	return b, err
 }
 
-// WriteFile writes a file to disk.
+// ReadFileRange reads length bytes at offset of a file from disk.
+func (backend StorageLocal) ReadFileRange(path string, offset, length uint64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := make([]byte, length)
+	if _, err := f.ReadAt(b, int64(offset)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// WriteFile writes a file to disk and syncs it according to the durability
+// policy.
 func (backend StorageLocal) WriteFile(path string, data []byte) (size uint64, err error) {
-	err = ioutil.WriteFile(path, data, 0600)
+	fs := backend.fs
+	if fs == nil {
+		fs = osFS{}
+	}
+
+	f, err := fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Write(data)
+	if err == nil && backend.durability != DurabilityNone {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return uint64(len(data)), err
+	}
+
+	if backend.durability == DurabilityDataAndDir {
+		// make sure the new directory entry survives a crash, too
+		err = syncDir(fs, filepath.Dir(path))
+	}
 	return uint64(len(data)), err
 }
 
+// RenameFile renames a file on disk and syncs its directory according to the
+// durability policy.
+func (backend StorageLocal) RenameFile(from, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+
+	if backend.durability == DurabilityDataAndDir {
+		fs := backend.fs
+		if fs == nil {
+			fs = osFS{}
+		}
+		return syncDir(fs, filepath.Dir(to))
+	}
+	return nil
+}
+
 // DeleteFile deletes a file from disk.
 func (backend StorageLocal) DeleteFile(path string) error {
 	// fmt.Println("Deleting:", path)
@@ -9,13 +9,21 @@
 
 package knoxite
 
-import "syscall"
+import (
+	"os"
+	"syscall"
+)
 
 // AvailableSpace returns the free space on this backend.
 func (backend *StorageLocal) AvailableSpace() (uint64, error) {
-	//FIXME: make this cross-platform compatible
+	return freeSpace(backend.Path)
+}
+
+// freeSpace returns the space available to the user on the file system
+// containing path.
+func freeSpace(path string) (uint64, error) {
 	var stat syscall.Statfs_t
-	err := syscall.Statfs(backend.Path, &stat)
+	err := syscall.Statfs(path, &stat)
 	if err != nil {
 		return 0, err
 	}
@@ -24,3 +32,16 @@ func (backend *StorageLocal) AvailableSpace() (uint64, error) {
 	// we convert both types to a uint64 as their type varies on different OS
 	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
 }
+
+// syncDir syncs the directory at path to disk.
+func syncDir(fs localFS, path string) error {
+	d, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
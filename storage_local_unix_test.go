@@ -0,0 +1,79 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// syncRecordingFS records the paths of all synced files.
+type syncRecordingFS struct {
+	synced []string
+}
+
+type syncRecordingFile struct {
+	*os.File
+	fs *syncRecordingFS
+}
+
+func (fs *syncRecordingFS) OpenFile(name string, flag int, perm os.FileMode) (localFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return syncRecordingFile{f, fs}, nil
+}
+
+func (f syncRecordingFile) Sync() error {
+	f.fs.synced = append(f.fs.synced, f.Name())
+	return f.File.Sync()
+}
+
+func TestStorageLocalDurability(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		durability uint16
+		synced     []string
+	}{
+		{DurabilityDataAndDir, []string{filepath.Join(dir, "chunk"), dir}},
+		{DurabilityDataOnly, []string{filepath.Join(dir, "chunk")}},
+		{DurabilityNone, nil},
+	}
+
+	for _, tt := range tests {
+		fs := &syncRecordingFS{}
+		backend := StorageLocal{fs: fs}
+		backend.SetOptions(BackendOptions{Durability: tt.durability})
+
+		data := []byte("some data")
+		n, err := backend.WriteFile(filepath.Join(dir, "chunk"), data)
+		if err != nil || n != uint64(len(data)) {
+			t.Errorf("Failed writing file: %v", err)
+		}
+		if !reflect.DeepEqual(fs.synced, tt.synced) {
+			t.Errorf("Durability %d: expected syncs of %v, got %v", tt.durability, tt.synced, fs.synced)
+		}
+
+		b, _ := ioutil.ReadFile(filepath.Join(dir, "chunk"))
+		if string(b) != string(data) {
+			t.Errorf("Expected %q to be written, got %q", data, b)
+		}
+	}
+}
@@ -9,8 +9,29 @@
 
 package knoxite
 
+import (
+	"golang.org/x/sys/windows"
+)
+
 // AvailableSpace returns the free space on this backend
 func (backend *StorageLocal) AvailableSpace() (uint64, error) {
-	//FIXME: make this cross-platform compatible
-	return 0, nil
+	return freeSpace(backend.Path)
+}
+
+// freeSpace returns the space available to the user on the volume
+// containing path.
+func freeSpace(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var available, total, free uint64
+	err = windows.GetDiskFreeSpaceEx(p, &available, &total, &free)
+	return available, err
+}
+
+// syncDir is a no-op, as directories can't be synced on Windows.
+func syncDir(fs localFS, path string) error {
+	return nil
 }
@@ -0,0 +1,134 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Error declarations.
+var (
+	ErrChunkNotIndexed  = errors.New("Chunk is missing from the index")
+	ErrChunkGap         = errors.New("Chunk numbers are not contiguous")
+	ErrChunkDuplicate   = errors.New("Chunk number occurs more than once")
+	ErrArchiveSize      = errors.New("Chunks don't cover the archive's size")
+	ErrArchivePath      = errors.New("Archive is stored under a different path")
+	ErrDuplicateArchive = errors.New("Path occurs more than once")
+)
+
+// A ValidationIssue describes an inconsistency in the metadata of a snapshot.
+type ValidationIssue struct {
+	Path   string
+	Err    error
+	Detail string
+}
+
+// Error returns a human-readable description of the issue.
+func (v ValidationIssue) Error() string {
+	if v.Detail == "" {
+		return fmt.Sprintf("%s: %s", v.Path, v.Err)
+	}
+	return fmt.Sprintf("%s: %s (%s)", v.Path, v.Err, v.Detail)
+}
+
+// Validate checks the internal consistency of a snapshot without loading any
+// chunks: every chunk must exist in index, the chunks of an archive must be
+// numbered contiguously and cover its size, and no path may occur twice.
+// It returns all issues found, ordered by path.
+func (snapshot *Snapshot) Validate(index *ChunkIndex) []ValidationIssue {
+	if err := index.Load(); err != nil {
+		return []ValidationIssue{{Err: err}}
+	}
+
+	snapshot.mut.Lock()
+	defer snapshot.mut.Unlock()
+
+	if err := snapshot.LoadArchives(); err != nil {
+		return []ValidationIssue{{Err: err}}
+	}
+
+	var issues []ValidationIssue
+	paths := make(map[string]string)
+	for key, arc := range snapshot.Archives {
+		if arc.Path != key {
+			issues = append(issues, ValidationIssue{
+				Path:   key,
+				Err:    ErrArchivePath,
+				Detail: arc.Path,
+			})
+		}
+		if other, ok := paths[arc.Path]; ok {
+			issues = append(issues, ValidationIssue{
+				Path:   arc.Path,
+				Err:    ErrDuplicateArchive,
+				Detail: fmt.Sprintf("stored as %s and %s", other, key),
+			})
+		}
+		paths[arc.Path] = key
+
+		issues = append(issues, validateArchive(key, arc, index)...)
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		return issues[i].Path < issues[j].Path
+	})
+	return issues
+}
+
+// validateArchive checks the chunks of the archive stored under path.
+func validateArchive(path string, arc *Archive, index *ChunkIndex) []ValidationIssue {
+	var issues []ValidationIssue
+
+	nums := make(map[uint]bool)
+	var size uint64
+	for _, chunk := range arc.Chunks {
+		if _, ok := index.Chunks[chunk.Hash]; !ok {
+			issues = append(issues, ValidationIssue{
+				Path:   path,
+				Err:    ErrChunkNotIndexed,
+				Detail: fmt.Sprintf("chunk %d, %s", chunk.Num, chunk.Hash),
+			})
+		}
+		if nums[chunk.Num] {
+			issues = append(issues, ValidationIssue{
+				Path:   path,
+				Err:    ErrChunkDuplicate,
+				Detail: fmt.Sprintf("chunk %d", chunk.Num),
+			})
+		}
+		nums[chunk.Num] = true
+		size += uint64(chunk.OriginalSize)
+	}
+	if arc.Failed {
+		// the content of failed archives is incomplete by definition
+		return issues
+	}
+
+	for i := uint(0); i < uint(len(nums)); i++ {
+		if !nums[i] {
+			issues = append(issues, ValidationIssue{
+				Path:   path,
+				Err:    ErrChunkGap,
+				Detail: fmt.Sprintf("chunk %d is missing", i),
+			})
+			break
+		}
+	}
+
+	if arc.Type == File && size != arc.Size {
+		issues = append(issues, ValidationIssue{
+			Path:   path,
+			Err:    ErrArchiveSize,
+			Detail: fmt.Sprintf("%d of %d bytes", size, arc.Size),
+		})
+	}
+
+	return issues
+}
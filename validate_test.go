@@ -0,0 +1,87 @@
+/*
+ * knoxite
+ *     Copyright (c) 2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotValidate(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(filepath.Join(dir, "repo"), testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	src := filepath.Join(dir, "data")
+	data := make([]byte, 512*1024)
+	_, _ = rand.Read(data)
+	if err := ioutil.WriteFile(src, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{dir},
+		Excludes:  []string{filepath.Join(dir, "repo")},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+		ChunkSize: 64 * 1024,
+	})
+
+	if issues := snapshot.Validate(&index); len(issues) > 0 {
+		t.Fatalf("Expected a consistent snapshot, got %v", issues)
+	}
+
+	arc := snapshot.Archives[src]
+	if len(arc.Chunks) < 3 {
+		t.Fatalf("Expected at least 3 chunks, got %d", len(arc.Chunks))
+	}
+
+	// inject a gap into the chunk coverage
+	idx, _ := arc.IndexOfChunk(1)
+	arc.Chunks = append(arc.Chunks[:idx], arc.Chunks[idx+1:]...)
+
+	errs := make(map[error]bool)
+	for _, issue := range snapshot.Validate(&index) {
+		if issue.Path != src {
+			t.Errorf("Expected issue for %s, got %s", src, issue.Path)
+		}
+		errs[issue.Err] = true
+	}
+	for _, err := range []error{ErrChunkGap, ErrArchiveSize} {
+		if !errs[err] {
+			t.Errorf("Expected Validate to report %q", err)
+		}
+	}
+
+	// drop a chunk from the index & store an archive under a second path
+	delete(index.Chunks, arc.Chunks[0].Hash)
+	snapshot.Archives[src+"_copy"] = arc
+
+	errs = make(map[error]bool)
+	for _, issue := range snapshot.Validate(&index) {
+		errs[issue.Err] = true
+	}
+	for _, err := range []error{ErrChunkNotIndexed, ErrArchivePath, ErrDuplicateArchive} {
+		if !errs[err] {
+			t.Errorf("Expected Validate to report %q", err)
+		}
+	}
+}
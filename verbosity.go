@@ -12,11 +12,12 @@ type Verbosity int
 
 const (
 	LogLevelFatal = iota
+	LogLevelError
 	LogLevelWarning
 	LogLevelInfo
 	LogLevelDebug
 )
 
 func (v Verbosity) String() string {
-	return [...]string{"Fatal", "Warning", "Info", "Debug"}[v]
+	return [...]string{"Fatal", "Error", "Warning", "Info", "Debug"}[v]
 }
@@ -8,10 +8,53 @@
 package knoxite
 
 import (
+	"encoding/hex"
+	"fmt"
+	"io"
 	"math"
 	"math/rand"
+	"sort"
+	"strconv"
+
+	"github.com/minio/highwayhash"
 )
 
+// A RestoredFile is the outcome of restoring a single file while verifying a
+// snapshot with VerifyRestore.
+type RestoredFile struct {
+	Path string
+	Err  error // why the file couldn't be restored intact, nil if it could
+}
+
+// A ChunkSizeError records a stored chunk part whose size differs from the
+// size recorded in the chunk-index, e.g. because it got truncated.
+type ChunkSizeError struct {
+	Hash     string
+	Part     uint
+	Expected uint64
+	Found    uint64
+	Err      error // why the size couldn't be determined, nil for a mismatch
+}
+
+func (e *ChunkSizeError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Chunk %s part %d: %v", e.Hash, e.Part, e.Err)
+	}
+	return fmt.Sprintf("Chunk %s part %d has %d bytes, expected %d", e.Hash, e.Part, e.Found, e.Expected)
+}
+
+func (e *ChunkSizeError) Unwrap() error {
+	return e.Err
+}
+
+// sizeWriter counts the bytes written to it.
+type sizeWriter uint64
+
+func (w *sizeWriter) Write(p []byte) (int, error) {
+	*w += sizeWriter(len(p))
+	return len(p), nil
+}
+
 func VerifyRepo(repository Repository, percentage int) (chan Progress, error) {
 	prog := make(chan Progress)
 
@@ -21,6 +64,9 @@ func VerifyRepo(repository Repository, percentage int) (chan Progress, error) {
 		for _, volume := range repository.Volumes {
 			for _, snapshotHash := range volume.Snapshots {
 				_, snapshot, err := repository.FindSnapshot(snapshotHash)
+				if err == nil {
+					err = snapshot.LoadArchives()
+				}
 				if err != nil {
 					prog <- newProgressError(err)
 				}
@@ -85,6 +131,9 @@ func VerifyVolume(repository Repository, volumeId string, percentage int) (chan
 
 		for _, snapshotHash := range volume.Snapshots {
 			_, snapshot, err := repository.FindSnapshot(snapshotHash)
+			if err == nil {
+				err = snapshot.LoadArchives()
+			}
 			if err != nil {
 				prog <- newProgressError(err)
 			}
@@ -140,6 +189,9 @@ func VerifySnapshot(repository Repository, snapshotId string, percentage int) (c
 
 	go func() {
 		_, snapshot, err := repository.FindSnapshot(snapshotId)
+		if err == nil {
+			err = snapshot.LoadArchives()
+		}
 		if err != nil {
 			prog <- newProgressError(err)
 		}
@@ -205,3 +257,114 @@ func VerifyArchive(repository Repository, arc Archive) error {
 
 	return nil
 }
+
+// VerifyRestore restores all files of snapshot without writing them anywhere,
+// verifying their size, content hash and HMAC against the recorded metadata.
+// Unlike VerifySnapshot, this exercises loading, decrypting, decompressing
+// and reassembling every chunk of every file. It returns the outcome of each
+// file, sorted by path.
+func VerifyRestore(repository Repository, snapshot *Snapshot) ([]RestoredFile, error) {
+	if err := snapshot.LoadArchives(); err != nil {
+		return nil, err
+	}
+
+	var files []RestoredFile
+	for _, arc := range snapshot.Archives {
+		if arc.Type != File {
+			continue
+		}
+		files = append(files, RestoredFile{
+			Path: arc.Path,
+			Err:  verifyRestoreArchive(repository, *arc),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	return files, nil
+}
+
+// verifyRestoreArchive reassembles the content of arc and compares it with
+// its recorded size and hashes.
+func verifyRestoreArchive(repository Repository, arc Archive) error {
+	if arc.Failed {
+		return ErrArchiveFailed
+	}
+
+	h, err := highwayhash.New(hashkey[:])
+	if err != nil {
+		return err
+	}
+	var size sizeWriter
+	if err := writeArchiveData(io.MultiWriter(h, &size), repository, arc); err != nil {
+		return err
+	}
+
+	if uint64(size) != arc.Size {
+		return &CheckSumError{"size", strconv.FormatUint(arc.Size, 10), strconv.FormatUint(uint64(size), 10)}
+	}
+	if arc.ContentHash != "" {
+		sum := hex.EncodeToString(h.Sum(nil))
+		if sum != arc.ContentHash {
+			return &CheckSumError{"content hash", arc.ContentHash, sum}
+		}
+	}
+
+	return nil
+}
+
+// VerifyChunkSizes compares the size of every chunk part stored on the
+// backends with the size recorded in index, without downloading any of them.
+// This quickly finds truncated or missing parts, but can't detect corrupted
+// content, see VerifyRepo for that. It returns the parts that don't match,
+// sorted by hash, or ErrStatUnsupported if the backends can't report sizes.
+func VerifyChunkSizes(repository Repository, index *ChunkIndex) ([]*ChunkSizeError, error) {
+	if err := index.Load(); err != nil {
+		return nil, err
+	}
+
+	index.mut.Lock()
+	items := make([]ChunkIndexItem, 0, len(index.Chunks))
+	for _, item := range index.Chunks {
+		items = append(items, *item)
+	}
+	index.mut.Unlock()
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Hash < items[j].Hash
+	})
+
+	var mismatches []*ChunkSizeError
+	for _, item := range items {
+		if item.Pack != "" {
+			// checked as part of its pack object
+			continue
+		}
+
+		chunk := Chunk{
+			Hash:        item.Hash,
+			DataParts:   item.DataParts,
+			ParityParts: item.ParityParts,
+			Size:        item.Size,
+		}
+		expected := chunk.partSize()
+		for part := uint(0); part < chunk.DataParts+chunk.ParityParts; part++ {
+			n, err := repository.backend.StatChunk(chunk, part)
+			if err == ErrStatUnsupported || err == ErrRepositoryClosed {
+				return nil, err
+			}
+			// only the referenced chunks tell the size of a pack object
+			if err != nil || n != expected && !(item.PackObject && n > expected) {
+				mismatches = append(mismatches, &ChunkSizeError{
+					Hash:     chunk.Hash,
+					Part:     part,
+					Expected: expected,
+					Found:    n,
+					Err:      err,
+				})
+			}
+		}
+	}
+
+	return mismatches, nil
+}
@@ -1,6 +1,8 @@
 package knoxite
 
 import (
+	"bytes"
+	"crypto/rand"
 	"errors"
 	"io/ioutil"
 	"os"
@@ -399,3 +401,137 @@ func TestVerifySnapshot(t *testing.T) {
 		}
 	}
 }
+
+func TestVerifyRestore(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	_ = os.Mkdir(src, 0755)
+	_ = ioutil.WriteFile(filepath.Join(src, "intact"), bytes.Repeat([]byte("intact "), 1024), 0644)
+	_ = ioutil.WriteFile(filepath.Join(src, "corrupt"), bytes.Repeat([]byte("corrupt "), 1024), 0644)
+
+	r, _ := NewRepository("mem://verify-restore", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:               wd,
+		Paths:             []string{src},
+		Compress:          CompressionGZip,
+		Encrypt:           EncryptionAES,
+		DataParts:         1,
+		RecordContentHash: true,
+	})
+
+	files, err := VerifyRestore(r, snapshot)
+	if err != nil {
+		t.Fatalf("Failed verifying restore: %s", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 verified files, got %d", len(files))
+	}
+	for _, f := range files {
+		if f.Err != nil {
+			t.Errorf("Expected %s to pass, got %v", f.Path, f.Err)
+		}
+	}
+
+	chunk := snapshot.Archives[filepath.Join(src, "corrupt")].Chunks[0]
+	memoryStores["verify-restore"][chunkKey(chunk.Hash, 0, 1)][20] ^= 0xff
+
+	files, err = VerifyRestore(r, snapshot)
+	if err != nil {
+		t.Fatalf("Failed verifying restore: %s", err)
+	}
+	for _, f := range files {
+		corrupt := f.Path == filepath.Join(src, "corrupt")
+		if corrupt && f.Err == nil {
+			t.Errorf("Expected %s to fail verification", f.Path)
+		}
+		if !corrupt && f.Err != nil {
+			t.Errorf("Expected %s to pass, got %v", f.Path, f.Err)
+		}
+	}
+}
+
+func TestVerifyChunkSizes(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 100*1024+1)
+	_, _ = rand.Read(data)
+	single := filepath.Join(dir, "single")
+	parity := filepath.Join(dir, "parity")
+	_ = ioutil.WriteFile(single, data, 0644)
+	_ = ioutil.WriteFile(parity, data[1:], 0644)
+
+	r, _ := NewRepository("mem://verify-chunk-sizes", testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+	snapshot := storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:       wd,
+		Paths:     []string{single},
+		Encrypt:   EncryptionAES,
+		DataParts: 1,
+	})
+	_ = storeSnapshot(t, &r, &index, StoreOptions{
+		CWD:         wd,
+		Paths:       []string{parity},
+		Encrypt:     EncryptionAES,
+		DataParts:   2,
+		ParityParts: 1,
+	})
+
+	mismatches, err := VerifyChunkSizes(r, &index)
+	if err != nil {
+		t.Fatalf("Failed verifying chunk sizes: %s", err)
+	}
+	if len(mismatches) > 0 {
+		t.Fatalf("Expected all chunk sizes to match, got %v", mismatches)
+	}
+
+	chunk := snapshot.Archives[single].Chunks[0]
+	store := memoryStores["verify-chunk-sizes"]
+	key := chunkKey(chunk.Hash, 0, 1)
+	store[key] = store[key][:len(store[key])-10]
+
+	r.ResetBandwidthStats()
+	mismatches, err = VerifyChunkSizes(r, &index)
+	if err != nil {
+		t.Fatalf("Failed verifying chunk sizes: %s", err)
+	}
+	if len(mismatches) != 1 {
+		t.Fatalf("Expected the truncated chunk to be found, got %v", mismatches)
+	}
+	m := mismatches[0]
+	if m.Hash != chunk.Hash || m.Part != 0 || m.Expected != uint64(chunk.Size) || m.Found != uint64(chunk.Size-10) || m.Err != nil {
+		t.Errorf("Expected chunk %s to be %d bytes short, got %v", chunk.Hash, 10, m)
+	}
+	if stats := r.BandwidthStats(); stats.Received != 0 || stats.Requests == 0 {
+		t.Errorf("Expected sizes to be verified without downloading chunks, received %d bytes", stats.Received)
+	}
+
+	delete(store, key)
+	mismatches, _ = VerifyChunkSizes(r, &index)
+	if len(mismatches) != 1 || mismatches[0].Err == nil {
+		t.Errorf("Expected the missing chunk to be reported, got %v", mismatches)
+	}
+
+	var stored int32
+	var be Backend = countingBackend{*r.backend.Backends[0], &stored}
+	r.backend.Backends[0] = &be
+	if _, err := VerifyChunkSizes(r, &index); err != ErrStatUnsupported {
+		t.Errorf("Expected %v, got %v", ErrStatUnsupported, err)
+	}
+}
@@ -7,7 +7,17 @@
 
 package knoxite
 
-import uuid "github.com/nu7hatch/gouuid"
+import (
+	"errors"
+	"time"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// Error declarations.
+var (
+	ErrNoSnapshotBefore = errors.New("No snapshot found at or before the given time")
+)
 
 // A Volume contains various snapshots.
 type Volume struct {
@@ -15,6 +25,8 @@ type Volume struct {
 	Name        string   `json:"name"`
 	Description string   `json:"description"`
 	Snapshots   []string `json:"snapshots"`
+
+	repository *Repository // checks whether snapshots can be removed
 }
 
 // NewVolume creates a new volume.
@@ -39,7 +51,9 @@ func (v *Volume) AddSnapshot(id string) error {
 	return nil
 }
 
-// RemoveSnapshot removes a snapshot from a volume.
+// RemoveSnapshot removes a snapshot from a volume. Once the volume belongs to
+// a repository, pinned and immutable snapshots can't be removed and
+// ErrPinnedSnapshot or ErrImmutableSnapshot gets returned.
 func (v *Volume) RemoveSnapshot(id string) error {
 	snapshots := []string{}
 	found := false
@@ -55,6 +69,11 @@ func (v *Volume) RemoveSnapshot(id string) error {
 	if !found {
 		return ErrSnapshotNotFound
 	}
+	if v.repository != nil {
+		if err := v.repository.checkRemovable(id); err != nil {
+			return err
+		}
+	}
 
 	v.Snapshots = snapshots
 	return nil
@@ -71,3 +90,24 @@ func (v *Volume) LoadSnapshot(id string, repository *Repository) (*Snapshot, err
 
 	return &Snapshot{}, ErrSnapshotNotFound
 }
+
+// SnapshotAsOf loads the latest snapshot of a volume that was created at or
+// before t.
+func (v *Volume) SnapshotAsOf(t time.Time, repository *Repository) (*Snapshot, error) {
+	var found *Snapshot
+	for _, id := range v.Snapshots {
+		snapshot, err := openSnapshot(id, repository)
+		if err != nil {
+			return &Snapshot{}, err
+		}
+
+		if !snapshot.Date.After(t) && (found == nil || snapshot.Date.After(found.Date)) {
+			found = snapshot
+		}
+	}
+
+	if found == nil {
+		return &Snapshot{}, ErrNoSnapshotBefore
+	}
+	return found, nil
+}
@@ -10,7 +10,9 @@ package knoxite
 import (
 	"io/ioutil"
 	"os"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestVolumeCreate(t *testing.T) {
@@ -133,3 +135,47 @@ func TestSnapshotRemove(t *testing.T) {
 		t.Errorf("Expected no error, got: %s", err)
 	}
 }
+
+func TestVolumeSnapshotAsOf(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	r, err := NewRepository("mem://volume-as-of", testPassword)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	vol, _ := NewVolume("test_name", "test_description")
+	_ = r.AddVolume(vol)
+
+	day := func(d int) time.Time {
+		return time.Date(2020, time.January, d, 12, 0, 0, 0, time.UTC)
+	}
+	for _, d := range []int{5, 1, 10} {
+		snapshot, _ := NewSnapshot(strconv.Itoa(d))
+		snapshot.Date = day(d)
+		if err := snapshot.Save(&r); err != nil {
+			t.Fatalf("Failed saving snapshot: %s", err)
+		}
+		_ = vol.AddSnapshot(snapshot.ID)
+	}
+
+	for asOf, expected := range map[time.Time]string{
+		day(7):                  "5",
+		day(10):                 "10",
+		day(30):                 "10",
+		day(1).Add(time.Minute): "1",
+	} {
+		snapshot, err := vol.SnapshotAsOf(asOf, &r)
+		if err != nil {
+			t.Errorf("Failed finding snapshot as of %s: %s", asOf, err)
+			continue
+		}
+		if snapshot.Description != expected {
+			t.Errorf("Expected snapshot from day %s as of %s, got day %s", expected, asOf, snapshot.Description)
+		}
+	}
+
+	_, err = RestoreAsOf(r, vol, day(1).Add(-time.Minute), "", RestoreOptions{})
+	if err != ErrNoSnapshotBefore {
+		t.Errorf("Expected %v, got %v", ErrNoSnapshotBefore, err)
+	}
+}